@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,9 +28,11 @@ import (
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server"
 	clientPkg "github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
 	"github.com/gocardless/draupnir/pkg/version"
 	"github.com/prometheus/common/log"
 	"github.com/urfave/cli"
+	"golang.org/x/oauth2"
 )
 
 const quickStart string = `
@@ -47,19 +60,150 @@ func main() {
 			Name:  "insecure",
 			Usage: "don't validate certificates when connecting to draupnir",
 		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "log more detail about requests to draupnir, such as redirects",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Value: "text",
+			Usage: "output format of the commands that take --output, unless they're given their own",
+		},
 	}
 
 	app.Commands = []cli.Command{
 		{
 			Name:  "server",
 			Usage: "start the draupnir server",
+			UsageText: `draupnir server [--env-file PATH] [--listen unix:PATH]
+
+--env-file loads a .env-style file of NAME=VALUE lines into the environment
+  before reading the config, so that DRAUPNIR_* variables in it override the
+  config file. Variables that are already set take precedence over the file.
+
+--listen serves plain HTTP on a unix socket at PATH, e.g. for a proxy in the
+  same pod, overriding http.unix_socket in the config`,
+			Flags: []cli.Flag{
+				envFileFlag,
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "serve plain HTTP on a unix socket, given as unix:PATH",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				err := server.Run(logger)
+				err := server.Run(logger, c.String("env-file"), c.String("listen"))
 				if err != nil {
 					logger.With("error", err.Error()).Fatal("Failed to start server")
 				}
 				return nil
 			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "selfcheck",
+					Usage: "check that the server is able to run, without starting it",
+					Flags: []cli.Flag{
+						envFileFlag,
+					},
+					Action: func(c *cli.Context) error {
+						err := server.SelfCheck(logger, c.String("env-file"))
+						if err != nil {
+							logger.With("error", err.Error()).Fatal("Self-check failed")
+						}
+
+						logger.Info("All self-checks passed")
+						return nil
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "show an operational overview of the server (admin only)",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "image-sizes",
+							Usage: "also measure the image subvolumes, before and after compression",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						status, err := client.GetServerStatus(c.Bool("image-sizes"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch server status")
+						}
+
+						fmt.Printf("Version: %s\n", status.Version)
+						fmt.Printf("Uptime: %s (since %s)\n", time.Duration(status.UptimeSeconds)*time.Second, status.StartedAt.Format(time.RFC3339))
+						if status.MaxImages > 0 {
+							fmt.Printf("Images: %d (max %d)\n", status.Images, status.MaxImages)
+						} else {
+							fmt.Printf("Images: %d\n", status.Images)
+						}
+						fmt.Printf("Instances: %d\n", status.Instances)
+						fmt.Printf("In-flight requests: %d\n", status.InFlightRequests)
+						if status.AnonTimeoutSeconds > 0 {
+							fmt.Printf("Anon timeout: %s\n", time.Duration(status.AnonTimeoutSeconds)*time.Second)
+						} else {
+							fmt.Println("Anon timeout: none")
+						}
+						fmt.Printf(
+							"Disk: %s used, %s free, %s total\n",
+							formatBytes(status.Disk.UsedBytes),
+							formatBytes(status.Disk.FreeBytes),
+							formatBytes(status.Disk.TotalBytes),
+						)
+						for _, volume := range status.Volumes {
+							fmt.Printf(
+								"  %s: %s used, %s free, %s total\n",
+								volume.Path,
+								formatBytes(volume.UsedBytes),
+								formatBytes(volume.FreeBytes),
+								formatBytes(volume.TotalBytes),
+							)
+						}
+						if status.ImageSizes != nil {
+							fmt.Printf(
+								"Images on disk: %s, %s before compression\n",
+								formatBytes(status.ImageSizes.DiskBytes),
+								formatBytes(status.ImageSizes.LogicalBytes),
+							)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "admin",
+			Usage: "administer other users (admin only)",
+			Subcommands: []cli.Command{
+				{
+					Name:  "revoke",
+					Usage: "revoke every token issued to a user",
+					UsageText: `draupnir admin revoke [email]
+
+[email] the email address of the user whose tokens to revoke
+
+Requests with any token issued to the user so far are rejected, e.g. when they
+leave or a token is compromised. They can authenticate again to get a new one.`,
+					Action: func(c *cli.Context) error {
+						email := c.Args().First()
+						if email == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an email address")
+						}
+
+						client := NewClient(c, logger)
+
+						revocation, err := client.RevokeTokens(email)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not revoke tokens")
+						}
+
+						logger.With("email", revocation.Email).With("revoked_at", revocation.RevokedAt.Format(time.RFC3339)).Info("Revoked tokens")
+						return nil
+					},
+				},
+			},
 		},
 		{
 			Name:        "config",
@@ -70,22 +214,71 @@ func main() {
 				{
 					Name:      "show",
 					Usage:     "show the current configuration",
-					UsageText: "draupnir config show",
+					UsageText: "draupnir config show [--expand-token] [--json]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "expand-token",
+							Usage: "show the full access and refresh tokens, rather than truncating them",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "print the configuration as a JSON object",
+						},
+					},
 					Action: func(c *cli.Context) error {
 						cfg := loadConfig(logger)
 
+						if c.Bool("json") {
+							return printJSON(ConfigToJSON(cfg, c.Bool("expand-token")))
+						}
+
 						domain := cfg.Domain
 						accessToken := cfg.Token.AccessToken
 						database := cfg.Database
 
 						fmt.Printf("Domain: %s\n", domain)
-						if len(accessToken) < 10 {
-							// Go doesn't appear to have a safe subslice operation...
+						if c.Bool("expand-token") {
 							fmt.Printf("Access Token: %s\n", accessToken)
+							fmt.Printf("Refresh Token: %s\n", cfg.Token.RefreshToken)
 						} else {
-							fmt.Printf("Access Token: %s****\n", accessToken[0:10])
+							fmt.Printf("Access Token: %s\n", truncateToken(accessToken))
 						}
 						fmt.Printf("Database: %s\n", database)
+						fmt.Printf("User Agent: %s\n", clientPkg.UserAgent(cfg.UserAgentSuffix))
+						if cfg.Insecure {
+							fmt.Println("Insecure: true")
+						}
+						if cfg.ImageAlias != "" {
+							fmt.Printf("Image Alias: %s\n", cfg.ImageAlias)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "validate",
+					Usage: "check that the current configuration is usable",
+					UsageText: `draupnir config validate
+
+Prints any problems with the configuration, exiting with a non-zero status if
+any of them would prevent draupnir from being used.`,
+					Action: func(c *cli.Context) error {
+						cfg := loadConfig(logger)
+
+						fatal := false
+						for _, issue := range cfg.Validate() {
+							if issue.Fatal {
+								fatal = true
+								fmt.Printf("error: %s\n", issue.Message)
+							} else {
+								fmt.Printf("warning: %s\n", issue.Message)
+							}
+						}
+
+						if fatal {
+							os.Exit(1)
+						}
+
+						fmt.Println("Configuration is valid")
 						return nil
 					},
 				},
@@ -93,16 +286,39 @@ func main() {
 					Name:  "set",
 					Usage: "set a config value",
 					UsageText: `draupnir config set [key] [value]
+   draupnir config set token [access_token] [refresh_token]
+   draupnir authenticate --print-token --no-store | draupnir config set token -
 
 [key] can take the following values:
-    domain: The domain of the draupnir server.
-    database: The default database to connect to. If not set, defaults to the PGDATABASE environment variable.`,
+    domain: The domain of the draupnir server, followed by the path it is mounted under if any, e.g. example.com/draupnir.
+    database: The default database to connect to. If not set, defaults to the PGDATABASE environment variable, then the image's default database.
+    user_agent_suffix: A string appended to the User-Agent sent to the server, e.g. to identify CI jobs.
+    pg_options: Session options for every connection to an instance, set as PGOPTIONS, e.g. "-c statement_timeout=0".
+    insecure: Whether to connect to the server over plain HTTP, as with --insecure, e.g. true.
+    image_alias: The image alias to create instances from when no image is given, e.g. latest-stable. Set it to "" to use the latest image.
+    token: The tokens to authenticate with, as obtained elsewhere with
+           draupnir authenticate --print-token. Either give the access and
+           refresh tokens, or - to read the printed JSON from stdin.`,
 					Action: func(c *cli.Context) error {
+						key := c.Args().First()
+						if strings.ToLower(key) == "token" {
+							token, err := tokenFromArgs(c.Args().Tail())
+							if err != nil {
+								cli.ShowCommandHelp(c, c.Command.Name)
+								logger.With("error", err).Fatal("Invalid token")
+							}
+
+							cfg := loadConfig(logger)
+							cfg.Token = token
+							storeConfig(cfg, logger)
+							logger.Info("Token stored")
+							return nil
+						}
+
 						if len(c.Args()) != 2 {
 							cli.ShowCommandHelp(c, c.Command.Name)
 							logger.Fatal("Invalid arguments")
 						}
-						key := c.Args().First()
 						val := c.Args()[1]
 
 						cfg := loadConfig(logger)
@@ -113,6 +329,28 @@ func main() {
 						case "database":
 							cfg.Database = val
 							storeConfig(cfg, logger)
+						case "user_agent_suffix":
+							cfg.UserAgentSuffix = val
+							storeConfig(cfg, logger)
+						case "pg_options":
+							if err := models.ValidatePGOptions(val); err != nil {
+								logger.With("error", err).Fatal("Invalid pg_options")
+							}
+							cfg.PGOptions = val
+							storeConfig(cfg, logger)
+						case "insecure":
+							insecure, err := strconv.ParseBool(val)
+							if err != nil {
+								logger.With("error", err).Fatal("Invalid insecure")
+							}
+							cfg.Insecure = insecure
+							storeConfig(cfg, logger)
+						case "image_alias":
+							if val != "" && !models.ValidImageAlias(val) {
+								logger.With("image_alias", val).Fatal("Invalid image_alias")
+							}
+							cfg.ImageAlias = val
+							storeConfig(cfg, logger)
 						default:
 							logger.With("key", key).Fatal("Invalid key")
 						}
@@ -121,37 +359,197 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "bootstrap",
+			Usage: "configure the server from a bootstrap document",
+			UsageText: `draupnir bootstrap [url]
+
+Fetches a JSON document describing your organisation's draupnir server from
+[url], and saves it to the configuration, e.g.
+
+    {"domain": "draupnir.example.com", "base_path": "/draupnir", "insecure": false, "database": "app"}
+
+Only domain is required. The stored token is left untouched, so run
+draupnir authenticate afterwards if you haven't already.`,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Invalid arguments")
+				}
+
+				bootstrap, err := fetchBootstrap(c.Args().First())
+				if err != nil {
+					logger.With("error", err).Fatal("Could not bootstrap configuration")
+				}
+
+				cfg := bootstrap.Apply(loadConfig(logger))
+				storeConfig(cfg, logger)
+
+				logger.With("domain", cfg.Domain).Info("Configuration bootstrapped")
+				if cfg.Token.RefreshToken == "" {
+					fmt.Println("Now run: draupnir authenticate")
+				}
+				return nil
+			},
+		},
 		{
 			Name:    "authenticate",
 			Aliases: []string{},
 			Usage:   "authenticate with google",
-			Flags:   []cli.Flag{cli.BoolFlag{Name: "force", Usage: "Force reauthentication"}},
+			UsageText: `draupnir authenticate [--force] [--print-token [--no-store]] [--output json]
+
+--print-token prints the resulting access and refresh tokens as JSON, e.g. to
+provision a token for a CI pipeline. Anyone holding these tokens can act as you,
+so treat the output as a secret.
+
+--output json prints whether authentication succeeded, and who as, e.g.
+{"authenticated": true, "email": "jane@example.com", "expires_at": "..."}, so
+that scripts can check it worked. On failure it prints
+{"authenticated": false, "error": "..."} and exits non-zero.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "force", Usage: "Force reauthentication"},
+				cli.BoolFlag{Name: "print-token", Usage: "print the tokens as JSON to stdout"},
+				cli.BoolFlag{Name: "no-store", Usage: "do not save the tokens to the config file (requires --print-token)"},
+				cli.StringFlag{Name: "output", Value: "text", Usage: "output format, one of: text, json"},
+			},
 			Action: func(c *cli.Context) error {
 				cfg := loadConfig(logger)
 				client := NewClient(c, logger)
 
-				if cfg.Token.RefreshToken != "" && !c.Bool("force") {
+				if c.Bool("no-store") && !c.Bool("print-token") {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("--no-store requires --print-token")
+				}
+
+				output := outputFormat(c, logger, "text", "json")
+				if output == "json" && c.Bool("print-token") {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("--output json cannot be combined with --print-token")
+				}
+
+				// fail reports that authentication failed, as JSON if requested
+				fail := func(err error, message string) {
+					if output == "json" {
+						printJSON(AuthenticationJSON{Error: errors.Wrap(err, message).Error()})
+						os.Exit(1)
+					}
+					logger.With("error", err).Fatal(message)
+				}
+
+				// succeed reports who the token authenticates as, if requested
+				succeed := func(client clientPkg.Client, token oauth2.Token) error {
+					if output != "json" {
+						return nil
+					}
+
+					user, err := client.GetCurrentUser()
+					if err != nil {
+						fail(err, "Could not fetch authenticated user")
+					}
+					return printJSON(AuthenticationToJSON(user, token))
+				}
+
+				if cfg.Token.RefreshToken != "" && !c.Bool("force") && !c.Bool("no-store") {
 					logger.Info("You're already authenticated. Pass --force to reauthenticate.")
-					return nil
+					return succeed(client, cfg.Token)
 				}
 
 				state := fmt.Sprintf("%d", rand.Int31())
 
 				url := fmt.Sprintf("%s/authenticate?state=%s", getServerURL(c, cfg), state)
-				err := exec.Command("open", url).Run()
+				err := openBrowser(url)
 				if err != nil {
-					fmt.Printf("Visit this link in your browser: %s\n", url)
+					logger.Debugf("Could not open a browser: %s", err)
+					// Keep stdout clean for the tokens or result when they're being printed
+					out := os.Stdout
+					if c.Bool("print-token") || output == "json" {
+						out = os.Stderr
+					}
+					fmt.Fprintf(out, "Visit this link in your browser: %s\n", url)
 				}
 
 				token, err := client.CreateAccessToken(state)
 				if err != nil {
-					logger.With("error", err).Fatal("Could not create access token")
+					fail(err, "Could not create access token")
 				}
 
-				cfg.Token = token
-				storeConfig(cfg, logger)
+				if !c.Bool("no-store") {
+					cfg.Token = token
+					storeConfig(cfg, logger)
+				}
+
+				if c.Bool("print-token") {
+					logger.Warn("The printed tokens grant access to Draupnir as you. Store them securely.")
+					if err := printJSON(token); err != nil {
+						logger.With("error", err).Fatal("Could not print tokens")
+					}
+				}
 
 				logger.Info("Successfully authenticated.")
+				return succeed(
+					clientPkg.NewClient(getServerURL(c, cfg), token, c.GlobalBool("skip-verify"), cfg.UserAgentSuffix),
+					token,
+				)
+			},
+		},
+		{
+			Name:  "logout",
+			Usage: "forget the stored tokens",
+			UsageText: `draupnir logout
+
+Removes the access and refresh tokens from the config file, e.g. before
+authenticating as another user. The tokens aren't revoked on the server, and
+running it again does nothing.`,
+			Action: func(c *cli.Context) error {
+				cfg := loadConfig(logger)
+
+				if cfg.Token.AccessToken != "" || cfg.Token.RefreshToken != "" {
+					cfg.Token = oauth2.Token{}
+					storeConfig(cfg, logger)
+				}
+
+				fmt.Println("Logged out.")
+				return nil
+			},
+		},
+		{
+			Name:  "ping",
+			Usage: "check that the server is reachable",
+			UsageText: `draupnir ping [--auth]
+
+Calls the server's health check, printing its version and how long it took to
+respond, e.g. for a shell prompt or a quick check before running a script. Exits
+non-zero if the server can't be reached or is down.
+
+--auth also checks that you're authenticated, printing who as.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "auth", Usage: "also check that you're authenticated"},
+			},
+			Action: func(c *cli.Context) error {
+				client := NewClient(c, logger)
+
+				start := time.Now()
+				report, serverVersion, err := client.CheckHealth()
+				if err != nil {
+					logger.With("error", err).Fatal("Server is unreachable")
+				}
+				fmt.Printf(
+					"Server %s is %s (version %s, %s)\n",
+					getServerURL(c, loadConfig(logger)),
+					report.Status,
+					serverVersion,
+					time.Since(start).Round(time.Millisecond),
+				)
+
+				if c.Bool("auth") {
+					start = time.Now()
+					user, err := client.GetCurrentUser()
+					if err != nil {
+						logger.With("error", err).Fatal("Not authenticated")
+					}
+					fmt.Printf("Authenticated as %s (%s)\n", user.Email, time.Since(start).Round(time.Millisecond))
+				}
+
 				return nil
 			},
 		},
@@ -163,301 +561,3014 @@ func main() {
 				{
 					Name:  "list",
 					Usage: "list your instances",
+					UsageText: `draupnir instances list [--mine | --all-users] [--output text|wide|json] [--sort id|expiry] [--expiring-within DURATION]
+
+--mine lists only your instances, which is the default
+--all-users lists the instances of every user, and requires admin access
+
+--output wide (or --format wide, or -o wide) prints a table with the owner,
+  image, backup date, size and expiry of each instance, rather than one compact
+  line each
+
+--output json, or draupnir --output json instances list, prints the instances
+  as a JSON array, with the seconds left before each expires as expires_in
+
+Instances that expire show when, and how long they have left.
+
+--sort expiry lists the instances that expire soonest first, and those that
+  never expire last
+
+On a terminal, instances that expire within --expiring-within (24h by default)
+are highlighted in yellow, and in red once less than half of it is left.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output, format, o",
+							Value: "text",
+							Usage: "output format, one of: text, wide, json",
+						},
+						cli.BoolFlag{
+							Name:  "mine",
+							Usage: "list only your instances (default)",
+						},
+						cli.BoolFlag{
+							Name:  "all-users",
+							Usage: "list the instances of all users (admin only)",
+						},
+						cli.StringFlag{
+							Name:  "sort",
+							Value: "id",
+							Usage: "order of the instances, one of: id, expiry",
+						},
+						cli.DurationFlag{
+							Name:  "expiring-within",
+							Value: 24 * time.Hour,
+							Usage: "highlight instances that expire within this duration",
+						},
+					},
 					Action: func(c *cli.Context) error {
+						if c.Bool("mine") && c.Bool("all-users") {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Cannot supply both --mine and --all-users")
+						}
+
+						format := outputFormat(c, logger, "text", "wide", "json")
+
+						order := c.String("sort")
+						if order != "id" && order != "expiry" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.With("sort", order).Fatal("Invalid sort order")
+						}
+
+						// Highlighting only makes sense to a person reading a terminal
+						highlight := expiryHighlighter{}
+						if isTerminal(os.Stdout) {
+							highlight = expiryHighlighter{now: time.Now(), window: c.Duration("expiring-within")}
+						}
+
 						client := NewClient(c, logger)
 
-						instances, err := client.ListInstances()
+						if c.Bool("all-users") {
+							instances, err := client.ListAllInstances()
+							if err != nil {
+								logger.With("error", err).Fatal("Could not fetch instances")
+							}
+							if order == "expiry" {
+								sort.SliceStable(instances, func(a, b int) bool {
+									return expiresBefore(instances[a].ExpiresAt, instances[b].ExpiresAt)
+								})
+							}
+							if format == "json" {
+								return printJSON(instances)
+							}
+							if format == "wide" {
+								rows := make([]InstanceRow, 0, len(instances))
+								for _, instance := range instances {
+									rows = append(rows, InstanceSummaryToRow(instance))
+								}
+								return printInstanceTable(os.Stdout, rows, highlight)
+							}
+							for _, instance := range instances {
+								var expiresAt time.Time
+								if instance.ExpiresAt != nil {
+									expiresAt = *instance.ExpiresAt
+								}
+								fmt.Println(highlight.apply(expiresAt, InstanceSummaryToString(instance)))
+							}
+							return nil
+						}
+
+						instances, meta, err := client.ListInstancesWithMeta()
 						if err != nil {
 							logger.With("error", err).Fatal("Could not fetch instances")
 						}
-						for _, instance := range instances {
-							fmt.Println(InstanceToString(instance))
+						if order == "expiry" {
+							sort.SliceStable(instances, func(a, b int) bool {
+								return expiresBefore(&instances[a].ExpiresAt, &instances[b].ExpiresAt)
+							})
+						}
+						if format == "json" {
+							instancesJSON := make([]InstanceJSON, 0, len(instances))
+							for _, instance := range instances {
+								instancesJSON = append(instancesJSON, InstanceToJSON(instance))
+							}
+							return printJSON(instancesJSON)
 						}
+						if format == "wide" {
+							rows := make([]InstanceRow, 0, len(instances))
+							for _, instance := range instances {
+								rows = append(rows, InstanceToRow(instance))
+							}
+							if err := printInstanceTable(os.Stdout, rows, highlight); err != nil {
+								return err
+							}
+						} else {
+							for _, instance := range instances {
+								fmt.Println(highlight.apply(instance.ExpiresAt, InstanceToString(instance)))
+							}
+						}
+						// The footer goes to stderr so that the list can be piped
+						fmt.Fprintf(os.Stderr, "%d instances\n", meta.TotalCount)
 						return nil
 					},
 				},
 				{
-					Name:  "create",
-					Usage: "create a new instance",
+					Name:  "count",
+					Usage: "print the number of instances",
+					UsageText: `draupnir instances count [--mine | --all-users]
+
+Prints just the number of instances, e.g. for monitoring scripts.
+
+--mine counts only your instances, which is the default
+--all-users counts the instances of every user, and requires admin access`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "mine",
+							Usage: "count only your instances (default)",
+						},
+						cli.BoolFlag{
+							Name:  "all-users",
+							Usage: "count the instances of all users (admin only)",
+						},
+					},
 					Action: func(c *cli.Context) error {
-						var image models.Image
-						client := NewClient(c, logger)
-
-						if c.NArg() == 0 {
-							image, err = client.GetLatestImage()
-						} else {
-							image, err = client.GetImage(c.Args().First())
+						if c.Bool("mine") && c.Bool("all-users") {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Cannot supply both --mine and --all-users")
 						}
 
-						if err != nil {
-							logger.With("error", err).Fatal("Could not fetch image")
+						client := NewClient(c, logger)
+
+						if c.Bool("all-users") {
+							instances, err := client.ListAllInstances()
+							if err != nil {
+								logger.With("error", err).Fatal("Could not fetch instances")
+							}
+							fmt.Println(len(instances))
+							return nil
 						}
 
-						instance, err := client.CreateInstance(image)
+						_, meta, err := client.ListInstancesWithMeta()
 						if err != nil {
-							logger.With("error", err).Fatal("Could not create instance")
+							logger.With("error", err).Fatal("Could not fetch instances")
 						}
-
-						logger.With("id", instance.ID).With("image", image.ID).Info("Created instance")
-						fmt.Println(InstanceToString(instance))
+						fmt.Println(meta.TotalCount)
 						return nil
 					},
 				},
 				{
-					Name:  "destroy",
-					Usage: "destroy an instance",
+					Name:  "show",
+					Usage: "show the details of an instance",
+					UsageText: `draupnir instances show [id]
+
+[id] the instance ID to show
+
+Prints the instance's details and a libpq connection string for it, e.g. for
+psql "$CONNECTION_STRING". Use draupnir env to export the connection details
+instead.`,
 					Action: func(c *cli.Context) error {
 						id := c.Args().First()
 						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
 							logger.Fatal("Must supply an instance id")
 						}
 
 						client := NewClient(c, logger)
 
 						instance, err := client.GetInstance(id)
+						if clientPkg.IsNotFound(err) {
+							logger.With("id", id).Fatal("Instance not found")
+						}
 						if err != nil {
 							logger.With("error", err).Fatal("Could not fetch instance")
 						}
 
-						err = client.DestroyInstance(instance)
+						details, err := connectionDetails(loadConfig(logger), instance, "", "")
 						if err != nil {
-							logger.With("error", err).Fatal("Could not destroy instance")
+							logger.With("error", err).Fatal("Could not get connection details")
 						}
 
-						logger.With("id", instance.ID).Info("Destroyed instance")
-						return nil
-					},
-				},
-			},
-		},
-		{
-			Name:    "images",
-			Aliases: []string{},
-			Usage:   "manage images",
-			Subcommands: []cli.Command{
-				{
-					Name:  "list",
-					Usage: "list available images",
-					Action: func(c *cli.Context) error {
-						client := NewClient(c, logger)
-
-						images, err := client.ListImages()
-
-						if err != nil {
-							logger.With("error", err).Fatal("Could not fetch images")
+						fmt.Printf("ID: %d\n", instance.ID)
+						if instance.Name != "" {
+							fmt.Printf("Name: %s\n", instance.Name)
 						}
-						for _, image := range images {
-							fmt.Println(ImageToString(image))
+						fmt.Printf("Port: %d\n", instance.Port)
+						fmt.Printf("Image ID: %d\n", instance.ImageID)
+						if !instance.ImageBackedUpAt.IsZero() {
+							fmt.Printf("Backed up at: %s\n", instance.ImageBackedUpAt.Format(time.RFC3339))
+						}
+						fmt.Printf("Created at: %s\n", instance.CreatedAt.Format(time.RFC3339))
+						if !instance.ExpiresAt.IsZero() {
+							fmt.Printf("Expires at: %s\n", instance.ExpiresAt.Format(time.RFC3339))
+						}
+						if instance.SchemaOnly {
+							fmt.Println("Schema only: true")
+						}
+						if instance.MaxConnections > 0 {
+							fmt.Printf("Connections: %d of %d\n", instance.Connections, instance.MaxConnections)
+						} else {
+							fmt.Printf("Connections: %d\n", instance.Connections)
 						}
+						fmt.Printf("Connection string: %s\n", details.ConnectionString())
 						return nil
 					},
 				},
 				{
 					Name:  "create",
-					Usage: "create a new image",
-					UsageText: `draupnir images create [backedUpAt] [anon.sql]
-
-[backedUpAt] an iso8601 timestamp defining when this backup was completed
-[anonyimse.sql] path to an anonymisation script that will be run on image finalisation`,
+					Usage: "create a new instance",
+					UsageText: `draupnir instances create [image_id|alias] [--output text|json] [--dry-run] [--schema-only] [--max-age DURATION [--allow-stale]]
+
+[image_id|alias] the image to create an instance of, or an alias that an image
+  was promoted to, e.g. latest-stable. Defaults to the image_alias config, if
+  set, otherwise the most recent ready image.
+
+--schema-only truncates every table in the instance, keeping only the schema.
+
+--max-age refuses to create an instance of an image backed up longer ago than
+  this, e.g. 168h, unless --allow-stale is given. Defaults to the server's
+  max_image_age, if any.
+
+--dry-run checks that the instance could be created, and shows the image and
+port it would use, without creating it.
+
+--timeout gives up waiting for the instance after this long, e.g. 5m. Waiting
+  can also be interrupted with Ctrl-C, and resumed with draupnir operations wait.
+
+--wait-connect also waits until postgres accepts connections on the instance's
+  port, so that it can be connected to straight away.`,
+					Flags: []cli.Flag{
+						timeoutFlag,
+						waitConnectFlag,
+						cli.StringFlag{
+							Name:  "output",
+							Value: "text",
+							Usage: "output format, one of: text, json",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "shorthand for --output json",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "show what would be created without creating it",
+						},
+						cli.BoolFlag{
+							Name:  "schema-only",
+							Usage: "truncate every table, keeping only the schema",
+						},
+						maxAgeFlag,
+						allowStaleFlag,
+					},
 					Action: func(c *cli.Context) error {
 						var image models.Image
 						client := NewClient(c, logger)
 
-						if len(c.Args()) != 2 {
-							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Invalid command arguments")
+						output := outputFormat(c, logger, "text", "json")
+						if c.Bool("json") {
+							output = "json"
 						}
 
-						backedUpAt, err := time.Parse(time.RFC3339, c.Args().Get(0))
+						image, err = imageFromArg(client, c.Args().First(), loadConfig(logger).ImageAlias)
+
 						if err != nil {
-							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Invalid backedUpAt timestamp")
+							logger.With("error", err).Fatal("Could not fetch image")
 						}
 
-						anonPath := c.Args().Get(1)
-						anon, err := ioutil.ReadFile(anonPath)
-						if err != nil {
-							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Invalid anon script")
+						if c.Bool("dry-run") {
+							plan, err := client.PlanInstance(image, createInstanceOptions(c))
+							if err != nil {
+								logger.With("error", err).Fatal("Could not create instance")
+							}
+
+							if output == "json" {
+								return printJSON(plan)
+							}
+
+							schemaOnly := ""
+							if plan.SchemaOnly {
+								schemaOnly = "schema-only "
+							}
+							fmt.Printf(
+								"Would create a %sinstance of image %d (backed up at %s) on port %d\n",
+								schemaOnly,
+								plan.ImageID,
+								plan.ImageBackedUpAt.Format(time.RFC3339),
+								plan.Port,
+							)
+							return nil
 						}
 
-						image, err = client.CreateImage(backedUpAt, anon)
+						ctx, cancel := waitContext(c)
+						defer cancel()
+
+						instance, err := createInstance(ctx, client, image, createInstanceOptions(c), logger)
 						if err != nil {
-							logger.With("error", err).Fatal("Could not create image")
+							logger.With("error", err).Fatal("Could not create instance")
 						}
 
-						fmt.Println(ImageToString(image))
+						if c.Bool("wait-connect") {
+							if err := waitForConnection(ctx, loadConfig(logger), instance, logger); err != nil {
+								logger.With("error", err).Fatal("Instance is not accepting connections")
+							}
+						}
+
+						if output == "json" {
+							return printJSON(InstanceToJSON(instance))
+						}
+
+						logger.With("id", instance.ID).With("image", image.ID).Info("Created instance")
+						fmt.Println(InstanceToString(instance))
 						return nil
 					},
 				},
 				{
-					Name:  "finalise",
-					Usage: "finalises an image (makes it ready)",
-					UsageText: `draupnir images finalise [id]
-
-[id] the image ID to finalise`,
+					Name:  "follow",
+					Usage: "recreate an instance whenever a newer image is ready",
+					UsageText: `draupnir instances follow [id] [--image-tag key=value] [--interval DURATION] [--destroy-old]
+
+Keeps checking for the latest ready image and, whenever it was backed up more
+recently than the one the instance was created from, creates an instance of
+it and prints its environment, as draupnir env does. Runs until interrupted
+with Ctrl-C, and carries on past errors, retrying at the next check.
+
+--image-tag only follows images with this tag, e.g. --image-tag env=nightly
+
+--interval is how often to check for a newer image, defaulting to 5m
+
+--destroy-old destroys each instance once its replacement is ready`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "image-tag",
+							Usage: "only follow images with this key=value tag",
+						},
+						cli.DurationFlag{
+							Name:  "interval",
+							Usage: "how often to check for a newer image",
+							Value: 5 * time.Minute,
+						},
+						cli.BoolFlag{
+							Name:  "destroy-old",
+							Usage: "destroy each instance once its replacement is ready",
+						},
+						cli.StringFlag{
+							Name:  "app-name",
+							Usage: "the application_name to connect with, instead of draupnir-<your user>",
+						},
+					},
 					Action: func(c *cli.Context) error {
-						var image models.Image
-						client := NewClient(c, logger)
-
-						if len(c.Args()) != 1 {
+						id := c.Args().First()
+						if id == "" {
 							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Invalid command arguments")
+							logger.Fatal("Must supply an instance id")
 						}
 
-						imageID, err := strconv.Atoi(c.Args().First())
-						if err != nil {
+						if c.Duration("interval") <= 0 {
 							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.With("error", err).Fatal("Invalid image ID")
+							logger.Fatal("--interval must be positive")
 						}
 
-						image, err = client.FinaliseImage(imageID)
+						client := NewClient(c, logger)
+
+						instance, err := client.GetInstance(id)
 						if err != nil {
-							logger.With("error", err).Fatal("Could not finalise image")
+							logger.With("error", err).Fatal("Could not fetch instance")
 						}
 
-						fmt.Println(ImageToString(image))
-						return nil
+						ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+						defer stop()
+
+						return followImages(ctx, client, instance, followOptions{
+							Tag:        c.String("image-tag"),
+							Interval:   c.Duration("interval"),
+							DestroyOld: c.Bool("destroy-old"),
+							AppName:    c.String("app-name"),
+						}, loadConfig(logger), logger)
 					},
 				},
 				{
-					Name:  "destroy",
-					Usage: "destroy an image",
+					Name:  "restart",
+					Usage: "restart the Postgres of an instance, keeping its data",
+					UsageText: `draupnir instances restart [id]
+
+[id] the instance ID to restart
+
+Stops and starts the instance's Postgres on the same port, which can recover it
+from a bad state without losing changes made to it, as destroying and
+recreating it would. Returns once it is accepting connections again.`,
 					Action: func(c *cli.Context) error {
 						id := c.Args().First()
 						if id == "" {
 							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Must supply an image id")
+							logger.Fatal("Must supply an instance id")
 						}
 
 						client := NewClient(c, logger)
 
-						image, err := client.GetImage(id)
+						instance, err := client.RestartInstance(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not restart instance")
+						}
+
+						logger.With("id", instance.ID).Info("Restarted instance")
+						fmt.Println(InstanceToString(instance))
+						return nil
+					},
+				},
+				{
+					Name:  "snapshot",
+					Usage: "save the current state of an instance as a new image",
+					UsageText: `draupnir instances snapshot [id] [--backed-up-at TIMESTAMP]
+
+[id] the instance ID to snapshot
+
+Saves the instance's data, including any changes made to it, as a new image
+that is ready straight away, so that a curated fixture can be shared and
+reused. The instance keeps running. The data isn't anonymised again, as it was
+anonymised when the instance's image was finalised.
+
+--backed-up-at records when the data was taken, in the same formats as
+  images create, e.g. to keep the original backup's time. Defaults to now.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "backed-up-at",
+							Value: "now",
+							Usage: "when the image's data was taken",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an instance id")
+						}
+
+						// A zero time is filled in by the server when it takes the snapshot
+						var backedUpAt time.Time
+						if value := c.String("backed-up-at"); value != "now" {
+							var err error
+							backedUpAt, err = parseTimestamp(value)
+							if err != nil {
+								logger.With("error", err).Fatal("Invalid --backed-up-at timestamp")
+							}
+						}
+
+						client := NewClient(c, logger)
+
+						image, err := client.SnapshotInstance(id, backedUpAt)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not snapshot instance")
+						}
+
+						logger.With("id", image.ID).Info("Snapshotted instance")
+						fmt.Println(ImageToString(image))
+						return nil
+					},
+				},
+				{
+					Name:  "logs",
+					Usage: "show the Postgres log of an instance",
+					UsageText: `draupnir instances logs [id] [--lines N] [--follow]
+
+[id] the instance ID whose log to show
+
+--follow keeps checking for new log lines until interrupted`,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "lines",
+							Value: 100,
+							Usage: "the number of lines to show",
+						},
+						cli.BoolFlag{
+							Name:  "follow",
+							Usage: "keep showing new lines as they are logged",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an instance id")
+						}
+
+						client := NewClient(c, logger)
+
+						var previous []string
+						for {
+							output, err := client.GetInstanceLogs(id, c.Int("lines"))
+							if err != nil {
+								logger.With("error", err).Fatal("Could not fetch instance logs")
+							}
+
+							current := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+							for _, line := range newLogLines(previous, current) {
+								fmt.Println(line)
+							}
+
+							if !c.Bool("follow") {
+								return nil
+							}
+
+							previous = current
+							time.Sleep(logPollInterval)
+						}
+					},
+				},
+				{
+					Name:  "rename",
+					Usage: "rename an instance",
+					UsageText: `draupnir instances rename [id] [newname]
+
+[id] the instance ID to rename
+[newname] the new name, at most 63 letters, numbers, dashes or underscores, and
+  not the name of another instance`,
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an instance id and a new name")
+						}
+
+						id := c.Args().Get(0)
+						if _, err := strconv.Atoi(id); err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.With("error", err).Fatal("Invalid instance ID")
+						}
+
+						client := NewClient(c, logger)
+
+						// The instance's ETag makes the rename fail if someone else
+						// changes the instance in the meantime, rather than
+						// overwriting their change
+						instance, err := client.GetInstance(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance")
+						}
+
+						instance, err = client.RenameInstance(instance, c.Args().Get(1))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not rename instance")
+						}
+
+						fmt.Println(InstanceToString(instance))
+						return nil
+					},
+				},
+				{
+					Name:  "destroy",
+					Usage: "destroy an instance",
+					UsageText: `draupnir instances destroy [id] [--yes]
+   draupnir instances destroy [--older-than DURATION] [--image ID] [--all] [--yes]
+
+[id] the instance ID to destroy
+
+You will be asked to confirm unless --yes (-y) is set, which is required when
+stdin isn't a terminal, e.g. in scripts.
+
+Instead of an ID, filters can be given to destroy several of your instances at
+once, e.g. --older-than 48h. Every matching instance is attempted even if some
+fail, and a summary is printed to stderr at the end, e.g.
+  destroyed: 5, missing: 0, failed: 1
+The exit status is non-zero if any failed.
+
+--ignore-missing treats instances that have already been destroyed as
+  destroyed, so that cleanup scripts can be retried. It is the default when
+  destroying several instances; pass --ignore-missing=false to turn it off.
+
+--output json prints the summary to stdout as a JSON object instead.`,
+					Flags: []cli.Flag{
+						ignoreMissingFlag,
+						cli.StringFlag{
+							Name:  "output",
+							Value: "text",
+							Usage: "summary format when destroying several instances, one of: text, json",
+						},
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "destroy instances created longer ago than this duration, e.g. 48h",
+						},
+						cli.IntFlag{
+							Name:  "image",
+							Usage: "destroy instances of this image",
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "destroy all of your instances",
+						},
+						yesFlag,
+					},
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						filtered := c.IsSet("older-than") || c.IsSet("image") || c.Bool("all")
+
+						output := outputFormat(c, logger, "text", "json")
+
+						if id != "" && filtered {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Cannot supply both an instance id and filters")
+						}
+
+						if id == "" && !filtered {
+							logger.Fatal("Must supply an instance id")
+						}
+
+						client := NewClient(c, logger)
+
+						if filtered {
+							instances, err := client.ListInstances()
+							if err != nil {
+								logger.With("error", err).Fatal("Could not fetch instances")
+							}
+
+							summary := batchSummary{Action: "destroyed"}
+							instances = filterInstances(instances, c.Duration("older-than"), c.Int("image"))
+							if len(instances) == 0 {
+								logger.Info("No matching instances to destroy")
+								return printBatchSummary(summary, output)
+							}
+
+							// Keep stdout for the JSON summary
+							list := os.Stdout
+							if output == "json" {
+								list = os.Stderr
+							}
+							for _, instance := range instances {
+								fmt.Fprintln(list, InstanceToString(instance))
+							}
+
+							confirmDestroy(c, logger, fmt.Sprintf("Destroy these %d instances?", len(instances)))
+
+							ignoreMissing := c.Bool("ignore-missing") || !c.IsSet("ignore-missing")
+							for _, instance := range instances {
+								err = client.DestroyInstance(instance)
+								switch {
+								case ignoreMissing && clientPkg.IsNotFound(err):
+									logger.With("id", instance.ID).Info("Instance already destroyed")
+									summary.Missing++
+								case err != nil:
+									logger.With("id", instance.ID).With("error", err).Error("Could not destroy instance")
+									summary.Failed++
+								default:
+									logger.With("id", instance.ID).Info("Destroyed instance")
+									summary.Succeeded++
+								}
+							}
+
+							if err := printBatchSummary(summary, output); err != nil {
+								return err
+							}
+							if summary.Failed > 0 {
+								os.Exit(1)
+							}
+							return nil
+						}
+
+						instance, err := client.GetInstance(id)
+						if err == nil {
+							if !c.Bool("yes") {
+								fmt.Fprintln(os.Stderr, InstanceToString(instance))
+							}
+							confirmDestroy(c, logger, "Destroy this instance?")
+							err = client.DestroyInstance(instance)
+						}
+						if c.Bool("ignore-missing") && clientPkg.IsNotFound(err) {
+							logger.With("id", id).Info("Instance already destroyed")
+							return nil
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not destroy instance")
+						}
+
+						logger.With("id", instance.ID).Info("Destroyed instance")
+						return nil
+					},
+				},
+				{
+					Name:  "adopt",
+					Usage: "register a clone that was started by hand as an instance (admin only)",
+					UsageText: `draupnir instances adopt [port] --image ID --path PATH [--user EMAIL] [--name NAME]
+
+[port] the port that the clone's postgres is listening on
+
+In recovery, an operator may start postgres on a subvolume by hand. Adopting it
+brings it back under draupnir's management: it is listed, and can be destroyed,
+like any other instance. The server checks that the clone is running and has
+the certificates that clients connect with, then moves its subvolume to where
+draupnir keeps instances, without stopping postgres.
+
+--image the image that the clone was made from
+--path the absolute path of the clone's subvolume, on the image's data path
+--user the email address of the instance's owner, defaulting to you
+--name names the instance, otherwise a name is generated`,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "image",
+							Usage: "the image that the clone was made from",
+						},
+						cli.StringFlag{
+							Name:  "path",
+							Usage: "the path of the clone's subvolume",
+						},
+						cli.StringFlag{
+							Name:  "user",
+							Usage: "the email address of the instance's owner, defaulting to you",
+						},
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "the name of the instance",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						port, err := strconv.ParseUint(c.Args().First(), 10, 16)
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply the port that the clone is listening on")
+						}
+
+						if !c.IsSet("image") || c.String("path") == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply --image and --path")
+						}
+
+						client := NewClient(c, logger)
+
+						instance, err := client.AdoptInstance(routes.AdoptInstanceRequest{
+							ImageID:   c.Int("image"),
+							Port:      uint16(port),
+							Path:      c.String("path"),
+							UserEmail: c.String("user"),
+							Name:      c.String("name"),
+						})
+						if err != nil {
+							logger.With("error", err).Fatal("Could not adopt instance")
+						}
+
+						fmt.Println(InstanceSummaryToString(instance))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:    "images",
+			Aliases: []string{},
+			Usage:   "manage images",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list available images",
+					UsageText: `draupnir images list [--output text|json]
+
+--output json, or draupnir --output json images list, prints the images as a
+  JSON array`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output",
+							Value: "text",
+							Usage: "output format, one of: text, json",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						output := outputFormat(c, logger, "text", "json")
+						client := NewClient(c, logger)
+
+						images, meta, err := client.ListImagesWithMeta()
+
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch images")
+						}
+						if output == "json" {
+							imagesJSON := make([]ImageJSON, 0, len(images))
+							for _, image := range images {
+								imagesJSON = append(imagesJSON, ImageToJSON(image))
+							}
+							return printJSON(imagesJSON)
+						}
+						for _, image := range images {
+							fmt.Println(ImageToString(image))
+						}
+						// The footer goes to stderr so that the list can be piped
+						fmt.Fprintf(os.Stderr, "%d images (%d ready)\n", meta.TotalCount, meta.ReadyCount)
+						return nil
+					},
+				},
+				{
+					Name:  "count",
+					Usage: "print the number of images",
+					UsageText: `draupnir images count [--ready-only]
+
+Prints just the number of images, e.g. for monitoring scripts.
+
+--ready-only counts only the images that have been finalised`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "ready-only",
+							Usage: "count only ready images",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						_, meta, err := client.ListImagesWithMeta()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch images")
+						}
+
+						if c.Bool("ready-only") {
+							fmt.Println(meta.ReadyCount)
+						} else {
+							fmt.Println(meta.TotalCount)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "show",
+					Usage: "show the details of an image",
+					UsageText: `draupnir images show [id]
+
+[id] the image ID to show`,
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id")
+						}
+
+						client := NewClient(c, logger)
+
+						image, err := client.GetImage(id)
 						if err != nil {
 							logger.With("error", err).Fatal("Could not fetch image")
 						}
 
-						err = client.DestroyImage(image)
-						if err != nil {
-							logger.With("error", err).Fatal("Could not destroy image")
-						}
+						fmt.Printf("ID: %d\n", image.ID)
+						fmt.Printf("Backed up at: %s\n", image.BackedUpAt.Format(time.RFC3339))
+						fmt.Printf("Ready: %t\n", image.Ready)
+						fmt.Printf("Created at: %s\n", image.CreatedAt.Format(time.RFC3339))
+						fmt.Printf("Updated at: %s\n", image.UpdatedAt.Format(time.RFC3339))
+						fmt.Printf(
+							"Anonymisation script: %s, %d lines\n",
+							formatBytes(uint64(image.AnonSizeBytes)),
+							image.AnonLineCount,
+						)
+						if image.SizeBytes > 0 {
+							fmt.Printf("Size: %s\n", formatBytes(image.SizeBytes))
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "latest",
+					Usage: "show the most recent ready image",
+					UsageText: `draupnir images latest [--output id|text]
+
+Prints the ID of the most recent ready image, so that it can be used in scripts:
+    draupnir instances create $(draupnir images latest)`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output",
+							Value: "id",
+							Usage: "output format, one of: id, text",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						output := outputFormat(c, logger, "id", "text")
+						client := NewClient(c, logger)
+
+						image, err := client.GetLatestImage()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch latest image")
+						}
+
+						if output == "text" {
+							fmt.Println(ImageToString(image))
+						} else {
+							fmt.Println(image.ID)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "create",
+					Usage: "create a new image",
+					UsageText: `draupnir images create [backedUpAt] [anon.sql]
+
+[backedUpAt] a timestamp defining when this backup was completed, e.g.
+             2017-05-01T12:00:00Z, "2017-05-01 12:00:00" (UTC) or 1493640000 (Unix epoch)
+[anonyimse.sql] path to an anonymisation script that will be run on image finalisation
+
+--tag key=value tags the image, so that it can be picked with e.g.
+  draupnir new --tag env=staging. May be given more than once.
+
+--force creates the image even if one already exists for the same backup
+  timestamp and tags.
+
+--default-db sets the database that users connect to in instances of the
+  image, unless they have chosen one with draupnir config set database or
+  PGDATABASE. Otherwise they connect to postgres.
+
+--finalise finalises the image straight after creating it, so that a backup can
+  be registered with a single command. The upload is performed beforehand by
+  --upload-command, which is run by the shell with DRAUPNIR_IMAGE_ID and
+  DRAUPNIR_UPLOAD_PATH set, e.g.
+  --upload-command 'scp db.tar.gz upload@my-draupnir.tld:$DRAUPNIR_UPLOAD_PATH'
+  If either step fails the image is destroyed. If the backup already has a
+  ready image, it is printed rather than creating another.
+
+--from-url has the server download the backup itself, from an s3://, gs:// or
+  https:// URL, instead of it being uploaded, and then finalises the image, e.g.
+  --from-url s3://backups/db/2016-01-01.tar.gz
+  The server's own credentials are used, and the download progress is logged.
+  It implies --finalise, and cannot be combined with --upload-command.
+
+--timeout gives up on the upload command or download after this long, e.g. 1h.
+  It can also be interrupted with Ctrl-C.`,
+					Flags: []cli.Flag{
+						timeoutFlag,
+						cli.StringSliceFlag{
+							Name:  "tag",
+							Usage: "tag the image with a key=value pair",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "create the image even if the backup already has one",
+						},
+						cli.StringFlag{
+							Name:  "default-db",
+							Usage: "the database to connect to by default in instances of the image",
+						},
+						cli.BoolFlag{
+							Name:  "finalise",
+							Usage: "finalise the image once it has been created",
+						},
+						cli.StringFlag{
+							Name:  "upload-command",
+							Usage: "shell command that uploads the backup, run before finalising",
+						},
+						cli.StringFlag{
+							Name:  "from-url",
+							Usage: "s3://, gs:// or https:// URL that the server fetches the backup from, before finalising",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						var image models.Image
+						client := NewClient(c, logger)
+
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						if c.IsSet("upload-command") && !c.Bool("finalise") {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("--upload-command requires --finalise")
+						}
+
+						if c.IsSet("from-url") && c.IsSet("upload-command") {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("--from-url cannot be used with --upload-command")
+						}
+						finalise := c.Bool("finalise") || c.IsSet("from-url")
+
+						backedUpAt, err := parseTimestamp(c.Args().Get(0))
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.With("error", err).Fatal("Invalid backedUpAt timestamp")
+						}
+
+						anonPath := c.Args().Get(1)
+						anon, err := ioutil.ReadFile(anonPath)
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid anon script")
+						}
+
+						uploadClient := client
+						if isTerminal(os.Stderr) {
+							uploadClient = client.WithUploadProgress(printUploadProgress)
+						}
+						image, err = uploadClient.CreateImage(backedUpAt, anon, c.StringSlice("tag"), c.String("default-db"), c.Bool("force"))
+						if duplicate, ok := err.(clientPkg.DuplicateImageError); ok {
+							if finalise {
+								existing, err := client.GetImage(strconv.Itoa(duplicate.ExistingID))
+								if err == nil && existing.Ready {
+									logger.With("id", existing.ID).Info("Backup already has a ready image")
+									fmt.Println(ImageToString(existing))
+									return nil
+								}
+							}
+
+							fmt.Println(duplicate.ExistingID)
+							logger.With("id", duplicate.ExistingID).Fatal("An image already exists for this backup, use --force to create another")
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not create image")
+						}
+
+						if finalise {
+							ctx, cancel := waitContext(c)
+							defer cancel()
+
+							image, err = uploadAndFinaliseImage(ctx, client, image, c.String("from-url"), c.String("upload-command"), logger)
+							if err != nil {
+								if destroyErr := client.DestroyImage(image); destroyErr != nil {
+									logger.With("id", image.ID).With("error", destroyErr).Error("Could not clean up image")
+								}
+								logger.With("id", image.ID).With("error", err).Fatal("Could not finalise image")
+							}
+						}
+
+						fmt.Println(ImageToString(image))
+						return nil
+					},
+				},
+				{
+					Name:  "set-anon",
+					Usage: "replace the anonymisation script of an image",
+					UsageText: `draupnir images set-anon [id] [anon.sql]
+
+[id] the image ID, which must not have been finalised yet
+[anon.sql] path to the new anonymisation script, to be run when the image is
+  finalised
+
+This corrects a script without uploading the backup again.`,
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id and an anon script")
+						}
+
+						id, err := strconv.Atoi(c.Args().Get(0))
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.With("error", err).Fatal("Invalid image ID")
+						}
+
+						anon, err := ioutil.ReadFile(c.Args().Get(1))
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid anon script")
+						}
+
+						client := NewClient(c, logger)
+
+						image, err := client.SetImageAnon(id, anon)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not update anon script")
+						}
+
+						logger.With("id", image.ID).With("anon_size_bytes", image.AnonSizeBytes).Info("Updated anon script")
+						fmt.Println(ImageToString(image))
+						return nil
+					},
+				},
+				{
+					Name:  "finalise",
+					Usage: "finalises an image (makes it ready)",
+					UsageText: `draupnir images finalise [id] [--timeout DURATION]
+
+[id] the image ID to finalise
+
+If the server is busy finalising other images, it queues this one, and this
+waits for it to be finalised.
+
+--timeout gives up waiting after this long, e.g. 5m`,
+					Flags: []cli.Flag{
+						timeoutFlag,
+					},
+					Action: func(c *cli.Context) error {
+						var image models.Image
+						client := NewClient(c, logger)
+
+						if len(c.Args()) != 1 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						imageID, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.With("error", err).Fatal("Invalid image ID")
+						}
+
+						ctx, cancel := waitContext(c)
+						defer cancel()
+
+						image, err = finaliseImage(ctx, client, imageID, logger)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not finalise image")
+						}
+
+						fmt.Println(ImageToString(image))
+						return nil
+					},
+				},
+				{
+					Name:  "promote",
+					Usage: "point an alias at an image",
+					UsageText: `draupnir images promote [id] [alias]
+   draupnir images promote [id] --alias latest-stable
+
+[id]    the image ID to promote, which must be ready
+[alias] the alias to move to the image, creating it if need be
+
+Instances can then be created from the image by its alias, e.g.
+    draupnir new --alias latest-stable
+    draupnir instances create latest-stable
+or by default, with draupnir config set image_alias latest-stable.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "alias",
+							Usage: "the alias to move to the image",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						alias := c.String("alias")
+						if alias == "" {
+							alias = c.Args().Get(1)
+						}
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil || alias == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id and an alias")
+						}
+
+						client := NewClient(c, logger)
+
+						imageAlias, err := client.PromoteImage(id, alias)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not promote image")
+						}
+
+						logger.With("id", imageAlias.ImageID).With("alias", imageAlias.Name).Info("Promoted image")
+						return nil
+					},
+				},
+				{
+					Name:  "aliases",
+					Usage: "list image aliases and the images they point at",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						aliases, err := client.ListImageAliases()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch image aliases")
+						}
+
+						for _, alias := range aliases {
+							fmt.Println(ImageAliasToString(alias))
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "destroy",
+					Usage: "destroy an image",
+					UsageText: `draupnir images destroy [id] [--ignore-missing] [--yes]
+
+[id] the image ID to destroy
+
+You will be asked to confirm unless --yes (-y) is set, which is required when
+stdin isn't a terminal, e.g. in scripts.
+
+--ignore-missing treats an image that has already been destroyed as destroyed,
+  so that cleanup scripts can be retried.`,
+					Flags: []cli.Flag{ignoreMissingFlag, yesFlag},
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id")
+						}
+
+						client := NewClient(c, logger)
+
+						image, err := client.GetImage(id)
+						if err == nil {
+							if !c.Bool("yes") {
+								fmt.Fprintln(os.Stderr, ImageToString(image))
+							}
+							confirmDestroy(c, logger, "Destroy this image?")
+							err = client.DestroyImage(image)
+						}
+						if c.Bool("ignore-missing") && clientPkg.IsNotFound(err) {
+							logger.With("id", id).Info("Image already destroyed")
+							return nil
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not destroy image")
+						}
+
+						logger.With("id", image.ID).Info("Destroyed image")
+						return nil
+					},
+				},
+				{
+					Name:  "replications",
+					Usage: "show the progress of copying an image to the server's peers",
+					UsageText: `draupnir images replications [id]
+
+Servers with replication_peers copy each image that was fetched from a URL to
+their peers once it's finalised. Prints the peer, status and ID of the image on
+each peer.`,
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id")
+						}
+
+						client := NewClient(c, logger)
+
+						replications, err := client.ListImageReplications(c.Args().First())
+						if err != nil {
+							logger.With("error", err).Fatal("Could not list replications")
+						}
+
+						for _, replication := range replications {
+							fmt.Println(ImageReplicationToString(replication))
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "diff",
+					Usage: "compare the schemas of two images (admin only)",
+					UsageText: `draupnir images diff [id] [other_id]
+
+[id]       the image ID to compare from
+[other_id] the image ID to compare to
+
+Prints the tables and columns that were added (+), removed (-) or changed (~),
+along with the estimated number of rows in each changed table.`,
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply two image ids")
+						}
+
+						client := NewClient(c, logger)
+
+						diff, err := client.DiffImages(c.Args().Get(0), c.Args().Get(1))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not diff images")
+						}
+
+						fmt.Print(ImageDiffToString(diff))
+						return nil
+					},
+				},
+				{
+					Name:  "gc",
+					Usage: "find and clean up leaked image subvolumes (admin only)",
+					UsageText: `draupnir images gc --orphaned-subvolumes [--dry-run=false]
+
+--orphaned-subvolumes reconciles images with the subvolumes on disk, listing
+  subvolumes that have no image, and images (older than an hour) that have no
+  subvolumes, along with an estimate of the space that can be reclaimed.
+
+Nothing is changed unless --dry-run=false is given, in which case orphaned
+subvolumes are destroyed, as are the images with missing subvolumes.`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "orphaned-subvolumes",
+							Usage: "reconcile images with the subvolumes on disk",
+						},
+						cli.BoolTFlag{
+							Name:  "dry-run",
+							Usage: "only report what would be cleaned up (default true)",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if !c.Bool("orphaned-subvolumes") {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply --orphaned-subvolumes")
+						}
+
+						client := NewClient(c, logger)
+
+						report, err := client.GCImages(c.BoolT("dry-run"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not reconcile images")
+						}
+
+						fmt.Print(ImageGCReportToString(report))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "env",
+			Usage: "show the environment variables to connect to an instance",
+			UsageText: `draupnir env [id]
+   draupnir env --tag key=value
+   draupnir env --all [--output text|json]
+
+[id] the instance ID to connect to
+
+--tag connects to your most recent instance of the latest image with this tag,
+  e.g. --tag env=staging
+
+--all prints how to connect to each of your instances, as a block headed with a
+  comment naming the instance, or with --output json as an object mapping each
+  instance ID to its connection details
+
+Connections are stamped with application_name=draupnir-<your user>, so that
+they can be attributed to you in pg_stat_activity. Use --app-name to override
+this.
+
+--pg-options sets PGOPTIONS, e.g. --pg-options '-c statement_timeout=0', in
+  place of the pg_options config value or the server's default
+
+--quiet doesn't print the comment advising what to do if the connection is
+  refused because the instance is still starting`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tag",
+					Usage: "connect to an instance of the latest image with this key=value tag",
+				},
+				cli.StringFlag{
+					Name:  "app-name",
+					Usage: "the application_name to connect with, instead of draupnir-<your user>",
+				},
+				cli.StringFlag{
+					Name:  "pg-options",
+					Usage: "session options to connect with, set as PGOPTIONS, e.g. '-c statement_timeout=0'",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "show how to connect to each of your instances",
+				},
+				cli.BoolFlag{
+					Name:  "quiet",
+					Usage: "don't print the hint on what to do if the connection is refused",
+				},
+				cli.StringFlag{Name: "output", Value: "text", Usage: "output format with --all, one of: text, json"},
+			},
+			Action: func(c *cli.Context) error {
+				id := c.Args().First()
+				tag := c.String("tag")
+				pgOptions := pgOptionsFlag(c, logger)
+
+				if c.Bool("all") {
+					if id != "" || tag != "" {
+						cli.ShowCommandHelp(c, c.Command.Name)
+						logger.Fatal("Cannot supply an instance id or a tag with --all")
+					}
+
+					output := outputFormat(c, logger, "text", "json")
+
+					client := NewClient(c, logger)
+					return showAllEnvironments(client, loadConfig(logger), c.String("app-name"), pgOptions, output)
+				}
+
+				if c.IsSet("output") || c.GlobalIsSet("output") {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Can only supply --output with --all")
+				}
+
+				if id != "" && tag != "" {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Cannot supply both an instance id and a tag")
+				}
+
+				if id == "" && tag == "" {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Must supply an instance id")
+				}
+
+				client := NewClient(c, logger)
+
+				var instance models.Instance
+				if tag != "" {
+					instance, err = latestInstanceWithTag(client, tag)
+				} else {
+					instance, err = client.GetInstance(id)
+				}
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance")
+				}
+
+				if err := setupClientEnvironment(loadConfig(logger), instance, c.String("app-name"), pgOptions); err != nil {
+					return err
+				}
+				if !c.Bool("quiet") {
+					printConnectionRefusedHint()
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "operations",
+			Aliases: []string{},
+			Usage:   "track and review instances and images being created",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "show the history of your instances and images being created, destroyed, fetched and finalised",
+					UsageText: `draupnir operations list [--kind KIND] [--status STATUS] [--since DURATION] [--limit N]
+
+Prints your operations, the most recent first, with how long each took and how
+it turned out.
+
+--kind only shows one kind of operation: create_instance, destroy_instance,
+  fetch_image, finalise_image or snapshot_instance
+
+--status only shows operations that are pending, succeeded or failed
+
+--since only shows operations started this long ago or more recently, e.g. 1h
+
+--user shows another user's operations (admin only)`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "kind", Usage: "the kind of operation to show"},
+						cli.StringFlag{Name: "status", Usage: "the status of operations to show"},
+						cli.DurationFlag{Name: "since", Usage: "only show operations started this long ago or since, e.g. 1h"},
+						cli.IntFlag{Name: "limit", Usage: "the most operations to show (default: 50)"},
+						cli.StringFlag{Name: "user", Usage: "the email address of the user whose operations to show"},
+						cli.BoolFlag{Name: "json", Usage: "print the operations as a JSON array"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						options := clientPkg.ListOperationsOptions{
+							Kind:   c.String("kind"),
+							Status: c.String("status"),
+							Limit:  c.Int("limit"),
+							User:   c.String("user"),
+						}
+						if since := c.Duration("since"); since > 0 {
+							options.Since = time.Now().Add(-since)
+						}
+
+						operations, err := client.ListOperations(options)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not list operations")
+						}
+
+						if c.Bool("json") {
+							operationsJSON := make([]OperationJSON, 0, len(operations))
+							for _, operation := range operations {
+								operationsJSON = append(operationsJSON, OperationToJSON(operation))
+							}
+							return printJSON(operationsJSON)
+						}
+
+						for _, operation := range operations {
+							fmt.Println(OperationToString(operation))
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "wait",
+					Usage: "wait for an operation to complete, and show the instance or image it produced",
+					UsageText: `draupnir operations wait [id]
+
+[id] the operation ID, as logged when the instance creation or queued image
+finalisation was started
+
+This resumes waiting for an instance that was being created, or an image that
+was being finalised, when the client was interrupted.
+
+--timeout gives up waiting after this long, e.g. 5m`,
+					Flags: []cli.Flag{
+						timeoutFlag,
+					},
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an operation id")
+						}
+
+						client := NewClient(c, logger)
+
+						operation, err := client.GetOperation(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch operation")
+						}
+
+						// Instances are destroyed while the client waits, so
+						// there is nothing to wait for
+						if operation.Kind == models.OperationDestroyInstance {
+							fmt.Println(OperationToString(operation))
+							return nil
+						}
+
+						ctx, cancel := waitContext(c)
+						defer cancel()
+
+						if operation.ImageID != 0 {
+							image, err := waitForImageOperation(ctx, client, operation, logger)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not finalise image")
+							}
+
+							fmt.Println(ImageToString(image))
+							return nil
+						}
+
+						instance, err := waitForOperation(ctx, client, operation, logger)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not create instance")
+						}
+
+						fmt.Println(InstanceToString(instance))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:    "new",
+			Aliases: []string{},
+			Usage:   "create a new instance",
+			UsageText: `draupnir new [--tag key=value | --alias ALIAS] [--name NAME] [--timeout DURATION] [--quiet] [--max-age DURATION [--allow-stale]]
+
+--tag creates the instance from the latest image with this tag, e.g.
+  --tag env=staging, rather than the latest image overall
+
+--alias creates the instance from the image that this alias was last promoted
+  to, e.g. latest-stable. Defaults to the image_alias config, unless --tag is
+  given.
+
+--name names the instance, otherwise a name is generated
+
+--quiet doesn't print the command to destroy the instance to stderr, or the
+  comment advising what to do if the connection is refused
+
+--timeout gives up waiting for the instance after this long, e.g. 5m
+
+--wait-connect also waits until postgres accepts connections on the instance's
+  port, so that it can be connected to straight away
+
+--pg-options sets PGOPTIONS, e.g. --pg-options '-c statement_timeout=0'
+
+--max-age refuses to create an instance of an image backed up longer ago than
+  this, e.g. 168h, unless --allow-stale is given. Defaults to the server's
+  max_image_age, if any.`,
+			Flags: []cli.Flag{
+				timeoutFlag,
+				waitConnectFlag,
+				cli.StringFlag{
+					Name:  "tag",
+					Usage: "use the latest image with this key=value tag",
+				},
+				cli.StringFlag{
+					Name:  "alias",
+					Usage: "use the image promoted to this alias",
+				},
+				cli.StringFlag{
+					Name:  "app-name",
+					Usage: "the application_name to connect with, instead of draupnir-<your user>",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "the name of the instance",
+				},
+				cli.BoolFlag{
+					Name:  "quiet",
+					Usage: "don't print the command to destroy the instance, or connection hints",
+				},
+				cli.StringFlag{
+					Name:  "pg-options",
+					Usage: "session options to connect with, set as PGOPTIONS, e.g. '-c statement_timeout=0'",
+				},
+				maxAgeFlag,
+				allowStaleFlag,
+			},
+			Action: func(c *cli.Context) error {
+				pgOptions := pgOptionsFlag(c, logger)
+				client := NewClient(c, logger)
+
+				if c.IsSet("tag") && c.IsSet("alias") {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("--tag and --alias cannot be used together")
+				}
+
+				alias := c.String("alias")
+				if alias == "" && !c.IsSet("tag") {
+					alias = loadConfig(logger).ImageAlias
+				}
+
+				var image models.Image
+				var err error
+				if alias != "" {
+					image, err = client.GetImageByAlias(alias)
+				} else {
+					image, err = client.GetLatestImageWithTag(c.String("tag"))
+				}
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch image")
+				}
+
+				ctx, cancel := waitContext(c)
+				defer cancel()
+
+				instance, err := createInstance(ctx, client, image, createInstanceOptions(c), logger)
+				if err != nil {
+					logger.With("error", err).Fatal("Could not create instance")
+				}
+
+				if c.Bool("wait-connect") {
+					if err := waitForConnection(ctx, loadConfig(logger), instance, logger); err != nil {
+						logger.With("error", err).Fatal("Instance is not accepting connections")
+					}
+				}
+
+				// The hint goes to stderr so that it isn't picked up when
+				// the environment is eval'd
+				if !c.Bool("quiet") {
+					fmt.Fprintf(os.Stderr, "# destroy with: draupnir instances destroy %d\n", instance.ID)
+				}
+
+				if err := setupClientEnvironment(loadConfig(logger), instance, c.String("app-name"), pgOptions); err != nil {
+					return err
+				}
+				// With --wait-connect we already know that postgres is up
+				if !c.Bool("quiet") && !c.Bool("wait-connect") {
+					printConnectionRefusedHint()
+				}
+				return nil
+			},
+		},
+	}
+
+	rejectGlobalOutput(app.Commands, logger)
+
+	app.Run(os.Args)
+}
+
+// defaultConnectionTemplate is used when the server does not advertise a
+// connection template for its instances
+const defaultConnectionTemplate = "export PGHOST={{.Hostname}} PGPORT={{.Port}} PGUSER=draupnir PGPASSWORD='' PGDATABASE={{.Database}} PGSSLMODE=verify-ca PGSSLROOTCERT='{{.CACertPath}}' PGSSLCERT='{{.ClientCertPath}}' PGSSLKEY='{{.ClientKeyPath}}' PGAPPNAME='{{.ApplicationName}}'{{if .PGOptions}} PGOPTIONS='{{.PGOptions}}'{{end}}{{if .ConnectTimeout}} PGCONNECT_TIMEOUT={{.ConnectTimeout}}{{end}}\n"
+
+// connectTimeoutSeconds is exported as PGCONNECT_TIMEOUT, so that connecting
+// to an instance that isn't reachable fails quickly rather than hanging
+const connectTimeoutSeconds = 5
+
+// printConnectionRefusedHint prints a comment after an instance's environment
+// on what to do if it can't be connected to yet. It comes after the
+// environment rather than before it, as eval $(draupnir env) joins the output
+// onto one line, where a leading comment would swallow the exports.
+func printConnectionRefusedHint() {
+	fmt.Println("# if the connection is refused, the instance may still be starting: retry, or create instances with --wait-connect")
+}
+
+// setupClientEnvironment writes the instance's credentials to disk and prints
+// how to connect to it. appName overrides the application_name advertised by
+// the server, and pgOptions the session options, if set.
+func setupClientEnvironment(config config.Config, instance models.Instance, appName string, pgOptions string) error {
+	details, err := connectionDetails(config, instance, appName, pgOptions)
+	if err != nil {
+		return err
+	}
+
+	// The server may dictate how to connect to its instances, otherwise output
+	// enviroment variables that can be read by libpq:
+	// https://www.postgresql.org/docs/current/libpq-envars.html
+	connectionTemplate := instance.ConnectionTemplate
+	if connectionTemplate == "" {
+		connectionTemplate = defaultConnectionTemplate
+	}
+
+	tmpl, err := template.New("connection").Parse(connectionTemplate)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse connection template")
+	}
+
+	err = tmpl.Execute(os.Stdout, details)
+	return errors.Wrap(err, "failed to render connection template")
+}
+
+// showAllEnvironments prints how to connect to each of the user's instances,
+// as with setupClientEnvironment, or as a JSON object of connection details
+// keyed by instance ID
+func showAllEnvironments(client clientPkg.Client, cfg config.Config, appName string, pgOptions string, output string) error {
+	summaries, err := client.ListInstances()
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+
+	allDetails := map[string]models.ConnectionDetails{}
+	for _, summary := range summaries {
+		// Instances are listed without their credentials
+		instance, err := client.GetInstance(strconv.Itoa(summary.ID))
+		if err != nil {
+			return errors.Wrapf(err, "failed to get instance %d", summary.ID)
+		}
+
+		if output == "json" {
+			details, err := connectionDetails(cfg, instance, appName, pgOptions)
+			if err != nil {
+				return err
+			}
+			allDetails[strconv.Itoa(instance.ID)] = details
+			continue
+		}
+
+		fmt.Printf("# instance %d", instance.ID)
+		if instance.Name != "" {
+			fmt.Printf(" (%s)", instance.Name)
+		}
+		fmt.Println()
+		if err := setupClientEnvironment(cfg, instance, appName, pgOptions); err != nil {
+			return err
+		}
+	}
+
+	if output == "json" {
+		return printJSON(allDetails)
+	}
+	return nil
+}
+
+// connectionDetails writes the instance's credentials to disk and returns how
+// to connect to it, with appName and pgOptions as for setupClientEnvironment
+func connectionDetails(config config.Config, instance models.Instance, appName string, pgOptions string) (models.ConnectionDetails, error) {
+	if instance.Credentials == nil {
+		return models.ConnectionDetails{}, errors.New("database credentials are not available")
+	}
+
+	// We use an OS-defined private temporary directory for storing the
+	// certficates and keys, rather than creating a directory such as:
+	// `~/.draupnir.d/$INSTANCE_ID/`.
+	// The advantage of this is that we do not have to write custom logic to
+	// clean-up old key data, instead we can rely on the OS to do this for us.
+	// On MacOS, where this client will be primarily run, the temp files are
+	// cleaned up if they have not been accessed in 3 days, which is perfect for
+	// this use case: https://superuser.com/a/187105
+	dir, err := ioutil.TempDir("", fmt.Sprintf("draupnir-%d-", instance.ID))
+	if err != nil {
+		return models.ConnectionDetails{}, errors.Wrap(err, "failed to create temporary directory")
+	}
+
+	caCertPath := filepath.Join(dir, "ca.crt")
+	clientCertPath := filepath.Join(dir, "client.crt")
+	clientKeyPath := filepath.Join(dir, "client.key")
+
+	if err := ioutil.WriteFile(caCertPath, []byte(instance.Credentials.CACertificate), 0644); err != nil {
+		return models.ConnectionDetails{}, errors.Wrapf(err, "failed to write content for %s", caCertPath)
+	}
+	if err := ioutil.WriteFile(clientCertPath, []byte(instance.Credentials.ClientCertificate), 0644); err != nil {
+		return models.ConnectionDetails{}, errors.Wrapf(err, "failed to write content for %s", clientCertPath)
+	}
+	if err := ioutil.WriteFile(clientKeyPath, []byte(instance.Credentials.ClientKey), 0600); err != nil {
+		return models.ConnectionDetails{}, errors.Wrapf(err, "failed to write content for %s", clientKeyPath)
+	}
+
+	// The database precedence is config -> environment variable -> the image's
+	// default -> 'postgres'
+	database := config.Database
+	if database == "" {
+		database = os.Getenv("PGDATABASE")
+	}
+	if database == "" {
+		database = instance.ImageDefaultDatabase
+	}
+	if database == "" {
+		database = "postgres"
+	}
+
+	if appName == "" {
+		appName = instance.ApplicationName
+	}
+
+	// As with the database, the session options given to the command take
+	// precedence over the config, and then the server's default
+	if pgOptions == "" {
+		pgOptions = config.PGOptions
+	}
+	if pgOptions == "" {
+		pgOptions = instance.PGOptions
+	}
+
+	return models.ConnectionDetails{
+		ID:              instance.ID,
+		Hostname:        instanceHost(config, instance),
+		Port:            instance.Port,
+		Database:        database,
+		CACertPath:      caCertPath,
+		ClientCertPath:  clientCertPath,
+		ClientKeyPath:   clientKeyPath,
+		ApplicationName: appName,
+		PGOptions:       pgOptions,
+		ConnectTimeout:  connectTimeoutSeconds,
+	}, nil
+}
+
+func ImageToString(i models.Image) string {
+	s := fmt.Sprintf("%2d [ %s - READY: %5t ]", i.ID, i.BackedUpAt.Format(time.RFC3339), i.Ready)
+	if i.SizeBytes > 0 {
+		s += " " + formatBytes(i.SizeBytes)
+	}
+	if i.Tags != "" {
+		s += " " + i.Tags
+	}
+	if i.Error != "" {
+		s += " ERROR: " + i.Error
+	}
+	return s
+}
+
+// OperationToString describes an operation on one line, e.g.
+// 7 [ SUCCEEDED - 2006-01-02T15:04:05Z - 1m5s ] create_instance instance 3
+func OperationToString(o models.Operation) string {
+	duration := "running"
+	if !o.FinishedAt.IsZero() {
+		duration = o.Duration().Round(time.Second).String()
+	}
+
+	kind := o.Kind
+	if kind == "" {
+		kind = "unknown"
+	}
+
+	s := fmt.Sprintf(
+		"%2d [ %s - %s - %s ] %s",
+		o.ID, strings.ToUpper(o.Status), o.CreatedAt.Format(time.RFC3339), duration, kind,
+	)
+	if o.InstanceID != 0 {
+		s += fmt.Sprintf(" instance %d", o.InstanceID)
+	}
+	if o.ImageID != 0 {
+		s += fmt.Sprintf(" image %d", o.ImageID)
+	}
+	if o.Error != "" {
+		s += " ERROR: " + o.Error
+	}
+	return s
+}
+
+// OperationJSON is the machine readable representation of an operation printed
+// by the CLI
+type OperationJSON struct {
+	ID         int        `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	InstanceID int        `json:"instance_id,omitempty"`
+	ImageID    int        `json:"image_id,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// DurationSeconds is how long the operation took, once it has finished
+	DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+}
+
+func OperationToJSON(o models.Operation) OperationJSON {
+	result := OperationJSON{
+		ID:         o.ID,
+		Kind:       o.Kind,
+		Status:     o.Status,
+		InstanceID: o.InstanceID,
+		ImageID:    o.ImageID,
+		Error:      o.Error,
+		CreatedAt:  o.CreatedAt,
+	}
+	if !o.FinishedAt.IsZero() {
+		duration := o.Duration().Seconds()
+		result.FinishedAt = &o.FinishedAt
+		result.DurationSeconds = &duration
+	}
+	return result
+}
+
+func ImageReplicationToString(r models.ImageReplication) string {
+	s := fmt.Sprintf("%s [ %s ]", r.Peer, strings.ToUpper(r.Status))
+	if r.PeerImageID != 0 {
+		s += fmt.Sprintf(" image %d", r.PeerImageID)
+	}
+	if r.Error != "" {
+		s += " ERROR: " + r.Error
+	}
+	return s
+}
+
+func ImageAliasToString(a models.ImageAlias) string {
+	return fmt.Sprintf(
+		"%s [ IMAGE: %d - PROMOTED BY: %s - %s ]",
+		a.Name, a.ImageID, a.PromotedBy, a.PromotedAt.Format(time.RFC3339),
+	)
+}
+
+func InstanceSummaryToString(i routes.InstanceSummary) string {
+	s := fmt.Sprintf(
+		"%2d [ PORT: %d - %s - IMAGE: %2d - %s ]",
+		i.ID, i.Port, i.UserEmail, i.ImageID, i.CreatedAt.Format(time.RFC3339),
+	)
+	if i.Name != "" {
+		s += " " + i.Name
+	}
+	if i.ExpiresAt != nil {
+		s += " [expires " + formatExpiresIn(*i.ExpiresAt, time.Now()) + "]"
+	}
+	return s
+}
+
+func InstanceToString(i models.Instance) string {
+	s := fmt.Sprintf("%2d [ PORT: %d - %s ]", i.ID, i.Port, i.CreatedAt.Format(time.RFC3339))
+	if i.Name != "" {
+		s += " " + i.Name
+	}
+	if !i.ImageBackedUpAt.IsZero() {
+		s += fmt.Sprintf(" (backup %s)", i.ImageBackedUpAt.Format("2006-01-02"))
+	}
+	if i.SchemaOnly {
+		s += " [schema only]"
+	}
+	if i.MaxConnections > 0 {
+		s += fmt.Sprintf(" [max %d connections]", i.MaxConnections)
+	}
+	if !i.ExpiresAt.IsZero() {
+		s += " [expires " + i.ExpiresAt.Format(time.RFC3339) + ", " + formatExpiresIn(i.ExpiresAt, time.Now()) + "]"
+	}
+	return s
+}
+
+// formatExpiresIn describes how long is left before expiresAt, to the minute,
+// e.g. "in 1h", "in 2h30m" or "expired"
+func formatExpiresIn(expiresAt, now time.Time) string {
+	left := expiresAt.Sub(now)
+	if left <= 0 {
+		return "expired"
+	}
+	if left < time.Minute {
+		return "in <1m"
+	}
+
+	hours := int(left / time.Hour)
+	minutes := int(left % time.Hour / time.Minute)
+	switch {
+	case hours == 0:
+		return fmt.Sprintf("in %dm", minutes)
+	case minutes == 0:
+		return fmt.Sprintf("in %dh", hours)
+	default:
+		return fmt.Sprintf("in %dh%dm", hours, minutes)
+	}
+}
+
+// expiresBefore orders instances by expiry, with those that never expire
+// (nil or zero) last
+func expiresBefore(a, b *time.Time) bool {
+	if a == nil || a.IsZero() {
+		return false
+	}
+	if b == nil || b.IsZero() {
+		return true
+	}
+	return a.Before(*b)
+}
+
+// expiryHighlighter colours the instances that expire within window of now:
+// yellow, then red once less than half of the window is left. The zero value
+// highlights nothing.
+type expiryHighlighter struct {
+	now    time.Time
+	window time.Duration
+}
+
+func (h expiryHighlighter) apply(expiresAt time.Time, s string) string {
+	if h.window <= 0 || expiresAt.IsZero() {
+		return s
+	}
+	left := expiresAt.Sub(h.now)
+	switch {
+	case left < h.window/2:
+		return "\033[31m" + s + "\033[0m"
+	case left < h.window:
+		return "\033[33m" + s + "\033[0m"
+	default:
+		return s
+	}
+}
+
+// InstanceRow is a line of instances list --format wide. Zero values are
+// unknown, and shown as -.
+type InstanceRow struct {
+	ID         int
+	Name       string
+	Owner      string
+	ImageID    int
+	BackedUpAt time.Time
+	Port       uint16
+	SizeBytes  uint64
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+func InstanceToRow(i models.Instance) InstanceRow {
+	return InstanceRow{
+		ID:         i.ID,
+		Name:       i.Name,
+		Owner:      i.UserEmail,
+		ImageID:    i.ImageID,
+		BackedUpAt: i.ImageBackedUpAt,
+		Port:       i.Port,
+		CreatedAt:  i.CreatedAt,
+		ExpiresAt:  i.ExpiresAt,
+	}
+}
+
+func InstanceSummaryToRow(i routes.InstanceSummary) InstanceRow {
+	row := InstanceRow{
+		ID:         i.ID,
+		Name:       i.Name,
+		Owner:      i.UserEmail,
+		ImageID:    i.ImageID,
+		BackedUpAt: i.ImageBackedUpAt,
+		Port:       i.Port,
+		CreatedAt:  i.CreatedAt,
+	}
+	if i.ExpiresAt != nil {
+		row.ExpiresAt = *i.ExpiresAt
+	}
+	return row
+}
+
+// printInstanceTable prints instances as columns aligned with a tabwriter,
+// under a header. Only the last column is highlighted, as the colour codes
+// would otherwise throw out the alignment.
+func printInstanceTable(w io.Writer, rows []InstanceRow, highlight expiryHighlighter) error {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	formatTime := func(t time.Time, layout string) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(layout)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tNAME\tOWNER\tIMAGE\tBACKUP\tPORT\tSIZE\tCREATED\tEXPIRES\tEXPIRES IN")
+	for _, row := range rows {
+		size := "-"
+		if row.SizeBytes > 0 {
+			size = formatBytes(row.SizeBytes)
+		}
+		expiresIn := "-"
+		if !row.ExpiresAt.IsZero() {
+			expiresIn = highlight.apply(row.ExpiresAt, formatExpiresIn(row.ExpiresAt, time.Now()))
+		}
+		fmt.Fprintf(
+			table,
+			"%d\t%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			row.ID,
+			orDash(row.Name),
+			orDash(row.Owner),
+			row.ImageID,
+			formatTime(row.BackedUpAt, "2006-01-02"),
+			row.Port,
+			size,
+			formatTime(row.CreatedAt, time.RFC3339),
+			formatTime(row.ExpiresAt, time.RFC3339),
+			expiresIn,
+		)
+	}
+	return table.Flush()
+}
+
+// AuthenticationJSON is the machine readable result of authenticate
+type AuthenticationJSON struct {
+	Authenticated bool       `json:"authenticated"`
+	Email         string     `json:"email,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// AuthenticationToJSON describes a successful authentication. Tokens that
+// don't expire have no expires_at.
+func AuthenticationToJSON(user routes.CurrentUser, token oauth2.Token) AuthenticationJSON {
+	result := AuthenticationJSON{Authenticated: true, Email: user.Email}
+	if !token.Expiry.IsZero() {
+		result.ExpiresAt = &token.Expiry
+	}
+	return result
+}
+
+// ConfigJSON is the machine readable output of config show
+type ConfigJSON struct {
+	Domain    string `json:"domain"`
+	Database  string `json:"database"`
+	UserAgent string `json:"user_agent"`
+	PGOptions string `json:"pg_options,omitempty"`
+	Insecure  bool   `json:"insecure,omitempty"`
+	// ImageAlias is the alias that instances are created from by default
+	ImageAlias string    `json:"image_alias,omitempty"`
+	Token      TokenJSON `json:"token"`
+}
+
+// TokenJSON describes the stored token. The refresh token is only included
+// when tokens are expanded.
+type TokenJSON struct {
+	AccessToken  string     `json:"access_token"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	Expiry       *time.Time `json:"expiry,omitempty"`
+	// Authenticated is true if a refresh token is stored
+	Authenticated bool `json:"authenticated"`
+}
+
+// ConfigToJSON describes the configuration, truncating the access token unless
+// expandToken is set
+func ConfigToJSON(cfg config.Config, expandToken bool) ConfigJSON {
+	token := TokenJSON{
+		AccessToken:   truncateToken(cfg.Token.AccessToken),
+		Authenticated: cfg.Token.RefreshToken != "",
+	}
+	if expandToken {
+		token.AccessToken = cfg.Token.AccessToken
+		token.RefreshToken = cfg.Token.RefreshToken
+	}
+	if !cfg.Token.Expiry.IsZero() {
+		token.Expiry = &cfg.Token.Expiry
+	}
+
+	return ConfigJSON{
+		Domain:     cfg.Domain,
+		Database:   cfg.Database,
+		UserAgent:  clientPkg.UserAgent(cfg.UserAgentSuffix),
+		PGOptions:  cfg.PGOptions,
+		Insecure:   cfg.Insecure,
+		ImageAlias: cfg.ImageAlias,
+		Token:      token,
+	}
+}
+
+// truncateToken shows just enough of a token to tell tokens apart
+func truncateToken(token string) string {
+	if len(token) < 10 {
+		return token
+	}
+	return token[0:10] + "****"
+}
+
+// InstanceJSON is the machine readable representation of an instance printed
+// by the CLI
+type InstanceJSON struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	ImageID   int       `json:"image_id"`
+	Hostname  string    `json:"hostname"`
+	Port      uint16    `json:"port"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// UserEmail is the instance's owner
+	UserEmail string `json:"user_email,omitempty"`
+	// ImageBackedUpAt is when the backup the instance was created from was taken
+	ImageBackedUpAt time.Time `json:"image_backed_up_at"`
+	SchemaOnly      bool      `json:"schema_only,omitempty"`
+	MaxConnections  int       `json:"max_connections,omitempty"`
+	// Connections is only known when a single instance is fetched
+	Connections int `json:"connections,omitempty"`
+	// ExpiresAt is when the instance will be destroyed automatically, if ever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ExpiresIn is the number of seconds left before ExpiresAt, and 0 once the
+	// instance has expired
+	ExpiresIn *int64 `json:"expires_in,omitempty"`
+}
+
+func InstanceToJSON(i models.Instance) InstanceJSON {
+	result := InstanceJSON{
+		ID:              i.ID,
+		Name:            i.Name,
+		ImageID:         i.ImageID,
+		Hostname:        i.Hostname,
+		Port:            i.Port,
+		CreatedAt:       i.CreatedAt,
+		UpdatedAt:       i.UpdatedAt,
+		UserEmail:       i.UserEmail,
+		ImageBackedUpAt: i.ImageBackedUpAt,
+		SchemaOnly:      i.SchemaOnly,
+		MaxConnections:  i.MaxConnections,
+		Connections:     i.Connections,
+	}
+	if !i.ExpiresAt.IsZero() {
+		expiresIn := int64(time.Until(i.ExpiresAt).Seconds())
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+		result.ExpiresAt = &i.ExpiresAt
+		result.ExpiresIn = &expiresIn
+	}
+	return result
+}
+
+// ImageJSON is the machine readable representation of an image printed by the
+// CLI
+type ImageJSON struct {
+	ID              int       `json:"id"`
+	BackedUpAt      time.Time `json:"backed_up_at"`
+	Ready           bool      `json:"ready"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	AnonSizeBytes   int       `json:"anon_size_bytes"`
+	AnonLineCount   int       `json:"anon_line_count"`
+	SizeBytes       uint64    `json:"size_bytes,omitempty"`
+	Tags            string    `json:"tags,omitempty"`
+	DefaultDatabase string    `json:"default_database,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	Destroying      bool      `json:"destroying,omitempty"`
+}
+
+func ImageToJSON(i models.Image) ImageJSON {
+	return ImageJSON{
+		ID:              i.ID,
+		BackedUpAt:      i.BackedUpAt,
+		Ready:           i.Ready,
+		CreatedAt:       i.CreatedAt,
+		UpdatedAt:       i.UpdatedAt,
+		AnonSizeBytes:   i.AnonSizeBytes,
+		AnonLineCount:   i.AnonLineCount,
+		SizeBytes:       i.SizeBytes,
+		Tags:            i.Tags,
+		DefaultDatabase: i.DefaultDatabase,
+		Error:           i.Error,
+		Destroying:      i.Destroying,
+	}
+}
+
+// outputFormat returns the format that a command prints in: its own --output
+// flag, under any of its names, if that was given, otherwise the global
+// --output flag if that was, otherwise the command's default. It must be one of
+// formats.
+func outputFormat(c *cli.Context, logger log.Logger, formats ...string) string {
+	output := c.String("output")
+	if !outputFlagSet(c) && c.GlobalIsSet("output") {
+		output = c.GlobalString("output")
+	}
+
+	for _, format := range formats {
+		if output == format {
+			return output
+		}
+	}
+
+	cli.ShowCommandHelp(c, c.Command.Name)
+	logger.With("output", output).Fatalf("Invalid output format, must be one of: %s", strings.Join(formats, ", "))
+	return ""
+}
+
+// outputFlagSet reports whether the command's own --output flag was given, by
+// any of its names
+func outputFlagSet(c *cli.Context) bool {
+	for _, flag := range c.Command.Flags {
+		names := strings.Split(flag.GetName(), ",")
+		if strings.TrimSpace(names[0]) != "output" {
+			continue
+		}
+		for _, name := range names {
+			if c.IsSet(strings.TrimSpace(name)) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-						logger.With("id", image.ID).Info("Destroyed image")
-						return nil
-					},
-				},
-			},
-		},
-		{
-			Name:  "env",
-			Usage: "show the environment variables to connect to an instance",
-			UsageText: `draupnir env [id]
+// rejectGlobalOutput makes the commands that don't take --output fail if the
+// global --output flag is given, rather than silently printing text
+func rejectGlobalOutput(commands []cli.Command, logger log.Logger) {
+	for i := range commands {
+		command := &commands[i]
+		rejectGlobalOutput(command.Subcommands, logger)
+
+		action, ok := command.Action.(func(*cli.Context) error)
+		if !ok || hasOutputFlag(command.Flags) {
+			continue
+		}
+		command.Action = func(c *cli.Context) error {
+			if c.GlobalIsSet("output") {
+				cli.ShowCommandHelp(c, c.Command.Name)
+				logger.Fatalf("%s doesn't support --output", c.Command.FullName())
+			}
+			return action(c)
+		}
+	}
+}
 
-[id] the instance ID to connect to`,
-			Action: func(c *cli.Context) error {
-				id := c.Args().First()
-				if id == "" {
-					cli.ShowCommandHelp(c, c.Command.Name)
-					logger.Fatal("Must supply an instance id")
-				}
+func hasOutputFlag(flags []cli.Flag) bool {
+	for _, flag := range flags {
+		if strings.TrimSpace(strings.Split(flag.GetName(), ",")[0]) == "output" {
+			return true
+		}
+	}
+	return false
+}
 
-				client := NewClient(c, logger)
+// browserLaunchers are the commands that open a URL in the user's browser on
+// each platform, in the order they're tried. Other platforms use the default.
+var browserLaunchers = map[string][][]string{
+	"darwin":  {{"open"}},
+	"windows": {{"rundll32", "url.dll,FileProtocolHandler"}},
+	"default": {{"xdg-open"}, {"sensible-browser"}, {"x-www-browser"}},
+}
 
-				instance, err := client.GetInstance(id)
-				if err != nil {
-					logger.With("error", err).Fatal("Could not fetch instance")
-				}
+// openBrowser opens url in the user's browser, trying each of the platform's
+// launchers until one succeeds. It returns the last launcher's error if none
+// of them do.
+func openBrowser(url string) error {
+	launchers, ok := browserLaunchers[runtime.GOOS]
+	if !ok {
+		launchers = browserLaunchers["default"]
+	}
 
-				return setupClientEnvironment(loadConfig(logger), instance)
-			},
-		},
-		{
-			Name:    "new",
-			Aliases: []string{},
-			Usage:   "create a new instance",
-			Action: func(c *cli.Context) error {
-				client := NewClient(c, logger)
+	var err error
+	for _, launcher := range launchers {
+		args := append(append([]string{}, launcher[1:]...), url)
+		if err = exec.Command(launcher[0], args...).Run(); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrapf(err, "failed to run %s", launchers[len(launchers)-1][0])
+}
 
-				image, err := client.GetLatestImage()
-				if err != nil {
-					logger.With("error", err).Fatal("Could not fetch image")
+// printJSON writes value to stdout as indented JSON
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// ImageGCReportToString renders an image gc report one subvolume or image per
+// line, followed by the space that can be, or was, reclaimed
+func ImageGCReportToString(report routes.ImageGCReport) string {
+	var b strings.Builder
+
+	for _, volume := range report.OrphanedVolumes {
+		fmt.Fprintf(&b, "orphaned subvolume: image %d on %s (%s)", volume.ImageID, volume.DataPath, formatBytes(volume.SizeBytes))
+		if volume.Error != "" {
+			fmt.Fprintf(&b, " - could not destroy: %s", volume.Error)
+		}
+		b.WriteString("\n")
+	}
+	for _, missing := range report.MissingVolumes {
+		fmt.Fprintf(&b, "missing subvolume: image %d", missing.ImageID)
+		if missing.Error != "" {
+			fmt.Fprintf(&b, " - could not destroy: %s", missing.Error)
+		}
+		b.WriteString("\n")
+	}
+
+	if report.DryRun {
+		fmt.Fprintf(&b, "%s reclaimable, run with --dry-run=false to clean up\n", formatBytes(report.ReclaimableBytes))
+	} else {
+		fmt.Fprintf(&b, "%s reclaimed\n", formatBytes(report.ReclaimableBytes))
+	}
+	return b.String()
+}
+
+// ImageDiffToString renders a schema diff one table or column per line
+func ImageDiffToString(diff routes.ImageDiff) string {
+	var b strings.Builder
+
+	for _, table := range diff.AddedTables {
+		fmt.Fprintf(&b, "+ %s\n", table)
+	}
+	for _, table := range diff.RemovedTables {
+		fmt.Fprintf(&b, "- %s\n", table)
+	}
+	for _, table := range diff.ChangedTables {
+		fmt.Fprintf(&b, "~ %s (rows: %d -> %d)\n", table.Name, table.EstimatedRowsFrom, table.EstimatedRowsTo)
+		for _, column := range table.AddedColumns {
+			fmt.Fprintf(&b, "    + %s\n", column)
+		}
+		for _, column := range table.RemovedColumns {
+			fmt.Fprintf(&b, "    - %s\n", column)
+		}
+		for _, column := range table.ChangedColumns {
+			fmt.Fprintf(&b, "    ~ %s: %s -> %s\n", column.Name, column.From, column.To)
+		}
+	}
+
+	if b.Len() == 0 {
+		return fmt.Sprintf("Images %d and %d have identical schemas\n", diff.From, diff.To)
+	}
+	return b.String()
+}
+
+// timestampFormats are the layouts accepted by parseTimestamp, in addition to
+// Unix epoch seconds. Layouts without a timezone are interpreted as UTC.
+var timestampFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// parseTimestamp parses a timestamp in any of the formats emitted by common
+// backup tools, normalising it to UTC
+func parseTimestamp(value string) (time.Time, error) {
+	for _, format := range timestampFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf(
+		"could not parse timestamp %q, accepted formats are: %s, Unix epoch seconds",
+		value, strings.Join(timestampFormats, ", "),
+	)
+}
+
+// operationPollInterval is how often we check on an instance that is still
+// being created
+const operationPollInterval = 2 * time.Second
+
+// envFileFlag names a .env-style file to load before the server reads its
+// config
+var envFileFlag = cli.StringFlag{
+	Name:   "env-file",
+	Usage:  "load environment variables from this file before reading the config",
+	EnvVar: "DRAUPNIR_ENV_FILE",
+}
+
+// ignoreMissingFlag makes commands that destroy resources treat resources that
+// no longer exist as destroyed
+var ignoreMissingFlag = cli.BoolFlag{
+	Name:  "ignore-missing",
+	Usage: "succeed if the resource has already been destroyed",
+}
+
+// yesFlag skips the confirmation asked for before destroying resources, and
+// is required when stdin isn't a terminal
+var yesFlag = cli.BoolFlag{
+	Name:  "yes, y",
+	Usage: "do not ask for confirmation before destroying",
+}
+
+// timeoutFlag limits how long commands that wait on the server will wait for
+var timeoutFlag = cli.DurationFlag{
+	Name:  "timeout",
+	Usage: "give up waiting after this long, e.g. 5m (default: wait indefinitely)",
+}
+
+// waitConnectFlag makes commands that create instances wait until postgres is
+// accepting connections
+var waitConnectFlag = cli.BoolFlag{
+	Name:  "wait-connect",
+	Usage: "wait until the instance accepts connections",
+}
+
+// maxAgeFlag and allowStaleFlag guard commands that create instances against
+// cloning old backups by accident
+var maxAgeFlag = cli.DurationFlag{
+	Name:  "max-age",
+	Usage: "refuse images backed up longer ago than this, e.g. 168h (default: the server's max_image_age)",
+}
+
+var allowStaleFlag = cli.BoolFlag{
+	Name:  "allow-stale",
+	Usage: "create the instance even if the image is older than the maximum age",
+}
+
+// createInstanceOptions reads the options shared by commands that create
+// instances from their flags. Flags that a command doesn't have are unset.
+func createInstanceOptions(c *cli.Context) clientPkg.CreateInstanceOptions {
+	return clientPkg.CreateInstanceOptions{
+		Name:       c.String("name"),
+		SchemaOnly: c.Bool("schema-only"),
+		MaxAge:     c.Duration("max-age"),
+		AllowStale: c.Bool("allow-stale"),
+	}
+}
+
+// connectPollInterval is how often we try to connect to an instance that isn't
+// yet accepting connections
+const connectPollInterval = 500 * time.Millisecond
+
+// waitContext returns a context for waiting on the server, which is cancelled
+// when the command's --timeout elapses or the user hits Ctrl-C
+func waitContext(c *cli.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+
+	timeout := c.Duration("timeout")
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// waitError describes why we stopped waiting, given a context that has been
+// cancelled
+func waitError(ctx context.Context, elapsed time.Duration) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("timed out after %s", elapsed.Round(time.Second))
+	}
+	return errors.Errorf("interrupted after %s", elapsed.Round(time.Second))
+}
+
+// imageFromArg returns the image given on the command line, either by ID or
+// by an alias that it was promoted to. Without an argument, it is the image
+// promoted to defaultAlias if set, otherwise the latest ready image.
+func imageFromArg(client clientPkg.Client, arg string, defaultAlias string) (models.Image, error) {
+	switch {
+	case arg == "" && defaultAlias != "":
+		return client.GetImageByAlias(defaultAlias)
+	case arg == "":
+		return client.GetLatestImage()
+	case models.ValidImageAlias(arg):
+		// Aliases start with a letter, so can't be mistaken for IDs
+		return client.GetImageByAlias(arg)
+	default:
+		return client.GetImage(arg)
+	}
+}
+
+// createInstance starts creating an instance of the image, and waits for it to
+// be ready. The operation ID is logged so that waiting can be resumed with
+// `draupnir operations wait` if we're interrupted.
+func createInstance(ctx context.Context, client clientPkg.Client, image models.Image, options clientPkg.CreateInstanceOptions, logger log.Logger) (models.Instance, error) {
+	operation, err := client.CreateInstanceAsync(image, options)
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	logger.With("operation", operation.ID).Infof(
+		"Creating instance, resume with: draupnir operations wait %d", operation.ID,
+	)
+	return waitForOperation(ctx, client, operation, logger)
+}
+
+// followOptions configures followImages
+type followOptions struct {
+	Tag        string
+	Interval   time.Duration
+	DestroyOld bool
+	AppName    string
+}
+
+// followImages checks for a newer ready image every interval, replacing the
+// instance with an instance of it whenever there is one and printing the
+// replacement's environment. Errors are logged and retried at the next check,
+// so that following survives the server restarting. It returns once ctx is
+// done.
+func followImages(ctx context.Context, client clientPkg.Client, instance models.Instance, options followOptions, cfg config.Config, logger log.Logger) error {
+	logger.With("instance", instance.ID).With("image", instance.ImageID).Info("Following images")
+
+	for {
+		image, err := client.GetLatestImageWithTag(options.Tag)
+		if err != nil {
+			logger.With("error", err).Error("Could not fetch the latest image, retrying")
+		} else if image.ID != instance.ImageID && image.BackedUpAt.After(instance.ImageBackedUpAt) {
+			logger.With("instance", instance.ID).With("image", image.ID).Info("Found a newer image, replacing instance")
+
+			replacement, err := createInstance(ctx, client, image, clientPkg.CreateInstanceOptions{SchemaOnly: instance.SchemaOnly}, logger)
+			if err != nil {
+				logger.With("error", err).Error("Could not create instance, retrying")
+			} else {
+				if err := setupClientEnvironment(cfg, replacement, options.AppName, ""); err != nil {
+					logger.With("error", err).Error("Could not set up the environment of the new instance")
 				}
 
-				instance, err := client.CreateInstance(image)
-				if err != nil {
-					logger.With("error", err).Fatal("Could not create instance")
+				if options.DestroyOld {
+					if err := client.DestroyInstance(instance); err != nil {
+						logger.With("instance", instance.ID).With("error", err).Error("Could not destroy old instance")
+					} else {
+						logger.With("instance", instance.ID).Info("Destroyed old instance")
+					}
 				}
 
-				return setupClientEnvironment(loadConfig(logger), instance)
-			},
-		},
+				instance = replacement
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.With("instance", instance.ID).Info("Stopped following images")
+			return nil
+		case <-time.After(options.Interval):
+		}
 	}
+}
 
-	app.Run(os.Args)
+// waitForOperation polls an operation until it has completed, returning the
+// instance it created. It gives up, leaving the operation running on the
+// server, when ctx is done.
+func waitForOperation(ctx context.Context, client clientPkg.Client, operation models.Operation, logger log.Logger) (models.Instance, error) {
+	start := time.Now()
+	operation, err := pollOperation(ctx, client, operation, logger)
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	elapsed := time.Since(start).Round(time.Second)
+	logger.With("operation", operation.ID).With("elapsed", elapsed).Info("Instance is ready")
+	return client.GetInstance(strconv.Itoa(operation.InstanceID))
 }
 
-func setupClientEnvironment(config config.Config, instance models.Instance) error {
-	if instance.Credentials == nil {
-		return errors.New("database credentials are not available")
+// waitForImageOperation waits for a queued finalisation to complete, and
+// returns the finalised image
+func waitForImageOperation(ctx context.Context, client clientPkg.Client, operation models.Operation, logger log.Logger) (models.Image, error) {
+	start := time.Now()
+	operation, err := pollOperation(ctx, client, operation, logger)
+	if err != nil {
+		return models.Image{}, err
 	}
 
-	// We use an OS-defined private temporary directory for storing the
-	// certficates and keys, rather than creating a directory such as:
-	// `~/.draupnir.d/$INSTANCE_ID/`.
-	// The advantage of this is that we do not have to write custom logic to
-	// clean-up old key data, instead we can rely on the OS to do this for us.
-	// On MacOS, where this client will be primarily run, the temp files are
-	// cleaned up if they have not been accessed in 3 days, which is perfect for
-	// this use case: https://superuser.com/a/187105
-	dir, err := ioutil.TempDir("", fmt.Sprintf("draupnir-%d-", instance.ID))
+	image, err := client.GetImage(strconv.Itoa(operation.ImageID))
 	if err != nil {
-		return errors.Wrap(err, "failed to create temporary directory")
+		return image, err
 	}
 
-	caCertPath := filepath.Join(dir, "ca.crt")
-	clientCertPath := filepath.Join(dir, "client.crt")
-	clientKeyPath := filepath.Join(dir, "client.key")
+	elapsed := time.Since(start).Round(time.Second)
+	if image.Ready {
+		logger.With("operation", operation.ID).With("elapsed", elapsed).Info("Image is ready")
+	} else {
+		logger.With("operation", operation.ID).With("elapsed", elapsed).Info("Backup fetched, the image can now be finalised")
+	}
+	return image, nil
+}
 
-	if err := ioutil.WriteFile(caCertPath, []byte(instance.Credentials.CACertificate), 0644); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", caCertPath)
+// pollOperation polls the operation until it is no longer pending, or ctx is
+// done. It fails if the operation did. Progress reported by the operation, such
+// as the bytes fetched so far, is logged as it changes.
+func pollOperation(ctx context.Context, client clientPkg.Client, operation models.Operation, logger log.Logger) (models.Operation, error) {
+	var err error
+	start := time.Now()
+	transferred := operation.BytesTransferred
+
+	for operation.Status == models.OperationPending {
+		select {
+		case <-ctx.Done():
+			return operation, errors.Wrapf(
+				waitError(ctx, time.Since(start)),
+				"operation %d is still %s, resume with: draupnir operations wait %d",
+				operation.ID, operation.Status, operation.ID,
+			)
+		case <-time.After(operationPollInterval):
+		}
+
+		operation, err = client.GetOperation(strconv.Itoa(operation.ID))
+		if err != nil {
+			return operation, errors.Wrap(err, "failed to check on operation")
+		}
+
+		if operation.BytesTransferred > transferred {
+			transferred = operation.BytesTransferred
+			logger.With("operation", operation.ID).With("fetched", formatBytes(uint64(transferred))).Info("Fetching backup")
+		}
 	}
-	if err := ioutil.WriteFile(clientCertPath, []byte(instance.Credentials.ClientCertificate), 0644); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", clientCertPath)
+
+	if operation.Status == models.OperationFailed {
+		elapsed := time.Since(start).Round(time.Second)
+		return operation, errors.Errorf("operation %d failed after %s: %s", operation.ID, elapsed, operation.Error)
 	}
-	if err := ioutil.WriteFile(clientKeyPath, []byte(instance.Credentials.ClientKey), 0600); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", clientKeyPath)
+
+	return operation, nil
+}
+
+// finaliseImage finalises the image, waiting for it if the server queues the
+// finalisation because it is busy with others
+func finaliseImage(ctx context.Context, client clientPkg.Client, imageID int, logger log.Logger) (models.Image, error) {
+	image, operation, err := client.FinaliseImage(imageID)
+	if err != nil {
+		return image, err
 	}
 
-	// The database precedence is config -> environment variable -> 'postgres'
-	database := config.Database
-	if database == "" {
-		database = os.Getenv("PGDATABASE")
+	if operation.ID == 0 {
+		return image, nil
 	}
-	if database == "" {
-		database = "postgres"
+
+	logger.With("operation", operation.ID).Info("Server is busy, finalisation has been queued")
+	return waitForImageOperation(ctx, client, operation, logger)
+}
+
+// waitForConnection polls the instance's port until postgres is accepting
+// connections, or ctx is done. The instance is dialled on the same host that
+// clients are told to connect to.
+func waitForConnection(ctx context.Context, cfg config.Config, instance models.Instance, logger log.Logger) error {
+	address := net.JoinHostPort(instanceHost(cfg, instance), strconv.Itoa(int(instance.Port)))
+	start := time.Now()
+
+	for {
+		err := pingPostgres(ctx, address)
+		if err == nil {
+			logger.With("address", address).With("elapsed", time.Since(start).Round(time.Millisecond)).Info("Instance is accepting connections")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(waitError(ctx, time.Since(start)), "last attempt to connect to %s failed: %s", address, err)
+		case <-time.After(connectPollInterval):
+		}
+	}
+}
+
+// sslRequest is the message a postgres client sends to ask to use SSL: its
+// length followed by the SSLRequest code
+var sslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// pingPostgres checks that postgres is accepting connections at address, by
+// sending an SSLRequest, which it answers with S or N before authentication.
+// This catches a port that accepts TCP connections before postgres is ready.
+func pingPostgres(ctx context.Context, address string) error {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	// Output enviroment variables that can be read by libpq:
-	// https://www.postgresql.org/docs/current/libpq-envars.html
-	fmt.Printf(
-		"export PGHOST=%s PGPORT=%d PGUSER=draupnir PGPASSWORD='' PGDATABASE=%s PGSSLMODE=verify-ca PGSSLROOTCERT='%s' PGSSLCERT='%s' PGSSLKEY='%s'\n",
-		instance.Hostname,
-		instance.Port,
-		database,
-		caCertPath,
-		clientCertPath,
-		clientKeyPath,
-	)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(sslRequest); err != nil {
+		return err
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[0] != 'S' && response[0] != 'N' {
+		return errors.Errorf("unexpected response to SSLRequest: %q", response[0])
+	}
+	return nil
+}
+
+// fetchImage has the server download the image's backup from sourceURL, and
+// waits for the download to complete
+func fetchImage(ctx context.Context, client clientPkg.Client, imageID int, sourceURL string, logger log.Logger) error {
+	operation, err := client.FetchImage(imageID, sourceURL)
+	if err != nil {
+		return errors.Wrap(err, "failed to start fetching the backup")
+	}
+
+	start := time.Now()
+	logger.With("operation", operation.ID).Info("Server is fetching the backup")
+	operation, err = pollOperation(ctx, client, operation, logger)
+	if err != nil {
+		return err
+	}
 
+	logger.
+		With("elapsed", time.Since(start).Round(time.Second)).
+		With("size", formatBytes(uint64(operation.BytesTransferred))).
+		Info("Fetch complete")
 	return nil
 }
 
-func ImageToString(i models.Image) string {
-	return fmt.Sprintf("%2d [ %s - READY: %5t ]", i.ID, i.BackedUpAt.Format(time.RFC3339), i.Ready)
+// uploadAndFinaliseImage populates a newly created image, either by having the
+// server fetch sourceURL or by running the upload command, if any, and then
+// finalises it. The upload command is killed if ctx is done before it finishes.
+func uploadAndFinaliseImage(ctx context.Context, client clientPkg.Client, image models.Image, sourceURL string, uploadCommand string, logger log.Logger) (models.Image, error) {
+	if sourceURL != "" {
+		if err := fetchImage(ctx, client, image.ID, sourceURL, logger); err != nil {
+			return image, err
+		}
+	} else if uploadCommand != "" {
+		if image.DataPath == "" {
+			return image, errors.New("server did not report where to upload the image")
+		}
+
+		start := time.Now()
+		cmd := exec.CommandContext(ctx, "sh", "-c", uploadCommand)
+		cmd.Env = append(
+			os.Environ(),
+			fmt.Sprintf("DRAUPNIR_IMAGE_ID=%d", image.ID),
+			fmt.Sprintf("DRAUPNIR_UPLOAD_PATH=%s", filepath.Join(image.DataPath, "image_uploads", strconv.Itoa(image.ID))),
+		)
+		// Keep stdout for the image, so that it can be parsed by scripts
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return image, errors.Wrap(waitError(ctx, time.Since(start)), "upload command did not finish")
+			}
+			return image, errors.Wrap(err, "upload command failed")
+		}
+		logger.With("elapsed", time.Since(start).Round(time.Second)).Info("Upload complete")
+	}
+
+	finalised, err := finaliseImage(ctx, client, image.ID, logger)
+	if err != nil {
+		return image, err
+	}
+	return finalised, nil
 }
 
-func InstanceToString(i models.Instance) string {
-	return fmt.Sprintf("%2d [ PORT: %d - %s ]", i.ID, i.Port, i.CreatedAt.Format(time.RFC3339))
+// logPollInterval is how often instances logs --follow checks for new lines
+const logPollInterval = 2 * time.Second
+
+// newLogLines returns the lines of the current tail of a log that weren't in
+// the previous tail, by finding where the last line we saw appears
+func newLogLines(previous, current []string) []string {
+	if len(previous) == 0 {
+		return current
+	}
+
+	last := previous[len(previous)-1]
+	for i := len(current) - 1; i >= 0; i-- {
+		if current[i] == last {
+			return current[i+1:]
+		}
+	}
+
+	// We've fallen too far behind to find our place, so show everything
+	return current
+}
+
+// latestInstanceWithTag returns the user's most recently created instance of
+// the latest image with the given tag
+func latestInstanceWithTag(client clientPkg.Client, tag string) (models.Instance, error) {
+	image, err := client.GetLatestImageWithTag(tag)
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	instances, err := client.ListInstances()
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	instances = filterInstances(instances, 0, image.ID)
+	if len(instances) == 0 {
+		return models.Instance{}, errors.Errorf("no instances of image %d, create one with draupnir new --tag %s", image.ID, tag)
+	}
+
+	latest := instances[0]
+	for _, instance := range instances[1:] {
+		if instance.CreatedAt.After(latest.CreatedAt) {
+			latest = instance
+		}
+	}
+
+	// The instance list doesn't include credentials, so fetch it individually
+	return client.GetInstance(strconv.Itoa(latest.ID))
+}
+
+// filterInstances returns the instances that were created longer ago than
+// olderThan, and that belong to the image with ID imageID. A zero value for
+// either filter matches all instances.
+func filterInstances(instances []models.Instance, olderThan time.Duration, imageID int) []models.Instance {
+	filtered := make([]models.Instance, 0)
+	for _, instance := range instances {
+		if olderThan != 0 && time.Since(instance.CreatedAt) < olderThan {
+			continue
+		}
+		if imageID != 0 && instance.ImageID != imageID {
+			continue
+		}
+		filtered = append(filtered, instance)
+	}
+	return filtered
+}
+
+// batchSummary counts the outcomes of an operation on several resources, so
+// that scripts can tell whether it partially failed
+type batchSummary struct {
+	// Action is what happened to the resources that succeeded, e.g. destroyed
+	Action    string `json:"action"`
+	Succeeded int    `json:"succeeded"`
+	// Missing counts resources that had already gone, and were skipped
+	Missing int `json:"missing"`
+	Failed  int `json:"failed"`
+}
+
+func (s batchSummary) String() string {
+	return fmt.Sprintf("%s: %d, missing: %d, failed: %d", s.Action, s.Succeeded, s.Missing, s.Failed)
+}
+
+// printBatchSummary prints the summary as a line on stderr, or with --output
+// json, as an object on stdout
+func printBatchSummary(summary batchSummary, output string) error {
+	if output == "json" {
+		return printJSON(summary)
+	}
+
+	_, err := fmt.Fprintln(os.Stderr, summary)
+	return err
+}
+
+// confirm asks the user a yes/no question on stdin, returning true only if
+// they answer yes
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	var answer string
+	fmt.Scanln(&answer)
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// confirmDestroy asks the user to confirm destroying something, exiting
+// unless they do. It doesn't ask if --yes is set, and exits if stdin isn't a
+// terminal, as nobody could answer.
+func confirmDestroy(c *cli.Context, logger log.Logger, question string) {
+	if c.Bool("yes") {
+		return
+	}
+	if !isTerminal(os.Stdin) {
+		logger.Fatal("Refusing to destroy without confirmation, as stdin is not a terminal: pass --yes")
+	}
+	if !confirm(question) {
+		logger.Fatal("Aborted")
+	}
+}
+
+// pgOptionsFlag returns the --pg-options flag, exiting if it was given but is
+// invalid
+func pgOptionsFlag(c *cli.Context, logger log.Logger) string {
+	if !c.IsSet("pg-options") {
+		return ""
+	}
+
+	pgOptions := c.String("pg-options")
+	if err := models.ValidatePGOptions(pgOptions); err != nil {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		logger.With("error", err).Fatal("Invalid --pg-options")
+	}
+	return pgOptions
+}
+
+// isTerminal returns true if f is a terminal, rather than e.g. a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// printUploadProgress renders the progress of an upload to stderr, redrawing
+// the same line until the upload completes
+func printUploadProgress(sent int64, total int64) {
+	fmt.Fprintf(os.Stderr, "\rUploading: %s / %s", formatBytes(uint64(sent)), formatBytes(uint64(total)))
+	if sent >= total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// formatBytes renders a number of bytes in a human readable form, e.g. "1.5GiB"
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// tokenFromArgs builds a token from the arguments to `config set token`: an
+// access and refresh token, or "-" to read a JSON token from stdin
+func tokenFromArgs(args []string) (oauth2.Token, error) {
+	switch {
+	case len(args) == 1 && args[0] == "-":
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return oauth2.Token{}, errors.Wrap(err, "failed to read token from stdin")
+		}
+		return config.ParseToken(data)
+	case len(args) == 2:
+		token := oauth2.Token{AccessToken: args[0], RefreshToken: args[1], TokenType: "Bearer"}
+		return token, config.ValidateToken(token)
+	case len(args) == 1:
+		return oauth2.Token{}, errors.New("a refresh token is required, as draupnir authenticates with it")
+	default:
+		return oauth2.Token{}, errors.New("expected an access and refresh token, or - to read JSON from stdin")
+	}
 }
 
 func loadConfig(logger log.Logger) config.Config {
@@ -475,19 +3586,82 @@ func storeConfig(cfg config.Config, logger log.Logger) {
 	}
 }
 
+// maxBootstrapSize is the largest bootstrap document that will be read
+const maxBootstrapSize = 64 * 1024
+
+// fetchBootstrap fetches and parses the bootstrap document at url, which must
+// be served over HTTPS so that it can't be tampered with
+func fetchBootstrap(url string) (config.Bootstrap, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return config.Bootstrap{}, errors.New("the bootstrap URL must start with https://")
+	}
+
+	httpClient := http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return config.Bootstrap{}, errors.Wrap(err, "failed to fetch bootstrap document")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return config.Bootstrap{}, errors.Errorf("failed to fetch bootstrap document: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBootstrapSize))
+	if err != nil {
+		return config.Bootstrap{}, errors.Wrap(err, "failed to read bootstrap document")
+	}
+
+	return config.ParseBootstrap(data)
+}
+
 func NewClient(c *cli.Context, logger log.Logger) clientPkg.Client {
 	cfg := loadConfig(logger)
-	return clientPkg.NewClient(
+	client := clientPkg.NewClient(
 		getServerURL(c, cfg),
 		cfg.Token,
 		c.GlobalBool("skip-verify"),
+		cfg.UserAgentSuffix,
 	)
+
+	if c.GlobalBool("verbose") {
+		client = client.WithRedirectReporter(func(from *url.URL, to *url.URL) {
+			logger.With("from", from.String()).With("to", to.String()).Info("Following redirect")
+		})
+	}
+	return client
+}
+
+// instanceHost returns the host to connect to the instance on. Instances are
+// advertised with the server's public_hostname, which may differ from the
+// API's domain, e.g. when the API is behind a proxy. Servers that don't
+// advertise one are assumed to serve both.
+func instanceHost(cfg config.Config, instance models.Instance) string {
+	if instance.Hostname != "" {
+		return instance.Hostname
+	}
+	return domainHost(cfg.Domain)
+}
+
+// domainHost returns the host of the server's domain, without the port or
+// path that it may include, e.g. example.com for example.com:8443/draupnir
+func domainHost(domain string) string {
+	if i := strings.Index(domain, "/"); i >= 0 {
+		domain = domain[:i]
+	}
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		return host
+	}
+	return domain
 }
 
+// getServerURL returns the URL of the server. The domain may include the path
+// that the server is mounted under, e.g. example.com/draupnir.
 func getServerURL(c *cli.Context, cfg config.Config) string {
-	if c.GlobalBool("insecure") {
-		return fmt.Sprintf("http://%s", cfg.Domain)
+	domain := strings.TrimSuffix(cfg.Domain, "/")
+	if c.GlobalBool("insecure") || cfg.Insecure {
+		return fmt.Sprintf("http://%s", domain)
 	}
 
-	return fmt.Sprintf("https://%s", cfg.Domain)
+	return fmt.Sprintf("https://%s", domain)
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestFormatExpiresIn(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		left     time.Duration
+		expected string
+	}{
+		{-time.Second, "expired"},
+		{0, "expired"},
+		{30 * time.Second, "in <1m"},
+		{45*time.Minute + 30*time.Second, "in 45m"},
+		{time.Hour, "in 1h"},
+		{2*time.Hour + 30*time.Minute, "in 2h30m"},
+		{26*time.Hour + 5*time.Minute, "in 26h5m"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, formatExpiresIn(now.Add(tc.left), now), tc.left.String())
+	}
+}
+
+func TestExpiresBefore(t *testing.T) {
+	now := time.Now()
+	soon := now.Add(time.Hour)
+	later := now.Add(2 * time.Hour)
+	never := time.Time{}
+
+	assert.True(t, expiresBefore(&soon, &later))
+	assert.False(t, expiresBefore(&later, &soon))
+	assert.True(t, expiresBefore(&later, &never))
+	assert.True(t, expiresBefore(&later, nil))
+	assert.False(t, expiresBefore(&never, &later))
+	assert.False(t, expiresBefore(nil, &later))
+	assert.False(t, expiresBefore(nil, nil))
+}
+
+func TestExpiryHighlighter(t *testing.T) {
+	now := time.Now()
+	highlight := expiryHighlighter{now: now, window: time.Hour}
+
+	assert.Equal(t, "\033[31mexpired\033[0m", highlight.apply(now.Add(-time.Minute), "expired"))
+	assert.Equal(t, "\033[31msoon\033[0m", highlight.apply(now.Add(10*time.Minute), "soon"))
+	assert.Equal(t, "\033[33mlater\033[0m", highlight.apply(now.Add(40*time.Minute), "later"))
+	assert.Equal(t, "fine", highlight.apply(now.Add(2*time.Hour), "fine"))
+	assert.Equal(t, "never", highlight.apply(time.Time{}, "never"))
+
+	// Off a terminal nothing is highlighted
+	assert.Equal(t, "soon", expiryHighlighter{}.apply(now.Add(10*time.Minute), "soon"))
+}
+
+func TestPrintInstanceTableHighlightsExpiresIn(t *testing.T) {
+	now := time.Now()
+	highlight := expiryHighlighter{now: now, window: 24 * time.Hour}
+	rows := []InstanceRow{
+		{ID: 1, Port: 5432, CreatedAt: now},
+		{ID: 2, Port: 5433, CreatedAt: now, ExpiresAt: now.Add(2*time.Hour + 30*time.Minute + 30*time.Second)},
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, printInstanceTable(&out, rows, highlight))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasSuffix(lines[0], "EXPIRES IN"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "-"), lines[1])
+	assert.True(t, strings.HasSuffix(lines[2], "\033[31min 2h30m\033[0m"), lines[2])
+}
+
+func TestOutputFormat(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"draupnir", "list"}, "text"},
+		{[]string{"draupnir", "--output", "json", "list"}, "json"},
+		{[]string{"draupnir", "list", "--output", "json"}, "json"},
+		{[]string{"draupnir", "list", "-o", "wide"}, "wide"},
+		// The command's own flag, by any name, beats the global one
+		{[]string{"draupnir", "--output", "json", "list", "--format", "wide"}, "wide"},
+	}
+
+	for _, tc := range testCases {
+		var output string
+		app := cli.NewApp()
+		app.Flags = []cli.Flag{cli.StringFlag{Name: "output", Value: "text"}}
+		app.Commands = []cli.Command{
+			{
+				Name:  "list",
+				Flags: []cli.Flag{cli.StringFlag{Name: "output, format, o", Value: "text"}},
+				Action: func(c *cli.Context) error {
+					output = outputFormat(c, log.Base(), "text", "wide", "json")
+					return nil
+				},
+			},
+		}
+
+		assert.Nil(t, app.Run(tc.args))
+		assert.Equal(t, tc.expected, output, strings.Join(tc.args, " "))
+	}
+}
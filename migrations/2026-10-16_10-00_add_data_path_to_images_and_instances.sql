@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN data_path text;
+ALTER TABLE instances ADD COLUMN data_path text;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN data_path;
+ALTER TABLE instances DROP COLUMN data_path;
@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE operations (
+  id serial PRIMARY KEY,
+  status text NOT NULL,
+  instance_id integer,
+  error text,
+  user_email text NOT NULL,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE operations;
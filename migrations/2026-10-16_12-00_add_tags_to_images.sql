@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN tags text DEFAULT ''::text NOT NULL;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN tags;
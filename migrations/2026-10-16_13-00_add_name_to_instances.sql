@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN name text;
+ALTER TABLE instances ADD CONSTRAINT instances_name_key UNIQUE (name);
+
+-- +migrate Down
+ALTER TABLE instances DROP CONSTRAINT instances_name_key;
+ALTER TABLE instances DROP COLUMN name;
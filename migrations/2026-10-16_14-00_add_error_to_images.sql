@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN error text;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN error;
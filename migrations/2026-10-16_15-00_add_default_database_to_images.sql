@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN default_database text;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN default_database;
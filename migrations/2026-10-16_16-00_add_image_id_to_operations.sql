@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE operations ADD COLUMN image_id integer;
+
+-- +migrate Down
+ALTER TABLE operations DROP COLUMN image_id;
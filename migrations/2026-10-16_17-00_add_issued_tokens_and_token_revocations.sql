@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE issued_tokens (
+  token_hash text PRIMARY KEY,
+  issued_at timestamptz NOT NULL
+);
+
+CREATE TABLE token_revocations (
+  email text PRIMARY KEY,
+  revoked_at timestamptz NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE token_revocations;
+DROP TABLE issued_tokens;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN expires_at timestamp with time zone;
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN expires_at;
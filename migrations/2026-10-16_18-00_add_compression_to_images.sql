@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN compression text;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN compression;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN destroying boolean DEFAULT false NOT NULL;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN destroying;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE operations ADD COLUMN bytes_transferred bigint DEFAULT 0 NOT NULL;
+
+-- +migrate Down
+ALTER TABLE operations DROP COLUMN bytes_transferred;
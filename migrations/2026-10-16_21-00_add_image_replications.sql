@@ -0,0 +1,18 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN source_url text;
+
+CREATE TABLE image_replications (
+  id serial PRIMARY KEY,
+  image_id integer NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+  peer text NOT NULL,
+  status text NOT NULL,
+  peer_image_id integer,
+  error text,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+  UNIQUE (image_id, peer)
+);
+
+-- +migrate Down
+DROP TABLE image_replications;
+ALTER TABLE images DROP COLUMN source_url;
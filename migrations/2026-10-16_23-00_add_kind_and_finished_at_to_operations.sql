@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE operations ADD COLUMN kind text;
+ALTER TABLE operations ADD COLUMN finished_at timestamptz;
+
+UPDATE operations SET kind = 'create_instance' WHERE instance_id IS NOT NULL;
+UPDATE operations SET finished_at = updated_at WHERE status <> 'pending';
+
+CREATE INDEX operations_user_email_created_at_idx ON operations (user_email, created_at);
+
+-- +migrate Down
+DROP INDEX operations_user_email_created_at_idx;
+ALTER TABLE operations DROP COLUMN finished_at;
+ALTER TABLE operations DROP COLUMN kind;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN max_connections integer DEFAULT 0 NOT NULL;
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN max_connections;
@@ -0,0 +1,10 @@
+-- +migrate Up
+CREATE TABLE image_aliases (
+  name text PRIMARY KEY,
+  image_id integer NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+  promoted_by text NOT NULL,
+  promoted_at timestamptz NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE image_aliases;
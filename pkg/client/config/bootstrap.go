@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Bootstrap is a document, shared by an organisation, that describes how to
+// connect to its draupnir server, e.g.
+//
+//	{"domain": "draupnir.example.com", "base_path": "/draupnir", "database": "app"}
+type Bootstrap struct {
+	Domain string `json:"domain"`
+	// BasePath is the path that the server is mounted under, if any
+	BasePath string `json:"base_path,omitempty"`
+	// Insecure servers are connected to over plain HTTP, as with --insecure
+	Insecure bool `json:"insecure,omitempty"`
+	// Database is the default database to connect to, if any
+	Database string `json:"database,omitempty"`
+}
+
+// ParseBootstrap decodes a bootstrap document, and validates it. Unknown
+// fields are rejected, so that a mistyped document isn't half applied.
+func ParseBootstrap(data []byte) (Bootstrap, error) {
+	var bootstrap Bootstrap
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&bootstrap); err != nil {
+		return bootstrap, errors.Wrap(err, "bootstrap document is not valid JSON")
+	}
+
+	return bootstrap, bootstrap.Validate()
+}
+
+// Validate checks that the bootstrap document describes a usable server
+func (b Bootstrap) Validate() error {
+	if b.Domain == "" {
+		return errors.New("domain is required")
+	}
+	if strings.Contains(b.Domain, "/") {
+		return errors.New("domain must not include a path, set base_path instead")
+	}
+
+	if b.BasePath != "" && (!strings.HasPrefix(b.BasePath, "/") || strings.HasSuffix(b.BasePath, "/")) {
+		return errors.Errorf("base_path %q must start and not end with a /", b.BasePath)
+	}
+
+	if issue, ok := validateDomain(b.Domain + b.BasePath); !ok {
+		return errors.New(issue.Message)
+	}
+
+	return nil
+}
+
+// Apply returns the config with the server described by the bootstrap
+// document. The token is left untouched, as is the database if the document
+// doesn't set one.
+func (b Bootstrap) Apply(config Config) Config {
+	config.Domain = b.Domain + b.BasePath
+	config.Insecure = b.Insecure
+	if b.Database != "" {
+		config.Database = b.Database
+	}
+	return config
+}
@@ -8,16 +8,28 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// DefaultDomain is the placeholder domain written to a new config file
+const DefaultDomain = "set-me-to-a-real-domain"
+
 // Config describes the configuration for the draupnir client
 type Config struct {
-	Domain   string
-	Token    oauth2.Token
-	Database string
+	Domain          string
+	Token           oauth2.Token
+	Database        string
+	UserAgentSuffix string
+	// PGOptions are session options for every connection to an instance,
+	// e.g. "-c statement_timeout=0"
+	PGOptions string
+	// Insecure connects to the server over plain HTTP, as with --insecure
+	Insecure bool
+	// ImageAlias is the alias whose image new instances are created from when
+	// no image is given, e.g. latest-stable, rather than the latest image
+	ImageAlias string
 }
 
 // Load parses the client config file
 func Load() (Config, error) {
-	config := Config{Domain: "set-me-to-a-real-domain"}
+	config := Config{Domain: DefaultDomain}
 	file, err := os.Open(configFilePath())
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// ParseToken decodes a token in the JSON format printed by
+// `draupnir authenticate --print-token`, and validates it
+func ParseToken(data []byte) (oauth2.Token, error) {
+	var token oauth2.Token
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&token); err != nil {
+		return token, errors.Wrap(err, "token is not valid JSON")
+	}
+
+	return token, ValidateToken(token)
+}
+
+// ValidateToken checks that a token can be used to authenticate with the
+// server. The client authenticates with the refresh token, so one is required.
+func ValidateToken(token oauth2.Token) error {
+	if token.RefreshToken == "" {
+		return errors.New("token has no refresh token")
+	}
+
+	for name, value := range map[string]string{
+		"access token":  token.AccessToken,
+		"refresh token": token.RefreshToken,
+	} {
+		if strings.ContainsAny(value, " \t\r\n") {
+			return errors.Errorf("%s contains whitespace", name)
+		}
+	}
+
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return errors.Errorf("token type %q is not supported, expected Bearer", token.TokenType)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Issue is a problem found when validating a config. Fatal issues mean that
+// the client cannot be used, the others are merely worth knowing about.
+type Issue struct {
+	Fatal   bool
+	Message string
+}
+
+// hostnamePattern matches a DNS name made of labels of letters, digits and
+// hyphens, that don't start or end with a hyphen
+var hostnamePattern = regexp.MustCompile(
+	`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`,
+)
+
+// Validate checks that the config is usable, returning any issues found
+func (c Config) Validate() []Issue {
+	issues := make([]Issue, 0)
+
+	if issue, ok := validateDomain(c.Domain); !ok {
+		issues = append(issues, issue)
+	}
+
+	if c.Token.RefreshToken == "" {
+		issues = append(issues, Issue{
+			Fatal:   true,
+			Message: "no refresh token is stored: run `draupnir authenticate`",
+		})
+	} else if !c.Token.Expiry.IsZero() && c.Token.Expiry.Before(time.Now()) {
+		issues = append(issues, Issue{
+			Fatal:   false,
+			Message: fmt.Sprintf("the access token expired at %s, and will be refreshed on next use", c.Token.Expiry.Format(time.RFC3339)),
+		})
+	}
+
+	if c.Database == "" {
+		issues = append(issues, Issue{
+			Fatal:   false,
+			Message: "no database is set, so PGDATABASE or 'postgres' will be used: run `draupnir config set database <name>`",
+		})
+	}
+
+	return issues
+}
+
+// validateDomain checks the domain of the server, which may be followed by the
+// path that the server is mounted under, e.g. example.com/draupnir
+func validateDomain(domain string) (Issue, bool) {
+	if domain == "" || domain == DefaultDomain {
+		return Issue{
+			Fatal:   true,
+			Message: "no domain is set: run `draupnir config set domain <domain>`",
+		}, false
+	}
+
+	host := domain
+	if i := strings.Index(domain, "/"); i >= 0 {
+		host = domain[:i]
+		if strings.ContainsAny(domain[i:], "?#") {
+			return Issue{
+				Fatal:   true,
+				Message: fmt.Sprintf("the domain %q has a path with a query or fragment", domain),
+			}, false
+		}
+	}
+
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return Issue{
+				Fatal:   true,
+				Message: fmt.Sprintf("the domain %q has an invalid port", domain),
+			}, false
+		}
+		host = h
+	}
+
+	if net.ParseIP(host) == nil && !hostnamePattern.MatchString(host) {
+		return Issue{
+			Fatal:   true,
+			Message: fmt.Sprintf("the domain %q is not a valid hostname, and should not include a scheme", domain),
+		}, false
+	}
+
+	return Issue{}, true
+}
@@ -1,13 +1,20 @@
 package exec
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
@@ -16,16 +23,99 @@ import (
 )
 
 type Executor interface {
-	CreateBtrfsSubvolume(ctx context.Context, id int) error
+	SelectDataPath(ctx context.Context) (string, error)
+	CreateBtrfsSubvolume(ctx context.Context, image models.Image) error
+	FetchImage(ctx context.Context, image models.Image, source *url.URL, progress func(int64)) error
 	FinaliseImage(ctx context.Context, image models.Image) error
-	CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error
-	RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error)
-	DestroyImage(ctx context.Context, id int) error
-	DestroyInstance(ctx context.Context, id int) error
+	CreateInstance(ctx context.Context, instance models.Instance) error
+	AdoptInstance(ctx context.Context, instance models.Instance, path string) error
+	RetrieveInstanceCredentials(ctx context.Context, instance models.Instance) (map[string][]byte, error)
+	DestroyImage(ctx context.Context, image models.Image) error
+	DestroyInstance(ctx context.Context, instance models.Instance) error
+	DiskUsage(ctx context.Context) ([]DiskUsage, error)
+	DescribeImage(ctx context.Context, image models.Image) (ImageSchema, error)
+	CheckSubvolumes(ctx context.Context) error
+	InstanceLogs(ctx context.Context, instance models.Instance, lines int) (string, error)
+	RestartInstance(ctx context.Context, instance models.Instance) error
+	InstanceConnections(ctx context.Context, instance models.Instance) (int, error)
+	SnapshotInstanceToImage(ctx context.Context, instance models.Instance, image models.Image) error
+	ListImageVolumes(ctx context.Context) ([]ImageVolume, error)
+	ImageSize(ctx context.Context, image models.Image) (uint64, error)
 }
 
-type OSExecutor struct {
+// DiskUsage describes the size of the filesystem holding a data path, and how
+// much of it is available
+type DiskUsage struct {
+	Path       string
+	TotalBytes uint64
+	FreeBytes  uint64
+	ReadOnly   bool
+}
+
+// ImageVolume describes the subvolumes found on disk for an image, whether or
+// not the image exists
+type ImageVolume struct {
+	// DataPath is the root of the volume that the subvolumes reside on
 	DataPath string
+	ImageID  int
+	// Uploaded and Snapshotted are true if the image_uploads and
+	// image_snapshots subvolumes exist respectively
+	Uploaded    bool
+	Snapshotted bool
+	// SizeBytes is the combined size of the subvolumes. This overestimates the
+	// space they occupy, as extents shared between them are counted twice.
+	SizeBytes uint64
+	// DiskBytes is the combined space the subvolumes occupy after
+	// compression, or SizeBytes if that can't be measured
+	DiskBytes uint64
+}
+
+// stRdOnly is the ST_RDONLY flag of statfs(2), set when the filesystem is
+// mounted read-only, e.g. after btrfs encounters an error
+const stRdOnly = 0x1
+
+// ImageSchema maps the fully qualified name of each table in an image, in the
+// form database.schema.table, to a description of that table
+type ImageSchema map[string]TableSchema
+
+// TableSchema describes the columns of a table, mapping column name to type,
+// along with the row count estimated by postgres
+type TableSchema struct {
+	Columns       map[string]string
+	EstimatedRows int64
+}
+
+// OSExecutor stores images and instances on one or more BTRFS volumes. New
+// images are placed on the volume with the most free space, and instances live
+// alongside the image they were created from, as snapshots cannot cross
+// volumes.
+type OSExecutor struct {
+	// DataPaths are the roots of each volume. The first is the default, for
+	// images and instances that don't record a data path.
+	DataPaths []string
+	// AnonTimeout limits how long an image's anonymisation script may run for
+	// when it is finalised. Zero means no limit.
+	AnonTimeout time.Duration
+	// FetchEnv is added to the environment of draupnir-fetch-image, as
+	// NAME=VALUE pairs, e.g. to give it credentials for object storage
+	FetchEnv []string
+}
+
+// ErrAnonTimeout is returned by FinaliseImage when the anonymisation script
+// runs for longer than the AnonTimeout
+var ErrAnonTimeout = errors.New("anon timed out")
+
+// anonTimeoutExitCode is the status draupnir-finalise-image exits with when
+// the anonymisation script times out, as returned by timeout(1)
+const anonTimeoutExitCode = 124
+
+// dataPath returns the root that a resource recorded as residing at path lives
+// on
+func (e OSExecutor) dataPath(path string) string {
+	if path == "" {
+		return e.DataPaths[0]
+	}
+	return path
 }
 
 func GetLogger(ctx context.Context) log.Logger {
@@ -60,12 +150,32 @@ func runCommandAndLog(logger log.Logger, message string, command *exec.Cmd) erro
 	return err
 }
 
+// SelectDataPath returns the data path with the most free space, on which a new
+// image should be placed
+func (e OSExecutor) SelectDataPath(ctx context.Context) (string, error) {
+	usages, err := e.DiskUsage(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	best := usages[0]
+	for _, usage := range usages[1:] {
+		if usage.FreeBytes > best.FreeBytes {
+			best = usage
+		}
+	}
+
+	return best.Path, nil
+}
+
 // CreateBtrfsSubvolume creates a BTRFS subvolume in $(DataPath)/image_uploads
 // and sets its permissions to 775 so that 'upload' can write to it.
-func (e OSExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
-	name := fmt.Sprintf("%d", id)
-	path := filepath.Join(e.DataPath, "image_uploads", name)
-	logger := GetLogger(ctx).With("imageID", id).With("path", path)
+// If the image has a compression algorithm, the subvolume is set to compress
+// everything written to it.
+func (e OSExecutor) CreateBtrfsSubvolume(ctx context.Context, image models.Image) error {
+	name := fmt.Sprintf("%d", image.ID)
+	path := filepath.Join(e.dataPath(image.DataPath), "image_uploads", name)
+	logger := GetLogger(ctx).With("imageID", image.ID).With("path", path)
 
 	cmd := exec.CommandContext(ctx, "btrfs", "subvolume", "create", path)
 	err := runCommandAndLog(logger, "Created btrfs subvolume", cmd)
@@ -73,6 +183,14 @@ func (e OSExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
 		return err
 	}
 
+	if image.Compression != "" {
+		cmd = exec.CommandContext(ctx, "btrfs", "property", "set", path, "compression", image.Compression)
+		err = runCommandAndLog(logger.With("compression", image.Compression), "Set subvolume compression", cmd)
+		if err != nil {
+			return err
+		}
+	}
+
 	perms := os.ModeDir | 0775
 	err = os.Chmod(path, perms)
 	if err != nil {
@@ -84,13 +202,62 @@ func (e OSExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
 	return nil
 }
 
+// FetchImage downloads a backup into the image's upload subvolume, where it is
+// extracted when the image is finalised, as an uploaded tarball would be. The
+// source may be an s3://, gs:// or https:// URL, which draupnir-fetch-image
+// streams to us. progress is called with the number of bytes written so far.
+func (e OSExecutor) FetchImage(ctx context.Context, image models.Image, source *url.URL, progress func(int64)) error {
+	dest := filepath.Join(e.dataPath(image.DataPath), "image_uploads", strconv.Itoa(image.ID), path.Base(source.Path))
+
+	// The query of a presigned URL is a credential, so leave it out of logs
+	redacted := *source
+	redacted.RawQuery = ""
+	logger := GetLogger(ctx).With("imageID", image.ID).With("url", redacted.String()).With("path", dest)
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return errors.Wrap(err, "failed to create backup file")
+	}
+	defer file.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "draupnir-fetch-image", source.String())
+	cmd.Env = append(os.Environ(), e.FetchEnv...)
+	cmd.Stdout = &progressWriter{w: file, progress: progress}
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		logger.With("error", err.Error()).With("stderr", stderr.String()).Info("Failed to fetch backup")
+		os.Remove(dest)
+		return errors.Wrapf(err, "failed to fetch backup: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	logger.With("elapsed", time.Since(start).Round(time.Second)).Info("Fetched backup")
+	return file.Close()
+}
+
+// progressWriter reports how many bytes have been written through it so far
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.progress(p.written)
+	return n, err
+}
+
 // FinaliseImage runs draupnir-finalise_image against the image
 // This does the following things:
 // - Gives ownership of the image directory to postgres
 // - Sets the permissions to 700 so postgres will start
 // - Removes postmaster.* files
 // - Starts postgres
-// - Runs anonymisation function
+// - Runs anonymisation function, for at most AnonTimeout
 // - Stops postgres
 // - Creates a snapshot of the image directory
 // This snapshot is the finalised image
@@ -118,13 +285,18 @@ func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error
 		ctx,
 		"sudo",
 		"draupnir-finalise-image",
-		e.DataPath,
+		e.dataPath(image.DataPath),
 		fmt.Sprintf("%d", image.ID),
 		fmt.Sprintf("%d", 5432+image.ID),
 		anonFile.Name(),
+		fmt.Sprintf("%d", int(e.AnonTimeout.Seconds())),
 	)
 
 	err = runCommandAndLog(logger, "Finalised image", cmd)
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == anonTimeoutExitCode {
+		os.Remove(anonFile.Name())
+		return ErrAnonTimeout
+	}
 	if err != nil {
 		return err
 	}
@@ -133,27 +305,62 @@ func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error
 	return os.Remove(anonFile.Name())
 }
 
-func (e OSExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error {
-	logger := GetLogger(ctx).With("imageID", imageID).With("instanceID", instanceID).With("port", port)
+func (e OSExecutor) CreateInstance(ctx context.Context, instance models.Instance) error {
+	logger := GetLogger(ctx).
+		With("imageID", instance.ImageID).
+		With("instanceID", instance.ID).
+		With("port", instance.Port)
 
-	cmd := exec.Command(
-		"sudo",
+	args := []string{
 		"draupnir-create-instance",
-		e.DataPath,
-		fmt.Sprintf("%d", imageID),
-		fmt.Sprintf("%d", instanceID),
-		fmt.Sprintf("%d", port),
-	)
+		e.dataPath(instance.DataPath),
+		fmt.Sprintf("%d", instance.ImageID),
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+	}
+	if instance.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	if instance.MaxConnections > 0 {
+		args = append(args, fmt.Sprintf("--max-connections=%d", instance.MaxConnections))
+	}
+
+	cmd := exec.CommandContext(ctx, "sudo", args...)
 
 	return runCommandAndLog(logger, "Creating instance", cmd)
 }
 
+// AdoptInstance takes over a clone that was started by hand, e.g. during
+// recovery, from the subvolume at path. draupnir-adopt-instance checks that the
+// clone's postgres is up on the instance's port and has the certificates that
+// draupnir serves, then moves the subvolume to where the instance's would be,
+// without stopping postgres.
+func (e OSExecutor) AdoptInstance(ctx context.Context, instance models.Instance, path string) error {
+	logger := GetLogger(ctx).
+		With("imageID", instance.ImageID).
+		With("instanceID", instance.ID).
+		With("port", instance.Port).
+		With("path", path)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-adopt-instance",
+		e.dataPath(instance.DataPath),
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+		path,
+	)
+
+	return runCommandAndLog(logger, "Adopted instance", cmd)
+}
+
 // RetrieveInstanceCredentials reads the certificate and key files from the
 // instance directory and returns them in a map
-func (e OSExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
-	logger := GetLogger(ctx).With("imageID", id)
+func (e OSExecutor) RetrieveInstanceCredentials(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+	logger := GetLogger(ctx).With("instanceID", instance.ID)
 
-	basePath := filepath.Join(e.DataPath, "instances", fmt.Sprintf("%d", id))
+	basePath := filepath.Join(e.dataPath(instance.DataPath), "instances", fmt.Sprintf("%d", instance.ID))
 
 	files := []string{"client.key", "client.crt", "ca.crt"}
 	fileContents := make(map[string][]byte)
@@ -171,29 +378,338 @@ func (e OSExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (ma
 	return fileContents, nil
 }
 
-func (e OSExecutor) DestroyImage(ctx context.Context, id int) error {
-	logger := GetLogger(ctx).With("imageID", id)
+func (e OSExecutor) DestroyImage(ctx context.Context, image models.Image) error {
+	logger := GetLogger(ctx).With("imageID", image.ID)
 
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		"sudo",
 		"draupnir-destroy-image",
-		e.DataPath,
-		fmt.Sprintf("%d", id),
+		e.dataPath(image.DataPath),
+		fmt.Sprintf("%d", image.ID),
 	)
 
 	return runCommandAndLog(logger, "Destroyed image", cmd)
 }
 
-func (e OSExecutor) DestroyInstance(ctx context.Context, id int) error {
-	logger := GetLogger(ctx).With("instanceID", id)
+func (e OSExecutor) DestroyInstance(ctx context.Context, instance models.Instance) error {
+	logger := GetLogger(ctx).With("instanceID", instance.ID)
 
 	cmd := exec.CommandContext(
 		ctx,
 		"sudo",
 		"draupnir-destroy-instance",
-		e.DataPath,
-		fmt.Sprintf("%d", id),
+		e.dataPath(instance.DataPath),
+		fmt.Sprintf("%d", instance.ID),
 	)
 
 	return runCommandAndLog(logger, "Destroyed instance", cmd)
 }
+
+// InstanceLogs returns the last lines of an instance's Postgres log
+func (e OSExecutor) InstanceLogs(ctx context.Context, instance models.Instance, lines int) (string, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-instance-logs",
+		fmt.Sprintf("%d", instance.ID),
+		strconv.Itoa(lines),
+	)
+
+	// The log is returned rather than logged, as it may be large
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read instance log")
+	}
+	return string(output), nil
+}
+
+// RestartInstance stops the instance's postgres and starts it again on the same
+// port, returning once it is accepting connections
+func (e OSExecutor) RestartInstance(ctx context.Context, instance models.Instance) error {
+	logger := GetLogger(ctx).
+		With("instanceID", instance.ID).
+		With("port", instance.Port)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-restart-instance",
+		e.dataPath(instance.DataPath),
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+	)
+
+	return runCommandAndLog(logger, "Restarted instance", cmd)
+}
+
+// InstanceConnections counts the clients connected to the instance's postgres,
+// excluding the connection that counts them. It connects over the socket in
+// the instance's directory, which the draupnir group may read.
+func (e OSExecutor) InstanceConnections(ctx context.Context, instance models.Instance) (int, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		"psql",
+		"-h", filepath.Join(e.dataPath(instance.DataPath), "instances", fmt.Sprintf("%d", instance.ID)),
+		"-p", fmt.Sprintf("%d", instance.Port),
+		"-U", "draupnir",
+		"-d", "postgres",
+		"-Atc", "SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()",
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to count instance connections")
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	return count, errors.Wrap(err, "failed to parse instance connections")
+}
+
+// SnapshotInstanceToImage saves the current state of the instance as the
+// image's finalised subvolume, so that it can be used as soon as the image is
+// marked as ready. The image must be on the same data path as the instance, as
+// snapshots cannot cross volumes. The instance is left running.
+func (e OSExecutor) SnapshotInstanceToImage(ctx context.Context, instance models.Instance, image models.Image) error {
+	logger := GetLogger(ctx).
+		With("instanceID", instance.ID).
+		With("imageID", image.ID)
+
+	if e.dataPath(instance.DataPath) != e.dataPath(image.DataPath) {
+		return errors.New("image must be on the same data path as the instance")
+	}
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-snapshot-instance",
+		e.dataPath(instance.DataPath),
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+		fmt.Sprintf("%d", image.ID),
+	)
+
+	return runCommandAndLog(logger, "Snapshotted instance", cmd)
+}
+
+// DiskUsage reports the space used and available on the filesystem that each
+// data path resides on
+func (e OSExecutor) DiskUsage(ctx context.Context) ([]DiskUsage, error) {
+	usages := make([]DiskUsage, 0, len(e.DataPaths))
+	for _, path := range e.DataPaths {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			return nil, errors.Wrapf(err, "failed to stat filesystem at %s", path)
+		}
+
+		usages = append(usages, DiskUsage{
+			Path:       path,
+			TotalBytes: stat.Blocks * uint64(stat.Bsize),
+			FreeBytes:  stat.Bavail * uint64(stat.Bsize),
+			ReadOnly:   stat.Flags&stRdOnly != 0,
+		})
+	}
+
+	return usages, nil
+}
+
+// ListImageVolumes runs draupnir-list-image-volumes on each data path, to find
+// every image subvolume on disk. Subvolumes whose name isn't an image ID, such
+// as that of the self-check, are ignored.
+func (e OSExecutor) ListImageVolumes(ctx context.Context) ([]ImageVolume, error) {
+	volumes := make([]ImageVolume, 0)
+
+	for _, root := range e.DataPaths {
+		cmd := exec.CommandContext(ctx, "sudo", "draupnir-list-image-volumes", root)
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list image volumes on %s", root)
+		}
+
+		found, err := parseImageVolumes(root, string(output))
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, found...)
+	}
+
+	return volumes, nil
+}
+
+// ImageSize returns the size in bytes of the image's finalised subvolume, or
+// zero if it hasn't been finalised
+func (e OSExecutor) ImageSize(ctx context.Context, image models.Image) (uint64, error) {
+	root := e.dataPath(image.DataPath)
+	cmd := exec.CommandContext(ctx, "sudo", "draupnir-list-image-volumes", root, strconv.Itoa(image.ID))
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list image volumes")
+	}
+
+	return parseImageSize(string(output))
+}
+
+// parseImageSize returns the size of the image_snapshots subvolume in the
+// output of draupnir-list-image-volumes, or zero if there isn't one
+func parseImageSize(output string) (uint64, error) {
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "image_snapshots" {
+			continue
+		}
+
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		return size, errors.Wrapf(err, "invalid size in image volume listing: %q", line)
+	}
+
+	return 0, nil
+}
+
+// parseImageVolumes parses the output of draupnir-list-image-volumes, which is
+// a line of the form "KIND IMAGE_ID BYTES [DISK_BYTES]" for each subvolume,
+// merging the upload and snapshot of each image
+func parseImageVolumes(root string, output string) ([]ImageVolume, error) {
+	volumes := make([]ImageVolume, 0)
+	byID := make(map[int]int)
+
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, errors.Errorf("unexpected line in image volume listing: %q", line)
+		}
+
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size in image volume listing: %q", line)
+		}
+
+		diskSize := size
+		if len(fields) == 4 {
+			diskSize, err = strconv.ParseUint(fields[3], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid disk size in image volume listing: %q", line)
+			}
+		}
+
+		index, ok := byID[id]
+		if !ok {
+			volumes = append(volumes, ImageVolume{DataPath: root, ImageID: id})
+			index = len(volumes) - 1
+			byID[id] = index
+		}
+
+		switch fields[0] {
+		case "image_uploads":
+			volumes[index].Uploaded = true
+		case "image_snapshots":
+			volumes[index].Snapshotted = true
+		default:
+			return nil, errors.Errorf("unexpected kind in image volume listing: %q", line)
+		}
+		volumes[index].SizeBytes += size
+		volumes[index].DiskBytes += diskSize
+	}
+
+	return volumes, nil
+}
+
+// selfCheckID is the name of the throwaway subvolume created by
+// CheckSubvolumes, which can never clash with a real image ID
+const selfCheckID = "selfcheck"
+
+// CheckSubvolumes creates and destroys a throwaway subvolume on each data path,
+// to prove that images can be created on it
+func (e OSExecutor) CheckSubvolumes(ctx context.Context) error {
+	for _, root := range e.DataPaths {
+		path := filepath.Join(root, "image_uploads", selfCheckID)
+		logger := GetLogger(ctx).With("path", path)
+
+		cmd := exec.CommandContext(ctx, "btrfs", "subvolume", "create", path)
+		if err := runCommandAndLog(logger, "Created self-check subvolume", cmd); err != nil {
+			return errors.Wrapf(err, "failed to create subvolume on %s", root)
+		}
+
+		cmd = exec.CommandContext(ctx, "sudo", "draupnir-destroy-image", root, selfCheckID)
+		if err := runCommandAndLog(logger, "Destroyed self-check subvolume", cmd); err != nil {
+			return errors.Wrapf(err, "failed to destroy subvolume on %s", root)
+		}
+	}
+
+	return nil
+}
+
+// DescribeImage runs draupnir-describe-image against a finalised image, which
+// boots a temporary copy of it and lists every table's columns and estimated
+// row count.
+func (e OSExecutor) DescribeImage(ctx context.Context, image models.Image) (ImageSchema, error) {
+	logger := GetLogger(ctx).With("imageID", image.ID)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-describe-image",
+		e.dataPath(image.DataPath),
+		fmt.Sprintf("%d", image.ID),
+		fmt.Sprintf("%d", 5432+image.ID),
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		logger = logger.With("error", err.Error())
+		if ee, ok := err.(*exec.ExitError); ok {
+			logger = logger.With("stderr", string(ee.Stderr))
+		}
+		logger.Info("Failed to describe image")
+		return nil, err
+	}
+	logger.Info("Described image")
+
+	return parseImageSchema(string(output))
+}
+
+// parseImageSchema parses the tab separated output of draupnir-describe-image
+func parseImageSchema(output string) (ImageSchema, error) {
+	schema := make(ImageSchema)
+	table := func(name string) TableSchema {
+		t, ok := schema[name]
+		if !ok {
+			t = TableSchema{Columns: make(map[string]string)}
+		}
+		return t
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		switch {
+		case fields[0] == "column" && len(fields) == 4:
+			t := table(fields[1])
+			t.Columns[fields[2]] = fields[3]
+			schema[fields[1]] = t
+		case fields[0] == "table" && len(fields) == 3:
+			rows, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid row count for table %s", fields[1])
+			}
+			t := table(fields[1])
+			t.EstimatedRows = rows
+			schema[fields[1]] = t
+		default:
+			return nil, errors.Errorf("unexpected line in image description: %q", line)
+		}
+	}
+
+	return schema, nil
+}
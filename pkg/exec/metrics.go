@@ -0,0 +1,129 @@
+package exec
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// ExecutorMetrics count the images and instances created and destroyed on
+// disk, and time the slowest operations
+type ExecutorMetrics struct {
+	ImagesCreated      *metrics.Counter
+	ImagesDestroyed    *metrics.Counter
+	InstancesCreated   *metrics.Counter
+	InstancesDestroyed *metrics.Counter
+
+	CreateSubvolumeDuration *metrics.Histogram
+	FinaliseImageDuration   *metrics.Histogram
+	CreateInstanceDuration  *metrics.Histogram
+}
+
+func NewExecutorMetrics() ExecutorMetrics {
+	return ExecutorMetrics{
+		ImagesCreated: metrics.NewCounter(
+			"draupnir_images_created_total",
+			"The number of images created, whether uploaded, fetched or snapshotted from an instance",
+		),
+		ImagesDestroyed: metrics.NewCounter(
+			"draupnir_images_destroyed_total",
+			"The number of images destroyed",
+		),
+		InstancesCreated: metrics.NewCounter(
+			"draupnir_instances_created_total",
+			"The number of instances created",
+		),
+		InstancesDestroyed: metrics.NewCounter(
+			"draupnir_instances_destroyed_total",
+			"The number of instances destroyed, by their owner or automatically",
+		),
+		CreateSubvolumeDuration: metrics.NewHistogram(
+			"draupnir_btrfs_subvolume_create_duration_seconds",
+			"How long creating an image's btrfs subvolume took",
+			metrics.DurationBuckets,
+		),
+		FinaliseImageDuration: metrics.NewHistogram(
+			"draupnir_image_finalise_duration_seconds",
+			"How long finalising an image took, including anonymisation",
+			metrics.DurationBuckets,
+		),
+		CreateInstanceDuration: metrics.NewHistogram(
+			"draupnir_instance_create_duration_seconds",
+			"How long creating an instance took",
+			metrics.DurationBuckets,
+		),
+	}
+}
+
+func (m ExecutorMetrics) Metrics() []metrics.Metric {
+	return []metrics.Metric{
+		m.ImagesCreated,
+		m.ImagesDestroyed,
+		m.InstancesCreated,
+		m.InstancesDestroyed,
+		m.CreateSubvolumeDuration,
+		m.FinaliseImageDuration,
+		m.CreateInstanceDuration,
+	}
+}
+
+// InstrumentedExecutor records ExecutorMetrics for the operations of the
+// Executor it wraps. Durations are observed whether or not the operation
+// succeeds, whereas only successful operations are counted.
+type InstrumentedExecutor struct {
+	Executor
+	Metrics ExecutorMetrics
+}
+
+func (e InstrumentedExecutor) CreateBtrfsSubvolume(ctx context.Context, image models.Image) error {
+	start := time.Now()
+	err := e.Executor.CreateBtrfsSubvolume(ctx, image)
+	e.Metrics.CreateSubvolumeDuration.Observe(time.Since(start).Seconds())
+	if err == nil {
+		e.Metrics.ImagesCreated.Inc()
+	}
+	return err
+}
+
+func (e InstrumentedExecutor) SnapshotInstanceToImage(ctx context.Context, instance models.Instance, image models.Image) error {
+	err := e.Executor.SnapshotInstanceToImage(ctx, instance, image)
+	if err == nil {
+		e.Metrics.ImagesCreated.Inc()
+	}
+	return err
+}
+
+func (e InstrumentedExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
+	start := time.Now()
+	err := e.Executor.FinaliseImage(ctx, image)
+	e.Metrics.FinaliseImageDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (e InstrumentedExecutor) DestroyImage(ctx context.Context, image models.Image) error {
+	err := e.Executor.DestroyImage(ctx, image)
+	if err == nil {
+		e.Metrics.ImagesDestroyed.Inc()
+	}
+	return err
+}
+
+func (e InstrumentedExecutor) CreateInstance(ctx context.Context, instance models.Instance) error {
+	start := time.Now()
+	err := e.Executor.CreateInstance(ctx, instance)
+	e.Metrics.CreateInstanceDuration.Observe(time.Since(start).Seconds())
+	if err == nil {
+		e.Metrics.InstancesCreated.Inc()
+	}
+	return err
+}
+
+func (e InstrumentedExecutor) DestroyInstance(ctx context.Context, instance models.Instance) error {
+	err := e.Executor.DestroyInstance(ctx, instance)
+	if err == nil {
+		e.Metrics.InstancesDestroyed.Inc()
+	}
+	return err
+}
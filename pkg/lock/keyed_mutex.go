@@ -0,0 +1,48 @@
+package lock
+
+import "sync"
+
+// KeyedMutex provides mutual exclusion per key, e.g. per image ID, such that
+// operations on different keys can proceed concurrently but operations on the
+// same key are serialised.
+type KeyedMutex struct {
+	mutex sync.Mutex
+	locks map[int]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mutex sync.Mutex
+	// refs is the number of callers holding or waiting for the lock. Once it
+	// drops to zero the entry is removed, so that the map doesn't grow forever.
+	refs int
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[int]*keyedMutexEntry)}
+}
+
+// Lock blocks until the lock for the given key is acquired, and returns a
+// function that releases it
+func (k *KeyedMutex) Lock(key int) func() {
+	k.mutex.Lock()
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mutex.Unlock()
+
+	entry.mutex.Lock()
+
+	return func() {
+		entry.mutex.Unlock()
+
+		k.mutex.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
@@ -0,0 +1,58 @@
+package lock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Semaphore limits the number of callers that may proceed at once, e.g. to
+// bound the number of concurrent finalisations. Callers beyond the limit wait
+// in line, and the length of the line can be observed.
+type Semaphore struct {
+	slots   chan struct{}
+	waiting int64
+}
+
+func NewSemaphore(size int) *Semaphore {
+	return &Semaphore{slots: make(chan struct{}, size)}
+}
+
+// Acquire blocks until a slot is free, and returns a function that frees it
+func (s *Semaphore) Acquire() func() {
+	atomic.AddInt64(&s.waiting, 1)
+	s.slots <- struct{}{}
+	atomic.AddInt64(&s.waiting, -1)
+
+	return s.release
+}
+
+// AcquireWithin waits at most timeout for a slot to be free. If one is, it
+// returns a function that frees it and true.
+func (s *Semaphore) AcquireWithin(timeout time.Duration) (func(), bool) {
+	atomic.AddInt64(&s.waiting, 1)
+	defer atomic.AddInt64(&s.waiting, -1)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return s.release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+func (s *Semaphore) release() {
+	<-s.slots
+}
+
+// Waiting returns the number of callers waiting for a slot
+func (s *Semaphore) Waiting() int {
+	return int(atomic.LoadInt64(&s.waiting))
+}
+
+// InUse returns the number of slots currently held
+func (s *Semaphore) InUse() int {
+	return len(s.slots)
+}
@@ -0,0 +1,297 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric is a single named value that can be rendered in the Prometheus text
+// exposition format
+type Metric interface {
+	Name() string
+	Help() string
+	Type() string
+	Value() float64
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	name string
+	help string
+	bits uint64
+}
+
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+func (g *Gauge) Name() string { return g.name }
+func (g *Gauge) Help() string { return g.help }
+func (g *Gauge) Type() string { return "gauge" }
+
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	name  string
+	help  string
+	count uint64
+}
+
+func NewCounter(name, help string) *Counter {
+	return &Counter{name: name, help: help}
+}
+
+func (c *Counter) Name() string { return c.name }
+func (c *Counter) Help() string { return c.help }
+func (c *Counter) Type() string { return "counter" }
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.count, 1)
+}
+
+func (c *Counter) Value() float64 {
+	return float64(atomic.LoadUint64(&c.count))
+}
+
+// Histogram counts observations, such as how long an operation took, in
+// buckets of cumulative upper bounds
+type Histogram struct {
+	name    string
+	help    string
+	mutex   sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// DurationBuckets suit operations that take from a fraction of a second to an
+// hour, in seconds
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+
+// NewHistogram returns a histogram with the given bucket upper bounds, which
+// must be sorted in increasing order. The +Inf bucket is implicit.
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	return &Histogram{name: name, help: help, bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Name() string { return h.name }
+func (h *Histogram) Help() string { return h.help }
+func (h *Histogram) Type() string { return "histogram" }
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if i := sort.SearchFloat64s(h.bounds, value); i < len(h.bounds) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// Value returns the number of observations
+func (h *Histogram) Value() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return float64(h.count)
+}
+
+// Samples renders the cumulative count of each bucket, then the sum and count
+// of the observations
+func (h *Histogram) Samples() []Sample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	samples := make([]Sample, 0, len(h.bounds)+3)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.buckets[i]
+		samples = append(samples, Sample{
+			Name:  h.name + "_bucket",
+			Label: fmt.Sprintf(`le="%v"`, bound),
+			Value: float64(cumulative),
+		})
+	}
+	samples = append(samples,
+		Sample{Name: h.name + "_bucket", Label: `le="+Inf"`, Value: float64(h.count)},
+		Sample{Name: h.name + "_sum", Value: h.sum},
+		Sample{Name: h.name + "_count", Value: float64(h.count)},
+	)
+	return samples
+}
+
+// Sample is one line of a metric's exposition, e.g. a bucket of a histogram
+type Sample struct {
+	Name string
+	// Label is rendered between braces if set, e.g. le="0.5"
+	Label string
+	Value float64
+}
+
+// Sampler is a metric that is rendered as several samples rather than a
+// single value
+type Sampler interface {
+	Metric
+	Samples() []Sample
+}
+
+// Collector is a metric whose value is computed when it is scraped, and so may
+// fail, e.g. because the disk it reports on is unavailable
+type Collector interface {
+	Metric
+	Collect() (float64, error)
+}
+
+// GaugeFunc is a gauge whose value is computed by calling a function on each
+// scrape
+type GaugeFunc struct {
+	name    string
+	help    string
+	collect func() (float64, error)
+}
+
+func NewGaugeFunc(name, help string, collect func() (float64, error)) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, collect: collect}
+}
+
+func (g *GaugeFunc) Name() string { return g.name }
+func (g *GaugeFunc) Help() string { return g.help }
+func (g *GaugeFunc) Type() string { return "gauge" }
+
+func (g *GaugeFunc) Collect() (float64, error) {
+	return g.collect()
+}
+
+// Value returns NaN if the value can't be collected
+func (g *GaugeFunc) Value() float64 {
+	value, err := g.Collect()
+	if err != nil {
+		return math.NaN()
+	}
+	return value
+}
+
+// CollectorErrorsName is the name of the counter, registered with every
+// registry, that counts failures to collect a metric
+const CollectorErrorsName = "draupnir_collector_errors_total"
+
+// Registry holds the metrics exposed by the server
+type Registry struct {
+	mutex           sync.Mutex
+	metrics         map[string]Metric
+	collectorErrors *Counter
+}
+
+func NewRegistry() *Registry {
+	collectorErrors := NewCounter(
+		CollectorErrorsName,
+		"The number of times a metric could not be collected",
+	)
+
+	return &Registry{
+		metrics:         map[string]Metric{collectorErrors.Name(): collectorErrors},
+		collectorErrors: collectorErrors,
+	}
+}
+
+// MustRegister adds metrics to the registry, panicking if any name is already
+// taken, as that can only be a programming error
+func (r *Registry) MustRegister(metrics ...Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, metric := range metrics {
+		if _, ok := r.metrics[metric.Name()]; ok {
+			panic(fmt.Sprintf("metric %s is already registered", metric.Name()))
+		}
+		r.metrics[metric.Name()] = metric
+	}
+}
+
+// collect returns the current value of a metric. If it is a collector that
+// errors or panics, the failure is counted and ok is false, so that one broken
+// collector can't take down the whole scrape.
+func (r *Registry) collect(metric Metric) (value float64, ok bool) {
+	collector, isCollector := metric.(Collector)
+	if !isCollector {
+		return metric.Value(), true
+	}
+
+	defer func() {
+		if recover() != nil {
+			r.collectorErrors.Inc()
+			value, ok = 0, false
+		}
+	}()
+
+	value, err := collector.Collect()
+	if err != nil {
+		r.collectorErrors.Inc()
+		return 0, false
+	}
+	return value, true
+}
+
+// Handler serves every registered metric in the Prometheus text exposition
+// format, sorted by name. Metrics that fail to collect are omitted.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.mutex.Lock()
+		names := make([]string, 0, len(r.metrics))
+		for name := range r.metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		metrics := make([]Metric, 0, len(names))
+		for _, name := range names {
+			metrics = append(metrics, r.metrics[name])
+		}
+		r.mutex.Unlock()
+
+		// Collect everything before rendering, so that the errors counter
+		// includes any failures from this scrape
+		values := make(map[string]float64)
+		for _, metric := range metrics {
+			if value, ok := r.collect(metric); ok {
+				values[metric.Name()] = value
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, metric := range metrics {
+			value, ok := values[metric.Name()]
+			if metric == Metric(r.collectorErrors) {
+				value, ok = r.collectorErrors.Value(), true
+			}
+			if !ok {
+				continue
+			}
+
+			fmt.Fprintf(w, "# HELP %s %s\n", metric.Name(), metric.Help())
+			fmt.Fprintf(w, "# TYPE %s %s\n", metric.Name(), metric.Type())
+			if sampler, isSampler := metric.(Sampler); isSampler {
+				for _, sample := range sampler.Samples() {
+					if sample.Label != "" {
+						fmt.Fprintf(w, "%s{%s} %v\n", sample.Name, sample.Label, sample.Value)
+					} else {
+						fmt.Fprintf(w, "%s %v\n", sample.Name, sample.Value)
+					}
+				}
+				continue
+			}
+			fmt.Fprintf(w, "%s %v\n", metric.Name(), value)
+		}
+	})
+}
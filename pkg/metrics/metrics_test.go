@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, registry *Registry) (int, string) {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, req)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHandlerRendersMetrics(t *testing.T) {
+	registry := NewRegistry()
+	gauge := NewGauge("draupnir_test_gauge", "A test gauge")
+	gauge.Set(2)
+	registry.MustRegister(gauge)
+
+	code, body := scrape(t, registry)
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(
+		t,
+		"# HELP draupnir_collector_errors_total The number of times a metric could not be collected\n"+
+			"# TYPE draupnir_collector_errors_total counter\n"+
+			"draupnir_collector_errors_total 0\n"+
+			"# HELP draupnir_test_gauge A test gauge\n"+
+			"# TYPE draupnir_test_gauge gauge\n"+
+			"draupnir_test_gauge 2\n",
+		body,
+	)
+}
+
+func TestHandlerSurvivesCollectorErrors(t *testing.T) {
+	registry := NewRegistry()
+	registry.MustRegister(
+		NewGaugeFunc("draupnir_failing", "Always fails", func() (float64, error) {
+			return 0, errors.New("disk unavailable")
+		}),
+		NewGaugeFunc("draupnir_panicking", "Always panics", func() (float64, error) {
+			panic("executor exploded")
+		}),
+		NewGaugeFunc("draupnir_working", "Always works", func() (float64, error) {
+			return 42, nil
+		}),
+	)
+
+	code, body := scrape(t, registry)
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "draupnir_collector_errors_total 2\n")
+	assert.Contains(t, body, "draupnir_working 42\n")
+	assert.NotContains(t, body, "draupnir_failing")
+	assert.NotContains(t, body, "draupnir_panicking")
+
+	// Errors accumulate across scrapes
+	_, body = scrape(t, registry)
+	assert.Contains(t, body, "draupnir_collector_errors_total 4\n")
+}
+
+func TestHandlerRendersHistograms(t *testing.T) {
+	registry := NewRegistry()
+	histogram := NewHistogram("draupnir_test_duration_seconds", "A test histogram", []float64{1, 10})
+	histogram.Observe(0.5)
+	histogram.Observe(1)
+	histogram.Observe(20)
+	registry.MustRegister(histogram)
+
+	_, body := scrape(t, registry)
+
+	assert.Contains(
+		t,
+		body,
+		"# HELP draupnir_test_duration_seconds A test histogram\n"+
+			"# TYPE draupnir_test_duration_seconds histogram\n"+
+			"draupnir_test_duration_seconds_bucket{le=\"1\"} 2\n"+
+			"draupnir_test_duration_seconds_bucket{le=\"10\"} 2\n"+
+			"draupnir_test_duration_seconds_bucket{le=\"+Inf\"} 3\n"+
+			"draupnir_test_duration_seconds_sum 21.5\n"+
+			"draupnir_test_duration_seconds_count 3\n",
+	)
+}
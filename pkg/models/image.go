@@ -1,6 +1,8 @@
 package models
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -11,13 +13,93 @@ type Image struct {
 	Anon       string
 	CreatedAt  time.Time `jsonapi:"attr,created_at,iso8601"`
 	UpdatedAt  time.Time `jsonapi:"attr,updated_at,iso8601"`
+	// DataPath is the root of the volume that the image resides on, under which
+	// it should be uploaded to image_uploads/<id>
+	DataPath string `jsonapi:"attr,data_path,omitempty"`
+	// AnonSizeBytes and AnonLineCount summarise the anonymisation script without
+	// exposing it, so that empty or truncated scripts can be spotted
+	AnonSizeBytes int `jsonapi:"attr,anon_size_bytes"`
+	AnonLineCount int `jsonapi:"attr,anon_line_count"`
+	// Tags is a comma separated list of key=value pairs, e.g. "env=staging",
+	// used to pick the latest image for a particular environment
+	Tags string `jsonapi:"attr,tags,omitempty"`
+	// Error describes why the image could not be finalised, e.g. because the
+	// anonymisation script timed out. It is cleared once finalisation succeeds.
+	Error string `jsonapi:"attr,error,omitempty"`
+	// DefaultDatabase is the database clients connect to in instances of the
+	// image, unless the user has chosen one. Defaults to postgres.
+	DefaultDatabase string `jsonapi:"attr,default_database,omitempty"`
+	// Compression is the btrfs compression algorithm that the image's files
+	// are written with, e.g. zstd, or empty if they're stored uncompressed
+	Compression string `jsonapi:"attr,compression,omitempty"`
+	// Destroying is set once the image is marked for deletion, after which no
+	// more instances may be created from it
+	Destroying bool `jsonapi:"attr,destroying,omitempty"`
+	// SourceURL is the URL that the image's backup was fetched from, if it
+	// wasn't uploaded, which peers fetch from when the image is replicated.
+	// It isn't exposed, as it may be signed.
+	SourceURL string
+	// SizeBytes is the size of the image's finalised subvolume on disk. It is
+	// only reported when fetching a single image, and is zero until the image
+	// is ready.
+	SizeBytes uint64 `jsonapi:"attr,size_bytes,omitempty"`
 }
 
-func NewImage(backedUpAt time.Time, anon string) Image {
+// Cloneable returns true if instances may be created from the image
+func (i Image) Cloneable() bool {
+	return i.Ready && !i.Destroying
+}
+
+// ParseTags splits a comma separated list of key=value tags, returning an
+// error if any of them are malformed
+func ParseTags(tags string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	if tags == "" {
+		return parsed, nil
+	}
+
+	for _, tag := range strings.Split(tags, ",") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return parsed, fmt.Errorf("tag %q is not of the form key=value", tag)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+
+	return parsed, nil
+}
+
+// HasTag returns true if the image is tagged with the given key=value pair
+func (i Image) HasTag(tag string) bool {
+	tags, err := ParseTags(i.Tags)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	value, ok := tags[parts[0]]
+	return ok && value == parts[1]
+}
+
+// SetAnonStats computes AnonSizeBytes and AnonLineCount from Anon
+func (i *Image) SetAnonStats() {
+	i.AnonSizeBytes = len(i.Anon)
+	i.AnonLineCount = strings.Count(i.Anon, "\n")
+	if i.Anon != "" && !strings.HasSuffix(i.Anon, "\n") {
+		i.AnonLineCount++
+	}
+}
+
+func NewImage(backedUpAt time.Time, anon string, dataPath string) Image {
 	return Image{
 		BackedUpAt: backedUpAt,
 		Ready:      false,
 		Anon:       anon,
+		DataPath:   dataPath,
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
 	}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"regexp"
+	"time"
+)
+
+// ImageAlias is a stable name for a vetted image, e.g. latest-stable, which is
+// moved from image to image by promoting them, so that clients can use it
+// rather than whichever image is newest
+type ImageAlias struct {
+	Name    string `jsonapi:"primary,image_aliases"`
+	ImageID int    `jsonapi:"attr,image_id"`
+	// PromotedBy is the email of the user who last moved the alias
+	PromotedBy string    `jsonapi:"attr,promoted_by"`
+	PromotedAt time.Time `jsonapi:"attr,promoted_at,iso8601"`
+}
+
+func NewImageAlias(name string, imageID int, email string) ImageAlias {
+	return ImageAlias{
+		Name:       name,
+		ImageID:    imageID,
+		PromotedBy: email,
+		PromotedAt: time.Now(),
+	}
+}
+
+// imageAliasPattern requires aliases to start with a letter, so that they
+// can't be mistaken for image IDs
+var imageAliasPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]{0,62}$`)
+
+// ValidImageAlias reports whether name may be used as an alias
+func ValidImageAlias(name string) bool {
+	return imageAliasPattern.MatchString(name)
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	ReplicationPending   = "pending"
+	ReplicationSucceeded = "succeeded"
+	ReplicationFailed    = "failed"
+	// ReplicationSkipped is recorded when an image can't be replicated, as it
+	// wasn't fetched from a URL that the peer could fetch it from too
+	ReplicationSkipped = "skipped"
+)
+
+// ImageReplication tracks the copying of a finalised image to a peer draupnir
+// server, which is identified by its URL
+type ImageReplication struct {
+	ID      int    `jsonapi:"primary,image_replications"`
+	ImageID int    `jsonapi:"attr,image_id"`
+	Peer    string `jsonapi:"attr,peer"`
+	Status  string `jsonapi:"attr,status"`
+	// PeerImageID is the ID of the copy of the image on the peer, once created
+	PeerImageID int       `jsonapi:"attr,peer_image_id,omitempty"`
+	Error       string    `jsonapi:"attr,error,omitempty"`
+	CreatedAt   time.Time `jsonapi:"attr,created_at,iso8601"`
+	UpdatedAt   time.Time `jsonapi:"attr,updated_at,iso8601"`
+}
+
+func NewImageReplication(imageID int, peer string) ImageReplication {
+	return ImageReplication{
+		ImageID:   imageID,
+		Peer:      peer,
+		Status:    ReplicationPending,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
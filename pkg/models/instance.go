@@ -1,32 +1,179 @@
 package models
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Instance struct {
-	ID           int    `jsonapi:"primary,instances"`
-	Hostname     string `jsonapi:"attr,hostname"`
-	ImageID      int    `jsonapi:"attr,image_id"`
-	UserEmail    string
+	ID       int    `jsonapi:"primary,instances"`
+	Hostname string `jsonapi:"attr,hostname"`
+	ImageID  int    `jsonapi:"attr,image_id"`
+	// UserEmail is the email of the instance's owner
+	UserEmail    string `jsonapi:"attr,user_email,omitempty"`
 	RefreshToken string
 	CreatedAt    time.Time `jsonapi:"attr,created_at,iso8601"`
 	UpdatedAt    time.Time `jsonapi:"attr,updated_at,iso8601"`
 	Port         uint16    `jsonapi:"attr,port"`
+	// ConnectionTemplate is an optional text/template, rendered by the client
+	// with ConnectionDetails, that dictates how to connect to the instance
+	ConnectionTemplate string `jsonapi:"attr,connection_template,omitempty"`
+	// DataPath is the root of the volume that the instance resides on, which is
+	// always the same as that of its image
+	DataPath string
+	// ETag is the entity tag that the server sent with the instance, which the
+	// client sends back in If-Match when modifying it. It isn't part of the
+	// payload.
+	ETag string
+	// ApplicationName is the application_name that the client stamps its
+	// connections with, so that they can be attributed to the instance's owner
+	// in pg_stat_activity
+	ApplicationName string `jsonapi:"attr,application_name,omitempty"`
+	// PGOptions are the server's default session options for connections to
+	// the instance, passed to libpq as PGOPTIONS, e.g. "-c statement_timeout=0"
+	PGOptions string `jsonapi:"attr,pg_options,omitempty"`
+	// Name is a human readable identifier for the instance, unique among
+	// existing instances
+	Name string `jsonapi:"attr,name,omitempty"`
+	// SchemaOnly instances are created with every table of the image's
+	// databases truncated, for tests that only need the schema
+	SchemaOnly bool `jsonapi:"attr,schema_only,omitempty"`
+	// MaxConnections is the most connections that the instance's postgres
+	// accepts, or zero if it has the image's max_connections
+	MaxConnections int `jsonapi:"attr,max_connections,omitempty"`
+	// Connections is how many clients are connected to the instance. It is
+	// only counted when a single instance is fetched.
+	Connections int `jsonapi:"attr,connections,omitempty"`
+	// ExpiresAt is when the instance will be destroyed automatically, or zero
+	// if it is kept until it is destroyed by its owner
+	ExpiresAt time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	// ImageBackedUpAt and ImageReady are read-only copies of the instance's
+	// image's attributes, so that clients needn't fetch the image to show them
+	ImageBackedUpAt time.Time `jsonapi:"attr,image_backed_up_at,iso8601"`
+	ImageReady      bool      `jsonapi:"attr,image_ready"`
+	// ImageDefaultDatabase is the default database of the instance's image
+	ImageDefaultDatabase string `jsonapi:"attr,image_default_database,omitempty"`
 
 	Credentials *InstanceCredentials `jsonapi:"relation,credentials"`
 }
 
-func NewInstance(imageID int, email, refreshToken string) Instance {
+func NewInstance(image Image, email, refreshToken string) Instance {
+	// Postgres keeps timestamps to the microsecond, so anything finer would be
+	// lost once the instance is stored, changing its ETag
+	now := time.Now().Truncate(time.Microsecond)
 	return Instance{
-		ImageID:      imageID,
-		UserEmail:    email,
-		RefreshToken: refreshToken,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		ImageID:              image.ID,
+		ImageBackedUpAt:      image.BackedUpAt,
+		ImageReady:           image.Ready,
+		ImageDefaultDatabase: image.DefaultDatabase,
+		DataPath:             image.DataPath,
+		UserEmail:            email,
+		RefreshToken:         refreshToken,
+		CreatedAt:            now,
+		UpdatedAt:            now,
 	}
 }
 
+// Expired returns true if the instance has an expiry time, and it has passed
+func (i Instance) Expired(now time.Time) bool {
+	return !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt)
+}
+
+// SetApplicationName derives ApplicationName from UserEmail, e.g.
+// draupnir-jane for jane@example.com
+func (i *Instance) SetApplicationName() {
+	if i.UserEmail == "" {
+		i.ApplicationName = ""
+		return
+	}
+	i.ApplicationName = "draupnir-" + strings.SplitN(i.UserEmail, "@", 2)[0]
+}
+
+// DefaultInstanceNameTemplate is used to name instances when the server isn't
+// configured with a template, and the user doesn't choose a name
+const DefaultInstanceNameTemplate = "{{.User}}-{{.ImageID}}-{{.Suffix}}"
+
+// InstanceNameDetails are the values available to an instance name template
+type InstanceNameDetails struct {
+	// User is the part of the owner's email address before the @
+	User    string
+	ImageID int
+	// Suffix is random, so that a user can have several instances of an image
+	Suffix string
+}
+
+// ConnectionDetails are the values available to an instance's
+// ConnectionTemplate
+type ConnectionDetails struct {
+	ID             int    `json:"id"`
+	Hostname       string `json:"hostname"`
+	Port           uint16 `json:"port"`
+	Database       string `json:"database"`
+	CACertPath     string `json:"ca_cert_path"`
+	ClientCertPath string `json:"client_cert_path"`
+	ClientKeyPath  string `json:"client_key_path"`
+	// ApplicationName is set as the connection's application_name
+	ApplicationName string `json:"application_name"`
+	// PGOptions are session options for the connection, set as PGOPTIONS
+	PGOptions string `json:"pg_options,omitempty"`
+	// ConnectTimeout is how many seconds to wait for the connection to be
+	// established, set as PGCONNECT_TIMEOUT
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+}
+
+// ConnectionString renders the details as a libpq keyword/value connection
+// string, e.g. for psql "host=... port=...", equivalent to the environment
+// of the default connection template
+func (d ConnectionDetails) ConnectionString() string {
+	params := []struct{ key, value string }{
+		{"host", d.Hostname},
+		{"port", strconv.Itoa(int(d.Port))},
+		{"user", "draupnir"},
+		{"dbname", d.Database},
+		{"sslmode", "verify-ca"},
+		{"sslrootcert", d.CACertPath},
+		{"sslcert", d.ClientCertPath},
+		{"sslkey", d.ClientKeyPath},
+		{"application_name", d.ApplicationName},
+		{"options", d.PGOptions},
+	}
+	if d.ConnectTimeout > 0 {
+		params = append(params, struct{ key, value string }{"connect_timeout", strconv.Itoa(d.ConnectTimeout)})
+	}
+
+	parts := make([]string, 0, len(params))
+	for _, param := range params {
+		if param.value != "" {
+			parts = append(parts, param.key+"="+quoteConnectionValue(param.value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteConnectionValue quotes values that libpq would otherwise misread,
+// escaping backslashes and single quotes
+func quoteConnectionValue(value string) string {
+	if !strings.ContainsAny(value, " '\\\t\n") {
+		return value
+	}
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + value + "'"
+}
+
+// ValidatePGOptions checks session options given for PGOPTIONS. They are
+// rendered in single quotes, so may not contain them.
+func ValidatePGOptions(options string) error {
+	if strings.TrimSpace(options) == "" {
+		return errors.New("options must not be empty")
+	}
+	if strings.ContainsAny(options, "'\n") {
+		return errors.New("options must not contain single quotes or newlines")
+	}
+	return nil
+}
+
 type InstanceCredentials struct {
 	// The JSON:API spec says that we should have an ID field, even though we'll
 	// just be setting it to the same value as the instance ID.
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	OperationPending   = "pending"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+)
+
+// Kinds of operation
+const (
+	OperationCreateInstance   = "create_instance"
+	OperationDestroyInstance  = "destroy_instance"
+	OperationFetchImage       = "fetch_image"
+	OperationFinaliseImage    = "finalise_image"
+	OperationSnapshotInstance = "snapshot_instance"
+)
+
+// Operation tracks the progress of an instance being created, or an image
+// being fetched or finalised, asynchronously, so that clients can check on it
+// after being disconnected. Operations are kept once they finish, as a history
+// of what each user has done, and those carried out while the client waited
+// are recorded too.
+type Operation struct {
+	ID         int    `jsonapi:"primary,operations"`
+	Kind       string `jsonapi:"attr,kind,omitempty"`
+	Status     string `jsonapi:"attr,status"`
+	InstanceID int    `jsonapi:"attr,instance_id,omitempty"`
+	ImageID    int    `jsonapi:"attr,image_id,omitempty"`
+	Error      string `jsonapi:"attr,error,omitempty"`
+	UserEmail  string
+	CreatedAt  time.Time `jsonapi:"attr,created_at,iso8601"`
+	UpdatedAt  time.Time `jsonapi:"attr,updated_at,iso8601"`
+	// BytesTransferred is how much of an image's backup has been fetched
+	BytesTransferred int64 `jsonapi:"attr,bytes_transferred,omitempty"`
+	// FinishedAt is when the operation stopped being pending, and is zero
+	// until then
+	FinishedAt time.Time `jsonapi:"attr,finished_at,iso8601"`
+}
+
+func NewOperation(email string, kind string) Operation {
+	return Operation{
+		Kind:      kind,
+		Status:    OperationPending,
+		UserEmail: email,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
+
+// Duration is how long the operation took, or zero if it hasn't finished
+func (o Operation) Duration() time.Duration {
+	if o.FinishedAt.IsZero() {
+		return 0
+	}
+	return o.FinishedAt.Sub(o.CreatedAt)
+}
@@ -13,6 +13,18 @@ import (
 
 const UPLOAD_USER_EMAIL = "upload"
 
+// IsAdmin reports whether the given user is allowed to use administrative
+// endpoints. The upload user, which authenticates via the shared secret, is
+// only an admin if UPLOAD_USER_EMAIL is listed in adminEmails.
+func IsAdmin(email string, adminEmails []string) bool {
+	for _, adminEmail := range adminEmails {
+		if email == adminEmail {
+			return true
+		}
+	}
+	return false
+}
+
 type Authenticator interface {
 	// AuthenticateRequest takes an HTTP request and
 	// attempts to authenticate it.
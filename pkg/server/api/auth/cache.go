@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CacheInvalidator forgets any cached authentication of a user, so that their
+// next request is authenticated afresh
+type CacheInvalidator interface {
+	Invalidate(email string)
+}
+
+// CachingAuthenticator remembers who each token belongs to for a short while,
+// so that a burst of requests with the same token is only checked with Google
+// once. Tokens are held as hashes, and failures aren't cached.
+// IsRefreshTokenValid is always passed through, as the instance cleaner relies
+// on it being up to date.
+type CachingAuthenticator struct {
+	Authenticator
+	ttl     time.Duration
+	mutex   *sync.Mutex
+	entries map[[sha256.Size]byte]cachedAuthentication
+	// generation is bumped by every Invalidate, so that an authentication that
+	// was in flight at the time isn't cached after the user's entries have been
+	// dropped
+	generation *uint64
+}
+
+type cachedAuthentication struct {
+	email        string
+	refreshToken string
+	expiresAt    time.Time
+}
+
+// NewCachingAuthenticator wraps authenticator, caching each successful
+// authentication for ttl
+func NewCachingAuthenticator(authenticator Authenticator, ttl time.Duration) CachingAuthenticator {
+	return CachingAuthenticator{
+		Authenticator: authenticator,
+		ttl:           ttl,
+		mutex:         &sync.Mutex{},
+		entries:       make(map[[sha256.Size]byte]cachedAuthentication),
+		generation:    new(uint64),
+	}
+}
+
+func (c CachingAuthenticator) AuthenticateRequest(r *http.Request) (string, string, error) {
+	key := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	now := time.Now()
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	generation := *c.generation
+	c.mutex.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.email, entry.refreshToken, nil
+	}
+
+	email, refreshToken, err := c.Authenticator.AuthenticateRequest(r)
+	if err != nil {
+		return email, refreshToken, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if *c.generation != generation {
+		return email, refreshToken, nil
+	}
+
+	// Sweep out expired entries as we go, so that tokens that are no longer
+	// used don't accumulate
+	for k, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedAuthentication{
+		email:        email,
+		refreshToken: refreshToken,
+		expiresAt:    now.Add(c.ttl),
+	}
+
+	return email, refreshToken, nil
+}
+
+// Invalidate forgets every cached token of the user, e.g. when their tokens
+// are revoked
+func (c CachingAuthenticator) Invalidate(email string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	*c.generation++
+	for k, e := range c.entries {
+		if e.email == email {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingAuthenticator authenticates each token as the user it names, e.g.
+// "Bearer jane" as jane@example.com, counting how often it's asked
+func countingAuthenticator(calls *int, err error) FakeAuthenticator {
+	return FakeAuthenticator{
+		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
+			*calls++
+			if err != nil {
+				return "", "", err
+			}
+			token := r.Header.Get("Authorization")[len("Bearer "):]
+			return token + "@example.com", "refresh-" + token, nil
+		},
+	}
+}
+
+func authenticate(c CachingAuthenticator, token string) (string, error) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	email, _, err := c.AuthenticateRequest(req)
+	return email, err
+}
+
+func TestCachingAuthenticatorHitWithinTTL(t *testing.T) {
+	calls := 0
+	c := NewCachingAuthenticator(countingAuthenticator(&calls, nil), time.Hour)
+
+	for i := 0; i < 3; i++ {
+		email, err := authenticate(c, "jane")
+		assert.Nil(t, err)
+		assert.Equal(t, "jane@example.com", email)
+	}
+	assert.Equal(t, 1, calls, "only the first request is checked")
+}
+
+func TestCachingAuthenticatorMissAfterTTL(t *testing.T) {
+	calls := 0
+	c := NewCachingAuthenticator(countingAuthenticator(&calls, nil), 10*time.Millisecond)
+
+	authenticate(c, "jane")
+	time.Sleep(20 * time.Millisecond)
+	email, err := authenticate(c, "jane")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "jane@example.com", email)
+	assert.Equal(t, 2, calls, "the expired entry is checked again")
+}
+
+func TestCachingAuthenticatorDoesNotCacheErrors(t *testing.T) {
+	calls := 0
+	c := NewCachingAuthenticator(countingAuthenticator(&calls, errors.New("invalid token")), time.Hour)
+
+	for i := 0; i < 2; i++ {
+		_, err := authenticate(c, "jane")
+		assert.EqualError(t, err, "invalid token")
+	}
+	assert.Equal(t, 2, calls, "every failure is checked afresh")
+}
+
+func TestCachingAuthenticatorInvalidate(t *testing.T) {
+	calls := 0
+	c := NewCachingAuthenticator(countingAuthenticator(&calls, nil), time.Hour)
+
+	authenticate(c, "jane")
+	authenticate(c, "john")
+	c.Invalidate("jane@example.com")
+	authenticate(c, "jane")
+	authenticate(c, "john")
+
+	assert.Equal(t, 3, calls, "only jane is checked again")
+}
+
+func TestCachingAuthenticatorInvalidateDuringAuthentication(t *testing.T) {
+	var c CachingAuthenticator
+	calls := 0
+	c = NewCachingAuthenticator(FakeAuthenticator{
+		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
+			calls++
+			// The user's tokens are revoked while the first check is in flight
+			if calls == 1 {
+				c.Invalidate("jane@example.com")
+			}
+			return "jane@example.com", "", nil
+		},
+	}, time.Hour)
+
+	authenticate(c, "jane")
+	authenticate(c, "jane")
+
+	assert.Equal(t, 2, calls, "the authentication in flight isn't cached")
+}
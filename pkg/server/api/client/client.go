@@ -7,8 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,13 +32,20 @@ type Client struct {
 	// e.g. "https://draupnir-server.my-infra.com"
 	url string
 	// OAuth Access Token
-	token  oauth2.Token
-	client *http.Client
+	token oauth2.Token
+	// The User-Agent header sent with every request
+	// e.g. "draupnir-client/5.3.4 (darwin/amd64) ci-runner"
+	userAgent string
+	client    *http.Client
+	// Called as the body of an image creation is uploaded, if set
+	uploadProgress ProgressFunc
 }
 
-// NewClient constructs a new draupnir client, pointing at the given endpoint
-func NewClient(url string, token oauth2.Token, insecure bool) Client {
-	client := &http.Client{}
+// NewClient constructs a new draupnir client, pointing at the given endpoint.
+// If a userAgentSuffix is given, it is appended to the default User-Agent so
+// that particular clients (e.g. CI jobs) can be identified in server logs.
+func NewClient(url string, token oauth2.Token, insecure bool, userAgentSuffix string) Client {
+	client := &http.Client{CheckRedirect: checkRedirect(nil)}
 
 	if insecure {
 		client.Transport = &http.Transport{
@@ -43,7 +53,71 @@ func NewClient(url string, token oauth2.Token, insecure bool) Client {
 		}
 	}
 
-	return Client{url, token, client}
+	return Client{url: url, token: token, userAgent: UserAgent(userAgentSuffix), client: client}
+}
+
+// WithUploadProgress returns a copy of the client that reports the progress of
+// uploading the request body of CreateImage to progress
+func (c Client) WithUploadProgress(progress ProgressFunc) Client {
+	c.uploadProgress = progress
+	return c
+}
+
+// RedirectFunc is called with the URLs that a request is redirected from and
+// to, before the redirect is followed
+type RedirectFunc func(from *url.URL, to *url.URL)
+
+// WithRedirectReporter returns a copy of the client that calls report for each
+// redirect that it follows
+func (c Client) WithRedirectReporter(report RedirectFunc) Client {
+	client := *c.client
+	client.CheckRedirect = checkRedirect(report)
+	c.client = &client
+	return c
+}
+
+// maxRedirects is how many redirects a request follows before failing
+const maxRedirects = 10
+
+// redirectedHeaders are only sent on to the same scheme and host as the
+// original request, so that tokens aren't leaked to another server
+var redirectedHeaders = []string{"Authorization", "Draupnir-Version", api.FeaturesHeader}
+
+// checkRedirect follows redirects of GET and HEAD requests, so that the client
+// keeps working when the server is moved behind a redirecting proxy or to
+// another path. Other requests fail instead, as net/http would replay them as
+// a GET on a 301, 302 or 303.
+func checkRedirect(report RedirectFunc) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		original := via[0]
+		if original.Method != http.MethodGet && original.Method != http.MethodHead {
+			return fmt.Errorf("server redirected %s %s to %s, but only GET and HEAD requests are redirected", original.Method, original.URL.Path, req.URL)
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		if req.URL.Scheme != original.URL.Scheme || req.URL.Host != original.URL.Host {
+			for _, header := range redirectedHeaders {
+				req.Header.Del(header)
+			}
+		}
+
+		if report != nil {
+			report(via[len(via)-1].URL, req.URL)
+		}
+		return nil
+	}
+}
+
+// UserAgent builds the User-Agent header for the client, identifying the
+// client version and platform
+func UserAgent(suffix string) string {
+	userAgent := fmt.Sprintf("draupnir-client/%s (%s/%s)", version.Version, runtime.GOOS, runtime.GOARCH)
+	if suffix != "" {
+		userAgent = fmt.Sprintf("%s %s", userAgent, suffix)
+	}
+	return userAgent
 }
 
 // DraupnirClient defines the API that a draupnir client conforms to
@@ -59,6 +133,12 @@ type DraupnirClient interface {
 }
 
 func (c Client) GetLatestImage() (models.Image, error) {
+	return c.GetLatestImageWithTag("")
+}
+
+// GetLatestImageWithTag returns the most recent ready image tagged with the
+// given key=value pair. An empty tag matches all images.
+func (c Client) GetLatestImageWithTag(tag string) (models.Image, error) {
 	var image models.Image
 	images, err := c.ListImages()
 
@@ -74,11 +154,14 @@ func (c Client) GetLatestImage() (models.Image, error) {
 	})
 
 	for _, image := range images {
-		if image.Ready {
+		if image.Ready && (tag == "" || image.HasTag(tag)) {
 			return image, nil
 		}
 	}
 
+	if tag != "" {
+		return image, fmt.Errorf("no images available with tag %s", tag)
+	}
 	return image, errors.New("no images available")
 }
 
@@ -90,13 +173,41 @@ func (c Client) GetImage(id string) (models.Image, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return image, parseError(resp.Body)
+		return image, parseResourceError(resp)
 	}
 
 	err = jsonapi.UnmarshalPayload(resp.Body, &image)
 	return image, err
 }
 
+// ListImageReplications returns the progress of copying the image to each of
+// the server's replication peers
+func (c Client) ListImageReplications(id string) ([]models.ImageReplication, error) {
+	var replications []models.ImageReplication
+	resp, err := c.get("/images/" + id + "/replications")
+	if err != nil {
+		return replications, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return replications, parseResourceError(resp)
+	}
+
+	maybeReplications, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(replications))
+	if err != nil {
+		return replications, err
+	}
+
+	// Convert from []interface{} to []ImageReplication
+	replications = make([]models.ImageReplication, 0)
+	for _, replication := range maybeReplications {
+		r := replication.(*models.ImageReplication)
+		replications = append(replications, *r)
+	}
+
+	return replications, nil
+}
+
 func (c Client) GetInstance(id string) (models.Instance, error) {
 	var instance models.Instance
 	resp, err := c.get("/instances/" + id)
@@ -105,28 +216,108 @@ func (c Client) GetInstance(id string) (models.Instance, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return instance, parseError(resp.Body)
+		return instance, parseResourceError(resp)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &instance)
+	instance.ETag = resp.Header.Get("ETag")
+	return instance, err
+}
+
+// RestartInstance restarts an instance's Postgres, returning the instance once
+// it is accepting connections
+func (c Client) RestartInstance(id string) (models.Instance, error) {
+	var instance models.Instance
+	var emptyPayload bytes.Buffer
+	resp, err := c.post(fmt.Sprintf("/instances/%s/restart", id), &emptyPayload)
+	if err != nil {
+		return instance, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return instance, parseResourceError(resp)
 	}
 
 	err = jsonapi.UnmarshalPayload(resp.Body, &instance)
 	return instance, err
 }
 
+// SnapshotInstance saves the current state of an instance as a new image,
+// returning the image once it is ready. A zero backedUpAt is the time of the
+// snapshot.
+func (c Client) SnapshotInstance(id string, backedUpAt time.Time) (models.Image, error) {
+	var image models.Image
+	request := routes.SnapshotInstanceRequest{BackedUpAt: backedUpAt}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return image, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/instances/%s/snapshot", id), &payload)
+	if err != nil {
+		return image, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return image, parseResourceError(resp)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &image)
+	return image, err
+}
+
+// GetInstanceLogs returns the last lines of an instance's Postgres log
+func (c Client) GetInstanceLogs(id string, lines int) (string, error) {
+	resp, err := c.get(fmt.Sprintf("/instances/%s/logs?lines=%d", id, lines))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", parseError(resp.Body)
+	}
+
+	output, err := ioutil.ReadAll(resp.Body)
+	return string(output), err
+}
+
 // ListImages returns a list of all images
 func (c Client) ListImages() ([]models.Image, error) {
+	images, _, err := c.ListImagesWithMeta()
+	return images, err
+}
+
+// ListImagesWithMeta returns a list of all images, along with how many there
+// are and how many of them are ready
+func (c Client) ListImagesWithMeta() ([]models.Image, routes.ImageListMeta, error) {
 	var images []models.Image
+	var payload struct {
+		Meta routes.ImageListMeta `json:"meta"`
+	}
+
 	resp, err := c.get("/images")
 	if err != nil {
-		return images, err
+		return images, payload.Meta, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return images, parseError(resp.Body)
+		return images, payload.Meta, parseError(resp.Body)
 	}
 
-	maybeImages, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(images))
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return images, payload.Meta, err
+	}
+
+	maybeImages, err := jsonapi.UnmarshalManyPayload(bytes.NewReader(body), reflect.TypeOf(images))
+	if err != nil {
+		return nil, payload.Meta, err
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, payload.Meta, err
 	}
 
 	// Convert from []interface{} to []Image
@@ -136,24 +327,44 @@ func (c Client) ListImages() ([]models.Image, error) {
 		images = append(images, *i)
 	}
 
-	return images, nil
+	return images, payload.Meta, nil
 }
 
 // ListInstances returns a list of all instances
 func (c Client) ListInstances() ([]models.Instance, error) {
+	instances, _, err := c.ListInstancesWithMeta()
+	return instances, err
+}
+
+// ListInstancesWithMeta returns a list of all instances, along with how many
+// there are
+func (c Client) ListInstancesWithMeta() ([]models.Instance, routes.InstanceListMeta, error) {
 	var instances []models.Instance
+	var payload struct {
+		Meta routes.InstanceListMeta `json:"meta"`
+	}
+
 	resp, err := c.get("/instances")
 	if err != nil {
-		return instances, err
+		return instances, payload.Meta, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return instances, parseError(resp.Body)
+		return instances, payload.Meta, parseError(resp.Body)
 	}
 
-	maybeInstances, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(instances))
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return instances, payload.Meta, err
+	}
+
+	maybeInstances, err := jsonapi.UnmarshalManyPayload(bytes.NewReader(body), reflect.TypeOf(instances))
+	if err != nil {
+		return nil, payload.Meta, err
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, payload.Meta, err
 	}
 
 	// Convert from []interface{} to []Instance
@@ -163,7 +374,7 @@ func (c Client) ListInstances() ([]models.Instance, error) {
 		instances = append(instances, *i)
 	}
 
-	return instances, nil
+	return instances, payload.Meta, nil
 }
 
 // CreateInstance creates a new instance
@@ -190,6 +401,194 @@ func (c Client) CreateInstance(image models.Image) (models.Instance, error) {
 	return instance, err
 }
 
+// CreateInstanceOptions configure the instance created by CreateInstanceAsync
+// and PlanInstance
+type CreateInstanceOptions struct {
+	// Name is the instance's name, or empty to have one generated
+	Name string
+	// SchemaOnly instances have every table truncated
+	SchemaOnly bool
+	// MaxAge rejects images backed up longer ago than this, overriding the
+	// server's max_image_age, unless AllowStale is set. Zero uses the server's.
+	MaxAge     time.Duration
+	AllowStale bool
+}
+
+func (o CreateInstanceOptions) request(image models.Image) routes.CreateInstanceRequest {
+	return routes.CreateInstanceRequest{
+		ImageID:    strconv.Itoa(image.ID),
+		Name:       o.Name,
+		SchemaOnly: o.SchemaOnly,
+		MaxAge:     int(o.MaxAge / time.Second),
+		AllowStale: o.AllowStale,
+	}
+}
+
+// CreateInstanceAsync starts creating an instance of the image, and returns
+// the operation tracking its progress
+func (c Client) CreateInstanceAsync(image models.Image, options CreateInstanceOptions) (models.Operation, error) {
+	var operation models.Operation
+	request := options.request(image)
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return operation, err
+	}
+
+	resp, err := c.post("/instances?async=true", &payload)
+	if err != nil {
+		return operation, err
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return operation, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &operation)
+	return operation, err
+}
+
+// GetOperation gets an operation by ID
+func (c Client) GetOperation(id string) (models.Operation, error) {
+	var operation models.Operation
+	resp, err := c.get("/operations/" + id)
+	if err != nil {
+		return operation, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return operation, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &operation)
+	return operation, err
+}
+
+// ListOperationsOptions filter the operations returned by ListOperations.
+// Empty fields aren't filtered on.
+type ListOperationsOptions struct {
+	Kind   string
+	Status string
+	// Since excludes operations started before it
+	Since time.Time
+	// Limit is the most operations to return, or zero for the server's default
+	Limit int
+	// User lists another user's operations, which only admins may do
+	User string
+}
+
+// ListOperations returns the user's operations, the most recent first
+func (c Client) ListOperations(options ListOperationsOptions) ([]models.Operation, error) {
+	var operations []models.Operation
+
+	params := url.Values{}
+	if options.Kind != "" {
+		params.Set("kind", options.Kind)
+	}
+	if options.Status != "" {
+		params.Set("status", options.Status)
+	}
+	if !options.Since.IsZero() {
+		params.Set("since", options.Since.UTC().Format(time.RFC3339))
+	}
+	if options.Limit > 0 {
+		params.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.User != "" {
+		params.Set("user", options.User)
+	}
+
+	path := "/operations"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	resp, err := c.get(path)
+	if err != nil {
+		return operations, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return operations, parseError(resp.Body)
+	}
+
+	maybeOperations, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(operations))
+	if err != nil {
+		return operations, err
+	}
+
+	// Convert from []interface{} to []Operation
+	operations = make([]models.Operation, 0)
+	for _, operation := range maybeOperations {
+		o := operation.(*models.Operation)
+		operations = append(operations, *o)
+	}
+
+	return operations, nil
+}
+
+// PlanInstance checks that an instance of the image could be created, and
+// returns what would be created, without creating anything
+func (c Client) PlanInstance(image models.Image, options CreateInstanceOptions) (routes.InstancePlan, error) {
+	var plan routes.InstancePlan
+	request := options.request(image)
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return plan, err
+	}
+
+	resp, err := c.post("/instances?dry_run=true", &payload)
+	if err != nil {
+		return plan, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return plan, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&plan)
+	return plan, err
+}
+
+// RenameInstance gives an instance a new name, which must not be taken by
+// another instance. If the instance has an ETag, the rename fails with
+// precondition_failed if the instance has changed since it was fetched.
+func (c Client) RenameInstance(instance models.Instance, name string) (models.Instance, error) {
+	var renamed models.Instance
+	request := routes.UpdateInstanceRequest{Name: name}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return renamed, err
+	}
+
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/instances/%d", c.url, instance.ID), &payload)
+	if err != nil {
+		return renamed, err
+	}
+	// Fail rather than overwrite a change made since the instance was fetched
+	if instance.ETag != "" {
+		req.Header.Set("If-Match", instance.ETag)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return renamed, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return renamed, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &renamed)
+	renamed.ETag = resp.Header.Get("ETag")
+	return renamed, err
+}
+
 // DestroyInstance destroys an instance
 func (c Client) DestroyInstance(instance models.Instance) error {
 	url := fmt.Sprintf("/instances/%d", instance.ID)
@@ -199,17 +598,33 @@ func (c Client) DestroyInstance(instance models.Instance) error {
 	}
 
 	if resp.StatusCode != http.StatusNoContent {
-		return parseError(resp.Body)
+		return parseResourceError(resp)
 	}
 
 	return nil
 }
 
+// DuplicateImageError is returned by CreateImage when an image of the same
+// backup already exists
+type DuplicateImageError struct {
+	ExistingID int
+}
+
+func (e DuplicateImageError) Error() string {
+	return fmt.Sprintf("image %d already exists for this backup", e.ExistingID)
+}
+
 // CreateImage creates a new image. This does not complete the process of preparing an
-// image, subsequent upload and finalisation steps are required.
-func (c Client) CreateImage(backedUpAt time.Time, anon []byte) (models.Image, error) {
+// image, subsequent upload and finalisation steps are required. Unless force is
+// set, this fails with a DuplicateImageError if the backup already has an image.
+func (c Client) CreateImage(backedUpAt time.Time, anon []byte, tags []string, defaultDatabase string, force bool) (models.Image, error) {
 	var image models.Image
-	request := routes.CreateImageRequest{BackedUpAt: backedUpAt, Anon: string(anon)}
+	request := routes.CreateImageRequest{
+		BackedUpAt:      backedUpAt,
+		Anon:            string(anon),
+		Tags:            strings.Join(tags, ","),
+		DefaultDatabase: defaultDatabase,
+	}
 
 	var payload bytes.Buffer
 	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
@@ -217,11 +632,24 @@ func (c Client) CreateImage(backedUpAt time.Time, anon []byte) (models.Image, er
 		return image, err
 	}
 
-	resp, err := c.post("/images", &payload)
+	path := "/images"
+	if force {
+		path += "?force=true"
+	}
+
+	resp, err := c.postWithProgress(path, &payload, c.uploadProgress)
 	if err != nil {
 		return image, err
 	}
 
+	if resp.StatusCode == http.StatusConflict {
+		var existingID int
+		_, scanErr := fmt.Sscanf(resp.Header.Get("Location"), "/images/%d", &existingID)
+		if scanErr == nil {
+			return image, DuplicateImageError{ExistingID: existingID}
+		}
+	}
+
 	if resp.StatusCode != http.StatusCreated {
 		return image, parseError(resp.Body)
 	}
@@ -231,24 +659,160 @@ func (c Client) CreateImage(backedUpAt time.Time, anon []byte) (models.Image, er
 }
 
 // FinaliseImage posts to images/id/done, causing draupnir to run the finalisation process
-// to anonymise and prepare the image for usage.
-func (c Client) FinaliseImage(imageID int) (models.Image, error) {
+// to anonymise and prepare the image for usage. If the server is busy
+// finalising other images, it queues this one and returns the operation
+// tracking its progress instead, in which case the image is not yet ready.
+func (c Client) FinaliseImage(imageID int) (models.Image, models.Operation, error) {
 	var image models.Image
+	var operation models.Operation
 	var emptyPayload bytes.Buffer
 
 	resp, err := c.post(fmt.Sprintf("/images/%d/done", imageID), &emptyPayload)
+	if err != nil {
+		return image, operation, err
+	}
+
+	if resp.StatusCode == http.StatusAccepted {
+		err = jsonapi.UnmarshalPayload(resp.Body, &operation)
+		return image, operation, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return image, operation, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &image)
+	return image, operation, err
+}
+
+// SetImageAnon replaces the anonymisation script of an image that hasn't been
+// finalised yet
+func (c Client) SetImageAnon(imageID int, anon []byte) (models.Image, error) {
+	var image models.Image
+	request := routes.UpdateImageRequest{Anon: string(anon)}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return image, err
+	}
+
+	resp, err := c.patch(fmt.Sprintf("/images/%d", imageID), &payload)
 	if err != nil {
 		return image, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return image, parseError(resp.Body)
+		return image, parseResourceError(resp)
 	}
 
 	err = jsonapi.UnmarshalPayload(resp.Body, &image)
 	return image, err
 }
 
+// FetchImage asks the server to download the image's backup from sourceURL
+// itself, in place of an upload. It returns the operation tracking the
+// download, after which the image still needs finalising.
+func (c Client) FetchImage(imageID int, sourceURL string) (models.Operation, error) {
+	var operation models.Operation
+	request := routes.FetchImageRequest{URL: sourceURL}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return operation, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/images/%d/fetch", imageID), &payload)
+	if err != nil {
+		return operation, err
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return operation, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &operation)
+	return operation, err
+}
+
+// PromoteImage moves the alias to the image, creating the alias if need be
+func (c Client) PromoteImage(imageID int, alias string) (models.ImageAlias, error) {
+	var imageAlias models.ImageAlias
+	request := routes.PromoteImageRequest{Alias: alias}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return imageAlias, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/images/%d/promote", imageID), &payload)
+	if err != nil {
+		return imageAlias, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return imageAlias, parseResourceError(resp)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &imageAlias)
+	return imageAlias, err
+}
+
+// GetImageAlias returns the alias with the given name
+func (c Client) GetImageAlias(name string) (models.ImageAlias, error) {
+	var imageAlias models.ImageAlias
+	resp, err := c.get("/image_aliases/" + url.PathEscape(name))
+	if err != nil {
+		return imageAlias, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return imageAlias, parseResourceError(resp)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &imageAlias)
+	return imageAlias, err
+}
+
+// GetImageByAlias returns the image that the alias was last promoted to
+func (c Client) GetImageByAlias(name string) (models.Image, error) {
+	imageAlias, err := c.GetImageAlias(name)
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	return c.GetImage(strconv.Itoa(imageAlias.ImageID))
+}
+
+// ListImageAliases returns every image alias, ordered by name
+func (c Client) ListImageAliases() ([]models.ImageAlias, error) {
+	var aliases []models.ImageAlias
+	resp, err := c.get("/image_aliases")
+	if err != nil {
+		return aliases, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return aliases, parseError(resp.Body)
+	}
+
+	maybeAliases, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(aliases))
+	if err != nil {
+		return aliases, err
+	}
+
+	// Convert from []interface{} to []ImageAlias
+	aliases = make([]models.ImageAlias, 0)
+	for _, alias := range maybeAliases {
+		a := alias.(*models.ImageAlias)
+		aliases = append(aliases, *a)
+	}
+
+	return aliases, nil
+}
+
 // DestroyImage destroys an image
 func (c Client) DestroyImage(image models.Image) error {
 	url := fmt.Sprintf("/images/%d", image.ID)
@@ -258,12 +822,178 @@ func (c Client) DestroyImage(image models.Image) error {
 	}
 
 	if resp.StatusCode != http.StatusNoContent {
-		return parseError(resp.Body)
+		return parseResourceError(resp)
 	}
 
 	return nil
 }
 
+// CheckHealth fetches the health report of the server, along with the server's
+// version. It fails if the server is down. This doesn't require the client to
+// be authenticated.
+func (c Client) CheckHealth() (routes.HealthReport, string, error) {
+	var report routes.HealthReport
+	resp, err := c.get("/health_check")
+	if err != nil {
+		return report, "", err
+	}
+	serverVersion := resp.Header.Get("Draupnir-Version")
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	if resp.StatusCode != http.StatusOK {
+		if err != nil {
+			return report, serverVersion, fmt.Errorf("health check responded with %s", resp.Status)
+		}
+		return report, serverVersion, fmt.Errorf("server is %s", report.Status)
+	}
+
+	return report, serverVersion, err
+}
+
+// GetCurrentUser returns the user that the client is authenticated as
+func (c Client) GetCurrentUser() (routes.CurrentUser, error) {
+	var user routes.CurrentUser
+	resp, err := c.get("/me")
+	if err != nil {
+		return user, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return user, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	return user, err
+}
+
+// GetServerStatus returns an operational snapshot of the server, including the
+// size of the image subvolumes if imageSizes is set. This requires the client
+// to be authenticated as an admin.
+func (c Client) GetServerStatus(imageSizes bool) (routes.ServerStatus, error) {
+	var status routes.ServerStatus
+	resp, err := c.get(fmt.Sprintf("/admin/status?image_sizes=%t", imageSizes))
+	if err != nil {
+		return status, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return status, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// GCImages reconciles image records with the subvolumes on disk, cleaning up
+// any that don't match unless dryRun is set. This requires the client to be
+// authenticated as an admin.
+func (c Client) GCImages(dryRun bool) (routes.ImageGCReport, error) {
+	var report routes.ImageGCReport
+	var emptyPayload bytes.Buffer
+
+	resp, err := c.post(fmt.Sprintf("/admin/images/gc?dry_run=%t", dryRun), &emptyPayload)
+	if err != nil {
+		return report, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return report, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	return report, err
+}
+
+// RevokeTokens invalidates every token issued to the user so far. This
+// requires the client to be authenticated as an admin.
+func (c Client) RevokeTokens(email string) (routes.TokenRevocation, error) {
+	var revocation routes.TokenRevocation
+
+	var payload bytes.Buffer
+	err := json.NewEncoder(&payload).Encode(routes.RevokeTokensRequest{Email: email})
+	if err != nil {
+		return revocation, err
+	}
+
+	resp, err := c.post("/admin/revoke", &payload)
+	if err != nil {
+		return revocation, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return revocation, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&revocation)
+	return revocation, err
+}
+
+// ListAllInstances lists the instances of every user. This requires the
+// client to be authenticated as an admin.
+func (c Client) ListAllInstances() ([]routes.InstanceSummary, error) {
+	var instances []routes.InstanceSummary
+	resp, err := c.get("/admin/instances")
+	if err != nil {
+		return instances, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		return instances, errors.New("listing the instances of all users requires admin access")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return instances, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&instances)
+	return instances, err
+}
+
+// AdoptInstance registers a clone that was started by hand as an instance.
+// This requires the client to be authenticated as an admin.
+func (c Client) AdoptInstance(request routes.AdoptInstanceRequest) (routes.InstanceSummary, error) {
+	var instance routes.InstanceSummary
+
+	var payload bytes.Buffer
+	err := json.NewEncoder(&payload).Encode(request)
+	if err != nil {
+		return instance, err
+	}
+
+	resp, err := c.post("/admin/instances/adopt", &payload)
+	if err != nil {
+		return instance, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		return instance, errors.New("adopting instances requires admin access")
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return instance, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&instance)
+	return instance, err
+}
+
+// DiffImages compares the schemas of two ready images. This requires the client
+// to be authenticated as an admin.
+func (c Client) DiffImages(from string, to string) (routes.ImageDiff, error) {
+	var diff routes.ImageDiff
+	resp, err := c.get(fmt.Sprintf("/admin/images/%s/diff/%s", from, to))
+	if err != nil {
+		return diff, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return diff, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&diff)
+	return diff, err
+}
+
 type createAccessTokenRequest struct {
 	State string `jsonapi:"attr,state"`
 }
@@ -292,10 +1022,19 @@ func (c Client) CreateAccessToken(state string) (oauth2.Token, error) {
 	return token, err
 }
 
+// Features are the opt-in server behaviours that this version of the client
+// understands, which are sent with every request in the Draupnir-Features
+// header. parseError reads both single errors and errors documents.
+var Features = []string{
+	api.FeatureErrorDocuments,
+}
+
 func (c Client) do(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", api.JSONAPIMediaType)
 	req.Header.Set("Authorization", c.authorizationHeader())
 	req.Header.Set("Draupnir-Version", version.Version)
+	req.Header.Set(api.FeaturesHeader, strings.Join(Features, ","))
+	req.Header.Set("User-Agent", c.userAgent)
 
 	return c.client.Do(req)
 }
@@ -318,6 +1057,34 @@ func (c Client) post(path string, payload *bytes.Buffer) (*http.Response, error)
 	return c.do(req)
 }
 
+// postWithProgress posts the payload, reporting progress as it is sent if
+// progress is set
+func (c Client) postWithProgress(path string, payload *bytes.Buffer, progress ProgressFunc) (*http.Response, error) {
+	if progress == nil {
+		return c.post(path, payload)
+	}
+
+	total := int64(payload.Len())
+	req, err := http.NewRequest(http.MethodPost, c.url+path, newProgressReader(payload, total, progress))
+	if err != nil {
+		return nil, err
+	}
+	// The length can't be inferred from the wrapped reader, and without it the
+	// body would be sent chunked
+	req.ContentLength = total
+
+	return c.do(req)
+}
+
+func (c Client) patch(path string, payload *bytes.Buffer) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPatch, c.url+path, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
 func (c Client) delete(path string) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodDelete, c.url+path, strings.NewReader(""))
 	if err != nil {
@@ -331,13 +1098,97 @@ func (c Client) authorizationHeader() string {
 	return fmt.Sprintf("Bearer %s", c.token.RefreshToken)
 }
 
-// parseError takes an io.Reader containing an API error response
-// and converts it to an error
+// NotFoundError is returned when the server responds that a resource doesn't
+// exist, e.g. because it has already been destroyed
+type NotFoundError struct {
+	Code    string
+	Message string
+}
+
+func (e NotFoundError) Error() string {
+	return e.Message
+}
+
+// IsNotFound returns true if err is a NotFoundError
+func IsNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+// APIError is an error rendered by the server. Its Code is one of the
+// api.Code* constants, which distinguish errors more finely than the status.
+type APIError struct {
+	Code    string
+	Message string
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+// HasCode returns true if err was rendered by the server with the code, one of
+// the api.Code* constants
+func HasCode(err error, code string) bool {
+	switch e := err.(type) {
+	case APIError:
+		return e.Code == code
+	case NotFoundError:
+		return e.Code == code
+	case DuplicateImageError:
+		return code == api.CodeDuplicateImage
+	default:
+		return false
+	}
+}
+
+// parseResourceError parses the error in a response about a particular
+// resource, returning a NotFoundError if the resource doesn't exist
+func parseResourceError(resp *http.Response) error {
+	err := parseError(resp.Body)
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		notFound := NotFoundError{Message: err.Error()}
+		if apiErr, ok := err.(APIError); ok {
+			notFound.Code = apiErr.Code
+		}
+		return notFound
+	}
+	return err
+}
+
+// parseError parses an error rendered by the server into an APIError. When
+// several errors were rendered, they are all described in the message, and
+// the code is that of the first.
 func parseError(r io.Reader) error {
-	var apiError api.Error
+	var apiError struct {
+		api.Error
+		api.Errors
+	}
 	err := json.NewDecoder(r).Decode(&apiError)
 	if err != nil {
 		return err
 	}
-	return fmt.Errorf("%s (%s)", apiError.Title, apiError.Detail)
+
+	if len(apiError.Errors.Errors) > 0 {
+		messages := make([]string, 0)
+		for _, e := range apiError.Errors.Errors {
+			messages = append(messages, fmt.Sprintf("%s (%s)", e.Title, e.Detail))
+		}
+		return APIError{
+			Code:    apiError.Errors.Errors[0].Code,
+			Message: strings.Join(messages, ", "),
+		}
+	}
+
+	message := fmt.Sprintf("%s (%s)", apiError.Title, apiError.Detail)
+	// Requests are authenticated with the refresh token, which the server
+	// exchanges for an access token itself, so a rejected token can't be
+	// refreshed by the client. It has to be replaced.
+	if apiError.Code == api.CodeUnauthorized {
+		message += ": run draupnir authenticate --force to sign in again"
+	}
+
+	return APIError{
+		Code:    apiError.Code,
+		Message: message,
+	}
 }
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// meServer responds to /me with the user, recording the request's headers
+func meServer(t *testing.T, headers *http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*headers = r.Header.Clone()
+		if r.URL.Path != "/me" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(routes.CurrentUser{Email: "test@draupnir"})
+	}))
+}
+
+func TestClientFollowsSameHostRedirects(t *testing.T) {
+	var headers http.Header
+	var redirects []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old/me", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/me", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		json.NewEncoder(w).Encode(routes.CurrentUser{Email: "test@draupnir"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := NewClient(server.URL+"/old", oauth2.Token{RefreshToken: "token"}, false, "").
+		WithRedirectReporter(func(from *url.URL, to *url.URL) {
+			redirects = append(redirects, from.Path+" -> "+to.Path)
+		})
+
+	user, err := client.GetCurrentUser()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "test@draupnir", user.Email)
+	assert.Equal(t, []string{"/old/me -> /me"}, redirects)
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"))
+	assert.Contains(t, headers, "Draupnir-Version")
+}
+
+func TestClientStripsHeadersOnCrossHostRedirects(t *testing.T) {
+	var headers http.Header
+	target := meServer(t, &headers)
+	defer target.Close()
+
+	// The servers listen on different ports, so have different hosts
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	client := NewClient(redirecting.URL, oauth2.Token{RefreshToken: "token"}, false, "")
+
+	user, err := client.GetCurrentUser()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "test@draupnir", user.Email)
+	assert.NotContains(t, headers, "Authorization")
+	assert.NotContains(t, headers, "Draupnir-Version")
+	assert.NotEmpty(t, headers.Get("User-Agent"))
+}
+
+func TestClientDoesNotFollowRedirectsOfUnsafeMethods(t *testing.T) {
+	var headers http.Header
+	target := meServer(t, &headers)
+	defer target.Close()
+
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/me", http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	client := NewClient(redirecting.URL, oauth2.Token{RefreshToken: "token"}, false, "")
+
+	_, err := client.GCImages(true)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "only GET and HEAD requests are redirected")
+	assert.Nil(t, headers)
+}
+
+func TestClientSuggestsReauthenticatingWhenUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.UnauthorizedError.Render(w, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, oauth2.Token{RefreshToken: "revoked"}, false, "")
+
+	_, err := client.GetCurrentUser()
+
+	assert.True(t, HasCode(err, api.CodeUnauthorized))
+	assert.Contains(t, err.Error(), "draupnir authenticate --force")
+}
+
+func TestClientRenamesInstancesIfUnchanged(t *testing.T) {
+	var ifMatch string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			ifMatch = r.Header.Get("If-Match")
+		}
+		w.Header().Set("ETag", `"1-1"`)
+		jsonapi.MarshalOnePayload(w, &models.Instance{ID: 1, Name: "bug-1234"})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, oauth2.Token{RefreshToken: "token"}, false, "")
+
+	instance, err := client.GetInstance("1")
+	assert.Nil(t, err)
+	assert.Equal(t, `"1-1"`, instance.ETag)
+
+	_, err = client.RenameInstance(instance, "bug-1234")
+
+	assert.Nil(t, err)
+	assert.Equal(t, `"1-1"`, ifMatch)
+}
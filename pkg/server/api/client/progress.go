@@ -0,0 +1,28 @@
+package client
+
+import "io"
+
+// ProgressFunc is called with the number of bytes of a request body that have
+// been sent so far, and the total size of the body
+type ProgressFunc func(sent int64, total int64)
+
+// progressReader wraps a request body, reporting each read to a ProgressFunc
+type progressReader struct {
+	reader   io.Reader
+	sent     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func newProgressReader(reader io.Reader, total int64, progress ProgressFunc) *progressReader {
+	return &progressReader{reader: reader, total: total, progress: progress}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.sent += int64(n)
+		r.progress(r.sent, r.total)
+	}
+	return n, err
+}
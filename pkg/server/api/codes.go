@@ -0,0 +1,30 @@
+package api
+
+// Error codes identify the kind of an Error, so that clients can tell errors
+// with the same status apart, e.g. an unready image from an invalid attribute.
+// They are part of the API: a code is never changed or reused for a different
+// error, although new codes may be added.
+const (
+	CodeBadRequest              = "bad_request"
+	CodeValidationFailed        = "validation_failed"
+	CodeUnauthorized            = "unauthorized"
+	CodeForbidden               = "forbidden"
+	CodeResourceNotFound        = "resource_not_found"
+	CodeMissingAPIVersionHeader = "missing_api_version_header"
+	CodeInvalidAPIVersion       = "invalid_api_version"
+	CodePreconditionFailed      = "precondition_failed"
+	CodeUnsupportedMediaType    = "unsupported_media_type"
+	CodeRequestTimeout          = "request_timeout"
+	CodeInternalServerError     = "internal_server_error"
+
+	CodeUnreadyImage       = "unready_image"
+	CodeImageNotCloneable  = "image_not_cloneable"
+	CodeStaleImage         = "stale_image"
+	CodeImageHasInstances  = "image_has_instances"
+	CodeDuplicateImage     = "duplicate_image"
+	CodeImageLimitReached  = "image_limit_reached"
+	CodeImageCreateTimeout = "image_create_timeout"
+	CodeAnonTimeout        = "anon_timeout"
+
+	CodeInstanceNameTaken = "instance_name_taken"
+)
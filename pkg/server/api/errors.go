@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gocardless/draupnir/pkg/version"
 )
@@ -27,9 +28,37 @@ func (e Error) Render(w http.ResponseWriter, statuscode int) {
 	json.NewEncoder(w).Encode(e)
 }
 
+// Errors is a collection of errors, rendered as a JSON:API errors document.
+// This is used when a request has several problems that should all be reported
+// at once, such as validation failures on multiple attributes.
+type Errors struct {
+	Errors []Error `json:"errors"`
+}
+
+func (e Errors) Render(w http.ResponseWriter, statuscode int) {
+	w.WriteHeader(statuscode)
+	json.NewEncoder(w).Encode(e)
+}
+
+// InvalidAttributeError describes a validation failure on a request body
+// attribute, pointing at the offending attribute so that clients can map the
+// error back to the field.
+func InvalidAttributeError(attribute string, detail string) Error {
+	return Error{
+		ID:     "validation_failed",
+		Code:   CodeValidationFailed,
+		Status: "422",
+		Title:  "Validation Failed",
+		Detail: detail,
+		Source: ErrorSource{
+			Pointer: fmt.Sprintf("/data/attributes/%s", attribute),
+		},
+	}
+}
+
 var InternalServerError = Error{
 	ID:     "internal_server_error",
-	Code:   "internal_server_error",
+	Code:   CodeInternalServerError,
 	Status: "500",
 	Title:  "Internal Server Error",
 	Detail: "Something went wrong :(",
@@ -37,7 +66,7 @@ var InternalServerError = Error{
 
 var MissingApiVersion = Error{
 	ID:     "missing_api_version_header",
-	Code:   "missing_api_version_header",
+	Code:   CodeMissingAPIVersionHeader,
 	Status: "400",
 	Title:  "Missing API Version Header",
 	Detail: "No API version specified in Draupnir-Version header",
@@ -46,7 +75,7 @@ var MissingApiVersion = Error{
 func InvalidApiVersion(v string) Error {
 	return Error{
 		ID:     "invalid_api_version",
-		Code:   "invalid_api_version",
+		Code:   CodeInvalidAPIVersion,
 		Status: "400",
 		Title:  "Invalid API Version",
 		Detail: fmt.Sprintf("Specified API version (%s) does not match server version (%s)", v, version.Version),
@@ -55,31 +84,55 @@ func InvalidApiVersion(v string) Error {
 
 var NotFoundError = Error{
 	ID:     "resource_not_found",
-	Code:   "resource_not_found",
+	Code:   CodeResourceNotFound,
 	Status: "404",
 	Title:  "Resource Not Found",
 	Detail: "The resource you requested could not be found",
 }
 
+var RequestTimeoutError = Error{
+	ID:     "request_timeout",
+	Code:   CodeRequestTimeout,
+	Status: "503",
+	Title:  "Request Timeout",
+	Detail: "The request took too long to complete",
+}
+
 var UnauthorizedError = Error{
 	ID:     "unauthorized",
-	Code:   "unauthorized",
+	Code:   CodeUnauthorized,
 	Status: "401",
 	Title:  "Unauthorized",
 	Detail: "You do not have permission to view this resource",
 }
 
+var ForbiddenError = Error{
+	ID:     "forbidden",
+	Code:   CodeForbidden,
+	Status: "403",
+	Title:  "Forbidden",
+	Detail: "You must be an admin to access this resource",
+}
+
 var ImageNotFoundError = Error{
 	ID:     "resource_not_found",
-	Code:   "resource_not_found",
+	Code:   CodeResourceNotFound,
 	Status: "404",
 	Title:  "Image Not Found",
 	Detail: "The image you specified could not be found",
 }
 
+var ImageAliasNotFoundError = Error{
+	ID:     "resource_not_found",
+	Code:   CodeResourceNotFound,
+	Status: "404",
+	Title:  "Image Alias Not Found",
+	Detail: "The image alias you specified could not be found",
+}
+
 var BadImageIDError = Error{
 	ID:     "bad_request",
-	Code:   "bad_request",
+	Code:   CodeBadRequest,
 	Status: "400",
 	Title:  "Bad Request",
 	Detail: "The image ID provided is not valid",
@@ -88,9 +141,31 @@ var BadImageIDError = Error{
 	},
 }
 
+var BadInstanceIDError = Error{
+	ID:     "bad_request",
+	Code:   CodeBadRequest,
+	Status: "400",
+	Title:  "Bad Request",
+	Detail: "The instance ID provided is not valid",
+	Source: ErrorSource{
+		Parameter: "id",
+	},
+}
+
+var BadLinesError = Error{
+	ID:     "bad_request",
+	Code:   CodeBadRequest,
+	Status: "400",
+	Title:  "Bad Request",
+	Detail: "The number of lines must be a positive number",
+	Source: ErrorSource{
+		Parameter: "lines",
+	},
+}
+
 var UnreadyImageError = Error{
 	ID:     "unprocessable_entity",
-	Code:   "unprocessable_entity",
+	Code:   CodeUnreadyImage,
 	Status: "422",
 	Title:  "Image Not Ready",
 	Detail: "The specified image is not ready to be used",
@@ -99,17 +174,125 @@ var UnreadyImageError = Error{
 	},
 }
 
+var ImageNotCloneableError = Error{
+	ID:     "unprocessable_entity",
+	Code:   CodeImageNotCloneable,
+	Status: "422",
+	Title:  "Image Not Cloneable",
+	Detail: "The specified image is being destroyed, so no more instances can be created from it",
+	Source: ErrorSource{
+		Parameter: "image_id",
+	},
+}
+
+// StaleImageError is returned when creating an instance of an image whose
+// backup is older than the maximum age, without allowing stale images
+func StaleImageError(age time.Duration, maxAge time.Duration) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   CodeStaleImage,
+		Status: "422",
+		Title:  "Image Too Old",
+		Detail: fmt.Sprintf(
+			"The image was backed up %s ago, which is older than the maximum age of %s. Set allow_stale to create an instance of it anyway",
+			formatAge(age), formatAge(maxAge),
+		),
+		Source: ErrorSource{
+			Parameter: "image_id",
+		},
+	}
+}
+
+// formatAge renders a duration in days once it is at least two days long, as
+// backups are usually that old, and to the minute otherwise
+func formatAge(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	return d.Round(time.Minute).String()
+}
+
 var CannotDeleteImageWithInstancesError = Error{
 	ID:     "unprocessable_entity",
-	Code:   "unprocessable_entity",
+	Code:   CodeImageHasInstances,
 	Status: "422",
 	Title:  "Image Has Instances",
 	Detail: "Cannot delete an image that has instances",
 }
 
+// DuplicateImageError is returned when creating an image of a backup that
+// already has one, identifying the existing image
+func DuplicateImageError(existingID int) Error {
+	return Error{
+		ID:     "duplicate_image",
+		Code:   CodeDuplicateImage,
+		Status: "409",
+		Title:  "Duplicate Image",
+		Detail: fmt.Sprintf("Image %d already exists for this backup, see /images/%d", existingID, existingID),
+		Source: ErrorSource{
+			Pointer: "/data/attributes/backed_up_at",
+		},
+	}
+}
+
+// ImageLimitReachedError is returned when creating an image would take the
+// server past its max_images
+func ImageLimitReachedError(max int) Error {
+	return Error{
+		ID:     "image_limit_reached",
+		Code:   CodeImageLimitReached,
+		Status: "507",
+		Title:  "Image Limit Reached",
+		Detail: fmt.Sprintf("The server already has its maximum of %d images, destroy old images before creating more", max),
+	}
+}
+
+var ImageCreateTimeoutError = Error{
+	ID:     "image_create_timeout",
+	Code:   CodeImageCreateTimeout,
+	Status: "503",
+	Title:  "Image Creation Timed Out",
+	Detail: "The image's storage could not be created within the server's image_create_timeout, so the image has been marked as errored",
+}
+
+var AnonTimeoutError = Error{
+	ID:     "anon_timeout",
+	Code:   CodeAnonTimeout,
+	Status: "422",
+	Title:  "Anonymisation Timed Out",
+	Detail: "The anonymisation script did not finish within the server's anon_timeout",
+}
+
+var InstanceNameTakenError = Error{
+	ID:     "instance_name_taken",
+	Code:   CodeInstanceNameTaken,
+	Status: "409",
+	Title:  "Instance Name Taken",
+	Detail: "Another instance already has this name",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/name",
+	},
+}
+
+var PreconditionFailedError = Error{
+	ID:     "precondition_failed",
+	Code:   CodePreconditionFailed,
+	Status: "412",
+	Title:  "Precondition Failed",
+	Detail: "The resource has been modified since you last fetched it",
+}
+
+var UnsupportedMediaTypeError = Error{
+	ID:     "unsupported_media_type",
+	Code:   CodeUnsupportedMediaType,
+	Status: "415",
+	Title:  "Unsupported Media Type",
+	Detail: "Request bodies must have a Content-Type of " + JSONAPIMediaType,
+}
+
 var InvalidJSONError = Error{
 	ID:     "bad_request",
-	Code:   "bad_request",
+	Code:   CodeBadRequest,
 	Status: "400",
 	Title:  "Invalid JSON",
 	Detail: "Your JSON is malformed",
@@ -117,7 +300,7 @@ var InvalidJSONError = Error{
 
 var OauthError = Error{
 	ID:     "bad_request",
-	Code:   "bad_request",
+	Code:   CodeBadRequest,
 	Status: "400",
 	Title:  "OAuth Error",
 	Detail: "There was some oauth error",
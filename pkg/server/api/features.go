@@ -0,0 +1,57 @@
+package api
+
+import (
+	"sort"
+	"strings"
+)
+
+// FeaturesHeader lists the opt-in features that a client understands,
+// separated by commas, e.g. "Draupnir-Features: error-documents". This lets
+// the server change its behaviour for the clients that expect it, without
+// breaking older clients that don't send the feature.
+const FeaturesHeader = "Draupnir-Features"
+
+// FeatureErrorDocuments renders every error as a JSON:API errors document, a
+// list under errors, rather than rendering single errors as a bare object
+const FeatureErrorDocuments = "error-documents"
+
+// KnownFeatures are the features that this server recognises. Others are
+// ignored, so that clients can send features introduced by newer servers.
+var KnownFeatures = []string{
+	FeatureErrorDocuments,
+}
+
+// Features is a set of features that a client has opted in to
+type Features map[string]bool
+
+// ParseFeatures returns the known features listed in the values of the
+// Draupnir-Features header, of which there may be several
+func ParseFeatures(values []string) Features {
+	features := Features{}
+	for _, value := range values {
+		for _, feature := range strings.Split(value, ",") {
+			feature = strings.ToLower(strings.TrimSpace(feature))
+			for _, known := range KnownFeatures {
+				if feature == known {
+					features[feature] = true
+				}
+			}
+		}
+	}
+	return features
+}
+
+// Has reports whether the client opted in to the feature
+func (f Features) Has(feature string) bool {
+	return f[feature]
+}
+
+// String lists the features in the format of the Draupnir-Features header
+func (f Features) String() string {
+	features := make([]string, 0, len(f))
+	for feature := range f {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return strings.Join(features, ",")
+}
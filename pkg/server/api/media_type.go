@@ -0,0 +1,5 @@
+package api
+
+// JSONAPIMediaType is the media type of JSON:API documents, which the API
+// accepts and returns for its resources
+const JSONAPIMediaType = "application/vnd.api+json"
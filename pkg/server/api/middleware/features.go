@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+const FeaturesKey key = 5
+
+// RecordFeatures parses the Draupnir-Features header into the request's
+// context, so that handlers can check which features the client opted in to
+// with HasFeature
+func RecordFeatures(next chain.Handler) chain.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		features := api.ParseFeatures(r.Header.Values(api.FeaturesHeader))
+		r = r.WithContext(context.WithValue(r.Context(), FeaturesKey, features))
+		return next(w, r)
+	}
+}
+
+// GetFeatures returns the features that the client opted in to. Requests that
+// weren't passed through RecordFeatures have none.
+func GetFeatures(r *http.Request) api.Features {
+	features, ok := r.Context().Value(FeaturesKey).(api.Features)
+	if !ok {
+		return api.Features{}
+	}
+	return features
+}
+
+func HasFeature(r *http.Request, feature string) bool {
+	return GetFeatures(r).Has(feature)
+}
+
+// RenderErrorDocuments rewrites errors rendered as a bare object into a
+// JSON:API errors document, for clients that opted in to the error-documents
+// feature. Other responses are passed through untouched, and are only
+// buffered for those clients.
+func RenderErrorDocuments(next chain.Handler) chain.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if !HasFeature(r, api.FeatureErrorDocuments) {
+			return next(w, r)
+		}
+
+		buffer := &bufferedResponseWriter{ResponseWriter: w}
+		err := next(buffer, r)
+		if buffer.status >= http.StatusBadRequest {
+			if document, ok := errorDocument(buffer.body.Bytes()); ok {
+				buffer.body.Reset()
+				buffer.body.Write(document)
+			}
+		}
+		buffer.flush()
+		return err
+	}
+}
+
+// errorDocument wraps a single error in an errors document. Bodies that
+// aren't a single error, including those that are already a document, are
+// left alone.
+func errorDocument(body []byte) ([]byte, bool) {
+	var single api.Error
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&single); err != nil || single.Code == "" {
+		return nil, false
+	}
+
+	document, err := json.Marshal(api.Errors{Errors: []api.Error{single}})
+	if err != nil {
+		return nil, false
+	}
+	return append(document, '\n'), true
+}
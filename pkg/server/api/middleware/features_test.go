@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordFeatures(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Add("Draupnir-Features", " Error-Documents, from-the-future")
+	req.Header.Add("Draupnir-Features", "another-unknown-feature")
+
+	var features api.Features
+	handler := RecordFeatures(func(w http.ResponseWriter, r *http.Request) error {
+		features = GetFeatures(r)
+		return nil
+	})
+
+	err := handler(httptest.NewRecorder(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, api.Features{api.FeatureErrorDocuments: true}, features)
+	assert.Equal(t, "error-documents", features.String())
+}
+
+func TestGetFeaturesWithoutRecordFeatures(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Draupnir-Features", "error-documents")
+
+	assert.False(t, HasFeature(req, api.FeatureErrorDocuments))
+}
+
+func TestRenderErrorDocuments(t *testing.T) {
+	testCases := []struct {
+		name     string
+		features string
+		status   int
+		render   func(w http.ResponseWriter)
+		expected string
+	}{
+		{
+			"without the feature, leaves single errors alone",
+			"", http.StatusNotFound,
+			func(w http.ResponseWriter) { api.ImageNotFoundError.Render(w, http.StatusNotFound) },
+			mustMarshal(t, api.ImageNotFoundError),
+		},
+		{
+			"with the feature, wraps single errors in a document",
+			"error-documents", http.StatusNotFound,
+			func(w http.ResponseWriter) { api.ImageNotFoundError.Render(w, http.StatusNotFound) },
+			mustMarshal(t, api.Errors{Errors: []api.Error{api.ImageNotFoundError}}),
+		},
+		{
+			"with the feature, leaves documents alone",
+			"error-documents", http.StatusUnprocessableEntity,
+			func(w http.ResponseWriter) {
+				api.Errors{Errors: []api.Error{api.InvalidAttributeError("alias", "is invalid")}}.
+					Render(w, http.StatusUnprocessableEntity)
+			},
+			mustMarshal(t, api.Errors{Errors: []api.Error{api.InvalidAttributeError("alias", "is invalid")}}),
+		},
+		{
+			"with the feature, leaves successful responses alone",
+			"error-documents", http.StatusOK,
+			func(w http.ResponseWriter) { w.Write([]byte(`{"code":"not_an_error"}`)) },
+			`{"code":"not_an_error"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Draupnir-Features", tc.features)
+
+			handler := RecordFeatures(RenderErrorDocuments(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "application/json")
+				tc.render(w)
+				return nil
+			}))
+
+			err := handler(recorder, req)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.status, recorder.Code)
+			assert.Equal(t, tc.expected, recorder.Body.String())
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body) + "\n"
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// CountInFlight keeps count of the number of requests that are currently being
+// served, so that it can be reported by the admin status endpoint
+func CountInFlight(counter *int64) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			atomic.AddInt64(counter, 1)
+			defer atomic.AddInt64(counter, -1)
+
+			return next(w, r)
+		}
+	}
+}
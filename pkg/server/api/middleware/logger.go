@@ -34,6 +34,7 @@ func NewRequestLogger(logger log.Logger) chain.Middleware {
 				With("headers__x_forwarded_for", r.Header.Get("X-Forwarded-For")).
 				With("headers__x_cloud_trace_context", r.Header.Get("X-Cloud-Trace-Context")).
 				With("headers__draupnir_version", r.Header.Get("Draupnir-Version")).
+				With("headers__draupnir_features", r.Header.Get("Draupnir-Features")).
 				With("headers__user_agent", r.Header.Get("User-Agent"))
 
 			// This coupling between middlewares isn't great, but it is valuable to
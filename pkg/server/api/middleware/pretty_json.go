@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// PrettyJSON indents JSON responses, so that they are readable when the API is
+// poked at with curl. Responses are indented when always is set, or when the
+// request has ?pretty=true, which takes precedence so that ?pretty=false
+// restores compact output. Other responses are passed through untouched, and
+// without being buffered.
+func PrettyJSON(always bool) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			pretty := always
+			if param, err := strconv.ParseBool(r.URL.Query().Get("pretty")); err == nil {
+				pretty = param
+			}
+			if !pretty {
+				return next(w, r)
+			}
+
+			buffer := &bufferedResponseWriter{ResponseWriter: w, indent: true}
+			err := next(buffer, r)
+			buffer.flush()
+			return err
+		}
+	}
+}
+
+// bufferedResponseWriter holds on to a response until it is flushed, so that
+// its body can be rewritten
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// indent indents JSON bodies when they are flushed
+	indent bool
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// flush writes the response, indented if it is JSON and indent is set. Bodies
+// that fail to parse are written as they are.
+func (b *bufferedResponseWriter) flush() {
+	if b.status == 0 && b.body.Len() == 0 {
+		return
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+
+	body := b.body.Bytes()
+	if b.indent && strings.Contains(b.Header().Get("Content-Type"), "json") {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			body = indented.Bytes()
+		}
+	}
+
+	b.ResponseWriter.WriteHeader(b.status)
+	b.ResponseWriter.Write(body)
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	respondsWith := func(contentType, body string) func(http.ResponseWriter, *http.Request) error {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(body))
+			return nil
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		always      bool
+		path        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			"by default, leaves JSON compact",
+			false, "/images", "application/json",
+			`{"id":1}` + "\n",
+			`{"id":1}` + "\n",
+		},
+		{
+			"with ?pretty=true, indents JSON",
+			false, "/images?pretty=true", "application/json",
+			`{"id":1,"tags":["a"]}` + "\n",
+			"{\n  \"id\": 1,\n  \"tags\": [\n    \"a\"\n  ]\n}\n",
+		},
+		{
+			"when always set, indents JSON",
+			true, "/images", "application/json",
+			`{"id":1}`,
+			"{\n  \"id\": 1\n}",
+		},
+		{
+			"when always set, ?pretty=false leaves JSON compact",
+			true, "/images?pretty=false", "application/json",
+			`{"id":1}`,
+			`{"id":1}`,
+		},
+		{
+			"leaves other content alone",
+			true, "/authenticate", "text/html",
+			`<p>{"id":1}</p>`,
+			`<p>{"id":1}</p>`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.path, nil)
+
+			err := PrettyJSON(tc.always)(respondsWith(tc.contentType, tc.body))(recorder, req)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusCreated, recorder.Code)
+			assert.Equal(t, tc.expected, recorder.Body.String())
+		})
+	}
+}
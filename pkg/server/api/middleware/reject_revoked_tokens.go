@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// RejectRevokedTokens renders 401 Unauthorized if an admin has revoked the
+// authenticated user's tokens since their token was issued. Tokens whose issue
+// wasn't recorded, e.g. because they were obtained elsewhere, are rejected
+// once the user's tokens have been revoked, as their age can't be known.
+// It must be placed after the Authenticate middleware.
+func RejectRevokedTokens(tokens store.TokenStore) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			logger, err := GetLogger(r)
+			if err != nil {
+				return err
+			}
+
+			email, err := GetAuthenticatedUser(r)
+			if err != nil {
+				return err
+			}
+
+			// The shared secret is revoked by changing it
+			if email == auth.UPLOAD_USER_EMAIL {
+				return next(w, r)
+			}
+
+			revokedAt, err := tokens.RevokedAt(email)
+			if err == sql.ErrNoRows {
+				return next(w, r)
+			}
+			if err != nil {
+				return errors.Wrap(err, "failed to check for token revocation")
+			}
+
+			refreshToken, _ := r.Context().Value(RefreshTokenKey).(string)
+			issuedAt, err := tokens.IssuedAt(refreshToken)
+			if err != nil && err != sql.ErrNoRows {
+				return errors.Wrap(err, "failed to check when token was issued")
+			}
+
+			if err == sql.ErrNoRows || !issuedAt.After(revokedAt) {
+				logger.With("email", email).Info("rejecting revoked token")
+				api.UnauthorizedError.Render(w, http.StatusUnauthorized)
+				return nil
+			}
+
+			return next(w, r)
+		}
+	}
+}
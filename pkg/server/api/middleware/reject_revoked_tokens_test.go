@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTokenStore knows of a single issued token, and a single revocation
+type fakeTokenStore struct {
+	token     string
+	issuedAt  time.Time
+	email     string
+	revokedAt time.Time
+}
+
+func (s fakeTokenStore) RecordIssued(refreshToken string, issuedAt time.Time) error {
+	return nil
+}
+
+func (s fakeTokenStore) IssuedAt(refreshToken string) (time.Time, error) {
+	if refreshToken != s.token {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return s.issuedAt, nil
+}
+
+func (s fakeTokenStore) Revoke(email string, revokedAt time.Time) error {
+	return nil
+}
+
+func (s fakeTokenStore) RevokedAt(email string) (time.Time, error) {
+	if email != s.email {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return s.revokedAt, nil
+}
+
+func TestRejectRevokedTokens(t *testing.T) {
+	revokedAt := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name   string
+		email  string
+		tokens fakeTokenStore
+		code   int
+	}{
+		{
+			"when the user's tokens were never revoked, calls handler",
+			"user@draupnir",
+			fakeTokenStore{},
+			http.StatusAccepted,
+		},
+		{
+			"when the token was issued after the revocation, calls handler",
+			"user@draupnir",
+			fakeTokenStore{"the-token", revokedAt.Add(time.Minute), "user@draupnir", revokedAt},
+			http.StatusAccepted,
+		},
+		{
+			"when the token was issued before the revocation, responds with error",
+			"user@draupnir",
+			fakeTokenStore{"the-token", revokedAt.Add(-time.Minute), "user@draupnir", revokedAt},
+			http.StatusUnauthorized,
+		},
+		{
+			"when the token's issue wasn't recorded, responds with error",
+			"user@draupnir",
+			fakeTokenStore{"another-token", revokedAt.Add(time.Minute), "user@draupnir", revokedAt},
+			http.StatusUnauthorized,
+		},
+		{
+			"when user is the upload user, calls handler",
+			auth.UPLOAD_USER_EMAIL,
+			fakeTokenStore{email: auth.UPLOAD_USER_EMAIL, revokedAt: revokedAt},
+			http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/instances", nil)
+			req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, tc.email))
+			req = req.WithContext(context.WithValue(req.Context(), RefreshTokenKey, "the-token"))
+
+			handler := RejectRevokedTokens(tc.tokens)(respondsWithStatus(http.StatusAccepted))
+			NewRequestLogger(log.NewNopLogger())(handler)(recorder, req)
+
+			assert.Equal(t, tc.code, recorder.Code)
+		})
+	}
+}
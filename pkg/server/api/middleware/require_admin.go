@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// RequireAdmin only yields to the next handler in the chain if the
+// authenticated user is an admin, otherwise it renders 403 Forbidden.
+// It must be placed after the Authenticate middleware.
+func RequireAdmin(adminEmails []string) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			email, err := GetAuthenticatedUser(r)
+			if err != nil {
+				return err
+			}
+
+			if !auth.IsAdmin(email, adminEmails) {
+				api.ForbiddenError.Render(w, http.StatusForbidden)
+				return nil
+			}
+
+			return next(w, r)
+		}
+	}
+}
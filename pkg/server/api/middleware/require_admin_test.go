@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	testCases := []struct {
+		name     string
+		email    string
+		handler  chain.Handler
+		apiError api.Error
+		code     int
+	}{
+		{
+			"when user is an admin, calls handler",
+			"admin@draupnir",
+			respondsWithStatus(http.StatusAccepted),
+			api.Error{},
+			http.StatusAccepted,
+		},
+		{
+			"when user is the upload user, responds with error",
+			auth.UPLOAD_USER_EMAIL,
+			shouldNeverBeCalled(t),
+			api.ForbiddenError,
+			http.StatusForbidden,
+		},
+		{
+			"when user is not an admin, responds with error",
+			"user@draupnir",
+			shouldNeverBeCalled(t),
+			api.ForbiddenError,
+			http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/admin/status", nil)
+			req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, tc.email))
+
+			RequireAdmin([]string{"admin@draupnir"})(tc.handler)(recorder, req)
+
+			if tc.apiError.ID != "" {
+				var response api.Error
+				err := json.NewDecoder(recorder.Body).Decode(&response)
+
+				assert.Nil(t, err, "failed to decode response into APIError")
+				assert.EqualValues(t, tc.apiError, response)
+			}
+
+			assert.Equal(t, tc.code, recorder.Code)
+		})
+	}
+}
+
+func TestRequireAdminWithUploadUserListed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/status", nil)
+	req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, auth.UPLOAD_USER_EMAIL))
+
+	RequireAdmin([]string{"admin@draupnir", auth.UPLOAD_USER_EMAIL})(respondsWithStatus(http.StatusAccepted))(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+}
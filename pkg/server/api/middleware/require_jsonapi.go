@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+// RequireJSONAPI sets the JSON:API media type on responses, and renders a 415
+// Unsupported Media Type for requests whose body has any other Content-Type.
+//
+// Clients older than minClientVersion send application/json, so their requests
+// are let through whatever their Content-Type, as are requests without a body.
+func RequireJSONAPI(minClientVersion string) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", api.JSONAPIMediaType)
+
+			if hasBody(r) && !clientOlderThan(r, minClientVersion) {
+				mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				// JSON:API forbids parameters on its media type
+				if err != nil || mediaType != api.JSONAPIMediaType || len(params) > 0 {
+					api.UnsupportedMediaTypeError.Render(w, http.StatusUnsupportedMediaType)
+					return nil
+				}
+			}
+
+			return next(w, r)
+		}
+	}
+}
+
+func hasBody(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		// A ContentLength of -1 means that the length is unknown
+		return r.ContentLength != 0
+	default:
+		return false
+	}
+}
+
+// clientOlderThan reports whether the request's Draupnir-Version is lower than
+// v. Versions that can't be parsed are never older.
+func clientOlderThan(r *http.Request, v string) bool {
+	major, minor, patch, err := version.ParseSemver(v)
+	if err != nil {
+		return false
+	}
+
+	clientMajor, clientMinor, clientPatch, err := version.ParseSemver(r.Header.Get("Draupnir-Version"))
+	if err != nil {
+		return false
+	}
+
+	if clientMajor != major {
+		return clientMajor < major
+	}
+	if clientMinor != minor {
+		return clientMinor < minor
+	}
+	return clientPatch < patch
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireJSONAPI(t *testing.T) {
+	testCases := []struct {
+		name          string
+		method        string
+		body          string
+		contentType   string
+		clientVersion string
+		code          int
+	}{
+		{
+			"when the body is JSON:API, calls handler",
+			"POST", "{}", api.JSONAPIMediaType, "5.4.0",
+			http.StatusAccepted,
+		},
+		{
+			"when the body is plain JSON, responds with error",
+			"POST", "{}", "application/json", "5.4.0",
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			"when the media type has parameters, responds with error",
+			"PATCH", "{}", api.JSONAPIMediaType + "; charset=utf-8", "5.4.0",
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			"when the Content-Type is missing, responds with error",
+			"POST", "{}", "", "5.4.0",
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			"when the client is older, calls handler",
+			"POST", "{}", "application/json", "5.3.6",
+			http.StatusAccepted,
+		},
+		{
+			"when there is no body, calls handler",
+			"POST", "", "application/json", "5.4.0",
+			http.StatusAccepted,
+		},
+		{
+			"when the request isn't mutating, calls handler",
+			"GET", "", "", "5.4.0",
+			http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "/images", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			req.Header.Set("Draupnir-Version", tc.clientVersion)
+
+			RequireJSONAPI("5.4.0")(respondsWithStatus(http.StatusAccepted))(recorder, req)
+
+			assert.Equal(t, tc.code, recorder.Code)
+			assert.Equal(t, api.JSONAPIMediaType, recorder.Header().Get("Content-Type"))
+
+			if tc.code == http.StatusUnsupportedMediaType {
+				var response api.Error
+				err := json.NewDecoder(recorder.Body).Decode(&response)
+
+				assert.Nil(t, err, "failed to decode response into APIError")
+				assert.EqualValues(t, api.UnsupportedMediaTypeError, response)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+// Timeout bounds the time taken to serve a request. If the handler has not
+// completed before the timeout elapses, the request context is cancelled (so
+// that any in-flight operations are aborted rather than leaked) and a 503
+// Service Unavailable is rendered in its place.
+//
+// As http.TimeoutHandler discards any headers set by the handler when it times
+// out, this should only be used to wrap routes that render JSON. The timeout
+// is rendered outside of the middleware chain, so it checks for the
+// error-documents feature itself.
+func Timeout(timeout time.Duration, next http.Handler) http.Handler {
+	body, _ := json.Marshal(api.RequestTimeoutError)
+	timeoutHandler := http.TimeoutHandler(next, timeout, string(body))
+
+	document, _ := json.Marshal(api.Errors{Errors: []api.Error{api.RequestTimeoutError}})
+	documentTimeoutHandler := http.TimeoutHandler(next, timeout, string(document))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if api.ParseFeatures(r.Header.Values(api.FeaturesHeader)).Has(api.FeatureErrorDocuments) {
+			documentTimeoutHandler.ServeHTTP(w, r)
+			return
+		}
+		timeoutHandler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeout(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	cancelled := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}
+
+	Timeout(10*time.Millisecond, http.HandlerFunc(handler)).ServeHTTP(recorder, req)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request context was not cancelled")
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var response api.Error
+	err := json.NewDecoder(recorder.Body).Decode(&response)
+
+	assert.Nil(t, err, "failed to decode response into APIError")
+	assert.EqualValues(t, api.RequestTimeoutError, response)
+}
+
+func TestTimeoutWithinDeadline(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	Timeout(time.Second, http.HandlerFunc(handler)).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+}
+
+func TestTimeoutWithErrorDocuments(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Draupnir-Features", "error-documents")
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+
+	Timeout(10*time.Millisecond, http.HandlerFunc(handler)).ServeHTTP(recorder, req)
+
+	var response api.Errors
+	err := json.NewDecoder(recorder.Body).Decode(&response)
+
+	assert.Nil(t, err, "failed to decode response into APIErrors")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, []api.Error{api.RequestTimeoutError}, response.Errors)
+}
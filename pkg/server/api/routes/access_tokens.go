@@ -10,6 +10,7 @@ import (
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 	"github.com/google/jsonapi"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -22,6 +23,8 @@ const OAUTH_CALLBACK_TIMEOUT = time.Minute
 type AccessTokens struct {
 	Callbacks map[string]chan OAuthCallback
 	Client    OAuthClient
+	// TokenStore records when tokens are issued, so that they can be revoked
+	TokenStore store.TokenStore
 }
 
 type OAuthCallback struct {
@@ -94,6 +97,10 @@ func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if err := a.TokenStore.RecordIssued(token.RefreshToken, time.Now()); err != nil {
+		return errors.Wrap(err, "failed to record issued token")
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(token)
 	if err != nil {
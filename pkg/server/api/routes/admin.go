@@ -0,0 +1,632 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+type Admin struct {
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	TokenStore    store.TokenStore
+	Executor      exec.Executor
+	StartedAt     time.Time
+	// AnonTimeout is the limit on how long anonymisation scripts may run for,
+	// or zero if there is none
+	AnonTimeout time.Duration
+	// MaxImages is the max_images limit, reported in the status
+	MaxImages int
+	// InFlight is the number of requests currently being served, maintained by
+	// the CountInFlight middleware
+	InFlight *int64
+	// NameTemplate names adopted instances, as for Instances.NameTemplate
+	NameTemplate *template.Template
+	// AuthCache, if set, is told to forget users whose tokens are revoked
+	AuthCache auth.CacheInvalidator
+}
+
+// ServerStatus is an operational snapshot of the server. There's no read-only
+// mode to report: the server always accepts writes.
+type ServerStatus struct {
+	Version          string     `json:"version"`
+	StartedAt        time.Time  `json:"started_at"`
+	UptimeSeconds    float64    `json:"uptime_seconds"`
+	Images           int        `json:"images"`
+	Instances        int        `json:"instances"`
+	InFlightRequests int64      `json:"in_flight_requests"`
+	Disk             DiskStatus `json:"disk"`
+	// Volumes is the usage of each data path, which Disk is the sum of
+	Volumes []DiskStatus `json:"volumes"`
+	// AnonTimeoutSeconds is the anon_timeout, or 0 if scripts may run forever
+	AnonTimeoutSeconds float64 `json:"anon_timeout_seconds"`
+	// MaxImages is the max_images limit, or 0 if there is none
+	MaxImages int `json:"max_images"`
+	// ImageSizes is only reported when asked for with ?image_sizes=true, as
+	// measuring every subvolume is slow
+	ImageSizes *ImageSizes `json:"image_sizes,omitempty"`
+}
+
+// ImageSizes compares the size of the data in every image subvolume with the
+// space it occupies after compression
+type ImageSizes struct {
+	LogicalBytes uint64 `json:"logical_bytes"`
+	DiskBytes    uint64 `json:"disk_bytes"`
+}
+
+type DiskStatus struct {
+	Path       string `json:"path,omitempty"`
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+}
+
+func (a Admin) Status(w http.ResponseWriter, r *http.Request) error {
+	images, err := a.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get images")
+	}
+
+	instances, err := a.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get instances")
+	}
+
+	usages, err := a.Executor.DiskUsage(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get disk usage")
+	}
+
+	var disk DiskStatus
+	volumes := make([]DiskStatus, 0, len(usages))
+	for _, usage := range usages {
+		volume := DiskStatus{
+			Path:       usage.Path,
+			TotalBytes: usage.TotalBytes,
+			UsedBytes:  usage.TotalBytes - usage.FreeBytes,
+			FreeBytes:  usage.FreeBytes,
+		}
+		volumes = append(volumes, volume)
+
+		disk.TotalBytes += volume.TotalBytes
+		disk.UsedBytes += volume.UsedBytes
+		disk.FreeBytes += volume.FreeBytes
+	}
+
+	status := ServerStatus{
+		Version:            version.Version,
+		StartedAt:          a.StartedAt,
+		UptimeSeconds:      time.Since(a.StartedAt).Seconds(),
+		Images:             len(images),
+		MaxImages:          a.MaxImages,
+		Instances:          len(instances),
+		InFlightRequests:   atomic.LoadInt64(a.InFlight),
+		Disk:               disk,
+		Volumes:            volumes,
+		AnonTimeoutSeconds: a.AnonTimeout.Seconds(),
+	}
+
+	if r.URL.Query().Get("image_sizes") == "true" {
+		imageVolumes, err := a.Executor.ListImageVolumes(r.Context())
+		if err != nil {
+			return errors.Wrap(err, "failed to list image volumes")
+		}
+
+		status.ImageSizes = &ImageSizes{}
+		for _, volume := range imageVolumes {
+			status.ImageSizes.LogicalBytes += volume.SizeBytes
+			status.ImageSizes.DiskBytes += volume.DiskBytes
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(status),
+		"failed to encode server status",
+	)
+}
+
+// InstanceSummary describes an instance belonging to any user, for operators
+type InstanceSummary struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	ImageID   int       `json:"image_id"`
+	UserEmail string    `json:"user_email"`
+	Hostname  string    `json:"hostname"`
+	Port      uint16    `json:"port"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the instance will be destroyed automatically, if ever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ImageBackedUpAt is when the backup of the instance's image was taken
+	ImageBackedUpAt time.Time `json:"image_backed_up_at"`
+}
+
+// ListInstances lists the instances of all users
+func (a Admin) ListInstances(w http.ResponseWriter, r *http.Request) error {
+	instances, err := a.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get instances")
+	}
+
+	summaries := make([]InstanceSummary, 0, len(instances))
+	for _, instance := range instances {
+		summary := InstanceSummary{
+			ID:              instance.ID,
+			Name:            instance.Name,
+			ImageID:         instance.ImageID,
+			UserEmail:       instance.UserEmail,
+			Hostname:        instance.Hostname,
+			Port:            instance.Port,
+			CreatedAt:       instance.CreatedAt,
+			ImageBackedUpAt: instance.ImageBackedUpAt,
+		}
+		if !instance.ExpiresAt.IsZero() {
+			expiresAt := instance.ExpiresAt
+			summary.ExpiresAt = &expiresAt
+		}
+		summaries = append(summaries, summary)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(summaries),
+		"failed to encode instances",
+	)
+}
+
+// AdoptInstanceRequest describes a clone that was started by hand, for draupnir
+// to manage as an instance
+type AdoptInstanceRequest struct {
+	ImageID int    `json:"image_id"`
+	Port    uint16 `json:"port"`
+	// Path is the subvolume that the clone is running from
+	Path string `json:"path"`
+	// UserEmail is the owner of the instance, defaulting to the admin adopting it
+	UserEmail string `json:"user_email"`
+	Name      string `json:"name"`
+}
+
+// AdoptInstance registers a clone that an operator started by hand, e.g. while
+// recovering from an incident, as an instance. Once the clone is verified to be
+// running, its subvolume is moved to where draupnir keeps instances, so that it
+// is listed and can be destroyed like any other.
+func (a Admin) AdoptInstance(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	adopter, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	var req AdoptInstanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.UserEmail == "" {
+		req.UserEmail = adopter
+	}
+
+	errs := make([]api.Error, 0)
+	if req.Port == 0 {
+		errs = append(errs, api.InvalidAttributeError("port", "port must be the port that the clone is listening on"))
+	}
+	if !filepath.IsAbs(req.Path) {
+		errs = append(errs, api.InvalidAttributeError("path", "path must be the absolute path of the clone's subvolume"))
+	}
+	if req.UserEmail == auth.UPLOAD_USER_EMAIL {
+		errs = append(errs, api.InvalidAttributeError("user_email", "user_email must be the address of a user"))
+	}
+	if req.Name != "" && !instanceNamePattern.MatchString(req.Name) {
+		errs = append(errs, invalidInstanceNameError.Errors...)
+	}
+	if len(errs) > 0 {
+		api.Errors{Errors: errs}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	image, err := a.ImageStore.Get(req.ImageID)
+	if err != nil {
+		logger.Info(err.Error())
+		api.ImageNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instances, err := a.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get instances")
+	}
+	for _, instance := range instances {
+		if instance.Port == req.Port {
+			api.Errors{Errors: []api.Error{api.InvalidAttributeError(
+				"port", "port is already used by instance "+strconv.Itoa(instance.ID),
+			)}}.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		if req.Name != "" && instance.Name == req.Name {
+			api.InstanceNameTakenError.Render(w, http.StatusConflict)
+			return nil
+		}
+	}
+
+	// The instance has no refresh token, so it is kept until it is destroyed
+	// rather than when its owner's token expires
+	instance := models.NewInstance(image, req.UserEmail, "")
+	instance.Port = req.Port
+	instance.Name = req.Name
+	if instance.Name == "" {
+		instance.Name, err = generateFreeInstanceName(a.InstanceStore, a.NameTemplate, req.UserEmail, image.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	instance, err = a.InstanceStore.Create(instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to create instance")
+	}
+
+	logger = logger.With("instance", instance.ID).With("path", req.Path).With("adopted_by", adopter)
+	if err := a.Executor.AdoptInstance(r.Context(), instance, req.Path); err != nil {
+		logger.With("error", err.Error()).Info("failed to adopt instance")
+		if err := a.InstanceStore.Destroy(instance); err != nil {
+			return errors.Wrap(err, "failed to remove instance that could not be adopted")
+		}
+
+		api.Errors{Errors: []api.Error{api.InvalidAttributeError(
+			"path", "the clone could not be adopted, see the server log for why",
+		)}}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+	logger.Info("adopted instance")
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(InstanceSummary{
+			ID:        instance.ID,
+			Name:      instance.Name,
+			ImageID:   instance.ImageID,
+			UserEmail: instance.UserEmail,
+			Hostname:  instance.Hostname,
+			Port:      instance.Port,
+			CreatedAt: instance.CreatedAt,
+		}),
+		"failed to encode instance",
+	)
+}
+
+// ImageDiff describes how the schema of one image differs from another
+type ImageDiff struct {
+	From          int         `json:"from"`
+	To            int         `json:"to"`
+	AddedTables   []string    `json:"added_tables"`
+	RemovedTables []string    `json:"removed_tables"`
+	ChangedTables []TableDiff `json:"changed_tables"`
+}
+
+type TableDiff struct {
+	Name              string       `json:"name"`
+	AddedColumns      []string     `json:"added_columns"`
+	RemovedColumns    []string     `json:"removed_columns"`
+	ChangedColumns    []ColumnDiff `json:"changed_columns"`
+	EstimatedRowsFrom int64        `json:"estimated_rows_from"`
+	EstimatedRowsTo   int64        `json:"estimated_rows_to"`
+}
+
+type ColumnDiff struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DiffImages compares the schemas of two finalised images. Each image is booted
+// in turn, so this can take a while on large images.
+func (a Admin) DiffImages(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	schemas := make([]exec.ImageSchema, 0, 2)
+	for _, param := range []string{"id", "other_id"} {
+		id, err := strconv.Atoi(mux.Vars(r)[param])
+		if err != nil {
+			logger.Info(err.Error())
+			api.NotFoundError.Render(w, http.StatusNotFound)
+			return nil
+		}
+
+		image, err := a.ImageStore.Get(id)
+		if err != nil {
+			logger.Info(err.Error())
+			api.ImageNotFoundError.Render(w, http.StatusNotFound)
+			return nil
+		}
+
+		if !image.Ready {
+			api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+
+		schema, err := a.Executor.DescribeImage(r.Context(), image)
+		if err != nil {
+			return errors.Wrapf(err, "failed to describe image %d", id)
+		}
+		schemas = append(schemas, schema)
+	}
+
+	diff := diffSchemas(schemas[0], schemas[1])
+	diff.From, _ = strconv.Atoi(mux.Vars(r)["id"])
+	diff.To, _ = strconv.Atoi(mux.Vars(r)["other_id"])
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(diff),
+		"failed to encode image diff",
+	)
+}
+
+// diffSchemas reports the tables and columns that differ between two schemas.
+// Tables whose columns match are only reported if their estimated row count
+// differs. All names are sorted so that the output is stable.
+func diffSchemas(from, to exec.ImageSchema) ImageDiff {
+	diff := ImageDiff{
+		AddedTables:   []string{},
+		RemovedTables: []string{},
+		ChangedTables: []TableDiff{},
+	}
+
+	for _, name := range tableNames(from) {
+		if _, ok := to[name]; !ok {
+			diff.RemovedTables = append(diff.RemovedTables, name)
+		}
+	}
+
+	for _, name := range tableNames(to) {
+		toTable := to[name]
+		fromTable, ok := from[name]
+		if !ok {
+			diff.AddedTables = append(diff.AddedTables, name)
+			continue
+		}
+
+		tableDiff := TableDiff{
+			Name:              name,
+			AddedColumns:      []string{},
+			RemovedColumns:    []string{},
+			ChangedColumns:    []ColumnDiff{},
+			EstimatedRowsFrom: fromTable.EstimatedRows,
+			EstimatedRowsTo:   toTable.EstimatedRows,
+		}
+
+		for _, column := range columnNames(fromTable.Columns) {
+			if _, ok := toTable.Columns[column]; !ok {
+				tableDiff.RemovedColumns = append(tableDiff.RemovedColumns, column)
+			}
+		}
+
+		for _, column := range columnNames(toTable.Columns) {
+			toType := toTable.Columns[column]
+			fromType, ok := fromTable.Columns[column]
+			if !ok {
+				tableDiff.AddedColumns = append(tableDiff.AddedColumns, column)
+			} else if fromType != toType {
+				tableDiff.ChangedColumns = append(
+					tableDiff.ChangedColumns,
+					ColumnDiff{Name: column, From: fromType, To: toType},
+				)
+			}
+		}
+
+		if len(tableDiff.AddedColumns) > 0 ||
+			len(tableDiff.RemovedColumns) > 0 ||
+			len(tableDiff.ChangedColumns) > 0 ||
+			tableDiff.EstimatedRowsFrom != tableDiff.EstimatedRowsTo {
+			diff.ChangedTables = append(diff.ChangedTables, tableDiff)
+		}
+	}
+
+	return diff
+}
+
+func tableNames(schema exec.ImageSchema) []string {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func columnNames(columns map[string]string) []string {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// imageGCGracePeriod is how old an image must be before it is considered to be
+// missing its subvolumes, as they are created after the image is recorded
+const imageGCGracePeriod = time.Hour
+
+// ImageGCReport describes the image subvolumes and records that don't match
+// up, and what was done about them
+type ImageGCReport struct {
+	DryRun bool `json:"dry_run"`
+	// OrphanedVolumes are subvolumes on disk with no image record
+	OrphanedVolumes []OrphanedImageVolume `json:"orphaned_volumes"`
+	// MissingVolumes are image records with no subvolumes on disk
+	MissingVolumes []MissingImageVolume `json:"missing_volumes"`
+	// ReclaimableBytes estimates the space used by the orphaned volumes
+	ReclaimableBytes uint64 `json:"reclaimable_bytes"`
+}
+
+type OrphanedImageVolume struct {
+	ImageID   int    `json:"image_id"`
+	DataPath  string `json:"data_path"`
+	SizeBytes uint64 `json:"size_bytes"`
+	// Error is set if the subvolumes could not be destroyed
+	Error string `json:"error,omitempty"`
+}
+
+type MissingImageVolume struct {
+	ImageID int `json:"image_id"`
+	// Error is set if the image record could not be destroyed
+	Error string `json:"error,omitempty"`
+}
+
+// GCImages reconciles image records with the subvolumes on disk. By default it
+// only reports what doesn't match up, but given ?dry_run=false it destroys
+// orphaned subvolumes, and the records of images whose subvolumes are missing.
+func (a Admin) GCImages(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	images, err := a.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get images")
+	}
+
+	volumes, err := a.Executor.ListImageVolumes(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to list image volumes")
+	}
+
+	report := ImageGCReport{
+		DryRun:          r.URL.Query().Get("dry_run") != "false",
+		OrphanedVolumes: make([]OrphanedImageVolume, 0),
+		MissingVolumes:  make([]MissingImageVolume, 0),
+	}
+
+	recorded := make(map[int]bool, len(images))
+	for _, image := range images {
+		recorded[image.ID] = true
+	}
+
+	onDisk := make(map[int]bool, len(volumes))
+	for _, volume := range volumes {
+		onDisk[volume.ImageID] = true
+		if recorded[volume.ImageID] {
+			continue
+		}
+
+		orphan := OrphanedImageVolume{
+			ImageID:   volume.ImageID,
+			DataPath:  volume.DataPath,
+			SizeBytes: volume.SizeBytes,
+		}
+		report.ReclaimableBytes += volume.SizeBytes
+
+		if !report.DryRun {
+			logger.With("image", volume.ImageID).With("path", volume.DataPath).Info("destroying orphaned image volume")
+			image := models.Image{ID: volume.ImageID, DataPath: volume.DataPath}
+			if err := a.Executor.DestroyImage(r.Context(), image); err != nil {
+				orphan.Error = err.Error()
+			}
+		}
+
+		report.OrphanedVolumes = append(report.OrphanedVolumes, orphan)
+	}
+
+	for _, image := range images {
+		if onDisk[image.ID] || time.Since(image.CreatedAt) < imageGCGracePeriod {
+			continue
+		}
+
+		missing := MissingImageVolume{ImageID: image.ID}
+
+		if !report.DryRun {
+			logger.With("image", image.ID).Info("destroying image with missing volume")
+			if err := a.ImageStore.Destroy(image); err != nil {
+				missing.Error = err.Error()
+			}
+		}
+
+		report.MissingVolumes = append(report.MissingVolumes, missing)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(report),
+		"failed to encode image gc report",
+	)
+}
+
+// RevokeTokensRequest names the user whose tokens should be revoked
+type RevokeTokensRequest struct {
+	Email string `json:"email"`
+}
+
+// TokenRevocation records that a user's tokens were revoked. Tokens issued
+// before RevokedAt are rejected.
+type TokenRevocation struct {
+	Email     string    `json:"email"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// RevokeTokens invalidates every token issued to a user so far, e.g. when they
+// leave or their token is compromised. The user must authenticate again to
+// keep using draupnir.
+func (a Admin) RevokeTokens(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	var req RevokeTokensRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.Email == "" || req.Email == auth.UPLOAD_USER_EMAIL {
+		errs := []api.Error{api.InvalidAttributeError(
+			"email", "email must be the address of a user, the shared secret is revoked by changing it",
+		)}
+		api.Errors{Errors: errs}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	revocation := TokenRevocation{Email: req.Email, RevokedAt: time.Now()}
+	if err := a.TokenStore.Revoke(revocation.Email, revocation.RevokedAt); err != nil {
+		return errors.Wrap(err, "failed to revoke tokens")
+	}
+	if a.AuthCache != nil {
+		a.AuthCache.Invalidate(revocation.Email)
+	}
+
+	revoker, _ := middleware.GetAuthenticatedUser(r)
+	logger.With("email", req.Email).With("revoked_by", revoker).Info("revoked tokens")
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(revocation),
+		"failed to encode token revocation",
+	)
+}
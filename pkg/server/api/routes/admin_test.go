@@ -0,0 +1,424 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminStatus(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/status", nil)
+
+	imageStore := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{{ID: 1}, {ID: 2}}, nil
+		},
+	}
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1}, {ID: 2}, {ID: 3}}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+			return []exec.DiskUsage{
+				{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 400},
+				{Path: "/draupnir2", TotalBytes: 500, FreeBytes: 500},
+			}, nil
+		},
+	}
+
+	inFlight := int64(1)
+	routeSet := Admin{
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		Executor:      executor,
+		StartedAt:     time.Now().Add(-time.Hour),
+		AnonTimeout:   30 * time.Minute,
+		MaxImages:     20,
+		InFlight:      &inFlight,
+	}
+	err := routeSet.Status(recorder, req)
+
+	var response ServerStatus
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, response.Images)
+	assert.Equal(t, 3, response.Instances)
+	assert.Equal(t, int64(1), response.InFlightRequests)
+	assert.Equal(t, DiskStatus{TotalBytes: 1500, UsedBytes: 600, FreeBytes: 900}, response.Disk)
+	assert.Equal(t, []DiskStatus{
+		{Path: "/draupnir", TotalBytes: 1000, UsedBytes: 600, FreeBytes: 400},
+		{Path: "/draupnir2", TotalBytes: 500, UsedBytes: 0, FreeBytes: 500},
+	}, response.Volumes)
+	assert.InDelta(t, time.Hour.Seconds(), response.UptimeSeconds, 60)
+	assert.Equal(t, float64(1800), response.AnonTimeoutSeconds)
+	assert.Equal(t, 20, response.MaxImages)
+}
+
+func TestAdminStatusWithImageSizes(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/status?image_sizes=true", nil)
+
+	executor := FakeExecutor{
+		_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+			return []exec.DiskUsage{}, nil
+		},
+		_ListImageVolumes: func(ctx context.Context) ([]exec.ImageVolume, error) {
+			return []exec.ImageVolume{
+				{DataPath: "/draupnir", ImageID: 1, SizeBytes: 1000, DiskBytes: 400},
+				{DataPath: "/draupnir", ImageID: 2, SizeBytes: 500, DiskBytes: 500},
+			}, nil
+		},
+	}
+
+	inFlight := int64(0)
+	routeSet := Admin{
+		ImageStore:    FakeImageStore{_List: func() ([]models.Image, error) { return []models.Image{}, nil }},
+		InstanceStore: FakeInstanceStore{_List: func() ([]models.Instance, error) { return []models.Instance{}, nil }},
+		Executor:      executor,
+		InFlight:      &inFlight,
+	}
+	err := routeSet.Status(recorder, req)
+
+	var response ServerStatus
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, &ImageSizes{LogicalBytes: 1500, DiskBytes: 900}, response.ImageSizes)
+}
+
+func TestAdminListInstances(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/instances", nil)
+	expiresAt := timestamp().Add(time.Hour)
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				{ID: 1, ImageID: 1, UserEmail: "test@draupnir", Port: 5432, CreatedAt: timestamp()},
+				{ID: 2, ImageID: 1, UserEmail: "otheruser@draupnir", Port: 5433, CreatedAt: timestamp(), ExpiresAt: expiresAt},
+			}, nil
+		},
+	}
+
+	err := Admin{InstanceStore: instanceStore}.ListInstances(recorder, req)
+
+	var response []InstanceSummary
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, []InstanceSummary{
+		{ID: 1, ImageID: 1, UserEmail: "test@draupnir", Port: 5432, CreatedAt: timestamp()},
+		{ID: 2, ImageID: 1, UserEmail: "otheruser@draupnir", Port: 5433, CreatedAt: timestamp(), ExpiresAt: &expiresAt},
+	}, response)
+}
+
+func TestAdminDiffImages(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/images/1/diff/2", nil)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: id, Ready: true}, nil
+		},
+	}
+
+	schemas := map[int]exec.ImageSchema{
+		1: {
+			"app.public.users": {
+				Columns:       map[string]string{"id": "integer", "email": "text", "age": "integer"},
+				EstimatedRows: 100,
+			},
+			"app.public.sessions": {
+				Columns:       map[string]string{"id": "integer"},
+				EstimatedRows: 10,
+			},
+			"app.public.events": {
+				Columns:       map[string]string{"id": "integer"},
+				EstimatedRows: 5,
+			},
+		},
+		2: {
+			"app.public.users": {
+				Columns:       map[string]string{"id": "bigint", "email": "text", "name": "text"},
+				EstimatedRows: 150,
+			},
+			"app.public.payments": {
+				Columns:       map[string]string{"id": "integer"},
+				EstimatedRows: 0,
+			},
+			"app.public.events": {
+				Columns:       map[string]string{"id": "integer"},
+				EstimatedRows: 5,
+			},
+		},
+	}
+
+	executor := FakeExecutor{
+		_DescribeImage: func(ctx context.Context, image models.Image) (exec.ImageSchema, error) {
+			return schemas[image.ID], nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Admin{ImageStore: imageStore, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/images/{id}/diff/{other_id}", errorHandler.Handle(routeSet.DiffImages))
+	router.ServeHTTP(recorder, req)
+
+	var response ImageDiff
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, ImageDiff{
+		From:          1,
+		To:            2,
+		AddedTables:   []string{"app.public.payments"},
+		RemovedTables: []string{"app.public.sessions"},
+		ChangedTables: []TableDiff{
+			{
+				Name:              "app.public.users",
+				AddedColumns:      []string{"name"},
+				RemovedColumns:    []string{"age"},
+				ChangedColumns:    []ColumnDiff{{Name: "id", From: "integer", To: "bigint"}},
+				EstimatedRowsFrom: 100,
+				EstimatedRowsTo:   150,
+			},
+		},
+	}, response)
+}
+
+func TestAdminDiffImagesWithUnreadyImage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/images/1/diff/2", nil)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: id, Ready: id == 1}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DescribeImage: func(ctx context.Context, image models.Image) (exec.ImageSchema, error) {
+			return exec.ImageSchema{}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Admin{ImageStore: imageStore, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/images/{id}/diff/{other_id}", errorHandler.Handle(routeSet.DiffImages))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.UnreadyImageError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func gcImagesFixtures(destroyedImages, destroyedVolumes *[]int) (FakeImageStore, FakeExecutor) {
+	imageStore := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				{ID: 1, CreatedAt: timestamp()},
+				{ID: 2, CreatedAt: timestamp()},
+				// Still being created, so its volume is expected to be missing
+				{ID: 4, CreatedAt: time.Now()},
+			}, nil
+		},
+		_Destroy: func(image models.Image) error {
+			*destroyedImages = append(*destroyedImages, image.ID)
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_ListImageVolumes: func(ctx context.Context) ([]exec.ImageVolume, error) {
+			return []exec.ImageVolume{
+				{DataPath: "/draupnir", ImageID: 1, Uploaded: true, Snapshotted: true, SizeBytes: 100},
+				{DataPath: "/draupnir2", ImageID: 3, Uploaded: true, SizeBytes: 50},
+			}, nil
+		},
+		_DestroyImage: func(ctx context.Context, image models.Image) error {
+			*destroyedVolumes = append(*destroyedVolumes, image.ID)
+			return nil
+		},
+	}
+
+	return imageStore, executor
+}
+
+func TestAdminGCImagesIsADryRunByDefault(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/admin/images/gc", nil)
+
+	var destroyedImages, destroyedVolumes []int
+	imageStore, executor := gcImagesFixtures(&destroyedImages, &destroyedVolumes)
+
+	err := Admin{ImageStore: imageStore, Executor: executor}.GCImages(recorder, req)
+
+	var response ImageGCReport
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, ImageGCReport{
+		DryRun:           true,
+		OrphanedVolumes:  []OrphanedImageVolume{{ImageID: 3, DataPath: "/draupnir2", SizeBytes: 50}},
+		MissingVolumes:   []MissingImageVolume{{ImageID: 2}},
+		ReclaimableBytes: 50,
+	}, response)
+	assert.Empty(t, destroyedImages)
+	assert.Empty(t, destroyedVolumes)
+}
+
+func TestAdminGCImagesCleansUp(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/admin/images/gc?dry_run=false", nil)
+
+	var destroyedImages, destroyedVolumes []int
+	imageStore, executor := gcImagesFixtures(&destroyedImages, &destroyedVolumes)
+
+	err := Admin{ImageStore: imageStore, Executor: executor}.GCImages(recorder, req)
+
+	var response ImageGCReport
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+	assert.False(t, response.DryRun)
+	assert.Equal(t, []int{2}, destroyedImages)
+	assert.Equal(t, []int{3}, destroyedVolumes)
+}
+
+func TestAdminRevokeTokens(t *testing.T) {
+	body := bytes.NewBufferString(`{"email": "leaver@draupnir"}`)
+	req, recorder, _ := createRequest(t, "POST", "/admin/revoke", body)
+
+	var revokedEmail string
+	tokenStore := FakeTokenStore{
+		_Revoke: func(email string, revokedAt time.Time) error {
+			revokedEmail = email
+			return nil
+		},
+	}
+
+	var invalidatedEmail string
+	authCache := FakeAuthCache{
+		_Invalidate: func(email string) {
+			invalidatedEmail = email
+		},
+	}
+
+	err := Admin{TokenStore: tokenStore, AuthCache: authCache}.RevokeTokens(recorder, req)
+
+	var response TokenRevocation
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, "leaver@draupnir", revokedEmail)
+	assert.Equal(t, "leaver@draupnir", invalidatedEmail)
+	assert.Equal(t, "leaver@draupnir", response.Email)
+	assert.WithinDuration(t, time.Now(), response.RevokedAt, time.Minute)
+}
+
+func TestAdminRevokeTokensOfUploadUser(t *testing.T) {
+	body := bytes.NewBufferString(`{"email": "upload"}`)
+	req, recorder, _ := createRequest(t, "POST", "/admin/revoke", body)
+
+	// Nothing is revoked, so _Revoke is not faked
+	err := Admin{TokenStore: FakeTokenStore{}}.RevokeTokens(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, "/data/attributes/email", response.Errors[0].Source.Pointer)
+}
+
+func TestAdminAdoptInstance(t *testing.T) {
+	body := bytes.NewBufferString(`{"image_id": 1, "port": 6543, "path": "/draupnir/instances/recovered", "name": "recovered"}`)
+	req, recorder, _ := createRequest(t, "POST", "/admin/instances/adopt", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: id, Ready: true, DataPath: "/draupnir"}, nil
+		},
+	}
+
+	var created models.Instance
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Port: 5432}}, nil
+		},
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			instance.ID = 2
+			created = instance
+			return instance, nil
+		},
+	}
+
+	var adoptedPath string
+	executor := FakeExecutor{
+		_AdoptInstance: func(ctx context.Context, instance models.Instance, path string) error {
+			adoptedPath = path
+			return nil
+		},
+	}
+
+	err := Admin{ImageStore: imageStore, InstanceStore: instanceStore, Executor: executor}.AdoptInstance(recorder, req)
+
+	var response InstanceSummary
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, "/draupnir/instances/recovered", adoptedPath)
+	assert.Equal(t, "test@draupnir", created.UserEmail)
+	assert.Equal(t, "", created.RefreshToken)
+	assert.Equal(t, "/draupnir", created.DataPath)
+	assert.Equal(t, 2, response.ID)
+	assert.Equal(t, "recovered", response.Name)
+	assert.Equal(t, uint16(6543), response.Port)
+}
+
+func TestAdminAdoptInstanceOnUsedPort(t *testing.T) {
+	body := bytes.NewBufferString(`{"image_id": 1, "port": 5432, "path": "/draupnir/instances/recovered"}`)
+	req, recorder, _ := createRequest(t, "POST", "/admin/instances/adopt", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: id, Ready: true}, nil
+		},
+	}
+
+	// Nothing is created or adopted, so _Create and _AdoptInstance are not faked
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Port: 5432}}, nil
+		},
+	}
+
+	err := Admin{ImageStore: imageStore, InstanceStore: instanceStore, Executor: FakeExecutor{}}.AdoptInstance(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, "/data/attributes/port", response.Errors[0].Source.Pointer)
+}
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// instanceETag returns an entity tag identifying the current state of an
+// instance. Every modification to an instance bumps its UpdatedAt, so this is
+// enough to detect concurrent changes. UpdatedAt is taken to the microsecond,
+// as postgres stores it, so that the tag is the same however the instance was
+// read.
+func instanceETag(instance models.Instance) string {
+	return fmt.Sprintf(`"%d-%d"`, instance.ID, instance.UpdatedAt.UnixMicro())
+}
+
+// ifMatch reports whether the request may modify a resource with the given
+// entity tag. If the request doesn't set the If-Match header then it is
+// unconditional, and always allowed.
+func ifMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -5,15 +5,19 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
 
+	"github.com/gocardless/draupnir/pkg/exec"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 )
 
 func NewFakeLogger() (log.Logger, *bytes.Buffer) {
@@ -23,11 +27,15 @@ func NewFakeLogger() (log.Logger, *bytes.Buffer) {
 }
 
 type FakeImageStore struct {
-	_List        func() ([]models.Image, error)
-	_Get         func(int) (models.Image, error)
-	_Create      func(models.Image) (models.Image, error)
-	_Destroy     func(models.Image) error
-	_MarkAsReady func(models.Image) (models.Image, error)
+	_List             func() ([]models.Image, error)
+	_Get              func(int) (models.Image, error)
+	_Create           func(models.Image) (models.Image, error)
+	_Destroy          func(models.Image) error
+	_MarkAsReady      func(models.Image) (models.Image, error)
+	_MarkAsErrored    func(models.Image, string) (models.Image, error)
+	_MarkAsDestroying func(models.Image) (models.Image, error)
+	_UpdateAnon       func(models.Image, string) (models.Image, error)
+	_SetSourceURL     func(models.Image, string) (models.Image, error)
 }
 
 func (s FakeImageStore) List() ([]models.Image, error) {
@@ -50,10 +58,46 @@ func (s FakeImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 	return s._MarkAsReady(image)
 }
 
+func (s FakeImageStore) MarkAsErrored(image models.Image, message string) (models.Image, error) {
+	return s._MarkAsErrored(image, message)
+}
+
+func (s FakeImageStore) MarkAsDestroying(image models.Image) (models.Image, error) {
+	return s._MarkAsDestroying(image)
+}
+
+func (s FakeImageStore) UpdateAnon(image models.Image, anon string) (models.Image, error) {
+	return s._UpdateAnon(image, anon)
+}
+
+func (s FakeImageStore) SetSourceURL(image models.Image, sourceURL string) (models.Image, error) {
+	return s._SetSourceURL(image, sourceURL)
+}
+
+type FakeImageAliasStore struct {
+	_List    func() ([]models.ImageAlias, error)
+	_Get     func(string) (models.ImageAlias, error)
+	_Promote func(models.ImageAlias) (models.ImageAlias, error)
+}
+
+func (s FakeImageAliasStore) List() ([]models.ImageAlias, error) {
+	return s._List()
+}
+
+func (s FakeImageAliasStore) Get(name string) (models.ImageAlias, error) {
+	return s._Get(name)
+}
+
+func (s FakeImageAliasStore) Promote(alias models.ImageAlias) (models.ImageAlias, error) {
+	return s._Promote(alias)
+}
+
 type FakeInstanceStore struct {
 	_Create  func(models.Instance) (models.Instance, error)
 	_List    func() ([]models.Instance, error)
 	_Get     func(int) (models.Instance, error)
+	_Rename  func(instance models.Instance, name string) (models.Instance, error)
+	_Touch   func(instance models.Instance) (models.Instance, error)
 	_Destroy func(instance models.Instance) error
 }
 
@@ -69,6 +113,14 @@ func (s FakeInstanceStore) Get(id int) (models.Instance, error) {
 	return s._Get(id)
 }
 
+func (s FakeInstanceStore) Rename(instance models.Instance, name string) (models.Instance, error) {
+	return s._Rename(instance, name)
+}
+
+func (s FakeInstanceStore) Touch(instance models.Instance) (models.Instance, error) {
+	return s._Touch(instance)
+}
+
 func (s FakeInstanceStore) Destroy(instance models.Instance) error {
 	return s._Destroy(instance)
 }
@@ -86,37 +138,195 @@ func (s FakeWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error)
 	return s._List()
 }
 
+type FakeTokenStore struct {
+	_RecordIssued func(refreshToken string, issuedAt time.Time) error
+	_IssuedAt     func(refreshToken string) (time.Time, error)
+	_Revoke       func(email string, revokedAt time.Time) error
+	_RevokedAt    func(email string) (time.Time, error)
+}
+
+func (s FakeTokenStore) RecordIssued(refreshToken string, issuedAt time.Time) error {
+	return s._RecordIssued(refreshToken, issuedAt)
+}
+
+func (s FakeTokenStore) IssuedAt(refreshToken string) (time.Time, error) {
+	return s._IssuedAt(refreshToken)
+}
+
+func (s FakeTokenStore) Revoke(email string, revokedAt time.Time) error {
+	return s._Revoke(email, revokedAt)
+}
+
+func (s FakeTokenStore) RevokedAt(email string) (time.Time, error) {
+	return s._RevokedAt(email)
+}
+
+type FakeAuthCache struct {
+	_Invalidate func(email string)
+}
+
+func (c FakeAuthCache) Invalidate(email string) {
+	c._Invalidate(email)
+}
+
+type FakeOperationStore struct {
+	_Create func(models.Operation) (models.Operation, error)
+	_Get    func(int) (models.Operation, error)
+	_List   func(store.OperationQuery) ([]models.Operation, error)
+	_Update func(models.Operation) (models.Operation, error)
+}
+
+func (s FakeOperationStore) Create(operation models.Operation) (models.Operation, error) {
+	return s._Create(operation)
+}
+
+func (s FakeOperationStore) Get(id int) (models.Operation, error) {
+	return s._Get(id)
+}
+
+func (s FakeOperationStore) List(query store.OperationQuery) ([]models.Operation, error) {
+	return s._List(query)
+}
+
+func (s FakeOperationStore) Update(operation models.Operation) (models.Operation, error) {
+	return s._Update(operation)
+}
+
+// acceptingOperationStore accepts every operation, for tests of routes that
+// record operations but aren't concerned with them
+func acceptingOperationStore() FakeOperationStore {
+	return FakeOperationStore{
+		_Create: func(operation models.Operation) (models.Operation, error) {
+			return operation, nil
+		},
+	}
+}
+
+type FakeReplicationStore struct {
+	_Create func(models.ImageReplication) (models.ImageReplication, error)
+	_List   func(int) ([]models.ImageReplication, error)
+	_Update func(models.ImageReplication) (models.ImageReplication, error)
+}
+
+func (s FakeReplicationStore) Create(replication models.ImageReplication) (models.ImageReplication, error) {
+	return s._Create(replication)
+}
+
+func (s FakeReplicationStore) List(imageID int) ([]models.ImageReplication, error) {
+	return s._List(imageID)
+}
+
+func (s FakeReplicationStore) Update(replication models.ImageReplication) (models.ImageReplication, error) {
+	return s._Update(replication)
+}
+
+type FakeReplicator struct {
+	_Replicate func(models.Image)
+}
+
+func (r FakeReplicator) Replicate(image models.Image) {
+	r._Replicate(image)
+}
+
 type FakeExecutor struct {
-	_CreateBtrfsSubvolume        func(ctx context.Context, id int) error
+	_SelectDataPath              func(ctx context.Context) (string, error)
+	_CreateBtrfsSubvolume        func(ctx context.Context, image models.Image) error
+	_FetchImage                  func(ctx context.Context, image models.Image, source *url.URL, progress func(int64)) error
 	_FinaliseImage               func(ctx context.Context, image models.Image) error
-	_CreateInstance              func(ctx context.Context, imageID int, instanceID int, port int) error
-	_RetrieveInstanceCredentials func(ctx context.Context, id int) (map[string][]byte, error)
-	_DestroyImage                func(ctx context.Context, id int) error
-	_DestroyInstance             func(ctx context.Context, id int) error
+	_CreateInstance              func(ctx context.Context, instance models.Instance) error
+	_AdoptInstance               func(ctx context.Context, instance models.Instance, path string) error
+	_RetrieveInstanceCredentials func(ctx context.Context, instance models.Instance) (map[string][]byte, error)
+	_DestroyImage                func(ctx context.Context, image models.Image) error
+	_DestroyInstance             func(ctx context.Context, instance models.Instance) error
+	_DiskUsage                   func(ctx context.Context) ([]exec.DiskUsage, error)
+	_DescribeImage               func(ctx context.Context, image models.Image) (exec.ImageSchema, error)
+	_CheckSubvolumes             func(ctx context.Context) error
+	_InstanceLogs                func(ctx context.Context, instance models.Instance, lines int) (string, error)
+	_RestartInstance             func(ctx context.Context, instance models.Instance) error
+	_SnapshotInstanceToImage     func(ctx context.Context, instance models.Instance, image models.Image) error
+	_InstanceConnections         func(ctx context.Context, instance models.Instance) (int, error)
+	_ListImageVolumes            func(ctx context.Context) ([]exec.ImageVolume, error)
+	_ImageSize                   func(ctx context.Context, image models.Image) (uint64, error)
 }
 
-func (e FakeExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
-	return e._CreateBtrfsSubvolume(ctx, id)
+func (e FakeExecutor) SelectDataPath(ctx context.Context) (string, error) {
+	return e._SelectDataPath(ctx)
+}
+
+func (e FakeExecutor) CreateBtrfsSubvolume(ctx context.Context, image models.Image) error {
+	return e._CreateBtrfsSubvolume(ctx, image)
 }
 
 func (e FakeExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
 	return e._FinaliseImage(ctx, image)
 }
 
-func (e FakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error {
-	return e._CreateInstance(ctx, imageID, instanceID, port)
+func (e FakeExecutor) CreateInstance(ctx context.Context, instance models.Instance) error {
+	return e._CreateInstance(ctx, instance)
+}
+
+func (e FakeExecutor) AdoptInstance(ctx context.Context, instance models.Instance, path string) error {
+	return e._AdoptInstance(ctx, instance, path)
+}
+
+func (e FakeExecutor) RetrieveInstanceCredentials(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+	return e._RetrieveInstanceCredentials(ctx, instance)
+}
+
+func (e FakeExecutor) DestroyImage(ctx context.Context, image models.Image) error {
+	return e._DestroyImage(ctx, image)
+}
+
+func (e FakeExecutor) DestroyInstance(ctx context.Context, instance models.Instance) error {
+	return e._DestroyInstance(ctx, instance)
+}
+
+func (e FakeExecutor) DiskUsage(ctx context.Context) ([]exec.DiskUsage, error) {
+	return e._DiskUsage(ctx)
+}
+
+func (e FakeExecutor) DescribeImage(ctx context.Context, image models.Image) (exec.ImageSchema, error) {
+	return e._DescribeImage(ctx, image)
+}
+
+func (e FakeExecutor) CheckSubvolumes(ctx context.Context) error {
+	return e._CheckSubvolumes(ctx)
+}
+
+func (e FakeExecutor) InstanceLogs(ctx context.Context, instance models.Instance, lines int) (string, error) {
+	return e._InstanceLogs(ctx, instance, lines)
+}
+
+func (e FakeExecutor) RestartInstance(ctx context.Context, instance models.Instance) error {
+	return e._RestartInstance(ctx, instance)
+}
+
+func (e FakeExecutor) SnapshotInstanceToImage(ctx context.Context, instance models.Instance, image models.Image) error {
+	return e._SnapshotInstanceToImage(ctx, instance, image)
+}
+
+func (e FakeExecutor) InstanceConnections(ctx context.Context, instance models.Instance) (int, error) {
+	return e._InstanceConnections(ctx, instance)
+}
+
+func (e FakeExecutor) FetchImage(ctx context.Context, image models.Image, source *url.URL, progress func(int64)) error {
+	return e._FetchImage(ctx, image, source, progress)
+}
+
+func (e FakeExecutor) ListImageVolumes(ctx context.Context) ([]exec.ImageVolume, error) {
+	return e._ListImageVolumes(ctx)
 }
 
-func (e FakeExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
-	return e._RetrieveInstanceCredentials(ctx, id)
+func (e FakeExecutor) ImageSize(ctx context.Context, image models.Image) (uint64, error) {
+	return e._ImageSize(ctx, image)
 }
 
-func (e FakeExecutor) DestroyImage(ctx context.Context, id int) error {
-	return e._DestroyImage(ctx, id)
+type FakePinger struct {
+	_PingContext func(ctx context.Context) error
 }
 
-func (e FakeExecutor) DestroyInstance(ctx context.Context, id int) error {
-	return e._DestroyInstance(ctx, id)
+func (p FakePinger) PingContext(ctx context.Context) error {
+	return p._PingContext(ctx)
 }
 
 type FakeErrorHandler struct {
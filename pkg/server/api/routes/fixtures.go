@@ -8,10 +8,12 @@ var listImagesFixture = jsonapi.ManyPayload{
 			Type: "images",
 			ID:   "1",
 			Attributes: map[string]interface{}{
-				"backed_up_at": "2016-01-01T12:33:44Z",
-				"created_at":   "2016-01-01T12:33:44Z",
-				"ready":        false,
-				"updated_at":   "2016-01-01T12:33:44Z",
+				"anon_line_count": float64(0),
+				"anon_size_bytes": float64(0),
+				"backed_up_at":    "2016-01-01T12:33:44Z",
+				"created_at":      "2016-01-01T12:33:44Z",
+				"ready":           false,
+				"updated_at":      "2016-01-01T12:33:44Z",
 			},
 		},
 	},
@@ -22,10 +24,12 @@ var createImageFixture = jsonapi.OnePayload{
 		Type: "images",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"backed_up_at": "2016-01-01T12:33:44Z",
-			"created_at":   "2016-01-01T12:33:44Z",
-			"ready":        false,
-			"updated_at":   "2016-01-01T12:33:44Z",
+			"anon_line_count": float64(0),
+			"anon_size_bytes": float64(0),
+			"backed_up_at":    "2016-01-01T12:33:44Z",
+			"created_at":      "2016-01-01T12:33:44Z",
+			"ready":           false,
+			"updated_at":      "2016-01-01T12:33:44Z",
 		},
 	},
 }
@@ -35,10 +39,12 @@ var doneImageFixture = jsonapi.OnePayload{
 		Type: "images",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"backed_up_at": "2016-01-01T12:33:44Z",
-			"created_at":   "2016-01-01T12:33:44Z",
-			"ready":        true,
-			"updated_at":   "2016-01-01T12:33:44Z",
+			"anon_line_count": float64(0),
+			"anon_size_bytes": float64(0),
+			"backed_up_at":    "2016-01-01T12:33:44Z",
+			"created_at":      "2016-01-01T12:33:44Z",
+			"ready":           true,
+			"updated_at":      "2016-01-01T12:33:44Z",
 		},
 	},
 }
@@ -48,10 +54,12 @@ var getImageFixture = jsonapi.OnePayload{
 		Type: "images",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"backed_up_at": "2016-01-01T12:33:44Z",
-			"created_at":   "2016-01-01T12:33:44Z",
-			"ready":        false,
-			"updated_at":   "2016-01-01T12:33:44Z",
+			"anon_line_count": float64(0),
+			"anon_size_bytes": float64(0),
+			"backed_up_at":    "2016-01-01T12:33:44Z",
+			"created_at":      "2016-01-01T12:33:44Z",
+			"ready":           false,
+			"updated_at":      "2016-01-01T12:33:44Z",
 		},
 	},
 }
@@ -61,11 +69,12 @@ var createInstanceFixture = jsonapi.OnePayload{
 		Type: "instances",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"image_id":   float64(1),
-			"hostname":   "draupnir-server.example.com",
-			"created_at": "2016-01-01T12:33:44Z",
-			"updated_at": "2016-01-01T12:33:44Z",
-			"port":       float64(0),
+			"image_id":    float64(1),
+			"image_ready": false,
+			"hostname":    "draupnir-server.example.com",
+			"created_at":  "2016-01-01T12:33:44Z",
+			"updated_at":  "2016-01-01T12:33:44Z",
+			"port":        float64(0),
 		},
 		Relationships: relationshipsFixture,
 	},
@@ -78,11 +87,13 @@ var listInstancesFixture = jsonapi.ManyPayload{
 			Type: "instances",
 			ID:   "1",
 			Attributes: map[string]interface{}{
-				"image_id":   float64(1),
-				"hostname":   "draupnir-server.example.com",
-				"created_at": "2016-01-01T12:33:44Z",
-				"port":       float64(5432),
-				"updated_at": "2016-01-01T12:33:44Z",
+				"image_id":    float64(1),
+				"image_ready": false,
+				"hostname":    "draupnir-server.example.com",
+				"created_at":  "2016-01-01T12:33:44Z",
+				"port":        float64(5432),
+				"updated_at":  "2016-01-01T12:33:44Z",
+				"user_email":  "test@draupnir",
 			},
 		},
 	},
@@ -93,11 +104,13 @@ var getInstanceFixture = jsonapi.OnePayload{
 		Type: "instances",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"image_id":   float64(1),
-			"hostname":   "draupnir-server.example.com",
-			"created_at": "2016-01-01T12:33:44Z",
-			"port":       float64(5432),
-			"updated_at": "2016-01-01T12:33:44Z",
+			"image_id":    float64(1),
+			"image_ready": false,
+			"hostname":    "draupnir-server.example.com",
+			"created_at":  "2016-01-01T12:33:44Z",
+			"port":        float64(5432),
+			"updated_at":  "2016-01-01T12:33:44Z",
+			"user_email":  "test@draupnir",
 		},
 		Relationships: relationshipsFixture,
 	},
@@ -122,3 +135,16 @@ var relationshipsFixture = map[string]interface{}{
 		},
 	},
 }
+
+var getOperationFixture = jsonapi.OnePayload{
+	Data: &jsonapi.Node{
+		Type: "operations",
+		ID:   "7",
+		Attributes: map[string]interface{}{
+			"status":      "succeeded",
+			"instance_id": float64(1),
+			"created_at":  "2016-01-01T12:33:44Z",
+			"updated_at":  "2016-01-01T12:33:44Z",
+		},
+	},
+}
@@ -1,12 +1,159 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/metrics"
+)
+
+// HealthStatus is the state of the server, or of one of its subsystems
+type HealthStatus string
+
+const (
+	// HealthOK means everything is working as expected
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded means requests are still being served, but some may fail,
+	// e.g. because the data volume is read-only or almost full
+	HealthDegraded HealthStatus = "degraded"
+	// HealthDown means requests cannot be served
+	HealthDown HealthStatus = "down"
 )
 
-func HealthCheck(w http.ResponseWriter, r *http.Request) error {
+// DefaultMinFreeDiskPercent is the percentage of each data volume that must
+// be free for the disk to be considered healthy, unless configured otherwise
+const DefaultMinFreeDiskPercent = 5
+
+// healthStatusValues are the values reported by the health status gauge
+var healthStatusValues = map[HealthStatus]float64{
+	HealthOK:       0,
+	HealthDegraded: 1,
+	HealthDown:     2,
+}
+
+// Pinger checks that a connection is alive, and is satisfied by *sql.DB
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+type Health struct {
+	Database Pinger
+	Executor exec.Executor
+	// StatusGauge is set to 0, 1 or 2 when the server is ok, degraded or down
+	StatusGauge *metrics.Gauge
+	// MinFreeDiskPercent is the percentage of each data volume that must be
+	// free for the disk to be healthy. If zero, DefaultMinFreeDiskPercent is
+	// used.
+	MinFreeDiskPercent int
+	// Draining, if set, reports whether the server is shutting down, in which
+	// case it is down, so that load balancers stop routing to it
+	Draining func() bool
+}
+
+type HealthReport struct {
+	Status     HealthStatus               `json:"status"`
+	Subsystems map[string]SubsystemHealth `json:"subsystems"`
+}
+
+type SubsystemHealth struct {
+	Status HealthStatus `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+}
+
+// LivenessReport is the response to a liveness probe
+type LivenessReport struct {
+	Status HealthStatus `json:"status"`
+}
+
+// Live reports that the process is up and serving requests. It checks no
+// dependencies, so that a failing database doesn't get the server restarted,
+// and always responds with a 200.
+func (h Health) Live(w http.ResponseWriter, r *http.Request) error {
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	return nil
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(LivenessReport{Status: HealthOK}),
+		"failed to encode liveness report",
+	)
+}
+
+// Check reports the health of the database and the data volume, for
+// readiness probes. The server is only as healthy as its least healthy
+// subsystem. Degraded servers still respond with a 200, so that they aren't
+// taken out of service, but down servers respond with a 503.
+func (h Health) Check(w http.ResponseWriter, r *http.Request) error {
+	report := HealthReport{
+		Status: HealthOK,
+		Subsystems: map[string]SubsystemHealth{
+			"database": h.checkDatabase(r.Context()),
+			"disk":     h.checkDisk(r.Context()),
+		},
+	}
+
+	if h.Draining != nil && h.Draining() {
+		report.Subsystems["server"] = SubsystemHealth{Status: HealthDown, Detail: "shutting down"}
+	}
+
+	for _, subsystem := range report.Subsystems {
+		if healthStatusValues[subsystem.Status] > healthStatusValues[report.Status] {
+			report.Status = subsystem.Status
+		}
+	}
+
+	h.StatusGauge.Set(healthStatusValues[report.Status])
+
+	if report.Status == HealthDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(report),
+		"failed to encode health report",
+	)
+}
+
+func (h Health) checkDatabase(ctx context.Context) SubsystemHealth {
+	if err := h.Database.PingContext(ctx); err != nil {
+		return SubsystemHealth{Status: HealthDown, Detail: err.Error()}
+	}
+	return SubsystemHealth{Status: HealthOK}
+}
+
+func (h Health) checkDisk(ctx context.Context) SubsystemHealth {
+	usages, err := h.Executor.DiskUsage(ctx)
+	if err != nil {
+		return SubsystemHealth{Status: HealthDown, Detail: err.Error()}
+	}
+
+	minFreePercent := h.MinFreeDiskPercent
+	if minFreePercent == 0 {
+		minFreePercent = DefaultMinFreeDiskPercent
+	}
+
+	// Running out of space fails image and instance creation, so it takes the
+	// server down, whereas a read-only volume only degrades it
+	health := SubsystemHealth{Status: HealthOK}
+	for _, usage := range usages {
+		if float64(usage.FreeBytes) < float64(usage.TotalBytes)*float64(minFreePercent)/100 {
+			return SubsystemHealth{
+				Status: HealthDown,
+				Detail: fmt.Sprintf("data volume %s is almost full", usage.Path),
+			}
+		}
+
+		if usage.ReadOnly && health.Status == HealthOK {
+			health = SubsystemHealth{
+				Status: HealthDegraded,
+				Detail: fmt.Sprintf("data volume %s is read-only", usage.Path),
+			}
+		}
+	}
+
+	return health
 }
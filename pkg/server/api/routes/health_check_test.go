@@ -1,31 +1,222 @@
 package routes
 
 import (
-	"encoding/json"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestHealthCheck(t *testing.T) {
+func TestHealthLive(t *testing.T) {
 	recorder := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/health_check", nil)
+	req, err := http.NewRequest("GET", "/healthz", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// Neither dependency is faked, as liveness mustn't check them
+	routeSet := Health{}
 	errorHandler := FakeErrorHandler{}
-	handler := http.HandlerFunc(errorHandler.Handle(HealthCheck))
+	handler := http.HandlerFunc(errorHandler.Handle(routeSet.Live))
 	handler.ServeHTTP(recorder, req)
 
-	assert.Equal(t, recorder.Code, http.StatusOK)
+	var response LivenessReport
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
 	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, LivenessReport{Status: HealthOK}, response)
+}
 
-	var response map[string]string
-	err = json.NewDecoder(recorder.Body).Decode(&response)
-	if err != nil {
-		t.Fatal(err)
+func TestHealthCheck(t *testing.T) {
+	healthyDatabase := FakePinger{
+		_PingContext: func(ctx context.Context) error { return nil },
+	}
+	healthyDisk := FakeExecutor{
+		_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+			return []exec.DiskUsage{{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 500}}, nil
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		database      FakePinger
+		executor      FakeExecutor
+		minFree       int
+		draining      bool
+		code          int
+		status        HealthStatus
+		subsystems    map[string]SubsystemHealth
+		expectedGauge float64
+	}{
+		{
+			name:     "when everything is healthy",
+			database: healthyDatabase,
+			executor: healthyDisk,
+			code:     http.StatusOK,
+			status:   HealthOK,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthOK},
+			},
+			expectedGauge: 0,
+		},
+		{
+			name:     "when the data volume is read-only",
+			database: healthyDatabase,
+			executor: FakeExecutor{
+				_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+					return []exec.DiskUsage{
+						{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 500},
+						{Path: "/draupnir2", TotalBytes: 1000, FreeBytes: 500, ReadOnly: true},
+					}, nil
+				},
+			},
+			code:   http.StatusOK,
+			status: HealthDegraded,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthDegraded, Detail: "data volume /draupnir2 is read-only"},
+			},
+			expectedGauge: 1,
+		},
+		{
+			name:     "when the data volume is almost full",
+			database: healthyDatabase,
+			executor: FakeExecutor{
+				_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+					return []exec.DiskUsage{{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 10}}, nil
+				},
+			},
+			code:   http.StatusServiceUnavailable,
+			status: HealthDown,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthDown, Detail: "data volume /draupnir is almost full"},
+			},
+			expectedGauge: 2,
+		},
+		{
+			name:     "when a data volume is almost full after a read-only one",
+			database: healthyDatabase,
+			executor: FakeExecutor{
+				_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+					return []exec.DiskUsage{
+						{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 500, ReadOnly: true},
+						{Path: "/draupnir2", TotalBytes: 1000, FreeBytes: 10},
+					}, nil
+				},
+			},
+			code:   http.StatusServiceUnavailable,
+			status: HealthDown,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthDown, Detail: "data volume /draupnir2 is almost full"},
+			},
+			expectedGauge: 2,
+		},
+		{
+			name:     "when the data volume has less free space than configured",
+			database: healthyDatabase,
+			executor: FakeExecutor{
+				_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+					return []exec.DiskUsage{{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 150}}, nil
+				},
+			},
+			minFree: 20,
+			code:    http.StatusServiceUnavailable,
+			status:  HealthDown,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthDown, Detail: "data volume /draupnir is almost full"},
+			},
+			expectedGauge: 2,
+		},
+		{
+			name:     "when the disk usage can't be read",
+			database: healthyDatabase,
+			executor: FakeExecutor{
+				_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+					return nil, errors.New("statfs failed")
+				},
+			},
+			code:   http.StatusServiceUnavailable,
+			status: HealthDown,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthDown, Detail: "statfs failed"},
+			},
+			expectedGauge: 2,
+		},
+		{
+			name:     "when the server is shutting down",
+			database: healthyDatabase,
+			executor: healthyDisk,
+			draining: true,
+			code:     http.StatusServiceUnavailable,
+			status:   HealthDown,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthOK},
+				"disk":     {Status: HealthOK},
+				"server":   {Status: HealthDown, Detail: "shutting down"},
+			},
+			expectedGauge: 2,
+		},
+		{
+			name: "when the database is unreachable",
+			database: FakePinger{
+				_PingContext: func(ctx context.Context) error { return errors.New("connection refused") },
+			},
+			executor: FakeExecutor{
+				_DiskUsage: func(ctx context.Context) ([]exec.DiskUsage, error) {
+					return []exec.DiskUsage{
+						{Path: "/draupnir", TotalBytes: 1000, FreeBytes: 500},
+						{Path: "/draupnir2", TotalBytes: 1000, FreeBytes: 500, ReadOnly: true},
+					}, nil
+				},
+			},
+			code:   http.StatusServiceUnavailable,
+			status: HealthDown,
+			subsystems: map[string]SubsystemHealth{
+				"database": {Status: HealthDown, Detail: "connection refused"},
+				"disk":     {Status: HealthDegraded, Detail: "data volume /draupnir2 is read-only"},
+			},
+			expectedGauge: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/health_check", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gauge := metrics.NewGauge("draupnir_health_status", "")
+			routeSet := Health{
+				Database:           tc.database,
+				Executor:           tc.executor,
+				StatusGauge:        gauge,
+				MinFreeDiskPercent: tc.minFree,
+				Draining:           func() bool { return tc.draining },
+			}
+			errorHandler := FakeErrorHandler{}
+			handler := http.HandlerFunc(errorHandler.Handle(routeSet.Check))
+			handler.ServeHTTP(recorder, req)
+
+			var response HealthReport
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Equal(t, tc.code, recorder.Code)
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, HealthReport{Status: tc.status, Subsystems: tc.subsystems}, response)
+			assert.Equal(t, tc.expectedGauge, gauge.Value())
+		})
 	}
-	assert.Equal(t, response, map[string]string{"status": "ok"})
 }
@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+)
+
+// ImageAliases give vetted images stable names, e.g. latest-stable, so that
+// clients can create instances of whichever image was last promoted to the
+// alias, rather than the newest
+type ImageAliases struct {
+	ImageAliasStore store.ImageAliasStore
+	ImageStore      store.ImageStore
+}
+
+// PromoteImageRequest moves an alias to an image
+type PromoteImageRequest struct {
+	Alias string `jsonapi:"attr,alias"`
+}
+
+// invalidImageAliasError is rendered when a requested alias doesn't satisfy
+// models.ValidImageAlias
+var invalidImageAliasError = api.Errors{Errors: []api.Error{api.InvalidAttributeError(
+	"alias", "alias must be at most 63 letters, numbers, dots, dashes or underscores, and start with a letter",
+)}}
+
+func (a ImageAliases) List(w http.ResponseWriter, r *http.Request) error {
+	aliases, err := a.ImageAliasStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get image aliases")
+	}
+
+	_aliases := make([]interface{}, 0)
+	for i := range aliases {
+		_aliases = append(_aliases, &aliases[i])
+	}
+
+	return errors.Wrap(
+		marshalListPayload(w, _aliases, ImageAliasListMeta{TotalCount: len(aliases)}),
+		"failed to marshal image aliases",
+	)
+}
+
+func (a ImageAliases) Get(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	alias, err := a.ImageAliasStore.Get(mux.Vars(r)["name"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.ImageAliasNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &alias),
+		"failed to marshal image alias",
+	)
+}
+
+// Promote moves an alias to the image, creating the alias if it doesn't exist,
+// and records who promoted the image. Only images that instances could be
+// created from may be promoted.
+func (a ImageAliases) Promote(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	req := PromoteImageRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if !models.ValidImageAlias(req.Alias) {
+		invalidImageAliasError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	image, err := a.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.ImageNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !image.Ready {
+		api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if !image.Cloneable() {
+		api.ImageNotCloneableError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	alias, err := a.ImageAliasStore.Promote(models.NewImageAlias(req.Alias, image.ID, email))
+	if err != nil {
+		return errors.Wrap(err, "failed to promote image")
+	}
+
+	logger.With("image", image.ID).With("alias", alias.Name).With("promoted_by", email).Info("promoted image")
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &alias),
+		"failed to marshal image alias",
+	)
+}
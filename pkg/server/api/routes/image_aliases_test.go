@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImagePromote(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &PromoteImageRequest{Alias: "latest-stable"})
+	req, recorder, _ := createRequest(t, "POST", "/images/1/promote", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: id, Ready: true}, nil
+		},
+	}
+
+	var promoted models.ImageAlias
+	aliasStore := FakeImageAliasStore{
+		_Promote: func(alias models.ImageAlias) (models.ImageAlias, error) {
+			promoted = alias
+			return alias, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAliases{ImageAliasStore: aliasStore, ImageStore: imageStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/promote", errorHandler.Handle(routeSet.Promote))
+	router.ServeHTTP(recorder, req)
+
+	var response models.ImageAlias
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "latest-stable", promoted.Name)
+	assert.Equal(t, 1, promoted.ImageID)
+	assert.Equal(t, "test@draupnir", promoted.PromotedBy)
+	assert.Equal(t, "latest-stable", response.Name)
+	assert.Equal(t, 1, response.ImageID)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImagePromoteRejectsUnreadyImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &PromoteImageRequest{Alias: "latest-stable"})
+	req, recorder, _ := createRequest(t, "POST", "/images/1/promote", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: id, Ready: false}, nil
+		},
+	}
+
+	// The alias isn't moved, so _Promote is not faked
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAliases{ImageAliasStore: FakeImageAliasStore{}, ImageStore: imageStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/promote", errorHandler.Handle(routeSet.Promote))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.UnreadyImageError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImagePromoteRejectsInvalidAlias(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &PromoteImageRequest{Alias: "42"})
+	req, recorder, _ := createRequest(t, "POST", "/images/1/promote", body)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAliases{ImageAliasStore: FakeImageAliasStore{}, ImageStore: FakeImageStore{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/promote", errorHandler.Handle(routeSet.Promote))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "/data/attributes/alias", response.Errors[0].Source.Pointer)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestGetImageAliasNotFound(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/image_aliases/latest-stable", nil)
+
+	aliasStore := FakeImageAliasStore{
+		_Get: func(name string) (models.ImageAlias, error) {
+			return models.ImageAlias{}, sql.ErrNoRows
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAliases{ImageAliasStore: aliasStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/image_aliases/{name}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.ImageAliasNotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
@@ -1,14 +1,24 @@
 package routes
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
+	"net/url"
+	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/lock"
+	"github.com/gocardless/draupnir/pkg/metrics"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
@@ -22,6 +32,38 @@ type Images struct {
 	ImageStore    store.ImageStore
 	InstanceStore store.InstanceStore
 	Executor      exec.Executor
+	// FinaliseLocks ensures that only one finalisation runs per image at a time,
+	// as concurrent finalisations would race on the image's subvolume
+	FinaliseLocks *lock.KeyedMutex
+	// FinaliseQueue bounds the number of finalisations that run at once, as
+	// they are heavy on CPU and IO. If nil, finalisations are unbounded.
+	FinaliseQueue *lock.Semaphore
+	// FinaliseQueueWait is how long a finalisation request waits for a slot in
+	// the queue before it is finalised in the background instead, responding
+	// with an operation to track it
+	FinaliseQueueWait time.Duration
+	OperationStore    store.OperationStore
+	// Compression is the btrfs compression algorithm that new images are
+	// written with, or empty to store them uncompressed
+	Compression string
+	// MaxImages is the most images that may exist at once, or zero if there
+	// is no limit
+	MaxImages int
+	// CreateTimeout limits how long creating an image's subvolume may take, or
+	// zero if there is no limit
+	CreateTimeout time.Duration
+	// CreateTimeouts, if set, counts the images whose subvolume creation
+	// timed out
+	CreateTimeouts *metrics.Counter
+	// Replicator, if set, copies images to peer servers once they're finalised
+	Replicator       Replicator
+	ReplicationStore store.ReplicationStore
+}
+
+// Replicator copies finalised images to peer draupnir servers in the
+// background, recording its progress in the ReplicationStore
+type Replicator interface {
+	Replicate(image models.Image)
 }
 
 func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
@@ -44,6 +86,15 @@ func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	// The size is informational, so failing to measure it shouldn't prevent
+	// the image from being shown
+	if image.Ready {
+		image.SizeBytes, err = i.Executor.ImageSize(r.Context(), image)
+		if err != nil {
+			logger.With("image", id).With("error", err.Error()).Info("failed to measure image size")
+		}
+	}
+
 	err = jsonapi.MarshalOnePayload(w, &image)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal payload")
@@ -59,13 +110,17 @@ func (i Images) List(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	// Build a slice of pointers to our images, because this is what jsonapi wants
-	_images := make([]*models.Image, 0)
+	_images := make([]interface{}, 0)
+	meta := ImageListMeta{TotalCount: len(images)}
 	for i := range images {
 		_images = append(_images, &images[i])
+		if images[i].Ready {
+			meta.ReadyCount++
+		}
 	}
 
 	return errors.Wrap(
-		jsonapi.MarshalManyPayload(w, _images),
+		marshalListPayload(w, _images, meta),
 		"failed to marshal images",
 	)
 }
@@ -73,6 +128,52 @@ func (i Images) List(w http.ResponseWriter, r *http.Request) error {
 type CreateImageRequest struct {
 	BackedUpAt time.Time `jsonapi:"attr,backed_up_at,iso8601"`
 	Anon       string    `jsonapi:"attr,anonymisation_script"`
+	Tags       string    `jsonapi:"attr,tags,omitempty"`
+	// DefaultDatabase is the database that clients should connect to by default
+	DefaultDatabase string `jsonapi:"attr,default_database,omitempty"`
+}
+
+// databaseNamePattern matches the database names that can safely be rendered
+// into connection commands
+var databaseNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$-]{0,62}$`)
+
+// Validate returns an error for each attribute of the request that is invalid
+func (r CreateImageRequest) Validate() []api.Error {
+	errs := make([]api.Error, 0)
+
+	if r.BackedUpAt.IsZero() {
+		errs = append(errs, api.InvalidAttributeError("backed_up_at", "backed_up_at must be set"))
+	}
+
+	if strings.TrimSpace(r.Anon) == "" {
+		errs = append(errs, api.InvalidAttributeError("anonymisation_script", "anonymisation_script must not be empty"))
+	}
+
+	if _, err := models.ParseTags(r.Tags); err != nil {
+		errs = append(errs, api.InvalidAttributeError("tags", err.Error()))
+	}
+
+	if r.DefaultDatabase != "" && !databaseNamePattern.MatchString(r.DefaultDatabase) {
+		errs = append(errs, api.InvalidAttributeError(
+			"default_database",
+			"default_database must be at most 63 letters, digits, underscores, dollar signs or hyphens, and start with a letter or underscore",
+		))
+	}
+
+	return errs
+}
+
+// countLiveImages counts the images that count towards max_images. Images
+// being destroyed or that failed to finalise are on their way out, so they
+// mustn't block new ones.
+func countLiveImages(images []models.Image) int {
+	live := 0
+	for _, image := range images {
+		if !image.Destroying && image.Error == "" {
+			live++
+		}
+	}
+	return live
 }
 
 func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
@@ -88,14 +189,85 @@ func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	image := models.NewImage(req.BackedUpAt, req.Anon)
+	if errs := req.Validate(); len(errs) > 0 {
+		api.Errors{Errors: errs}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	if !force || i.MaxImages > 0 {
+		images, err := i.ImageStore.List()
+		if err != nil {
+			return errors.Wrap(err, "failed to get images")
+		}
+
+		// Registering the same backup twice is almost always a mistake, so
+		// require the caller to be explicit about it
+		if !force {
+			for _, image := range images {
+				if image.BackedUpAt.Equal(req.BackedUpAt) && image.Tags == req.Tags {
+					w.Header().Set("Location", fmt.Sprintf("/images/%d", image.ID))
+					api.DuplicateImageError(image.ID).Render(w, http.StatusConflict)
+					return nil
+				}
+			}
+		}
+
+		// The limit can't be forced past, as it protects the host's disk
+		if live := countLiveImages(images); i.MaxImages > 0 && live >= i.MaxImages {
+			logger.With("images", live).With("max_images", i.MaxImages).Info("image limit reached")
+			api.ImageLimitReachedError(i.MaxImages).Render(w, http.StatusInsufficientStorage)
+			return nil
+		}
+	}
+
+	dataPath, err := i.Executor.SelectDataPath(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to select data path")
+	}
+
+	image := models.NewImage(req.BackedUpAt, req.Anon, dataPath)
+	image.Tags = req.Tags
+	image.DefaultDatabase = req.DefaultDatabase
+	image.Compression = i.Compression
 	image, err = i.ImageStore.Create(image)
 	if err != nil {
 		return errors.Wrap(err, "failed to create new image")
 	}
 
-	if err := i.Executor.CreateBtrfsSubvolume(r.Context(), image.ID); err != nil {
-		return errors.Wrap(err, "failed to create btrfs subvolume")
+	// A degraded disk can make creating the subvolume hang, so it is given a
+	// budget rather than holding the request until the upload timeout
+	ctx := r.Context()
+	if i.CreateTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.CreateTimeout)
+		defer cancel()
+	}
+
+	if err := i.Executor.CreateBtrfsSubvolume(ctx, image); err != nil {
+		if ctx.Err() != context.DeadlineExceeded || r.Context().Err() != nil {
+			return errors.Wrap(err, "failed to create btrfs subvolume")
+		}
+
+		logger.With("image", image.ID).With("timeout", i.CreateTimeout).Info("Creating subvolume timed out")
+		if i.CreateTimeouts != nil {
+			i.CreateTimeouts.Inc()
+		}
+
+		if _, err := i.ImageStore.MarkAsErrored(image, "subvolume creation timed out"); err != nil {
+			return errors.Wrap(err, "failed to mark image as errored")
+		}
+
+		// Cleaning up may be as slow as creating was, so it isn't waited for
+		go func(image models.Image) {
+			ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+			if err := i.Executor.DestroyImage(ctx, image); err != nil {
+				logger.With("image", image.ID).With("error", err.Error()).Error("Failed to clean up image subvolume")
+			}
+		}(image)
+
+		api.ImageCreateTimeoutError.Render(w, http.StatusServiceUnavailable)
+		return nil
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -119,6 +291,11 @@ func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	// Fetch the image once we hold the lock, so that if another finalisation
+	// was in progress we will see that it has completed.
+	unlock := i.FinaliseLocks.Lock(id)
+	defer unlock()
+
 	image, err := i.ImageStore.Get(id)
 	if err != nil {
 		logger.Info(err.Error())
@@ -127,14 +304,34 @@ func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if !image.Ready {
-		err = i.Executor.FinaliseImage(r.Context(), image)
+		if i.FinaliseQueue != nil {
+			release, ok := i.FinaliseQueue.AcquireWithin(i.FinaliseQueueWait)
+			if !ok {
+				return i.finaliseAsync(w, r, image)
+			}
+			defer release()
+		}
+
+		email, err := middleware.GetAuthenticatedUser(r)
 		if err != nil {
-			return errors.Wrap(err, "failed to finalise image")
+			return err
 		}
+		operation := models.NewOperation(email, models.OperationFinaliseImage)
+		operation.ImageID = image.ID
 
-		image, err = i.ImageStore.MarkAsReady(image)
+		image, err = i.finalise(r.Context(), image)
+		failure := "failed to finalise image"
+		if err == exec.ErrAnonTimeout {
+			failure = err.Error()
+		}
+		recordOperation(logger, i.OperationStore, operation, err, failure)
+
+		if err == exec.ErrAnonTimeout {
+			api.AnonTimeoutError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
 		if err != nil {
-			return errors.Wrap(err, "failed to mark image as ready")
+			return err
 		}
 	}
 
@@ -146,6 +343,370 @@ func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
 	)
 }
 
+// finaliseAsync responds with an operation straight away, and finalises the
+// image once there is room in the queue, recording the outcome on the operation
+func (i Images) finaliseAsync(w http.ResponseWriter, r *http.Request, image models.Image) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	operation := models.NewOperation(email, models.OperationFinaliseImage)
+	operation.ImageID = image.ID
+	operation, err = i.OperationStore.Create(operation)
+	if err != nil {
+		return errors.Wrap(err, "failed to create operation")
+	}
+
+	logger = logger.With("operation", operation.ID).With("image", image.ID)
+	logger.Info("Finalisation queue is full, finalising in the background")
+
+	go func() {
+		// The request's context is cancelled as soon as we respond, so finalise
+		// the image with a fresh one
+		ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+		release := i.FinaliseQueue.Acquire()
+		defer release()
+
+		// Another request may have finalised the image while we were queued
+		unlock := i.FinaliseLocks.Lock(image.ID)
+		defer unlock()
+
+		image, err := i.ImageStore.Get(image.ID)
+		if err == nil && !image.Ready {
+			_, err = i.finalise(ctx, image)
+		}
+
+		if err != nil {
+			logger.With("error", err.Error()).Error("Failed to finalise image asynchronously")
+			operation.Status = models.OperationFailed
+			operation.Error = "failed to finalise image"
+			if err == exec.ErrAnonTimeout {
+				operation.Error = err.Error()
+			}
+		} else {
+			operation.Status = models.OperationSucceeded
+		}
+
+		if _, err := i.OperationStore.Update(operation); err != nil {
+			logger.With("error", err.Error()).Error("Failed to record outcome of operation")
+		}
+	}()
+
+	w.Header().Set("Location", fmt.Sprintf("/operations/%d", operation.ID))
+	w.WriteHeader(http.StatusAccepted)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &operation),
+		"failed to marshal operation",
+	)
+}
+
+// FetchImageRequest asks the server to download an image's backup itself,
+// rather than it being uploaded
+type FetchImageRequest struct {
+	URL string `jsonapi:"attr,url"`
+}
+
+// fetchSchemes are the URL schemes that draupnir-fetch-image can download from
+var fetchSchemes = map[string]bool{"s3": true, "gs": true, "https": true}
+
+// Validate returns an error for each attribute of the request that is invalid
+func (r FetchImageRequest) Validate() []api.Error {
+	errs := make([]api.Error, 0)
+
+	source, err := url.Parse(r.URL)
+	if err != nil || !fetchSchemes[source.Scheme] || source.Host == "" {
+		errs = append(errs, api.InvalidAttributeError("url", "url must be an s3://, gs:// or https:// URL"))
+	} else if !strings.Contains(path.Base(source.Path), ".tar") {
+		errs = append(errs, api.InvalidAttributeError("url", "url must point to a tarball, e.g. base.tar.gz"))
+	}
+
+	return errs
+}
+
+// fetchProgressInterval is how often the progress of a fetch is recorded on
+// its operation
+const fetchProgressInterval = 5 * time.Second
+
+// Fetch downloads the image's backup from the given URL in the background,
+// responding with an operation that tracks the download. The image is then
+// finalised as usual.
+func (i Images) Fetch(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if image.Ready {
+		api.Errors{Errors: []api.Error{api.InvalidAttributeError(
+			"url", "the image has already been finalised",
+		)}}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	req := FetchImageRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		api.Errors{Errors: errs}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+	source, _ := url.Parse(req.URL)
+
+	operation := models.NewOperation(email, models.OperationFetchImage)
+	operation.ImageID = image.ID
+	operation, err = i.OperationStore.Create(operation)
+	if err != nil {
+		return errors.Wrap(err, "failed to create operation")
+	}
+
+	logger = logger.With("operation", operation.ID).With("image", image.ID)
+	logger.Info("Fetching image backup in the background")
+
+	go func() {
+		// The request's context is cancelled as soon as we respond, so fetch the
+		// backup with a fresh one
+		ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+		// Hold the finalise lock, so that the image isn't finalised before the
+		// backup has been fetched
+		unlock := i.FinaliseLocks.Lock(image.ID)
+		defer unlock()
+
+		var transferred int64
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(fetchProgressInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					progress := operation
+					progress.BytesTransferred = atomic.LoadInt64(&transferred)
+					if _, err := i.OperationStore.Update(progress); err != nil {
+						logger.With("error", err.Error()).Error("Failed to record progress of operation")
+					}
+				}
+			}
+		}()
+
+		err := i.Executor.FetchImage(ctx, image, source, func(n int64) {
+			atomic.StoreInt64(&transferred, n)
+		})
+		close(done)
+
+		operation.BytesTransferred = atomic.LoadInt64(&transferred)
+		if err != nil {
+			logger.With("error", err.Error()).Error("Failed to fetch image backup")
+			operation.Status = models.OperationFailed
+			operation.Error = "failed to fetch backup"
+		} else {
+			operation.Status = models.OperationSucceeded
+
+			// Peers fetch the backup from the same URL when the image is
+			// replicated
+			if _, err := i.ImageStore.SetSourceURL(image, req.URL); err != nil {
+				logger.With("error", err.Error()).Error("Failed to record source of image backup")
+			}
+		}
+
+		if _, err := i.OperationStore.Update(operation); err != nil {
+			logger.With("error", err.Error()).Error("Failed to record outcome of operation")
+		}
+	}()
+
+	w.Header().Set("Location", fmt.Sprintf("/operations/%d", operation.ID))
+	w.WriteHeader(http.StatusAccepted)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &operation),
+		"failed to marshal operation",
+	)
+}
+
+// Replications lists the progress of copying the image to each peer server
+func (i Images) Replications(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	replications, err := i.ReplicationStore.List(image.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to list replications")
+	}
+
+	// Build a slice of pointers to our replications, because this is what
+	// jsonapi wants
+	_replications := make([]interface{}, 0)
+	for j := range replications {
+		_replications = append(_replications, &replications[j])
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, _replications),
+		"failed to marshal replications",
+	)
+}
+
+// finalise runs the anonymisation script against the image and snapshots it,
+// marking it as ready. If the script times out the image is marked as errored,
+// and exec.ErrAnonTimeout is returned. The caller must hold the image's
+// finalise lock.
+func (i Images) finalise(ctx context.Context, image models.Image) (models.Image, error) {
+	err := i.Executor.FinaliseImage(ctx, image)
+	if err == exec.ErrAnonTimeout {
+		exec.GetLogger(ctx).With("image", image.ID).Info("Anonymisation script timed out")
+		if _, err := i.ImageStore.MarkAsErrored(image, err.Error()); err != nil {
+			return image, errors.Wrap(err, "failed to mark image as errored")
+		}
+		return image, err
+	}
+	if err != nil {
+		return image, errors.Wrap(err, "failed to finalise image")
+	}
+
+	image, err = i.ImageStore.MarkAsReady(image)
+	if err != nil {
+		return image, errors.Wrap(err, "failed to mark image as ready")
+	}
+
+	if i.Replicator != nil {
+		i.Replicator.Replicate(image)
+	}
+	return image, nil
+}
+
+// UpdateImageRequest changes an image that hasn't been finalised yet. Only its
+// anonymisation script may be changed.
+type UpdateImageRequest struct {
+	Anon string `jsonapi:"attr,anonymisation_script"`
+}
+
+// Validate returns an error for each attribute of the request that is invalid
+func (r UpdateImageRequest) Validate() []api.Error {
+	errs := make([]api.Error, 0)
+
+	if strings.TrimSpace(r.Anon) == "" || !utf8.ValidString(r.Anon) {
+		errs = append(errs, api.InvalidAttributeError("anonymisation_script", "anonymisation_script must be non-empty SQL"))
+	}
+
+	return errs
+}
+
+// imageAlreadyFinalisedError is rendered when changing the anonymisation
+// script of an image that has been finalised, as the script has already run
+var imageAlreadyFinalisedError = api.Errors{Errors: []api.Error{api.InvalidAttributeError(
+	"anonymisation_script", "the image has already been finalised, create a new image to change its script",
+)}}
+
+// Update replaces the anonymisation script of an image that hasn't been
+// finalised, so that a script can be corrected without uploading the backup
+// again
+func (i Images) Update(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	req := UpdateImageRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		api.Errors{Errors: errs}.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	// Wait for any finalisation in progress, which may be running the current
+	// script, and then check whether it made the image ready
+	unlock := i.FinaliseLocks.Lock(id)
+	defer unlock()
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if image.Ready {
+		imageAlreadyFinalisedError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	image, err = i.ImageStore.UpdateAnon(image, req.Anon)
+	if err == sql.ErrNoRows {
+		imageAlreadyFinalisedError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to update anonymisation script")
+	}
+
+	logger.With("image", image.ID).With("anon_size_bytes", image.AnonSizeBytes).Info("Updated anonymisation script")
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &image),
+		"failed to marshal image",
+	)
+}
+
 func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 	logger, err := middleware.GetLogger(r)
 	if err != nil {
@@ -165,6 +726,13 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	image, err := i.ImageStore.Get(id)
+	if err == sql.ErrNoRows {
+		// Destroying is idempotent, so that it can be retried if the response
+		// to an earlier attempt was lost
+		logger.With("image", id).Info("image already destroyed")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
 	if err != nil {
 		logger.Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
@@ -172,6 +740,13 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if email == auth.UPLOAD_USER_EMAIL {
+		// Stop instances being created from the image while the existing ones
+		// are destroyed
+		image, err = i.ImageStore.MarkAsDestroying(image)
+		if err != nil {
+			return errors.Wrap(err, "failed to mark image as destroying")
+		}
+
 		// Destroy all instances of this image, if there are any
 		instances, err := i.InstanceStore.List()
 		for _, instance := range instances {
@@ -181,7 +756,7 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 			logger.With("instance", instance.ID).Info("destroying instance")
 			err = i.InstanceStore.Destroy(instance)
 			if err == nil {
-				err = i.Executor.DestroyInstance(r.Context(), instance.ID)
+				err = i.Executor.DestroyInstance(r.Context(), instance)
 			}
 			if err != nil {
 				return errors.Wrap(err, "failed to destroy instance")
@@ -202,7 +777,7 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return errors.Wrap(err, "failed to destroy image")
 	}
 
-	err = i.Executor.DestroyImage(r.Context(), id)
+	err = i.Executor.DestroyImage(r.Context(), image)
 	if err != nil {
 		return errors.Wrap(err, "failed to destroy image")
 	}
@@ -3,12 +3,20 @@ package routes
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/lock"
+	"github.com/gocardless/draupnir/pkg/metrics"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
@@ -56,6 +64,65 @@ func TestGetImage(t *testing.T) {
 	assert.Nil(t, errorHandler.Error)
 }
 
+func TestGetReadyImageReportsSize(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_ImageSize: func(ctx context.Context, image models.Image) (uint64, error) {
+			assert.Equal(t, 1, image.ID)
+			return 5368709120, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, float64(5368709120), response.Data.Attributes["size_bytes"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestGetImageWhenSizeCannotBeMeasured(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_ImageSize: func(ctx context.Context, image models.Image) (uint64, error) {
+			return 0, errors.New("du failed")
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, response.Data.Attributes, "size_bytes")
+	assert.Nil(t, errorHandler.Error)
+}
+
 func TestListImages(t *testing.T) {
 	req, recorder, _ := createRequest(t, "GET", "/images", nil)
 
@@ -84,6 +151,27 @@ func TestListImages(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestListImagesIncludesCounts(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images", nil)
+
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{{ID: 1, Ready: true}, {ID: 2, Ready: false}, {ID: 3, Ready: true}}, nil
+		},
+	}
+
+	err := Images{ImageStore: store}.List(recorder, req)
+
+	var response struct {
+		Meta ImageListMeta `json:"meta"`
+	}
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, ImageListMeta{TotalCount: 3, ReadyCount: 2}, response.Meta)
+	assert.Nil(t, err)
+}
+
 func TestCreateImage(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := CreateImageRequest{
@@ -94,12 +182,20 @@ func TestCreateImage(t *testing.T) {
 	req, recorder, _ := createRequest(t, "POST", "/images", body)
 
 	executor := FakeExecutor{
-		_CreateBtrfsSubvolume: func(ctx context.Context, id int) error { assert.Equal(t, id, 1); return nil },
+		_SelectDataPath: func(ctx context.Context) (string, error) { return "/draupnir", nil },
+		_CreateBtrfsSubvolume: func(ctx context.Context, image models.Image) error {
+			assert.Equal(t, image.ID, 1)
+			return nil
+		},
 	}
 
 	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{}, nil
+		},
 		_Create: func(image models.Image) (models.Image, error) {
 			assert.Equal(t, image.Anon, "SELECT * FROM foo;")
+			assert.Equal(t, image.DataPath, "/draupnir")
 			return models.Image{
 				ID:         1,
 				BackedUpAt: image.BackedUpAt,
@@ -121,6 +217,191 @@ func TestCreateImage(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestImageCreateTimesOut(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt: timestamp(),
+		Anon:       "SELECT * FROM foo;",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	destroyed := make(chan models.Image, 1)
+	executor := FakeExecutor{
+		_SelectDataPath: func(ctx context.Context) (string, error) { return "/draupnir", nil },
+		_CreateBtrfsSubvolume: func(ctx context.Context, image models.Image) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		_DestroyImage: func(ctx context.Context, image models.Image) error {
+			destroyed <- image
+			return nil
+		},
+	}
+
+	var errored string
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{}, nil
+		},
+		_Create: func(image models.Image) (models.Image, error) {
+			image.ID = 1
+			return image, nil
+		},
+		_MarkAsErrored: func(image models.Image, message string) (models.Image, error) {
+			errored = message
+			image.Error = message
+			return image, nil
+		},
+	}
+
+	timeouts := metrics.NewCounter("image_create_timeouts", "")
+	routeSet := Images{
+		ImageStore:     store,
+		Executor:       executor,
+		CreateTimeout:  10 * time.Millisecond,
+		CreateTimeouts: timeouts,
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, api.ImageCreateTimeoutError, response)
+	assert.Equal(t, "subvolume creation timed out", errored)
+	assert.Equal(t, float64(1), timeouts.Value())
+	assert.Equal(t, 1, (<-destroyed).ID)
+	assert.Nil(t, err)
+}
+
+func TestImageCreateWithDuplicateBackedUpAt(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt: timestamp(),
+		Anon:       "SELECT * FROM foo;",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	// backed_up_at is sent with second precision
+	backedUpAt := timestamp().Truncate(time.Second)
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				{ID: 1, BackedUpAt: backedUpAt, Tags: "env=staging"},
+				{ID: 2, BackedUpAt: backedUpAt},
+			}, nil
+		},
+	}
+
+	err := Images{ImageStore: store}.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, "/images/2", recorder.Header().Get("Location"))
+	assert.Equal(t, api.DuplicateImageError(2), response)
+	assert.Nil(t, err)
+}
+
+func TestImageCreateAtImageLimit(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt: timestamp(),
+		Anon:       "SELECT * FROM foo;",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	// The limit applies even when forcing
+	req, recorder, _ := createRequest(t, "POST", "/images?force=true", body)
+
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{{ID: 1}, {ID: 2}}, nil
+		},
+		_Create: func(image models.Image) (models.Image, error) {
+			t.Fatal("image should not be created")
+			return image, nil
+		},
+	}
+
+	err := Images{ImageStore: store, MaxImages: 2}.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+	assert.Equal(t, api.ImageLimitReachedError(2), response)
+	assert.Nil(t, err)
+}
+
+func TestImageCreateAtImageLimitWithDestroyingImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt: timestamp(),
+		Anon:       "SELECT * FROM foo;",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images?force=true", body)
+
+	created := false
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				{ID: 1},
+				// Neither of these counts towards the limit
+				{ID: 2, Destroying: true},
+				{ID: 3, Error: "anonymisation failed"},
+			}, nil
+		},
+		_Create: func(image models.Image) (models.Image, error) {
+			created = true
+			image.ID = 4
+			return image, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_SelectDataPath:       func(ctx context.Context) (string, error) { return "/draupnir", nil },
+		_CreateBtrfsSubvolume: func(ctx context.Context, image models.Image) error { return nil },
+	}
+
+	err := Images{ImageStore: store, Executor: executor, MaxImages: 2}.Create(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.True(t, created)
+	assert.Nil(t, err)
+}
+
+func TestImageCreateWithDuplicateBackedUpAtAndForce(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt: timestamp(),
+		Anon:       "SELECT * FROM foo;",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images?force=true", body)
+
+	// The existing images aren't listed when forcing, so _List is not faked
+	store := FakeImageStore{
+		_Create: func(image models.Image) (models.Image, error) {
+			image.ID = 3
+			return image, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_SelectDataPath:       func(ctx context.Context) (string, error) { return "/draupnir", nil },
+		_CreateBtrfsSubvolume: func(ctx context.Context, image models.Image) error { return nil },
+	}
+
+	err := Images{ImageStore: store, Executor: executor}.Create(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
+}
+
 func TestImageCreateReturnsErrorWithInvalidPayload(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	payload := map[string]string{"this is": "not a valid JSON API request payload"}
@@ -138,6 +419,66 @@ func TestImageCreateReturnsErrorWithInvalidPayload(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestImageCreateReturnsValidationErrors(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{Anon: "  "}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	err := Images{}.Create(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, 2, len(response.Errors))
+	assert.Equal(t, "/data/attributes/backed_up_at", response.Errors[0].Source.Pointer)
+	assert.Equal(t, "/data/attributes/anonymisation_script", response.Errors[1].Source.Pointer)
+	assert.Nil(t, err)
+}
+
+func TestImageCreateReturnsValidationErrorWithMalformedTags(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt: timestamp(),
+		Anon:       "SELECT * FROM foo;",
+		Tags:       "env=staging,team",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	err := Images{}.Create(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, 1, len(response.Errors))
+	assert.Equal(t, "/data/attributes/tags", response.Errors[0].Source.Pointer)
+	assert.Nil(t, err)
+}
+
+func TestImageCreateReturnsValidationErrorWithMalformedDefaultDatabase(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt:      timestamp(),
+		Anon:            "SELECT * FROM foo;",
+		DefaultDatabase: "app'; rm -rf /",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	err := Images{}.Create(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, 1, len(response.Errors))
+	assert.Equal(t, "/data/attributes/default_database", response.Errors[0].Source.Pointer)
+	assert.Nil(t, err)
+}
+
 func TestImageCreateReturnsErrorWhenSubvolumeCreationFails(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := CreateImageRequest{
@@ -148,6 +489,9 @@ func TestImageCreateReturnsErrorWhenSubvolumeCreationFails(t *testing.T) {
 	req, recorder, logs := createRequest(t, "POST", "/images", body)
 
 	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{}, nil
+		},
 		_Create: func(image models.Image) (models.Image, error) {
 			return models.Image{
 				ID:         1,
@@ -160,7 +504,8 @@ func TestImageCreateReturnsErrorWhenSubvolumeCreationFails(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_CreateBtrfsSubvolume: func(context.Context, int) error {
+		_SelectDataPath: func(ctx context.Context) (string, error) { return "/draupnir", nil },
+		_CreateBtrfsSubvolume: func(context.Context, models.Image) error {
 			return errors.New("some btrfs error")
 		},
 	}
@@ -211,7 +556,7 @@ func TestImageDone(t *testing.T) {
 	}
 
 	errorHandler := FakeErrorHandler{}
-	routeSet := Images{ImageStore: store, Executor: executor}
+	routeSet := Images{ImageStore: store, Executor: executor, FinaliseLocks: lock.NewKeyedMutex(), OperationStore: acceptingOperationStore()}
 	router := mux.NewRouter()
 	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
 	router.ServeHTTP(recorder, req)
@@ -224,6 +569,364 @@ func TestImageDone(t *testing.T) {
 	assert.Nil(t, errorHandler.Error)
 }
 
+func TestImageDoneReplicatesImage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false}, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return nil
+		},
+	}
+
+	var replicated []models.Image
+	replicator := FakeReplicator{
+		_Replicate: func(i models.Image) {
+			replicated = append(replicated, i)
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:     store,
+		Executor:       executor,
+		FinaliseLocks:  lock.NewKeyedMutex(),
+		Replicator:     replicator,
+		OperationStore: acceptingOperationStore(),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	if assert.Len(t, replicated, 1) {
+		assert.Equal(t, 1, replicated[0].ID)
+		assert.True(t, replicated[0].Ready)
+	}
+}
+
+func TestImageDoneMarksImageErroredWhenAnonTimesOut(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{ID: 1, Ready: false}
+	var errored string
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+		_MarkAsErrored: func(i models.Image, message string) (models.Image, error) {
+			assert.Equal(t, image, i)
+
+			errored = message
+			i.Error = message
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return exec.ErrAnonTimeout
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: executor, FinaliseLocks: lock.NewKeyedMutex(), OperationStore: acceptingOperationStore()}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "anon timed out", errored)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.AnonTimeoutError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDoneQueuesWhenFinalisationsAreBusy(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{ID: 1, Ready: false}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return nil
+		},
+	}
+
+	updated := make(chan models.Operation, 1)
+	operationStore := FakeOperationStore{
+		_Create: func(operation models.Operation) (models.Operation, error) {
+			assert.Equal(t, 1, operation.ImageID)
+			assert.Equal(t, models.OperationPending, operation.Status)
+			operation.ID = 7
+			return operation, nil
+		},
+		_Update: func(operation models.Operation) (models.Operation, error) {
+			updated <- operation
+			return operation, nil
+		},
+	}
+
+	// Occupy the only slot, so that the request has to queue
+	queue := lock.NewSemaphore(1)
+	release := queue.Acquire()
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:        store,
+		Executor:          executor,
+		OperationStore:    operationStore,
+		FinaliseLocks:     lock.NewKeyedMutex(),
+		FinaliseQueue:     queue,
+		FinaliseQueueWait: 10 * time.Millisecond,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "/operations/7", recorder.Header().Get("Location"))
+	assert.Nil(t, errorHandler.Error)
+
+	release()
+
+	select {
+	case operation := <-updated:
+		assert.Equal(t, models.OperationSucceeded, operation.Status)
+		assert.Equal(t, 1, operation.ImageID)
+	case <-time.After(time.Second):
+		t.Fatal("image was not finalised once the queue had room")
+	}
+}
+
+func TestImageFetch(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &FetchImageRequest{URL: "s3://backups/base.tar.gz"})
+	req, recorder, _ := createRequest(t, "POST", "/images/1/fetch", body)
+
+	sourceURLs := make(chan string, 1)
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false}, nil
+		},
+		_SetSourceURL: func(i models.Image, sourceURL string) (models.Image, error) {
+			sourceURLs <- sourceURL
+			i.SourceURL = sourceURL
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FetchImage: func(ctx context.Context, i models.Image, source *url.URL, progress func(int64)) error {
+			assert.Equal(t, 1, i.ID)
+			assert.Equal(t, "s3://backups/base.tar.gz", source.String())
+			progress(1024)
+			return nil
+		},
+	}
+
+	updated := make(chan models.Operation, 1)
+	operationStore := FakeOperationStore{
+		_Create: func(operation models.Operation) (models.Operation, error) {
+			operation.ID = 7
+			return operation, nil
+		},
+		_Update: func(operation models.Operation) (models.Operation, error) {
+			updated <- operation
+			return operation, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:     store,
+		Executor:       executor,
+		OperationStore: operationStore,
+		FinaliseLocks:  lock.NewKeyedMutex(),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/fetch", errorHandler.Handle(routeSet.Fetch))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "/operations/7", recorder.Header().Get("Location"))
+	assert.Nil(t, errorHandler.Error)
+
+	select {
+	case operation := <-updated:
+		assert.Equal(t, models.OperationSucceeded, operation.Status)
+		assert.Equal(t, 1, operation.ImageID)
+		assert.Equal(t, int64(1024), operation.BytesTransferred)
+	case <-time.After(time.Second):
+		t.Fatal("backup was not fetched")
+	}
+
+	assert.Equal(t, "s3://backups/base.tar.gz", <-sourceURLs)
+}
+
+func TestImageFetchRejectsUnsupportedURLs(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &FetchImageRequest{URL: "ftp://backups/base.tar.gz"})
+	req, recorder, _ := createRequest(t, "POST", "/images/1/fetch", body)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/fetch", errorHandler.Handle(routeSet.Fetch))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "/data/attributes/url", response.Errors[0].Source.Pointer)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageUpdate(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &UpdateImageRequest{Anon: "UPDATE users SET email = 'x';\n"})
+	req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+	var updatedAnon string
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false, Anon: "SELECT 1;\n"}, nil
+		},
+		_UpdateAnon: func(image models.Image, anon string) (models.Image, error) {
+			updatedAnon = anon
+			image.Anon = anon
+			image.SetAnonStats()
+			return image, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, FinaliseLocks: lock.NewKeyedMutex()}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Update))
+	router.ServeHTTP(recorder, req)
+
+	var response models.Image
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "UPDATE users SET email = 'x';\n", updatedAnon)
+	assert.Equal(t, 30, response.AnonSizeBytes)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageUpdateRejectsReadyImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &UpdateImageRequest{Anon: "SELECT 1;"})
+	req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+	// The script isn't changed, so _UpdateAnon is not faked
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, FinaliseLocks: lock.NewKeyedMutex()}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Update))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "/data/attributes/anonymisation_script", response.Errors[0].Source.Pointer)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDoneConcurrently(t *testing.T) {
+	var mutex sync.Mutex
+	image := models.Image{ID: 1, Ready: false}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			image.Ready = true
+			return image, nil
+		},
+	}
+
+	var finalisations int32
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			atomic.AddInt32(&finalisations, 1)
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		},
+	}
+
+	routeSet := Images{ImageStore: store, Executor: executor, FinaliseLocks: lock.NewKeyedMutex(), OperationStore: acceptingOperationStore()}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 2; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+			router.ServeHTTP(recorder, req)
+
+			var response jsonapi.OnePayload
+			err := json.NewDecoder(recorder.Body).Decode(&response)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, true, response.Data.Attributes["ready"])
+			assert.Nil(t, errorHandler.Error)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), finalisations)
+}
+
 func TestImageDoneWithNonNumericID(t *testing.T) {
 	req, recorder, logs := createRequest(t, "POST", "/images/bad_id/done", nil)
 
@@ -266,8 +969,8 @@ func TestImageDestroy(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_DestroyImage: func(ctx context.Context, imageID int) error {
-			assert.Equal(t, 1, imageID)
+		_DestroyImage: func(ctx context.Context, i models.Image) error {
+			assert.Equal(t, image, i)
 			return nil
 		},
 	}
@@ -285,6 +988,27 @@ func TestImageDestroy(t *testing.T) {
 	assert.Nil(t, errorHandler.Error)
 }
 
+func TestImageDestroyWhenAlreadyDestroyed(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/images/1", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{}, sql.ErrNoRows
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+
+	router := mux.NewRouter()
+	routeSet := Images{ImageStore: store}
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, 0, len(recorder.Body.Bytes()))
+	assert.Nil(t, errorHandler.Error)
+}
+
 func TestImageDestroyFromUploadUser(t *testing.T) {
 	req, recorder, logs := createRequest(t, "DELETE", "/images/1", nil)
 
@@ -296,13 +1020,20 @@ func TestImageDestroyFromUploadUser(t *testing.T) {
 		UpdatedAt:  timestamp(),
 	}
 
+	destroying := image
+	destroying.Destroying = true
+
 	imageStore := FakeImageStore{
 		_Get: func(id int) (models.Image, error) {
 			assert.Equal(t, 1, id)
 			return image, nil
 		},
-		_Destroy: func(i models.Image) error {
+		_MarkAsDestroying: func(i models.Image) (models.Image, error) {
 			assert.Equal(t, image, i)
+			return destroying, nil
+		},
+		_Destroy: func(i models.Image) error {
+			assert.Equal(t, destroying, i)
 			return nil
 		},
 	}
@@ -324,11 +1055,11 @@ func TestImageDestroyFromUploadUser(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_DestroyImage: func(ctx context.Context, imageID int) error {
-			assert.Equal(t, 1, imageID)
+		_DestroyImage: func(ctx context.Context, i models.Image) error {
+			assert.Equal(t, destroying, i)
 			return nil
 		},
-		_DestroyInstance: func(context.Context, int) error {
+		_DestroyInstance: func(context.Context, models.Instance) error {
 			return nil
 		},
 	}
@@ -361,6 +1092,52 @@ func TestImageDestroyFromUploadUser(t *testing.T) {
 	assert.Nil(t, errorHandler.Error)
 }
 
+func TestImageReplications(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1/replications", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	replicationStore := FakeReplicationStore{
+		_List: func(imageID int) ([]models.ImageReplication, error) {
+			assert.Equal(t, 1, imageID)
+			return []models.ImageReplication{
+				{
+					ID:          3,
+					ImageID:     1,
+					Peer:        "https://draupnir.eu.example.com",
+					Status:      models.ReplicationSucceeded,
+					PeerImageID: 12,
+					CreatedAt:   timestamp(),
+					UpdatedAt:   timestamp(),
+				},
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, ReplicationStore: replicationStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/replications", errorHandler.Handle(routeSet.Replications))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	replications, err := jsonapi.UnmarshalManyPayload(recorder.Body, reflect.TypeOf(new(models.ImageReplication)))
+	assert.Nil(t, err)
+	if assert.Len(t, replications, 1) {
+		replication := replications[0].(*models.ImageReplication)
+		assert.Equal(t, 3, replication.ID)
+		assert.Equal(t, "https://draupnir.eu.example.com", replication.Peer)
+		assert.Equal(t, models.ReplicationSucceeded, replication.Status)
+		assert.Equal(t, 12, replication.PeerImageID)
+	}
+}
+
 func timestamp() time.Time {
 	loc, err := time.LoadLocation("UTC")
 	if err != nil {
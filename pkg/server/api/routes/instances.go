@@ -1,11 +1,18 @@
 package routes
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/pkg/errors"
@@ -25,13 +32,78 @@ type Instances struct {
 	ImageStore              store.ImageStore
 	WhitelistedAddressStore store.WhitelistedAddressStore
 	ApplyWhitelist          func(string)
+	OperationStore          store.OperationStore
 	Executor                exec.Executor
 	MinInstancePort         uint16
 	MaxInstancePort         uint16
+	// AdminUserEmails may view the logs of any instance, in addition to its owner
+	AdminUserEmails []string
+	// NameTemplate names instances that aren't given a name when they are
+	// created. If nil, models.DefaultInstanceNameTemplate is used.
+	NameTemplate *template.Template
+	// MaxImageAge is the age beyond which an image's backup is too stale to
+	// create instances of, unless the request allows it. Zero is unlimited.
+	MaxImageAge time.Duration
+	// MaxImages is the most images that may exist at once, including those
+	// snapshotted from instances, or zero if there is no limit
+	MaxImages int
+	// MaxConnections limits the connections that new instances accept, so that
+	// a runaway client can't exhaust them. Zero keeps the image's limit.
+	MaxConnections int
+	// InstanceTTL is how long new instances live before they are destroyed
+	// automatically. Zero keeps them until they are destroyed by their owner.
+	InstanceTTL time.Duration
 }
 
+// defaultLogLines and maxLogLines bound how much of an instance's log is
+// returned by a single request
+const (
+	defaultLogLines = 100
+	maxLogLines     = 10000
+)
+
 type CreateInstanceRequest struct {
-	ImageID string `jsonapi:"attr,image_id"`
+	ImageID    string `jsonapi:"attr,image_id"`
+	Name       string `jsonapi:"attr,name,omitempty"`
+	SchemaOnly bool   `jsonapi:"attr,schema_only,omitempty"`
+	// MaxAge overrides the server's max_image_age, in seconds
+	MaxAge     int  `jsonapi:"attr,max_age,omitempty"`
+	AllowStale bool `jsonapi:"attr,allow_stale,omitempty"`
+}
+
+// SnapshotInstanceRequest saves an instance as a new image. BackedUpAt
+// defaults to the time of the snapshot.
+type SnapshotInstanceRequest struct {
+	BackedUpAt time.Time `jsonapi:"attr,backed_up_at,iso8601,omitempty"`
+}
+
+// UpdateInstanceRequest changes an existing instance. Only its name may be
+// changed.
+type UpdateInstanceRequest struct {
+	Name string `jsonapi:"attr,name"`
+}
+
+// invalidInstanceNameError is rendered when a requested name doesn't match
+// instanceNamePattern
+var invalidInstanceNameError = api.Errors{Errors: []api.Error{api.InvalidAttributeError(
+	"name", "name must be at most 63 letters, numbers, dashes or underscores",
+)}}
+
+// instanceNamePattern restricts names to those that are easy to type and safe
+// to use in file names
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// nonNameCharacters matches the parts of a user's email address that are
+// replaced when it is used in a generated name
+var nonNameCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// InstancePlan describes the instance that would be created by a request, and
+// is returned instead of creating it when the request is a dry run
+type InstancePlan struct {
+	ImageID         int       `json:"image_id"`
+	ImageBackedUpAt time.Time `json:"image_backed_up_at"`
+	Port            uint16    `json:"port"`
+	SchemaOnly      bool      `json:"schema_only,omitempty"`
 }
 
 func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
@@ -70,17 +142,73 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if !image.Cloneable() {
+		api.ImageNotCloneableError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	maxAge := i.MaxImageAge
+	if req.MaxAge > 0 {
+		maxAge = time.Duration(req.MaxAge) * time.Second
+	}
+	if age := time.Since(image.BackedUpAt); maxAge > 0 && age > maxAge && !req.AllowStale {
+		api.StaleImageError(age, maxAge).Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
 	refreshToken, ok := r.Context().Value(middleware.RefreshTokenKey).(string)
 	if !ok {
 		log.Fatal("Access token key is missing from context")
 	}
 
-	instance := models.NewInstance(imageID, email, refreshToken)
+	instance := models.NewInstance(image, email, refreshToken)
 	port, err := generateRandomFreePort(i.InstanceStore, i.MinInstancePort, i.MaxInstancePort)
 	if err != nil {
 		return err
 	}
 	instance.Port = port
+	instance.SchemaOnly = req.SchemaOnly
+	instance.MaxConnections = i.MaxConnections
+	if i.InstanceTTL > 0 {
+		instance.ExpiresAt = instance.CreatedAt.Add(i.InstanceTTL)
+	}
+
+	if req.Name != "" {
+		if !instanceNamePattern.MatchString(req.Name) {
+			invalidInstanceNameError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+
+		taken, err := instanceNameTaken(i.InstanceStore, req.Name)
+		if err != nil {
+			return err
+		}
+		if taken {
+			api.InstanceNameTakenError.Render(w, http.StatusConflict)
+			return nil
+		}
+		instance.Name = req.Name
+	} else {
+		instance.Name, err = generateFreeInstanceName(i.InstanceStore, i.NameTemplate, email, image.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		plan := InstancePlan{
+			ImageID:         image.ID,
+			ImageBackedUpAt: image.BackedUpAt,
+			Port:            instance.Port,
+			SchemaOnly:      instance.SchemaOnly,
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return errors.Wrap(
+			json.NewEncoder(w).Encode(plan),
+			"failed to encode instance plan",
+		)
+	}
 
 	instance, err = i.InstanceStore.Create(instance)
 
@@ -100,17 +228,92 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	if err := i.Executor.CreateInstance(r.Context(), imageID, instance.ID, int(instance.Port)); err != nil {
-		return errors.Wrap(err, "failed to create instance")
+	if r.URL.Query().Get("async") == "true" {
+		return i.createAsync(w, r, instance, ipaddr)
 	}
 
-	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
+	operation := models.NewOperation(email, models.OperationCreateInstance)
+	operation.InstanceID = instance.ID
+
+	instance, err = i.provision(r.Context(), instance, ipaddr)
+	recordOperation(logger, i.OperationStore, operation, err, "failed to create instance")
 	if err != nil {
-		logger.With("instance", instance.ID).Info(
-			errors.Wrap(err, "failed to retrieve instance credentials"),
-		)
-		api.InternalServerError.Render(w, http.StatusInternalServerError)
-		return nil
+		// The request may have timed out, cancelling its context, so clean up
+		// with a fresh one
+		ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+		if cleanupErr := i.destroyFailedInstance(ctx, instance); cleanupErr != nil {
+			logger.With("error", cleanupErr.Error()).Error("Failed to clean up instance")
+		}
+		return err
+	}
+
+	w.Header().Set("ETag", instanceETag(instance))
+	w.WriteHeader(http.StatusCreated)
+	err = jsonapi.MarshalOnePayload(w, &instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal instance")
+	}
+
+	return nil
+}
+
+// createAsync responds with an operation straight away, and provisions the
+// instance in the background, recording the outcome on the operation
+func (i Instances) createAsync(w http.ResponseWriter, r *http.Request, instance models.Instance, ipaddr string) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	operation := models.NewOperation(instance.UserEmail, models.OperationCreateInstance)
+	operation.InstanceID = instance.ID
+	operation, err = i.OperationStore.Create(operation)
+	if err != nil {
+		return errors.Wrap(err, "failed to create operation")
+	}
+
+	logger = logger.With("operation", operation.ID).With("instance", instance.ID)
+
+	go func() {
+		// The request's context is cancelled as soon as we respond, so provision
+		// the instance with a fresh one
+		ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+		_, err := i.provision(ctx, instance, ipaddr)
+		if err != nil {
+			logger.With("error", err.Error()).Error("Failed to create instance asynchronously")
+			if cleanupErr := i.destroyFailedInstance(ctx, instance); cleanupErr != nil {
+				logger.With("error", cleanupErr.Error()).Error("Failed to clean up instance")
+			}
+			operation.Status = models.OperationFailed
+			operation.Error = "failed to create instance"
+		} else {
+			operation.Status = models.OperationSucceeded
+		}
+
+		if _, err := i.OperationStore.Update(operation); err != nil {
+			logger.With("error", err.Error()).Error("Failed to record outcome of operation")
+		}
+	}()
+
+	w.Header().Set("Location", fmt.Sprintf("/operations/%d", operation.ID))
+	w.WriteHeader(http.StatusAccepted)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &operation),
+		"failed to marshal operation",
+	)
+}
+
+// provision creates an instance on disk, and whitelists the user's IP address
+// for it. The returned instance includes its credentials.
+func (i Instances) provision(ctx context.Context, instance models.Instance, ipaddr string) (models.Instance, error) {
+	if err := i.Executor.CreateInstance(ctx, instance); err != nil {
+		return instance, errors.Wrap(err, "failed to create instance")
+	}
+
+	files, err := i.Executor.RetrieveInstanceCredentials(ctx, instance)
+	if err != nil {
+		return instance, errors.Wrap(err, "failed to retrieve instance credentials")
 	}
 
 	creds := models.NewInstanceCredentials(
@@ -121,19 +324,25 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 
 	// Add the user's IP address to the whitelist
 	address := models.NewWhitelistedAddress(ipaddr, &instance)
-	address, err = i.WhitelistedAddressStore.Create(address)
+	_, err = i.WhitelistedAddressStore.Create(address)
 	if err != nil {
-		return errors.Wrap(err, "failed to record whitelisted IP address")
+		return instance, errors.Wrap(err, "failed to record whitelisted IP address")
 	}
 	i.ApplyWhitelist("api")
 
-	w.WriteHeader(http.StatusCreated)
-	err = jsonapi.MarshalOnePayload(w, &instance)
-	if err != nil {
-		return errors.Wrap(err, "failed to marshal instance")
-	}
+	return instance, nil
+}
 
-	return nil
+// destroyFailedInstance removes an instance that couldn't be provisioned, so
+// that its row, port and any partial subvolume aren't leaked. The row is
+// removed even if the subvolume can't be, as provisioning may have failed
+// before it was created.
+func (i Instances) destroyFailedInstance(ctx context.Context, instance models.Instance) error {
+	diskErr := i.Executor.DestroyInstance(ctx, instance)
+	if err := i.InstanceStore.Destroy(instance); err != nil {
+		return errors.Wrap(err, "failed to remove instance from table")
+	}
+	return errors.Wrap(diskErr, "failed to destroy instance on disk")
 }
 
 func (i Instances) List(w http.ResponseWriter, r *http.Request) error {
@@ -149,7 +358,7 @@ func (i Instances) List(w http.ResponseWriter, r *http.Request) error {
 
 	// Build a slice of pointers to our images, because this is what jsonapi wants
 	// At the same time, filter out instances that don't belong to this user
-	_instances := make([]*models.Instance, 0)
+	_instances := make([]interface{}, 0)
 	for idx, instance := range instances {
 		if instance.UserEmail == email {
 			_instances = append(_instances, &instances[idx])
@@ -157,7 +366,7 @@ func (i Instances) List(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	return errors.Wrap(
-		jsonapi.MarshalManyPayload(w, _instances),
+		marshalListPayload(w, _instances, InstanceListMeta{TotalCount: len(_instances)}),
 		"failed to marshal instances",
 	)
 }
@@ -176,7 +385,7 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
-		api.NotFoundError.Render(w, http.StatusNotFound)
+		api.BadInstanceIDError.Render(w, http.StatusBadRequest)
 		return nil
 	}
 
@@ -197,7 +406,7 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
+	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance)
 	if err != nil {
 		logger.With("instance", id).Info(
 			errors.Wrap(err, "failed to retrieve instance credentials"),
@@ -212,6 +421,13 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 	)
 	instance.Credentials = &creds
 
+	// The count is only informative, so the instance is returned without it if
+	// its postgres can't be reached
+	instance.Connections, err = i.Executor.InstanceConnections(r.Context(), instance)
+	if err != nil {
+		logger.With("instance", id).With("error", err.Error()).Info("failed to count instance connections")
+	}
+
 	// Add the user's IP address to the whitelist
 	address := models.NewWhitelistedAddress(ipaddr, &instance)
 	address, err = i.WhitelistedAddressStore.Create(address)
@@ -220,13 +436,16 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 	}
 	i.ApplyWhitelist("api")
 
+	w.Header().Set("ETag", instanceETag(instance))
 	return errors.Wrap(
 		jsonapi.MarshalOnePayload(w, &instance),
 		"failed to marshal instance",
 	)
 }
 
-func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
+// Update renames an instance, returning it with its new name. As when creating
+// an instance, the name must not be taken by another instance.
+func (i Instances) Update(w http.ResponseWriter, r *http.Request) error {
 	logger, err := middleware.GetLogger(r)
 	if err != nil {
 		return err
@@ -240,11 +459,99 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
+		api.BadInstanceIDError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if email != instance.UserEmail {
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
+	if !ifMatch(r, instanceETag(instance)) {
+		api.PreconditionFailedError.Render(w, http.StatusPreconditionFailed)
+		return nil
+	}
+
+	req := UpdateInstanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if !instanceNamePattern.MatchString(req.Name) {
+		invalidInstanceNameError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if req.Name != instance.Name {
+		taken, err := instanceNameTaken(i.InstanceStore, req.Name)
+		if err != nil {
+			return err
+		}
+		if taken {
+			api.InstanceNameTakenError.Render(w, http.StatusConflict)
+			return nil
+		}
+
+		logger.With("instance", id).With("name", req.Name).Info("renaming instance")
+		instance, err = i.InstanceStore.Rename(instance, req.Name)
+		if err != nil {
+			// The instance may have changed since we checked its ETag
+			if err == sql.ErrNoRows {
+				api.PreconditionFailedError.Render(w, http.StatusPreconditionFailed)
+				return nil
+			}
+			// Another instance may have taken the name since we checked
+			if strings.Contains(err.Error(), "instances_name_key") {
+				api.InstanceNameTakenError.Render(w, http.StatusConflict)
+				return nil
+			}
+			return errors.Wrap(err, "failed to rename instance")
+		}
+	}
+
+	w.Header().Set("ETag", instanceETag(instance))
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.BadInstanceIDError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
 	instance, err := i.InstanceStore.Get(id)
+	if err == sql.ErrNoRows {
+		// Destroying is idempotent, so that it can be retried if the response
+		// to an earlier attempt was lost
+		logger.With("instance", id).Info("instance already destroyed")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
 	if err != nil {
 		logger.With("instance", id).Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
@@ -256,13 +563,34 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if !ifMatch(r, instanceETag(instance)) {
+		api.PreconditionFailedError.Render(w, http.StatusPreconditionFailed)
+		return nil
+	}
+
+	// Claim the instance before destroying it, so that a change made since we
+	// checked its ETag fails one request or the other rather than being lost
+	instance, err = i.InstanceStore.Touch(instance)
+	if err == sql.ErrNoRows {
+		api.PreconditionFailedError.Render(w, http.StatusPreconditionFailed)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to claim instance")
+	}
+
 	logger.With("instance", id).Info("destroying instance")
-	err = i.Executor.DestroyInstance(r.Context(), instance.ID)
+	operation := models.NewOperation(email, models.OperationDestroyInstance)
+	operation.InstanceID = instance.ID
+
+	err = i.Executor.DestroyInstance(r.Context(), instance)
 	if err != nil {
+		recordOperation(logger, i.OperationStore, operation, err, "failed to destroy instance")
 		return errors.Wrap(err, "failed to destroy instance on disk")
 	}
 
 	err = i.InstanceStore.Destroy(instance)
+	recordOperation(logger, i.OperationStore, operation, err, "failed to destroy instance")
 	if err != nil {
 		return errors.Wrap(err, "failed to remove instance from table")
 	}
@@ -306,3 +634,267 @@ GetNewPort:
 
 	return port, nil
 }
+
+// defaultNameTemplate is parsed once, for route sets without a NameTemplate
+var defaultNameTemplate = template.Must(
+	template.New("instance_name").Parse(models.DefaultInstanceNameTemplate),
+)
+
+// instanceNameTaken returns true if an existing instance has the given name
+func instanceNameTaken(store store.InstanceStore, name string) (bool, error) {
+	instances, err := store.List()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list instances to check name")
+	}
+
+	for _, instance := range instances {
+		if instance.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// generateFreeInstanceName renders the name template, with a new random suffix
+// each time, until it produces a name that no existing instance has
+func generateFreeInstanceName(store store.InstanceStore, tmpl *template.Template, email string, imageID int) (string, error) {
+	if tmpl == nil {
+		tmpl = defaultNameTemplate
+	}
+
+	instances, err := store.List()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list instances to determine free name")
+	}
+
+	taken := make(map[string]bool)
+	for _, instance := range instances {
+		taken[instance.Name] = true
+	}
+
+	user := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+	user = nonNameCharacters.ReplaceAllString(user, "-")
+
+	for attempts := 0; attempts < 100; attempts++ {
+		var name bytes.Buffer
+		err := tmpl.Execute(&name, models.InstanceNameDetails{
+			User:    user,
+			ImageID: imageID,
+			Suffix:  fmt.Sprintf("%06x", rand.Intn(1<<24)),
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "failed to render instance name")
+		}
+
+		if !taken[name.String()] {
+			return name.String(), nil
+		}
+	}
+
+	return "", errors.New("No free instance name found after 100 attempts")
+}
+
+// Restart stops and starts the instance's Postgres, keeping its data and port,
+// and returns the instance once it is accepting connections again
+func (i Instances) Restart(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.BadInstanceIDError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if email != instance.UserEmail && !auth.IsAdmin(email, i.AdminUserEmails) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if err := i.Executor.RestartInstance(r.Context(), instance); err != nil {
+		return errors.Wrap(err, "failed to restart instance")
+	}
+
+	logger.With("instance", instance.ID).With("restarted_by", email).Info("restarted instance")
+
+	w.Header().Set("ETag", instanceETag(instance))
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+// Snapshot saves the current state of an instance as a new image, which is
+// ready as soon as it is returned. The instance's data was anonymised when its
+// image was finalised, so it isn't anonymised again. Only the instance's owner,
+// or an admin, may snapshot it.
+func (i Instances) Snapshot(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.BadInstanceIDError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	req := SnapshotInstanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if email != instance.UserEmail && !auth.IsAdmin(email, i.AdminUserEmails) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	images, err := i.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get images")
+	}
+	if live := countLiveImages(images); i.MaxImages > 0 && live >= i.MaxImages {
+		logger.With("images", live).With("max_images", i.MaxImages).Info("image limit reached")
+		api.ImageLimitReachedError(i.MaxImages).Render(w, http.StatusInsufficientStorage)
+		return nil
+	}
+
+	backedUpAt := req.BackedUpAt
+	if backedUpAt.IsZero() {
+		backedUpAt = time.Now()
+	}
+
+	// The snapshot is taken on the instance's volume, as snapshots cannot
+	// cross volumes
+	image := models.NewImage(
+		backedUpAt,
+		fmt.Sprintf("-- Snapshot of instance %d, which was already anonymised", instance.ID),
+		instance.DataPath,
+	)
+	for _, source := range images {
+		if source.ID == instance.ImageID {
+			image.DefaultDatabase = source.DefaultDatabase
+			image.Compression = source.Compression
+		}
+	}
+
+	image, err = i.ImageStore.Create(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to create new image")
+	}
+
+	logger = logger.With("instance", instance.ID).With("image", image.ID)
+
+	operation := models.NewOperation(email, models.OperationSnapshotInstance)
+	operation.InstanceID = instance.ID
+	operation.ImageID = image.ID
+
+	err = i.Executor.SnapshotInstanceToImage(r.Context(), instance, image)
+	recordOperation(logger, i.OperationStore, operation, err, "failed to snapshot instance")
+	if err != nil {
+		if _, markErr := i.ImageStore.MarkAsErrored(image, "failed to snapshot instance"); markErr != nil {
+			logger.With("error", markErr.Error()).Error("Failed to mark image as errored")
+		}
+		return errors.Wrap(err, "failed to snapshot instance")
+	}
+
+	image, err = i.ImageStore.MarkAsReady(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark image as ready")
+	}
+
+	logger.With("snapshotted_by", email).Info("snapshotted instance")
+
+	w.Header().Set("Location", fmt.Sprintf("/images/%d", image.ID))
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &image),
+		"failed to marshal image",
+	)
+}
+
+// Logs returns the tail of the instance's Postgres log, as plain text
+func (i Instances) Logs(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.BadInstanceIDError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	lines := defaultLogLines
+	if param := r.URL.Query().Get("lines"); param != "" {
+		lines, err = strconv.Atoi(param)
+		if err != nil || lines < 1 {
+			api.BadLinesError.Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+	if lines > maxLogLines {
+		lines = maxLogLines
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if email != instance.UserEmail && !auth.IsAdmin(email, i.AdminUserEmails) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	output, err := i.Executor.InstanceLogs(r.Context(), instance, lines)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve instance logs")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(output))
+	return errors.Wrap(err, "failed to write instance logs")
+}
@@ -3,10 +3,15 @@ package routes
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
@@ -34,6 +39,8 @@ func TestInstanceCreate(t *testing.T) {
 		_Create: func(instance models.Instance) (models.Instance, error) {
 			assert.Equal(t, 1, instance.ImageID)
 			assert.Equal(t, uint16(5434), instance.Port, "port is 5434 (the only free port)")
+			assert.Equal(t, "/draupnir2", instance.DataPath, "instance is placed alongside its image")
+			assert.Regexp(t, `^test-1-[0-9a-f]{6}$`, instance.Name)
 			return models.Instance{
 				ID:        1,
 				Hostname:  "draupnir-server.example.com",
@@ -67,7 +74,7 @@ func TestInstanceCreate(t *testing.T) {
 	imageStore := FakeImageStore{
 		_Get: func(id int) (models.Image, error) {
 			assert.Equal(t, 1, id)
-			return models.Image{ID: 1, Ready: true}, nil
+			return models.Image{ID: 1, Ready: true, DataPath: "/draupnir2"}, nil
 		},
 	}
 
@@ -85,13 +92,13 @@ func TestInstanceCreate(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int) error {
-			assert.Equal(t, 1, instanceID)
-			assert.Equal(t, 1, imageID)
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, 1, instance.ImageID)
 			return nil
 		},
-		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
-			assert.Equal(t, 1, id)
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			assert.Equal(t, 1, instance.ID)
 			return fakeCredentialsMap, nil
 		},
 	}
@@ -102,6 +109,7 @@ func TestInstanceCreate(t *testing.T) {
 		WhitelistedAddressStore: whitelistedAddressStore,
 		Executor:                executor,
 		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
+		OperationStore:          acceptingOperationStore(),
 		MinInstancePort:         5432,
 		MaxInstancePort:         5435,
 	}
@@ -116,260 +124,1190 @@ func TestInstanceCreate(t *testing.T) {
 
 }
 
-func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
+func TestInstanceCreateSchemaOnly(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
-	request := CreateInstanceRequest{ImageID: "1"}
+	request := CreateInstanceRequest{ImageID: "1", SchemaOnly: true}
 	jsonapi.MarshalOnePayload(body, &request)
 	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
 	instanceStore := FakeInstanceStore{
-		_Create: func(image models.Instance) (models.Instance, error) {
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-			}, nil
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.True(t, instance.SchemaOnly)
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
 		},
 	}
 
 	imageStore := FakeImageStore{
 		_Get: func(id int) (models.Image, error) {
-			return models.Image{ID: 1, Ready: false}, nil
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
 		},
 	}
 
 	executor := FakeExecutor{
-		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int) error {
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			assert.True(t, instance.SchemaOnly, "the executor is asked for a schema-only clone")
 			return nil
 		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
 	}
 
 	routeSet := Instances{
-		InstanceStore: instanceStore,
-		ImageStore:    imageStore,
-		Executor:      executor,
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		OperationStore:          acceptingOperationStore(),
+		MinInstancePort:         5432,
+		MaxInstancePort:         5433,
 	}
 	err := routeSet.Create(recorder, req)
 
-	var response api.Error
-	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
 
-	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
-	assert.Equal(t, api.UnreadyImageError, response)
+	var response models.Instance
+	err = jsonapi.UnmarshalPayload(recorder.Body, &response)
 	assert.Nil(t, err)
+	assert.True(t, response.SchemaOnly)
 }
 
-func TestInstanceCreateReturnsErrorWithInvalidPayload(t *testing.T) {
+func TestInstanceCreateDestroysInstanceWhenProvisioningFails(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
-	request := map[string]string{"this is": "not a valid JSON API request payload"}
-	json.NewEncoder(body).Encode(&request)
-	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+	jsonapi.MarshalOnePayload(body, &CreateInstanceRequest{ImageID: "1"})
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
-	err := Instances{}.Create(recorder, req)
+	// The request times out while the instance is being created
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
 
-	var response api.Error
-	decodeJSON(t, recorder.Body, &response)
+	destroyed := false
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			assert.Equal(t, 1, instance.ID)
+			destroyed = true
+			return nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	destroyedOnDisk := false
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			cancel()
+			return ctx.Err()
+		},
+		_DestroyInstance: func(ctx context.Context, instance models.Instance) error {
+			assert.Nil(t, ctx.Err(), "the cleanup isn't cancelled with the request")
+			assert.Equal(t, 1, instance.ID)
+			destroyedOnDisk = true
+			return nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:   instanceStore,
+		ImageStore:      imageStore,
+		Executor:        executor,
+		OperationStore:  acceptingOperationStore(),
+		MinInstancePort: 5432,
+		MaxInstancePort: 5433,
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.NotNil(t, err)
+	assert.True(t, destroyedOnDisk, "the partial instance is destroyed on disk")
+	assert.True(t, destroyed, "the instance's row is removed")
+}
+
+func TestInstanceCreateWithMaxConnections(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.Equal(t, 20, instance.MaxConnections)
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			assert.Equal(t, 20, instance.MaxConnections, "the executor is asked to limit connections")
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		OperationStore:          acceptingOperationStore(),
+		MinInstancePort:         5432,
+		MaxInstancePort:         5433,
+		MaxConnections:          20,
+	}
+	err := routeSet.Create(recorder, req)
 
+	assert.Equal(t, http.StatusCreated, recorder.Code)
 	assert.Nil(t, err)
-	assert.Equal(t, http.StatusBadRequest, recorder.Code)
-	assert.Equal(t, api.InvalidJSONError, response)
-	assert.Contains(t, logs.String(), "not a jsonapi representation")
+
+	var response models.Instance
+	err = jsonapi.UnmarshalPayload(recorder.Body, &response)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, response.MaxConnections)
 }
 
-func TestInstanceCreateWithInvalidImageID(t *testing.T) {
+func TestInstanceCreateWithTTL(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
-	request := CreateInstanceRequest{ImageID: "garbage"}
+	request := CreateInstanceRequest{ImageID: "1"}
 	jsonapi.MarshalOnePayload(body, &request)
-	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.Equal(t, instance.CreatedAt.Add(8*time.Hour), instance.ExpiresAt)
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
 
 	routeSet := Instances{
-		Executor: FakeExecutor{},
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		OperationStore:          acceptingOperationStore(),
+		MinInstancePort:         5432,
+		MaxInstancePort:         5433,
+		InstanceTTL:             8 * time.Hour,
 	}
 	err := routeSet.Create(recorder, req)
 
-	var response api.Error
-	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
 
-	assert.Equal(t, http.StatusBadRequest, recorder.Code)
-	assert.Equal(t, api.BadImageIDError, response)
-	assert.Contains(t, logs.String(), "parsing \\\"garbage\\\": invalid syntax")
+	var response models.Instance
+	err = jsonapi.UnmarshalPayload(recorder.Body, &response)
 	assert.Nil(t, err)
+	assert.False(t, response.ExpiresAt.IsZero())
 }
 
-func TestInstanceList(t *testing.T) {
-	req, recorder, _ := createRequest(t, "GET", "/instances", nil)
+func TestInstanceCreateDryRun(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances?dry_run=true", body)
 
-	store := FakeInstanceStore{
+	// Creating the instance would call the store's Create method and the
+	// executor, neither of which are faked, so would panic.
+	instanceStore := FakeInstanceStore{
 		_List: func() ([]models.Instance, error) {
-			return []models.Instance{
-				models.Instance{
-					ID:        1,
-					Hostname:  "draupnir-server.example.com",
-					ImageID:   1,
-					Port:      5432,
-					CreatedAt: timestamp(),
-					UpdatedAt: timestamp(),
-					UserEmail: "test@draupnir",
-				},
-				models.Instance{
-					ID:        2,
-					Hostname:  "draupnir-server.example.com",
-					ImageID:   1,
-					Port:      5433,
-					CreatedAt: timestamp(),
-					UpdatedAt: timestamp(),
-					UserEmail: "otheruser@draupnir",
-				},
-			}, nil
+			return []models.Instance{{ID: 1, Port: 5432}}, nil
 		},
 	}
 
-	routeSet := Instances{InstanceStore: store}
-	err := routeSet.List(recorder, req)
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true, BackedUpAt: timestamp()}, nil
+		},
+	}
 
-	var response jsonapi.ManyPayload
+	routeSet := Instances{
+		InstanceStore:   instanceStore,
+		ImageStore:      imageStore,
+		Executor:        FakeExecutor{},
+		MinInstancePort: 5432,
+		MaxInstancePort: 5434,
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response InstancePlan
 	decodeJSON(t, recorder.Body, &response)
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
-	assert.Equal(t, listInstancesFixture, response)
 	assert.Nil(t, err)
+	assert.Equal(t, InstancePlan{ImageID: 1, ImageBackedUpAt: timestamp(), Port: 5433}, response)
 }
 
-func TestInstanceGet(t *testing.T) {
-	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+func TestInstanceCreateAsync(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances?async=true", body)
 
-	store := FakeInstanceStore{
-		_Get: func(id int) (models.Instance, error) {
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				Port:      5432,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-				UserEmail: "test@draupnir",
-			}, nil
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
 		},
 	}
 
 	whitelistedAddressStore := FakeWhitelistedAddressStore{
 		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
-			assert.Equal(t, 1, addr.Instance.ID)
-			assert.Equal(t, "1.2.3.4", addr.IPAddress)
-			return models.WhitelistedAddress{
-				IPAddress: addr.IPAddress,
-				Instance:  addr.Instance,
+			return addr, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			assert.Equal(t, 1, instance.ID)
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	updated := make(chan models.Operation, 1)
+	operationStore := FakeOperationStore{
+		_Create: func(operation models.Operation) (models.Operation, error) {
+			assert.Equal(t, models.OperationPending, operation.Status)
+			assert.Equal(t, 1, operation.InstanceID)
+			assert.Equal(t, "test@draupnir", operation.UserEmail)
+			operation.ID = 7
+			operation.CreatedAt = timestamp()
+			operation.UpdatedAt = timestamp()
+			return operation, nil
+		},
+		_Update: func(operation models.Operation) (models.Operation, error) {
+			updated <- operation
+			return operation, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		OperationStore:          operationStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		MinInstancePort:         5432,
+		MaxInstancePort:         5435,
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "/operations/7", recorder.Header().Get("Location"))
+	assert.Nil(t, err)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "7", response.Data.ID)
+	assert.Equal(t, models.OperationPending, response.Data.Attributes["status"])
+
+	operation := <-updated
+	assert.Equal(t, models.OperationSucceeded, operation.Status)
+	assert.Equal(t, "", operation.Error)
+}
+
+func TestInstanceCreateWithTakenName(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1", Name: "my-clone"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	// The instance is never created, so _Create is not faked
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Port: 5432, Name: "my-clone"}}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:   instanceStore,
+		ImageStore:      imageStore,
+		MinInstancePort: 5432,
+		MaxInstancePort: 5434,
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, api.InstanceNameTakenError, response)
+	assert.Nil(t, err)
+}
+
+func TestGenerateFreeInstanceNameUsesTemplate(t *testing.T) {
+	store := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Name: "jane-doe-clone-3"}}, nil
+		},
+	}
+
+	tmpl := template.Must(template.New("name").Parse("{{.User}}-clone-{{.ImageID}}-{{.Suffix}}"))
+	name, err := generateFreeInstanceName(store, tmpl, "Jane.Doe@example.com", 3)
+
+	assert.Nil(t, err)
+	assert.Regexp(t, `^jane-doe-clone-3-[0-9a-f]{6}$`, name)
+}
+
+func TestGenerateFreeInstanceNameAvoidsCollisions(t *testing.T) {
+	store := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Name: "jane-3"}}, nil
+		},
+	}
+
+	// Without a suffix, the template can only ever produce a taken name
+	tmpl := template.Must(template.New("name").Parse("{{.User}}-{{.ImageID}}"))
+	_, err := generateFreeInstanceName(store, tmpl, "jane@example.com", 3)
+
+	assert.EqualError(t, err, "No free instance name found after 100 attempts")
+}
+
+func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Create: func(image models.Instance) (models.Instance, error) {
+			t.Error("no instance should be stored for an unready image")
+			return models.Instance{}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instance models.Instance) error {
+			t.Error("no instance should be created from an unready image")
+			return nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: instanceStore,
+		ImageStore:    imageStore,
+		Executor:      executor,
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.UnreadyImageError, response)
+	assert.Nil(t, err)
+}
+
+func TestInstanceCreateReturnsErrorWithImageBeingDestroyed(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true, Destroying: true}, nil
+		},
+	}
+
+	routeSet := Instances{ImageStore: imageStore}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.ImageNotCloneableError, response)
+	assert.Nil(t, err)
+}
+
+func TestInstanceCreateReturnsErrorWithStaleImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true, BackedUpAt: time.Now().Add(-30 * 24 * time.Hour)}, nil
+		},
+	}
+
+	routeSet := Instances{ImageStore: imageStore, MaxImageAge: 7 * 24 * time.Hour}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.CodeStaleImage, response.Code)
+	assert.Contains(t, response.Detail, "backed up 30 days ago")
+	assert.Contains(t, response.Detail, "maximum age of 7 days")
+	assert.Nil(t, err)
+}
+
+func TestInstanceCreateWithStaleImageAllowed(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1", MaxAge: 3600, AllowStale: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances?dry_run=true", body)
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:   instanceStore,
+		ImageStore:      imageStore,
+		MinInstancePort: 5432,
+		MaxInstancePort: 5433,
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+}
+
+func TestInstanceCreateReturnsErrorWithInvalidPayload(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := map[string]string{"this is": "not a valid JSON API request payload"}
+	json.NewEncoder(body).Encode(&request)
+	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+
+	err := Instances{}.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidJSONError, response)
+	assert.Contains(t, logs.String(), "not a jsonapi representation")
+}
+
+func TestInstanceCreateWithInvalidImageID(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "garbage"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+
+	routeSet := Instances{
+		Executor: FakeExecutor{},
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.BadImageIDError, response)
+	assert.Contains(t, logs.String(), "parsing \\\"garbage\\\": invalid syntax")
+	assert.Nil(t, err)
+}
+
+func TestInstanceList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances", nil)
+
+	store := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				models.Instance{
+					ID:        1,
+					Hostname:  "draupnir-server.example.com",
+					ImageID:   1,
+					Port:      5432,
+					CreatedAt: timestamp(),
+					UpdatedAt: timestamp(),
+					UserEmail: "test@draupnir",
+				},
+				models.Instance{
+					ID:        2,
+					Hostname:  "draupnir-server.example.com",
+					ImageID:   1,
+					Port:      5433,
+					CreatedAt: timestamp(),
+					UpdatedAt: timestamp(),
+					UserEmail: "otheruser@draupnir",
+				},
+			}, nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store}
+	err := routeSet.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, listInstancesFixture, response)
+	assert.Nil(t, err)
+}
+
+func TestInstanceListCountsOnlyYourInstances(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances", nil)
+
+	store := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				{ID: 1, UserEmail: "test@draupnir"},
+				{ID: 2, UserEmail: "otheruser@draupnir"},
+				{ID: 3, UserEmail: "test@draupnir"},
+			}, nil
+		},
+	}
+
+	err := Instances{InstanceStore: store}.List(recorder, req)
+
+	var response struct {
+		Meta InstanceListMeta `json:"meta"`
+	}
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, InstanceListMeta{TotalCount: 2}, response.Meta)
+	assert.Nil(t, err)
+}
+
+func TestInstanceGet(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			assert.Equal(t, 1, addr.Instance.ID)
+			assert.Equal(t, "1.2.3.4", addr.IPAddress)
+			return models.WhitelistedAddress{
+				IPAddress: addr.IPAddress,
+				Instance:  addr.Instance,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+			}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			assert.Equal(t, 1, instance.ID)
+			return fakeCredentialsMap, nil
+		},
+		_InstanceConnections: func(ctx context.Context, instance models.Instance) (int, error) {
+			return 0, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:           store,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
+		Executor:                executor,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, getInstanceFixture, response)
+	assert.Equal(t, instanceETag(models.Instance{ID: 1, UpdatedAt: timestamp()}), recorder.Header().Get("ETag"))
+}
+
+func TestInstanceGetCountsConnections(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, Port: 5432, MaxConnections: 20, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveInstanceCredentials: func(ctx context.Context, instance models.Instance) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+		_InstanceConnections: func(ctx context.Context, instance models.Instance) (int, error) {
+			assert.Equal(t, 1, instance.ID)
+			return 3, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:           store,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		ApplyWhitelist:          func(s string) {},
+		Executor:                executor,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response models.Instance
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, 20, response.MaxConnections)
+	assert.Equal(t, 3, response.Connections)
+}
+
+func TestInstanceGetFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			assert.Equal(t, 1, id)
+
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "otheruser@draupnir",
+			}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: store,
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceGetWhenMissing(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{}, sql.ErrNoRows
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: store,
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceRoutesWithNonNumericID(t *testing.T) {
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			t.Fatal("the store should not be queried")
+			return models.Instance{}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: store,
+	}
+
+	testCases := []struct {
+		method  string
+		path    string
+		handler func(http.ResponseWriter, *http.Request) error
+	}{
+		{"GET", "/instances/{id}", routeSet.Get},
+		{"PATCH", "/instances/{id}", routeSet.Update},
+		{"DELETE", "/instances/{id}", routeSet.Destroy},
+		{"POST", "/instances/{id}/restart", routeSet.Restart},
+		{"POST", "/instances/{id}/snapshot", routeSet.Snapshot},
+		{"GET", "/instances/{id}/logs", routeSet.Logs},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			path := strings.Replace(tc.path, "{id}", "abc", 1)
+			req, recorder, _ := createRequest(t, tc.method, path, nil)
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.Methods(tc.method).Path(tc.path).HandlerFunc(errorHandler.Handle(tc.handler))
+			router.ServeHTTP(recorder, req)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, api.BadInstanceIDError, response)
+			assert.Nil(t, errorHandler.Error)
+		})
+	}
+}
+
+func TestInstanceUpdate(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &UpdateInstanceRequest{Name: "bug-1234"})
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+
+	renamedAt := timestamp().Add(time.Hour)
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, Name: "my-clone", UpdatedAt: timestamp(), UserEmail: "test@draupnir"}, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Name: "my-clone"}, {ID: 2, Name: "other-clone"}}, nil
+		},
+		_Rename: func(instance models.Instance, name string) (models.Instance, error) {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, "bug-1234", name)
+			instance.Name = name
+			instance.UpdatedAt = renamedAt
+			return instance, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Update)).Methods("PATCH")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var instance models.Instance
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &instance))
+	assert.Equal(t, "bug-1234", instance.Name)
+	assert.Equal(t, instanceETag(models.Instance{ID: 1, UpdatedAt: renamedAt}), recorder.Header().Get("ETag"))
+}
+
+// TestInstanceUpdateWithETagFromPreviousUpdate renames an instance twice, the
+// second time with the ETag returned by the first. The store keeps timestamps to
+// the microsecond, as postgres does, but hands back a finer one from Rename.
+func TestInstanceUpdateWithETagFromPreviousUpdate(t *testing.T) {
+	stored := models.Instance{ID: 1, Name: "my-clone", UpdatedAt: timestamp(), UserEmail: "test@draupnir"}
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return stored, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{stored}, nil
+		},
+		_Rename: func(instance models.Instance, name string) (models.Instance, error) {
+			if !instance.UpdatedAt.Equal(stored.UpdatedAt) {
+				return instance, sql.ErrNoRows
+			}
+			renamedAt := time.Now()
+			stored.Name = name
+			stored.UpdatedAt = renamedAt.Truncate(time.Microsecond)
+			instance.Name = name
+			instance.UpdatedAt = renamedAt
+			return instance, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Update)).Methods("PATCH")
+
+	rename := func(name, etag string) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer([]byte{})
+		jsonapi.MarshalOnePayload(body, &UpdateInstanceRequest{Name: name})
+		req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := rename("bug-1234", "")
+	assert.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+
+	second := rename("bug-5678", etag)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "bug-5678", stored.Name)
+	assert.NotEqual(t, etag, second.Header().Get("ETag"))
+
+	// The first ETag is now stale
+	third := rename("bug-9012", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, third.Code)
+	assert.Equal(t, "bug-5678", stored.Name)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceUpdateWithTakenName(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &UpdateInstanceRequest{Name: "other-clone"})
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+
+	// The instance is never renamed, so _Rename is not faked
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, Name: "my-clone", UserEmail: "test@draupnir"}, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{{ID: 1, Name: "my-clone"}, {ID: 2, Name: "other-clone"}}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Update)).Methods("PATCH")
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, api.InstanceNameTakenError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceUpdateWithInvalidName(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &UpdateInstanceRequest{Name: "not a/name"})
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, Name: "my-clone", UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Update)).Methods("PATCH")
+	router.ServeHTTP(recorder, req)
+
+	var response api.Errors
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "/data/attributes/name", response.Errors[0].Source.Pointer)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceUpdateFromWrongUser(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &UpdateInstanceRequest{Name: "bug-1234"})
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, Name: "my-clone", UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Update)).Methods("PATCH")
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceDestroy(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
 				CreatedAt: timestamp(),
 				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
 			}, nil
 		},
+		_Touch: func(instance models.Instance) (models.Instance, error) {
+			return instance, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			return nil
+		},
 	}
 
 	executor := FakeExecutor{
-		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
-			assert.Equal(t, 1, id)
-			return fakeCredentialsMap, nil
+		_DestroyInstance: func(ctx context.Context, instance models.Instance) error {
+			return nil
+		},
+	}
+
+	var recorded models.Operation
+	operationStore := FakeOperationStore{
+		_Create: func(operation models.Operation) (models.Operation, error) {
+			recorded = operation
+			return operation, nil
 		},
 	}
 
-	errorHandler := FakeErrorHandler{}
 	routeSet := Instances{
-		InstanceStore:           store,
-		WhitelistedAddressStore: whitelistedAddressStore,
-		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
-		Executor:                executor,
+		InstanceStore:  store,
+		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
+		Executor:       executor,
+		OperationStore: operationStore,
 	}
+
+	errorHandler := FakeErrorHandler{}
 	router := mux.NewRouter()
-	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
 	router.ServeHTTP(recorder, req)
 
-	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, models.OperationDestroyInstance, recorded.Kind)
+	assert.Equal(t, models.OperationSucceeded, recorded.Status)
+	assert.Equal(t, 1, recorded.InstanceID)
+	assert.Equal(t, "test@draupnir", recorded.UserEmail)
+	assert.False(t, recorded.FinishedAt.IsZero(), "the operation is recorded as finished")
 	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, 0, len(recorder.Body.Bytes()))
+}
 
-	var response jsonapi.OnePayload
-	decodeJSON(t, recorder.Body, &response)
+func TestInstanceDestroyWhenAlreadyDestroyed(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
 
-	assert.Equal(t, getInstanceFixture, response)
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{}, sql.ErrNoRows
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, 0, len(recorder.Body.Bytes()))
 }
 
-func TestInstanceGetFromWrongUser(t *testing.T) {
-	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+func TestInstanceDestroyWithStaleETag(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+	req.Header.Set("If-Match", `"1-0"`)
 
 	store := FakeInstanceStore{
 		_Get: func(id int) (models.Instance, error) {
-			assert.Equal(t, 1, id)
-
 			return models.Instance{
 				ID:        1,
-				Hostname:  "draupnir-server.example.com",
 				ImageID:   1,
-				Port:      5432,
 				CreatedAt: timestamp(),
 				UpdatedAt: timestamp(),
-				UserEmail: "otheruser@draupnir",
+				UserEmail: "test@draupnir",
 			}, nil
 		},
+		_Destroy: func(instance models.Instance) error {
+			t.Fatal("instance should not be destroyed")
+			return nil
+		},
 	}
 
-	routeSet := Instances{
-		InstanceStore: store,
-	}
+	routeSet := Instances{InstanceStore: store}
 
 	errorHandler := FakeErrorHandler{}
 	router := mux.NewRouter()
-	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
 	router.ServeHTTP(recorder, req)
 
 	var response api.Error
 	decodeJSON(t, recorder.Body, &response)
 
-	assert.Equal(t, http.StatusNotFound, recorder.Code)
-	assert.Equal(t, api.NotFoundError, response)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	assert.Equal(t, api.PreconditionFailedError, response)
 	assert.Nil(t, errorHandler.Error)
 }
 
-func TestInstanceDestroy(t *testing.T) {
+func TestInstanceDestroyWhenChangedSinceETagChecked(t *testing.T) {
 	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+	req.Header.Set("If-Match", instanceETag(models.Instance{ID: 1, UpdatedAt: timestamp()}))
 
 	store := FakeInstanceStore{
 		_Get: func(id int) (models.Instance, error) {
 			return models.Instance{
 				ID:        1,
-				Hostname:  "draupnir-server.example.com",
 				ImageID:   1,
-				Port:      5432,
 				CreatedAt: timestamp(),
 				UpdatedAt: timestamp(),
 				UserEmail: "test@draupnir",
 			}, nil
 		},
-		_Destroy: func(instance models.Instance) error {
-			return nil
+		// The instance is renamed between the ETag check and the claim
+		_Touch: func(instance models.Instance) (models.Instance, error) {
+			return instance, sql.ErrNoRows
 		},
 	}
 
 	executor := FakeExecutor{
-		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+		_DestroyInstance: func(ctx context.Context, instance models.Instance) error {
+			t.Fatal("instance should not be destroyed")
 			return nil
 		},
 	}
 
-	routeSet := Instances{
-		InstanceStore:  store,
-		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
-		Executor:       executor,
-	}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
 
 	errorHandler := FakeErrorHandler{}
 	router := mux.NewRouter()
 	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
 	router.ServeHTTP(recorder, req)
 
-	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	assert.Equal(t, api.PreconditionFailedError, response)
 	assert.Nil(t, errorHandler.Error)
-	assert.Equal(t, 0, len(recorder.Body.Bytes()))
 }
 
 func TestInstanceDestroyFromWrongUser(t *testing.T) {
@@ -393,7 +1331,7 @@ func TestInstanceDestroyFromWrongUser(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+		_DestroyInstance: func(ctx context.Context, instance models.Instance) error {
 			return nil
 		},
 	}
@@ -428,13 +1366,16 @@ func TestInstanceDestroyFromUploadUser(t *testing.T) {
 				UserEmail: "test@draupnir",
 			}, nil
 		},
+		_Touch: func(instance models.Instance) (models.Instance, error) {
+			return instance, nil
+		},
 		_Destroy: func(instance models.Instance) error {
 			return nil
 		},
 	}
 
 	executor := FakeExecutor{
-		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+		_DestroyInstance: func(ctx context.Context, instance models.Instance) error {
 			return nil
 		},
 	}
@@ -450,6 +1391,7 @@ func TestInstanceDestroyFromUploadUser(t *testing.T) {
 		InstanceStore:  store,
 		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
 		Executor:       executor,
+		OperationStore: acceptingOperationStore(),
 	}
 	router := mux.NewRouter()
 	route := chain.New(errorHandler.Handle).
@@ -462,3 +1404,280 @@ func TestInstanceDestroyFromUploadUser(t *testing.T) {
 	assert.Equal(t, 0, len(recorder.Body.Bytes()))
 	assert.Nil(t, errorHandler.Error)
 }
+
+func TestInstanceRestart(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/restart", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, Port: 5433, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	restarted := false
+	executor := FakeExecutor{
+		_RestartInstance: func(ctx context.Context, instance models.Instance) error {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, uint16(5433), instance.Port)
+			restarted = true
+			return nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/restart", errorHandler.Handle(routeSet.Restart))
+	router.ServeHTTP(recorder, req)
+
+	var response models.Instance
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.True(t, restarted)
+	assert.Equal(t, 1, response.ID)
+	assert.Equal(t, uint16(5433), response.Port)
+}
+
+func TestInstanceRestartFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/restart", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	// The executor isn't faked, as the instance must not be restarted
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: FakeExecutor{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/restart", errorHandler.Handle(routeSet.Restart))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceSnapshot(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := SnapshotInstanceRequest{BackedUpAt: timestamp().Truncate(time.Second)}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/snapshot", body)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, Port: 5433, DataPath: "/draupnir-b", UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{{ID: 2, DefaultDatabase: "app", Ready: true}}, nil
+		},
+		_Create: func(image models.Image) (models.Image, error) {
+			assert.Equal(t, timestamp().Truncate(time.Second), image.BackedUpAt)
+			assert.Equal(t, "/draupnir-b", image.DataPath)
+			assert.Equal(t, "app", image.DefaultDatabase)
+			assert.False(t, image.Ready)
+			image.ID = 3
+			return image, nil
+		},
+		_MarkAsReady: func(image models.Image) (models.Image, error) {
+			image.Ready = true
+			return image, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_SnapshotInstanceToImage: func(ctx context.Context, instance models.Instance, image models.Image) error {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, 3, image.ID)
+			return nil
+		},
+	}
+
+	var recorded models.Operation
+	operationStore := FakeOperationStore{
+		_Create: func(operation models.Operation) (models.Operation, error) {
+			recorded = operation
+			return operation, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:  instanceStore,
+		ImageStore:     imageStore,
+		OperationStore: operationStore,
+		Executor:       executor,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/snapshot", errorHandler.Handle(routeSet.Snapshot))
+	router.ServeHTTP(recorder, req)
+
+	var response models.Image
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "/images/3", recorder.Header().Get("Location"))
+	assert.Equal(t, 3, response.ID)
+	assert.True(t, response.Ready)
+
+	assert.Equal(t, models.OperationSnapshotInstance, recorded.Kind)
+	assert.Equal(t, models.OperationSucceeded, recorded.Status)
+	assert.Equal(t, 1, recorded.InstanceID)
+	assert.Equal(t, 3, recorded.ImageID)
+}
+
+func TestInstanceSnapshotFromWrongUser(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &SnapshotInstanceRequest{})
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/snapshot", body)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	// The image store and executor aren't faked, as no image must be created
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore, ImageStore: FakeImageStore{}, Executor: FakeExecutor{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/snapshot", errorHandler.Handle(routeSet.Snapshot))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceSnapshotWithImageLimitReached(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &SnapshotInstanceRequest{})
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/snapshot", body)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{{ID: 2}}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore, ImageStore: imageStore, Executor: FakeExecutor{}, MaxImages: 1}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/snapshot", errorHandler.Handle(routeSet.Snapshot))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, api.ImageLimitReachedError(1), response)
+}
+
+func TestInstanceLogs(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs?lines=2", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_InstanceLogs: func(ctx context.Context, instance models.Instance, lines int) (string, error) {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, 2, lines)
+			return "LOG:  database system is ready to accept connections\nLOG:  checkpoint starting\n", nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "LOG:  database system is ready to accept connections\nLOG:  checkpoint starting\n", recorder.Body.String())
+}
+
+func TestInstanceLogsFromAdmin(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_InstanceLogs: func(ctx context.Context, instance models.Instance, lines int) (string, error) {
+			assert.Equal(t, defaultLogLines, lines)
+			return "LOG:  checkpoint starting\n", nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:   store,
+		Executor:        executor,
+		AdminUserEmails: []string{"test@draupnir"},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLogsFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: FakeExecutor{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLogsWithInvalidLines(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs?lines=-5", nil)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.BadLinesError, response)
+	assert.Nil(t, errorHandler.Error)
+}
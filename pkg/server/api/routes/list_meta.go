@@ -0,0 +1,42 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/google/jsonapi"
+)
+
+// ImageListMeta is the top-level meta object of the images list
+type ImageListMeta struct {
+	TotalCount int `json:"total_count"`
+	ReadyCount int `json:"ready_count"`
+}
+
+// InstanceListMeta is the top-level meta object of the instances list
+type InstanceListMeta struct {
+	TotalCount int `json:"total_count"`
+}
+
+// ImageAliasListMeta is the top-level meta object of the image aliases list
+type ImageAliasListMeta struct {
+	TotalCount int `json:"total_count"`
+}
+
+// listPayload is a jsonapi list payload with a top-level meta object, which
+// jsonapi.ManyPayload doesn't support
+type listPayload struct {
+	*jsonapi.ManyPayload
+	Meta interface{} `json:"meta"`
+}
+
+// marshalListPayload writes models, a slice of struct pointers, as a jsonapi
+// list payload along with the given meta object
+func marshalListPayload(w io.Writer, models []interface{}, meta interface{}) error {
+	payload, err := jsonapi.MarshalMany(models)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(listPayload{ManyPayload: payload, Meta: meta})
+}
@@ -0,0 +1,164 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/log"
+)
+
+type Operations struct {
+	OperationStore store.OperationStore
+	// AdminUserEmails may list the operations of any user
+	AdminUserEmails []string
+}
+
+// defaultOperationsLimit and maxOperationsLimit bound how many operations are
+// returned by a single request
+const (
+	defaultOperationsLimit = 50
+	maxOperationsLimit     = 500
+)
+
+// OperationListMeta is the top-level meta object of the operations list
+type OperationListMeta struct {
+	TotalCount int `json:"total_count"`
+}
+
+// List returns the user's operations, the most recent first. They may be
+// filtered by kind, status and since, an RFC 3339 timestamp, and limited with
+// limit. Admins may list another user's operations with user.
+func (o Operations) List(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	params := r.URL.Query()
+	query := store.OperationQuery{
+		UserEmail: email,
+		Kind:      params.Get("kind"),
+		Status:    params.Get("status"),
+		Limit:     defaultOperationsLimit,
+	}
+
+	if user := params.Get("user"); user != "" && user != email {
+		if !auth.IsAdmin(email, o.AdminUserEmails) {
+			api.ForbiddenError.Render(w, http.StatusForbidden)
+			return nil
+		}
+		query.UserEmail = user
+	}
+
+	if since := params.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			invalidOperationsParameterError("since", "since must be an RFC 3339 timestamp").Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxOperationsLimit {
+			invalidOperationsParameterError("limit", fmt.Sprintf("limit must be between 1 and %d", maxOperationsLimit)).Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	operations, err := o.OperationStore.List(query)
+	if err != nil {
+		return errors.Wrap(err, "failed to list operations")
+	}
+
+	// Build a slice of pointers to our operations, because this is what jsonapi
+	// wants
+	_operations := make([]interface{}, 0, len(operations))
+	for idx := range operations {
+		_operations = append(_operations, &operations[idx])
+	}
+
+	return errors.Wrap(
+		marshalListPayload(w, _operations, OperationListMeta{TotalCount: len(_operations)}),
+		"failed to marshal operations",
+	)
+}
+
+func invalidOperationsParameterError(parameter string, detail string) api.Error {
+	return api.Error{
+		ID:     "bad_request",
+		Code:   api.CodeBadRequest,
+		Status: "400",
+		Title:  "Bad Request",
+		Detail: detail,
+		Source: api.ErrorSource{
+			Parameter: parameter,
+		},
+	}
+}
+
+// recordOperation stores an operation that was carried out while the client
+// waited, once it is over, so that it appears in the history alongside those
+// carried out in the background. failure is recorded as the operation's error
+// if err is set, as err itself may reveal more than the user should see.
+// Failing to record the operation is only logged.
+func recordOperation(logger log.Logger, operations store.OperationStore, operation models.Operation, err error, failure string) {
+	operation.Status = models.OperationSucceeded
+	if err != nil {
+		operation.Status = models.OperationFailed
+		operation.Error = failure
+	}
+	operation.FinishedAt = time.Now()
+	operation.UpdatedAt = operation.FinishedAt
+
+	if _, err := operations.Create(operation); err != nil {
+		logger.With("error", err.Error()).Error("Failed to record operation")
+	}
+}
+
+func (o Operations) Get(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	operation, err := o.OperationStore.Get(id)
+	if err != nil {
+		logger.With("operation", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if email != operation.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &operation),
+		"failed to marshal operation",
+	)
+}
@@ -0,0 +1,166 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationGet(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations/7", nil)
+
+	store := FakeOperationStore{
+		_Get: func(id int) (models.Operation, error) {
+			assert.Equal(t, 7, id)
+			return models.Operation{
+				ID:         7,
+				Status:     models.OperationSucceeded,
+				InstanceID: 1,
+				UserEmail:  "test@draupnir",
+				CreatedAt:  timestamp(),
+				UpdatedAt:  timestamp(),
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{OperationStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, getOperationFixture, response)
+}
+
+func TestOperationGetFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations/7", nil)
+
+	store := FakeOperationStore{
+		_Get: func(id int) (models.Operation, error) {
+			return models.Operation{
+				ID:        7,
+				Status:    models.OperationPending,
+				UserEmail: "otheruser@draupnir",
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{OperationStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestOperationList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations?kind=create_instance&status=failed&since=2016-01-01T00:00:00Z&limit=10", nil)
+
+	operationStore := FakeOperationStore{
+		_List: func(query store.OperationQuery) ([]models.Operation, error) {
+			assert.Equal(t, store.OperationQuery{
+				UserEmail: "test@draupnir",
+				Kind:      models.OperationCreateInstance,
+				Status:    models.OperationFailed,
+				Since:     time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+				Limit:     10,
+			}, query)
+			return []models.Operation{
+				{
+					ID:         7,
+					Kind:       models.OperationCreateInstance,
+					Status:     models.OperationFailed,
+					InstanceID: 1,
+					Error:      "failed to create instance",
+					UserEmail:  "test@draupnir",
+					CreatedAt:  timestamp(),
+					UpdatedAt:  timestamp(),
+					FinishedAt: timestamp(),
+				},
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{OperationStore: operationStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations", errorHandler.Handle(routeSet.List))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Len(t, response.Data, 1)
+	assert.Equal(t, "create_instance", response.Data[0].Attributes["kind"])
+	assert.Equal(t, "2016-01-01T12:33:44Z", response.Data[0].Attributes["finished_at"])
+}
+
+func TestOperationListOfAnotherUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations?user=otheruser@draupnir", nil)
+
+	operationStore := FakeOperationStore{
+		_List: func(query store.OperationQuery) ([]models.Operation, error) {
+			assert.Equal(t, "otheruser@draupnir", query.UserEmail)
+			return []models.Operation{}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{OperationStore: operationStore, AdminUserEmails: []string{"test@draupnir"}}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations", errorHandler.Handle(routeSet.List))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestOperationListOfAnotherUserWithoutAdmin(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations?user=otheruser@draupnir", nil)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{OperationStore: FakeOperationStore{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations", errorHandler.Handle(routeSet.List))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestOperationListWithInvalidLimit(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations?limit=1000", nil)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{OperationStore: FakeOperationStore{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations", errorHandler.Handle(routeSet.List))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "limit", response.Source.Parameter)
+	assert.Nil(t, errorHandler.Error)
+}
@@ -0,0 +1,74 @@
+//go:build testing
+
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Seed creates canned fixtures for end-to-end tests of draupnir's clients,
+// directly in the stores, so no backup is needed and btrfs and postgres are
+// never touched. It is only compiled into servers built with the testing
+// build tag.
+type Seed struct {
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	// InstancePort is given to every seeded instance, as nothing listens on it
+	InstancePort uint16
+}
+
+// SeedResponse identifies the seeded fixtures
+type SeedResponse struct {
+	ImageID    int `json:"image_id"`
+	InstanceID int `json:"instance_id"`
+}
+
+// seedAnon is the anonymisation script of seeded images
+const seedAnon = "SELECT 1;\n"
+
+// Create seeds a ready image, tagged with the tags query parameter if given,
+// and an instance of it owned by the authenticated user
+func (s Seed) Create(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	image := models.NewImage(time.Now().UTC().Truncate(time.Second), seedAnon, "")
+	image.Tags = r.URL.Query().Get("tags")
+	if _, err := models.ParseTags(image.Tags); err != nil {
+		return errors.Wrap(err, "invalid tags")
+	}
+
+	image, err = s.ImageStore.Create(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to create image")
+	}
+
+	image, err = s.ImageStore.MarkAsReady(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark image as ready")
+	}
+
+	// Without a refresh token the instance is left alone by the cleaner
+	instance := models.NewInstance(image, email, "")
+	instance.Port = s.InstancePort
+	instance, err = s.InstanceStore.Create(instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to create instance")
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(SeedResponse{ImageID: image.ID, InstanceID: instance.ID}),
+		"failed to encode seed response",
+	)
+}
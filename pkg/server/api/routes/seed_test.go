@@ -0,0 +1,55 @@
+//go:build testing
+
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedCreate(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/test/seed?tags=env=test", nil)
+
+	imageStore := FakeImageStore{
+		_Create: func(image models.Image) (models.Image, error) {
+			assert.Equal(t, "env=test", image.Tags)
+			assert.False(t, image.Ready)
+			image.ID = 1
+			return image, nil
+		},
+		_MarkAsReady: func(image models.Image) (models.Image, error) {
+			assert.Equal(t, 1, image.ID)
+			image.Ready = true
+			return image, nil
+		},
+	}
+
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.Equal(t, 1, instance.ImageID)
+			assert.True(t, instance.ImageReady)
+			assert.Equal(t, "test@draupnir", instance.UserEmail)
+			assert.Equal(t, "", instance.RefreshToken)
+			assert.Equal(t, uint16(5432), instance.Port)
+			instance.ID = 2
+			return instance, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Seed{ImageStore: imageStore, InstanceStore: instanceStore, InstancePort: 5432}
+	router := mux.NewRouter()
+	router.HandleFunc("/test/seed", errorHandler.Handle(routeSet.Create))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response SeedResponse
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, SeedResponse{ImageID: 1, InstanceID: 2}, response)
+}
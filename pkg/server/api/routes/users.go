@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+type Users struct {
+	AdminUserEmails []string
+}
+
+// CurrentUser describes who a request is authenticated as
+type CurrentUser struct {
+	Email string `json:"email"`
+	Admin bool   `json:"admin"`
+}
+
+// Me returns the user that the request is authenticated as, so that clients
+// can check that their token works and whose it is
+func (u Users) Me(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	user := CurrentUser{
+		Email: email,
+		Admin: auth.IsAdmin(email, u.AdminUserEmails),
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(
+		json.NewEncoder(w).Encode(user),
+		"failed to encode user",
+	)
+}
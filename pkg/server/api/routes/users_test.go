@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMe(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/me", nil)
+
+	err := Users{}.Me(recorder, req)
+
+	var user CurrentUser
+	decodeJSON(t, recorder.Body, &user)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, CurrentUser{Email: "test@draupnir", Admin: false}, user)
+}
+
+func TestMeFromAdmin(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/me", nil)
+
+	err := Users{AdminUserEmails: []string{"test@draupnir"}}.Me(recorder, req)
+
+	var user CurrentUser
+	decodeJSON(t, recorder.Body, &user)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, CurrentUser{Email: "test@draupnir", Admin: true}, user)
+}
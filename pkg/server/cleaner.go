@@ -20,15 +20,21 @@ type InstanceCleaner struct {
 	instanceStore store.InstanceStore
 	executor      exec.Executor
 	authenticator auth.Authenticator
+	// jitterPercent randomises the interval between cleans by up to this
+	// percentage of it
+	jitterPercent int
+	metrics       BackgroundJobMetrics
 }
 
-func NewInstanceCleaner(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, executor exec.Executor, authenticator auth.Authenticator) *InstanceCleaner {
+func NewInstanceCleaner(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, executor exec.Executor, authenticator auth.Authenticator, jitterPercent int, metrics BackgroundJobMetrics) *InstanceCleaner {
 	return &InstanceCleaner{
 		logger:        logger,
 		sentryClient:  sentryClient,
 		instanceStore: instanceStore,
 		executor:      executor,
 		authenticator: authenticator,
+		jitterPercent: jitterPercent,
+		metrics:       metrics,
 	}
 }
 
@@ -38,42 +44,49 @@ func (ic *InstanceCleaner) Start(ctx context.Context, interval time.Duration) er
 	ctx = context.WithValue(ctx, middleware.LoggerKey, &ic.logger)
 	for {
 		select {
-		case <-time.After(interval):
-			ic.logger.Info("Cleaning old instances with invalid tokens")
-			instances, err := ic.instanceStore.List()
+		case <-time.After(jitteredInterval(interval, ic.jitterPercent)):
+			start := time.Now()
+			ic.clean(ctx)
+			ic.metrics.Observe(start)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (ic *InstanceCleaner) clean(ctx context.Context) {
+	ic.logger.Info("Cleaning old instances with invalid tokens")
+	instances, err := ic.instanceStore.List()
+	if err != nil {
+		err = errors.Wrap(err, "cannot clean instances: unable to list instances")
+		ic.logger.Error(err.Error())
+		ic.sentryClient.CaptureError(err, map[string]string{})
+		return
+	}
+
+	for _, instance := range instances {
+		if instance.RefreshToken != "" {
+			valid, err, validityErr := ic.authenticator.IsRefreshTokenValid(instance.RefreshToken)
 			if err != nil {
-				err = errors.Wrap(err, "cannot clean instances: unable to list instances")
-				ic.logger.Error(err.Error())
+				err = errors.Wrap(err, "failed to validate token")
+				ic.logger.With("instance", instance.ID).Error(err.Error())
 				ic.sentryClient.CaptureError(err, map[string]string{})
-			} else {
-				for _, instance := range instances {
-					if instance.RefreshToken != "" {
-						valid, err, validityErr := ic.authenticator.IsRefreshTokenValid(instance.RefreshToken)
-						if err != nil {
-							err = errors.Wrap(err, "failed to validate token")
-							ic.logger.With("instance", instance.ID).Error(err.Error())
-							ic.sentryClient.CaptureError(err, map[string]string{})
-						} else if !valid {
-							logger := ic.logger.With("instance", instance.ID).With("user", instance.UserEmail)
-							logger.Infof("Token for instance invalid: destroying instance: %s", validityErr.Error())
-							err = ic.destroyInstance(ctx, instance)
-							if err != nil {
-								err = errors.Wrap(err, "failed to destroy instance")
-								logger.Error(err.Error())
-								ic.sentryClient.CaptureError(err, map[string]string{})
-							}
-						}
-					}
+			} else if !valid {
+				logger := ic.logger.With("instance", instance.ID).With("user", instance.UserEmail)
+				logger.Infof("Token for instance invalid: destroying instance: %s", validityErr.Error())
+				err = ic.destroyInstance(ctx, instance)
+				if err != nil {
+					err = errors.Wrap(err, "failed to destroy instance")
+					logger.Error(err.Error())
+					ic.sentryClient.CaptureError(err, map[string]string{})
 				}
 			}
-		case <-ctx.Done():
-			return nil
 		}
 	}
 }
 
 func (ic *InstanceCleaner) destroyInstance(ctx context.Context, instance models.Instance) error {
-	err := ic.executor.DestroyInstance(ctx, instance.ID)
+	err := ic.executor.DestroyInstance(ctx, instance)
 	if err == nil {
 		err = ic.instanceStore.Destroy(instance)
 	}
@@ -2,11 +2,17 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
+	"text/template"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
 )
 
 // HTTPConfig holds Draupnir's HTTP configuration
@@ -15,6 +21,7 @@ type HTTPConfig struct {
 	InsecureListenAddress string `toml:"insecure_listen_address" required:"false"`
 	TLSCertificatePath    string `toml:"tls_certificate" required:"false"`
 	TLSPrivateKeyPath     string `toml:"tls_private_key" required:"false"`
+	UnixSocketPath        string `toml:"unix_socket" required:"false"`
 }
 
 // OAuthConfig holds Draupnir's OAuth configuration
@@ -24,37 +31,109 @@ type OAuthConfig struct {
 	ClientSecret string `toml:"client_secret"`
 }
 
+// ReplicationPeer is another draupnir server that finalised images are copied
+// to. RefreshToken authenticates draupnir with the peer, as a user that may
+// create images there.
+type ReplicationPeer struct {
+	URL          string `toml:"url"`
+	RefreshToken string `toml:"refresh_token"`
+}
+
+const (
+	// StoragePostgres keeps images and instances in the database at
+	// database_url, which is the default
+	StoragePostgres = "postgres"
+	// StorageMemory keeps them in memory, so that the server can be tried out
+	// without a database. Everything is lost when the server stops.
+	StorageMemory = "memory"
+)
+
 // Config holds all Draupnir configuration
 type Config struct {
-	DatabaseURL            string      `toml:"database_url"`
-	DataPath               string      `toml:"data_path"`
-	Environment            string      `toml:"environment"`
-	SharedSecret           string      `toml:"shared_secret"`
-	TrustedUserEmailDomain string      `toml:"trusted_user_email_domain"`
-	PublicHostname         string      `toml:"public_hostname"`
-	SentryDsn              string      `toml:"sentry_dsn" required:"false"`
-	MinInstancePort        uint16      `toml:"min_instance_port"`
-	MaxInstancePort        uint16      `toml:"max_instance_port"`
-	HTTPConfig             HTTPConfig  `toml:"http"`
-	OAuthConfig            OAuthConfig `toml:"oauth"`
-	CleanInterval          string      `toml:"clean_interval"`
-	EnableWhitelisting     bool        `toml:"enable_ip_whitelisting" required:"false"`
-	WhitelisterInterval    string      `toml:"whitelist_reconcile_interval"`
-	TrustedProxyCIDRs      []string    `toml:"trusted_proxy_cidrs" required:"false"`
-	UseXForwardedFor       bool        `toml:"use_x_forwarded_for" required:"false"`
+	DatabaseURL            string            `toml:"database_url" required:"false"`
+	Storage                string            `toml:"storage" required:"false"`
+	DataPath               string            `toml:"data_path"`
+	ExtraDataPaths         []string          `toml:"extra_data_paths" required:"false"`
+	Environment            string            `toml:"environment"`
+	SharedSecret           string            `toml:"shared_secret"`
+	TrustedUserEmailDomain string            `toml:"trusted_user_email_domain"`
+	PublicHostname         string            `toml:"public_hostname"`
+	SentryDsn              string            `toml:"sentry_dsn" required:"false"`
+	MinInstancePort        uint16            `toml:"min_instance_port"`
+	MaxInstancePort        uint16            `toml:"max_instance_port"`
+	HTTPConfig             HTTPConfig        `toml:"http"`
+	OAuthConfig            OAuthConfig       `toml:"oauth"`
+	CleanInterval          string            `toml:"clean_interval"`
+	EnableWhitelisting     bool              `toml:"enable_ip_whitelisting" required:"false"`
+	WhitelisterInterval    string            `toml:"whitelist_reconcile_interval"`
+	TrustedProxyCIDRs      []string          `toml:"trusted_proxy_cidrs" required:"false"`
+	UseXForwardedFor       bool              `toml:"use_x_forwarded_for" required:"false"`
+	RequestTimeout         string            `toml:"request_timeout" required:"false"`
+	UploadRequestTimeout   string            `toml:"upload_request_timeout" required:"false"`
+	AdminUserEmails        []string          `toml:"admin_user_emails" required:"false"`
+	ConnectionTemplate     string            `toml:"connection_template" required:"false"`
+	SkipSelfCheck          bool              `toml:"skip_self_check" required:"false"`
+	InstanceNameTemplate   string            `toml:"instance_name_template" required:"false"`
+	AnonTimeout            string            `toml:"anon_timeout" required:"false"`
+	FinaliseConcurrency    int               `toml:"finalise_concurrency" required:"false"`
+	FinaliseQueueWait      string            `toml:"finalise_queue_wait" required:"false"`
+	ImageCompressionName   string            `toml:"image_compression" required:"false"`
+	BasePath               string            `toml:"base_path" required:"false"`
+	ImageFetchEnv          []string          `toml:"image_fetch_env" required:"false"`
+	PrettyJSON             bool              `toml:"pretty_json" required:"false"`
+	AuthCacheTTL           string            `toml:"auth_cache_ttl" required:"false"`
+	MaxImages              int               `toml:"max_images" required:"false"`
+	ImageCreateTimeout     string            `toml:"image_create_timeout" required:"false"`
+	ReplicationPeers       []ReplicationPeer `toml:"replication_peers" required:"false"`
+	PGOptions              string            `toml:"pg_options" required:"false"`
+	MaxImageAge            string            `toml:"max_image_age" required:"false"`
+	JobJitterPercent       int               `toml:"job_jitter_percent" required:"false"`
+	InstanceMaxConnections int               `toml:"instance_max_connections" required:"false"`
+	InstanceTTL            string            `toml:"instance_ttl" required:"false"`
+	ReapInterval           string            `toml:"reap_interval" required:"false"`
+	MinFreeDiskPercent     int               `toml:"min_free_disk_percent" required:"false"`
+	ShutdownTimeout        string            `toml:"shutdown_timeout" required:"false"`
+	ShutdownDrainDelay     string            `toml:"shutdown_drain_delay" required:"false"`
+}
+
+// Image compression algorithms. CompressionNone, the default, stores images
+// uncompressed; the others are passed to btrfs.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionLzo  = "lzo"
+)
+
+// ImageCompression returns the btrfs compression algorithm that new images
+// should be written with, or empty if they should be stored uncompressed
+func (c Config) ImageCompression() string {
+	if c.ImageCompressionName == CompressionNone {
+		return ""
+	}
+	return c.ImageCompressionName
 }
 
-// Load parses and validates the server config file located at `path`
+// Load parses and validates the server config file located at `path`, with
+// any settings overridden by DRAUPNIR_ environment variables. The file may be
+// missing if the settings are all given by the environment.
 func Load(path string) (Config, error) {
 	var config Config
 	file, err := os.Open(path)
-	if err != nil {
+	if err != nil && !(os.IsNotExist(err) && envOverridesSet()) {
 		return config, errors.Wrap(err, fmt.Sprintf("No configuration file found at %s", path))
 	}
 
-	_, err = toml.DecodeReader(file, &config)
+	if err == nil {
+		defer file.Close()
+		_, err = toml.DecodeReader(file, &config)
+		if err != nil {
+			return config, errors.Wrap(err, "Could not parse configuration file")
+		}
+	}
+
+	err = applyEnvOverrides(reflect.ValueOf(&config).Elem(), reflect.TypeOf(config), EnvPrefix)
 	if err != nil {
-		return config, errors.Wrap(err, "Could not parse configuration file")
+		return config, errors.Wrap(err, "Invalid environment variable")
 	}
 
 	err = validateConfig(config)
@@ -72,6 +151,89 @@ func validateConfig(cfg Config) error {
 	if len(emptyFields) > 0 {
 		return fmt.Errorf("Missing required fields: %v", emptyFields)
 	}
+
+	switch cfg.Storage {
+	case "", StoragePostgres:
+		if cfg.DatabaseURL == "" {
+			return fmt.Errorf("Missing required fields: [database_url]")
+		}
+	case StorageMemory:
+	default:
+		return fmt.Errorf("Invalid storage %q, must be %q or %q", cfg.Storage, StoragePostgres, StorageMemory)
+	}
+
+	switch cfg.ImageCompressionName {
+	case "", CompressionNone, CompressionZstd, CompressionLzo:
+	default:
+		return fmt.Errorf("Invalid image_compression %q, must be %q, %q or %q", cfg.ImageCompressionName, CompressionNone, CompressionZstd, CompressionLzo)
+	}
+
+	// Postgres reserves 3 connections for superusers by default, and refuses
+	// to start unless max_connections exceeds them
+	if cfg.InstanceMaxConnections != 0 && cfg.InstanceMaxConnections <= 3 {
+		return fmt.Errorf("Invalid instance_max_connections %d, must be 0 or more than 3", cfg.InstanceMaxConnections)
+	}
+
+	if cfg.JobJitterPercent < 0 || cfg.JobJitterPercent > 100 {
+		return fmt.Errorf("Invalid job_jitter_percent %d, must be between 0 and 100", cfg.JobJitterPercent)
+	}
+
+	if cfg.MinFreeDiskPercent < 0 || cfg.MinFreeDiskPercent > 100 {
+		return fmt.Errorf("Invalid min_free_disk_percent %d, must be between 0 and 100", cfg.MinFreeDiskPercent)
+	}
+
+	if cfg.MaxImages < 0 {
+		return fmt.Errorf("Invalid max_images %d, must not be negative", cfg.MaxImages)
+	}
+
+	if cfg.BasePath != "" && (!strings.HasPrefix(cfg.BasePath, "/") || strings.HasSuffix(cfg.BasePath, "/")) {
+		return fmt.Errorf("Invalid base_path %q, must start and not end with a /, e.g. /draupnir", cfg.BasePath)
+	}
+
+	for _, variable := range cfg.ImageFetchEnv {
+		if !strings.Contains(variable, "=") {
+			return fmt.Errorf("Invalid image_fetch_env entry %q, must be of the form NAME=VALUE", variable)
+		}
+	}
+
+	for _, peer := range cfg.ReplicationPeers {
+		peerURL, err := url.Parse(peer.URL)
+		if err != nil || (peerURL.Scheme != "http" && peerURL.Scheme != "https") || peerURL.Host == "" {
+			return fmt.Errorf("Invalid replication_peers url %q, must be an http:// or https:// URL", peer.URL)
+		}
+		if peer.RefreshToken == "" {
+			return fmt.Errorf("Missing refresh_token for replication peer %s", peer.URL)
+		}
+	}
+
+	if cfg.ConnectionTemplate != "" {
+		tmpl, err := template.New("connection").Parse(cfg.ConnectionTemplate)
+		if err != nil {
+			return errors.Wrap(err, "Invalid connection_template")
+		}
+		err = tmpl.Execute(ioutil.Discard, models.ConnectionDetails{})
+		if err != nil {
+			return errors.Wrap(err, "Invalid connection_template")
+		}
+	}
+
+	if cfg.PGOptions != "" {
+		if err := models.ValidatePGOptions(cfg.PGOptions); err != nil {
+			return errors.Wrap(err, "Invalid pg_options")
+		}
+	}
+
+	if cfg.InstanceNameTemplate != "" {
+		tmpl, err := template.New("instance_name").Parse(cfg.InstanceNameTemplate)
+		if err != nil {
+			return errors.Wrap(err, "Invalid instance_name_template")
+		}
+		err = tmpl.Execute(ioutil.Discard, models.InstanceNameDetails{})
+		if err != nil {
+			return errors.Wrap(err, "Invalid instance_name_template")
+		}
+	}
+
 	return nil
 }
 
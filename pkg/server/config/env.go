@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EnvPrefix is prepended to the upper-cased name of a setting to give the
+// environment variable that overrides it, e.g. DRAUPNIR_DATABASE_URL for
+// database_url, and DRAUPNIR_HTTP_LISTEN_ADDRESS for http.listen_address
+const EnvPrefix = "DRAUPNIR_"
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadEnvFile reads a .env-style file of KEY=VALUE lines into the process
+// environment. Blank lines, comments starting with # and an `export ` prefix
+// are allowed, and values may be wrapped in single or double quotes. Variables
+// that are already set are left alone, so that the real environment takes
+// precedence. It returns the names of the variables it set.
+func LoadEnvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open env file")
+	}
+	defer file.Close()
+
+	vars := make(map[string]string)
+	names := make([]string, 0)
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("Invalid env file %s, line %d is not NAME=VALUE", path, lineNumber)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if _, ok := vars[name]; !ok {
+			names = append(names, name)
+		}
+		vars[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not read env file")
+	}
+
+	set := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if err := os.Setenv(name, vars[name]); err != nil {
+			return set, errors.Wrapf(err, "Could not set %s", name)
+		}
+		set = append(set, name)
+	}
+
+	return set, nil
+}
+
+// envOverridesSet reports whether any setting is given by the environment
+func envOverridesSet() bool {
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, EnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEnvOverrides sets each setting that has a DRAUPNIR_ environment
+// variable to the variable's value. Lists are comma separated.
+func applyEnvOverrides(val reflect.Value, ty reflect.Type, prefix string) error {
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		name := prefix + strings.ToUpper(ty.Field(i).Tag.Get("toml"))
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(field, ty.Field(i).Type, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid %s", name)
+			}
+			field.SetBool(parsed)
+		case reflect.Int:
+			parsed, err := strconv.ParseInt(value, 10, 0)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid %s", name)
+			}
+			field.SetInt(parsed)
+		case reflect.Uint16:
+			parsed, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid %s", name)
+			}
+			field.SetUint(parsed)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s cannot be set from the environment", name)
+			}
+			items := make([]string, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("%s cannot be set from the environment", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/metrics"
+)
+
+// jitterSource randomises the intervals of background jobs. It is seeded
+// independently of the global source, so that hosts started together don't
+// jitter in step.
+var jitterSource = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// jitteredInterval returns interval moved by a random amount of up to percent
+// of it either way, so that background jobs with the same interval drift apart
+// rather than all running at once. Each wait, including the first after
+// startup, is jittered separately.
+func jitteredInterval(interval time.Duration, percent int) time.Duration {
+	spread := int64(interval) * int64(percent) / 100
+	if spread <= 0 {
+		return interval
+	}
+
+	jitterSource.Lock()
+	defer jitterSource.Unlock()
+	return interval + time.Duration(jitterSource.Int63n(2*spread+1)-spread)
+}
+
+// BackgroundJobMetrics record when a background job last ran, and how long it
+// took, e.g. draupnir_cleaner_last_run_timestamp_seconds
+type BackgroundJobMetrics struct {
+	LastRun         *metrics.Gauge
+	LastRunDuration *metrics.Gauge
+}
+
+func NewBackgroundJobMetrics(job string, description string) BackgroundJobMetrics {
+	return BackgroundJobMetrics{
+		LastRun: metrics.NewGauge(
+			"draupnir_"+job+"_last_run_timestamp_seconds",
+			"When "+description+" last finished, as a Unix timestamp",
+		),
+		LastRunDuration: metrics.NewGauge(
+			"draupnir_"+job+"_last_run_duration_seconds",
+			"How long "+description+" took when it last ran",
+		),
+	}
+}
+
+// Observe records a run of the job that started at start and has just finished
+func (m BackgroundJobMetrics) Observe(start time.Time) {
+	now := time.Now()
+	m.LastRun.Set(float64(now.UnixNano()) / float64(time.Second))
+	m.LastRunDuration.Set(now.Sub(start).Seconds())
+}
+
+func (m BackgroundJobMetrics) Metrics() []metrics.Metric {
+	return []metrics.Metric{m.LastRun, m.LastRunDuration}
+}
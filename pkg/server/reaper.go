@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+)
+
+// InstanceReaper destroys instances once they have outlived their expiry
+// time, so that forgotten instances don't exhaust ports and disk
+type InstanceReaper struct {
+	logger        log.Logger
+	sentryClient  *raven.Client
+	instanceStore store.InstanceStore
+	executor      exec.Executor
+	// jitterPercent randomises the interval between reaps by up to this
+	// percentage of it
+	jitterPercent int
+	metrics       BackgroundJobMetrics
+}
+
+func NewInstanceReaper(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, executor exec.Executor, jitterPercent int, metrics BackgroundJobMetrics) *InstanceReaper {
+	return &InstanceReaper{
+		logger:        logger,
+		sentryClient:  sentryClient,
+		instanceStore: instanceStore,
+		executor:      executor,
+		jitterPercent: jitterPercent,
+		metrics:       metrics,
+	}
+}
+
+func (ir *InstanceReaper) Start(ctx context.Context, interval time.Duration) error {
+	// The exec package logs through the logger in the context
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &ir.logger)
+	for {
+		select {
+		case <-time.After(jitteredInterval(interval, ir.jitterPercent)):
+			start := time.Now()
+			ir.reap(ctx)
+			ir.metrics.Observe(start)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (ir *InstanceReaper) reap(ctx context.Context) {
+	instances, err := ir.instanceStore.List()
+	if err != nil {
+		err = errors.Wrap(err, "cannot reap instances: unable to list instances")
+		ir.logger.Error(err.Error())
+		ir.sentryClient.CaptureError(err, map[string]string{})
+		return
+	}
+
+	now := time.Now()
+	for _, instance := range instances {
+		if !instance.Expired(now) {
+			continue
+		}
+
+		logger := ir.logger.With("instance", instance.ID).With("user", instance.UserEmail)
+		logger.Infof("Instance expired at %s: destroying instance", instance.ExpiresAt.Format(time.RFC3339))
+
+		err := ir.executor.DestroyInstance(ctx, instance)
+		if err == nil {
+			err = ir.instanceStore.Destroy(instance)
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed to destroy expired instance")
+			logger.Error(err.Error())
+			ir.sentryClient.CaptureError(err, map[string]string{})
+		}
+	}
+}
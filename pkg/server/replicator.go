@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	clientPkg "github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/server/config"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// replicationQueueSize is how many finalised images may wait to be
+	// replicated before further images are marked as failed
+	replicationQueueSize = 64
+	// replicationPollInterval is how often a peer's operations are checked on
+	replicationPollInterval = 5 * time.Second
+)
+
+// ImageReplicator copies finalised images to peer draupnir servers, so that a
+// fleet of regional servers can share a catalogue of backups. Each peer
+// fetches the image's backup from the URL it was fetched from here and
+// finalises it with the same anonymisation script, so images whose backup was
+// uploaded are skipped.
+type ImageReplicator struct {
+	logger           log.Logger
+	peers            []config.ReplicationPeer
+	imageStore       store.ImageStore
+	replicationStore store.ReplicationStore
+	queue            chan int
+}
+
+func NewImageReplicator(logger log.Logger, peers []config.ReplicationPeer, imageStore store.ImageStore, replicationStore store.ReplicationStore) *ImageReplicator {
+	return &ImageReplicator{
+		logger:           logger,
+		peers:            peers,
+		imageStore:       imageStore,
+		replicationStore: replicationStore,
+		queue:            make(chan int, replicationQueueSize),
+	}
+}
+
+// Replicate records a pending replication of the image to each peer, and
+// queues the image to be replicated by Start
+func (ir *ImageReplicator) Replicate(image models.Image) {
+	logger := ir.logger.With("image", image.ID)
+
+	replications := make([]models.ImageReplication, 0, len(ir.peers))
+	for _, peer := range ir.peers {
+		replication, err := ir.replicationStore.Create(models.NewImageReplication(image.ID, peer.URL))
+		if err != nil {
+			logger.With("peer", peer.URL).With("error", err.Error()).Error("Failed to record replication")
+			continue
+		}
+		replications = append(replications, replication)
+	}
+
+	select {
+	case ir.queue <- image.ID:
+		logger.Info("Queued image for replication")
+	default:
+		logger.Error("Replication queue is full, not replicating image")
+		for _, replication := range replications {
+			ir.finish(replication, errors.New("replication queue is full"))
+		}
+	}
+}
+
+// Start replicates queued images, one at a time, until ctx is done
+func (ir *ImageReplicator) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case imageID := <-ir.queue:
+			ir.replicateImage(ctx, imageID)
+		}
+	}
+}
+
+func (ir *ImageReplicator) replicateImage(ctx context.Context, imageID int) {
+	logger := ir.logger.With("image", imageID)
+
+	image, err := ir.imageStore.Get(imageID)
+	if err != nil {
+		logger.With("error", err.Error()).Error("Failed to get image to replicate")
+		return
+	}
+
+	replications, err := ir.replicationStore.List(imageID)
+	if err != nil {
+		logger.With("error", err.Error()).Error("Failed to list replications")
+		return
+	}
+
+	for _, replication := range replications {
+		if replication.Status != models.ReplicationPending {
+			continue
+		}
+
+		peer, ok := ir.peer(replication.Peer)
+		if !ok {
+			ir.finish(replication, errors.New("peer is no longer configured"))
+			continue
+		}
+
+		if image.SourceURL == "" {
+			replication.Status = models.ReplicationSkipped
+			replication.Error = "the image's backup was uploaded, so peers can't fetch it"
+			if _, err := ir.replicationStore.Update(replication); err != nil {
+				logger.With("error", err.Error()).Error("Failed to record outcome of replication")
+			}
+			continue
+		}
+
+		logger.With("peer", peer.URL).Info("Replicating image")
+		ir.finish(ir.replicateTo(ctx, image, peer, replication))
+	}
+}
+
+// replicateTo creates the image on the peer, then has the peer fetch and
+// finalise it. If any step fails, the peer's copy of the image is destroyed.
+func (ir *ImageReplicator) replicateTo(ctx context.Context, image models.Image, peer config.ReplicationPeer, replication models.ImageReplication) (models.ImageReplication, error) {
+	client := clientPkg.NewClient(peer.URL, oauth2.Token{RefreshToken: peer.RefreshToken}, false, "replication")
+
+	tags := make([]string, 0)
+	if image.Tags != "" {
+		tags = strings.Split(image.Tags, ",")
+	}
+
+	peerImage, err := client.CreateImage(image.BackedUpAt, []byte(image.Anon), tags, image.DefaultDatabase, false)
+	if duplicate, ok := err.(clientPkg.DuplicateImageError); ok {
+		existing, err := client.GetImage(strconv.Itoa(duplicate.ExistingID))
+		if err == nil && existing.Ready {
+			replication.PeerImageID = existing.ID
+			return replication, nil
+		}
+		return replication, errors.Errorf("peer has an unfinalised image %d of the same backup", duplicate.ExistingID)
+	}
+	if err != nil {
+		return replication, errors.Wrap(err, "failed to create image on peer")
+	}
+
+	replication.PeerImageID = peerImage.ID
+	if replication, err = ir.replicationStore.Update(replication); err != nil {
+		return replication, errors.Wrap(err, "failed to record peer image")
+	}
+
+	err = ir.fetchAndFinalise(ctx, client, peerImage.ID, image.SourceURL)
+	if err != nil {
+		if destroyErr := client.DestroyImage(peerImage); destroyErr != nil {
+			ir.logger.With("peer", peer.URL).With("peer_image", peerImage.ID).With("error", destroyErr.Error()).Error("Failed to clean up image on peer")
+		}
+	}
+	return replication, err
+}
+
+func (ir *ImageReplicator) fetchAndFinalise(ctx context.Context, client clientPkg.Client, imageID int, sourceURL string) error {
+	operation, err := client.FetchImage(imageID, sourceURL)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch backup on peer")
+	}
+	if err := ir.waitForOperation(ctx, client, operation); err != nil {
+		return errors.Wrap(err, "failed to fetch backup on peer")
+	}
+
+	_, operation, err = client.FinaliseImage(imageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to finalise image on peer")
+	}
+	if operation.ID != 0 {
+		if err := ir.waitForOperation(ctx, client, operation); err != nil {
+			return errors.Wrap(err, "failed to finalise image on peer")
+		}
+	}
+
+	return nil
+}
+
+// waitForOperation polls an operation on the peer until it is no longer
+// pending, failing if the operation did
+func (ir *ImageReplicator) waitForOperation(ctx context.Context, client clientPkg.Client, operation models.Operation) error {
+	var err error
+	for operation.Status == models.OperationPending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replicationPollInterval):
+		}
+
+		operation, err = client.GetOperation(strconv.Itoa(operation.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	if operation.Status == models.OperationFailed {
+		return errors.Errorf("operation %d failed: %s", operation.ID, operation.Error)
+	}
+	return nil
+}
+
+// finish records the outcome of a replication
+func (ir *ImageReplicator) finish(replication models.ImageReplication, err error) {
+	logger := ir.logger.With("image", replication.ImageID).With("peer", replication.Peer)
+
+	if err != nil {
+		logger.With("error", err.Error()).Error("Failed to replicate image")
+		replication.Status = models.ReplicationFailed
+		replication.Error = err.Error()
+	} else {
+		logger.With("peer_image", replication.PeerImageID).Info("Replicated image")
+		replication.Status = models.ReplicationSucceeded
+	}
+
+	if _, err := ir.replicationStore.Update(replication); err != nil {
+		logger.With("error", err.Error()).Error("Failed to record outcome of replication")
+	}
+}
+
+func (ir *ImageReplicator) peer(url string) (config.ReplicationPeer, bool) {
+	for _, peer := range ir.peers {
+		if peer.URL == url {
+			return peer, true
+		}
+	}
+	return config.ReplicationPeer{}, false
+}
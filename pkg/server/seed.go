@@ -0,0 +1,29 @@
+//go:build testing
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// registerSeedRoute serves POST /test/seed, which creates fixtures for
+// end-to-end tests. It is only compiled with the testing build tag, which
+// release builds never set.
+func registerSeedRoute(logger log.Logger, router *mux.Router, apiChain chain.Chain, imageStore store.ImageStore, instanceStore store.InstanceStore, instancePort uint16) {
+	logger.Warn("Built with the testing tag, serving POST /test/seed. Do not use this server in production.")
+
+	seedRouteSet := routes.Seed{
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		InstancePort:  instancePort,
+	}
+
+	router.Methods("POST").Path("/test/seed").Handler(
+		apiChain.Resolve(seedRouteSet.Create),
+	)
+}
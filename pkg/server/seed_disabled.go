@@ -0,0 +1,16 @@
+//go:build !testing
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// registerSeedRoute does nothing, as the seed endpoint is only compiled into
+// servers built with the testing build tag
+func registerSeedRoute(logger log.Logger, router *mux.Router, apiChain chain.Chain, imageStore store.ImageStore, instanceStore store.InstanceStore, instancePort uint16) {
+}
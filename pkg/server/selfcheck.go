@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/gocardless/draupnir/pkg/server/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+)
+
+// selfCheck is a single check that the server can do its job
+type selfCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// SelfCheck loads the configuration and runs the startup self-check, without
+// starting the server
+func SelfCheck(logger log.Logger, envFile string) error {
+	if err := loadEnvFile(logger, envFile); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(ConfigFilePath)
+	if err != nil {
+		return errors.Wrap(err, "Could not load configuration")
+	}
+
+	if cfg.Storage == config.StorageMemory {
+		return runSelfCheck(context.Background(), logger, cfg, memoryDatabase{}, createExecutor(cfg, 0))
+	}
+
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		return errors.Wrap(err, "Could not connect to database")
+	}
+	defer db.Close()
+
+	return runSelfCheck(context.Background(), logger, cfg, db, createExecutor(cfg, 0))
+}
+
+// runSelfCheck verifies that the database is reachable, that subvolumes can be
+// created on every data path and that there is a free port to run instances
+// on, logging the result of each check. This catches misconfiguration at boot
+// rather than on the first request that needs it.
+func runSelfCheck(ctx context.Context, logger log.Logger, cfg config.Config, db routes.Pinger, executor exec.Executor) error {
+	// The exec package requires a logger in the context
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &logger)
+
+	checks := []selfCheck{
+		{name: "database", check: db.PingContext},
+		{name: "subvolumes", check: executor.CheckSubvolumes},
+		{
+			name: "ports",
+			check: func(context.Context) error {
+				return checkPortRange(cfg.MinInstancePort, cfg.MaxInstancePort)
+			},
+		},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.check(ctx); err != nil {
+			logger.With("check", c.name).With("error", err.Error()).Error("Self-check failed")
+			failed++
+			continue
+		}
+		logger.With("check", c.name).Info("Self-check passed")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d self-checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkPortRange returns an error unless at least one port in the instance
+// port range can be listened on
+func checkPortRange(min, max uint16) error {
+	if min > max {
+		return fmt.Errorf("min_instance_port %d is greater than max_instance_port %d", min, max)
+	}
+
+	for port := int(min); port <= int(max); port++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			return listener.Close()
+		}
+	}
+
+	return fmt.Errorf("no ports between %d and %d are free", min, max)
+}
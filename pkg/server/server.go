@@ -5,10 +5,18 @@ import (
 	"database/sql"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/lock"
+	"github.com/gocardless/draupnir/pkg/metrics"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
@@ -26,35 +34,214 @@ import (
 // ConfigFilePath is the expected path of the server configuration file
 const ConfigFilePath = "/etc/draupnir/config.toml"
 
-// Run starts the draupnir server
-// Any error returned is fatal
-func Run(logger log.Logger) error {
+// loadEnvFile loads the variables in the env file at path, if there is one,
+// so that they can override the config file
+func loadEnvFile(logger log.Logger, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	names, err := config.LoadEnvFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Could not load env file")
+	}
+
+	logger.With("env_file", path).With("variables", strings.Join(names, ",")).Info("Loaded env file")
+	return nil
+}
+
+// DefaultRequestTimeout is the maximum time spent serving an API request, if
+// not overridden in the configuration file
+const DefaultRequestTimeout = "60s"
+
+// DefaultUploadRequestTimeout is the maximum time spent serving requests to the
+// image upload routes (creation and finalisation), which are expected to take
+// longer than others, if not overridden in the configuration file
+const DefaultUploadRequestTimeout = "30m"
+
+// DefaultFinaliseQueueWait is how long a finalisation request waits for a
+// slot before being finalised in the background, if finalise_queue_wait isn't
+// configured
+const DefaultFinaliseQueueWait = "10s"
+
+// JSONAPIClientVersion is the first client version that sends request bodies
+// with the JSON:API media type. Older clients send application/json, which is
+// still accepted from them.
+const JSONAPIClientVersion = "5.4.0"
+
+// DefaultImageCreateTimeout is how long creating an image's subvolume may
+// take, if image_create_timeout isn't set
+const DefaultImageCreateTimeout = "2m"
+
+// DefaultAnonTimeout is how long anonymisation scripts may run for, if
+// anon_timeout isn't configured: forever
+const DefaultAnonTimeout = "0s"
+
+// DefaultAuthCacheTTL is how long a token is trusted for after being checked
+// with Google, if auth_cache_ttl isn't configured
+const DefaultAuthCacheTTL = "60s"
+
+// DefaultMaxImageAge is how old an image may be to create instances of, if
+// max_image_age isn't configured: any age
+const DefaultMaxImageAge = "0s"
+
+// DefaultInstanceTTL is how long instances live before they are destroyed, if
+// instance_ttl isn't configured: until their owner destroys them
+const DefaultInstanceTTL = "0s"
+
+// DefaultShutdownDrainDelay is how long the server keeps serving after being
+// asked to shut down, while reporting that it isn't ready, if
+// shutdown_drain_delay isn't configured
+const DefaultShutdownDrainDelay = "0s"
+
+// DefaultReapInterval is how often expired instances are destroyed, if
+// reap_interval isn't configured
+const DefaultReapInterval = "5m"
+
+// Run starts the draupnir server. If envFile is set, its variables are loaded
+// into the environment before the config is read. If listen is set, it
+// overrides where the server listens for plain HTTP, and must be of the form
+// unix:PATH. Any error returned is fatal.
+func Run(logger log.Logger, envFile string, listen string) error {
+	startedAt := time.Now()
+
+	if err := loadEnvFile(logger, envFile); err != nil {
+		return err
+	}
+
 	logger.With("config", ConfigFilePath).Info("Loading config file")
 	cfg, err := config.Load(ConfigFilePath)
 	if err != nil {
 		return errors.Wrap(err, "Could not load configuration")
 	}
 
+	if listen != "" {
+		if !strings.HasPrefix(listen, "unix:") || listen == "unix:" {
+			return errors.Errorf("invalid listen address %q, must be of the form unix:PATH", listen)
+		}
+		cfg.HTTPConfig.UnixSocketPath = strings.TrimPrefix(listen, "unix:")
+	}
+
 	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxyCIDRs)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse trusted proxes")
 	}
 
+	requestTimeout, err := parseDurationWithDefault(cfg.RequestTimeout, DefaultRequestTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid request timeout")
+	}
+
+	uploadRequestTimeout, err := parseDurationWithDefault(cfg.UploadRequestTimeout, DefaultUploadRequestTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid upload request timeout")
+	}
+
+	// By default, shutdown waits as long as the longest request may take, so
+	// that no finalisation is cut short
+	shutdownTimeout, err := parseDurationWithDefault(cfg.ShutdownTimeout, uploadRequestTimeout.String())
+	if err != nil {
+		return errors.Wrap(err, "invalid shutdown timeout")
+	}
+
+	shutdownDrainDelay, err := parseDurationWithDefault(cfg.ShutdownDrainDelay, DefaultShutdownDrainDelay)
+	if err != nil {
+		return errors.Wrap(err, "invalid shutdown drain delay")
+	}
+
+	anonTimeout, err := parseDurationWithDefault(cfg.AnonTimeout, DefaultAnonTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid anon timeout")
+	}
+
+	imageCreateTimeout, err := parseDurationWithDefault(cfg.ImageCreateTimeout, DefaultImageCreateTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid image create timeout")
+	}
+
+	finaliseQueueWait, err := parseDurationWithDefault(cfg.FinaliseQueueWait, DefaultFinaliseQueueWait)
+	if err != nil {
+		return errors.Wrap(err, "invalid finalise queue wait")
+	}
+
+	authCacheTTL, err := parseDurationWithDefault(cfg.AuthCacheTTL, DefaultAuthCacheTTL)
+	if err != nil {
+		return errors.Wrap(err, "invalid auth cache ttl")
+	}
+
+	maxImageAge, err := parseDurationWithDefault(cfg.MaxImageAge, DefaultMaxImageAge)
+	if err != nil {
+		return errors.Wrap(err, "invalid max image age")
+	}
+
+	instanceTTL, err := parseDurationWithDefault(cfg.InstanceTTL, DefaultInstanceTTL)
+	if err != nil {
+		return errors.Wrap(err, "invalid instance ttl")
+	}
+
+	reapInterval, err := parseDurationWithDefault(cfg.ReapInterval, DefaultReapInterval)
+	if err != nil {
+		return errors.Wrap(err, "invalid reap interval")
+	}
+	if reapInterval <= 0 {
+		return errors.New("invalid reap interval: must be positive")
+	}
+
 	logger.Info("Configuration successfully loaded")
 
 	logger = log.With("environment", cfg.Environment)
 
 	oauthConfig := createOauthConfig(cfg.OAuthConfig)
-	authenticator := createAuthenticator(cfg, oauthConfig)
-	executor := createExecutor(cfg)
+	authenticator := createAuthenticator(cfg, oauthConfig, authCacheTTL)
+	// Operations on disk are counted and timed, whichever route or background
+	// job performs them
+	executorMetrics := exec.NewExecutorMetrics()
+	executor := exec.InstrumentedExecutor{
+		Executor: createExecutor(cfg, anonTimeout),
+		Metrics:  executorMetrics,
+	}
 
-	db, err := sql.Open("postgres", cfg.DatabaseURL)
-	if err != nil {
-		return errors.Wrap(err, "Could not connect to database")
+	var (
+		database                routes.Pinger
+		imageStore              store.ImageStore
+		instanceStore           store.InstanceStore
+		whitelistedAddressStore store.WhitelistedAddressStore
+		operationStore          store.OperationStore
+		tokenStore              store.TokenStore
+		replicationStore        store.ReplicationStore
+		imageAliasStore         store.ImageAliasStore
+	)
+	if cfg.Storage == config.StorageMemory {
+		logger.Warn("Using in-memory storage, nothing will be persisted")
+		memory := store.NewMemoryStores(cfg.PublicHostname, cfg.ConnectionTemplate, cfg.PGOptions)
+		database = memoryDatabase{}
+		imageStore = memory.Images
+		instanceStore = memory.Instances
+		whitelistedAddressStore = memory.WhitelistedAddresses
+		operationStore = memory.Operations
+		tokenStore = memory.Tokens
+		replicationStore = memory.Replications
+		imageAliasStore = memory.ImageAliases
+	} else {
+		db, err := sql.Open("postgres", cfg.DatabaseURL)
+		if err != nil {
+			return errors.Wrap(err, "Could not connect to database")
+		}
+		database = db
+		imageStore = createImageStore(db)
+		instanceStore = createInstanceStore(db, cfg)
+		whitelistedAddressStore = createWhitelistedAddressStore(db)
+		operationStore = createOperationStore(db)
+		tokenStore = createTokenStore(db)
+		replicationStore = createReplicationStore(db)
+		imageAliasStore = createImageAliasStore(db)
+	}
+
+	if cfg.SkipSelfCheck {
+		logger.Info("Skipping startup self-check")
+	} else if err := runSelfCheck(context.Background(), logger, cfg, database, executor); err != nil {
+		return errors.Wrap(err, "Startup self-check failed")
 	}
-	imageStore := createImageStore(db)
-	instanceStore := createInstanceStore(db, cfg)
-	whitelistedAddressStore := createWhitelistedAddressStore(db)
 
 	sentryClient, err := raven.New(cfg.SentryDsn)
 	if err != nil {
@@ -67,8 +254,12 @@ func Run(logger log.Logger) error {
 	var whitelister *IPAddressWhitelister
 	var whitelisterTriggerFunc func(string)
 
+	cleanerMetrics := NewBackgroundJobMetrics("cleaner", "cleaning instances with invalid tokens")
+	whitelisterMetrics := NewBackgroundJobMetrics("whitelist_reconcile", "reconciling the IP address whitelist")
+	reaperMetrics := NewBackgroundJobMetrics("reaper", "destroying expired instances")
+
 	if cfg.EnableWhitelisting {
-		whitelister = NewIPAddressWhitelister(logger.With("component", "whitelister"), sentryClient, whitelistedAddressStore)
+		whitelister = NewIPAddressWhitelister(logger.With("component", "whitelister"), sentryClient, whitelistedAddressStore, cfg.JobJitterPercent, whitelisterMetrics)
 		whitelisterTriggerFunc = whitelister.TriggerReconcile
 	} else {
 		whitelisterTriggerFunc = func(s string) {
@@ -76,10 +267,46 @@ func Run(logger log.Logger) error {
 		}
 	}
 
+	var finaliseQueue *lock.Semaphore
+	if cfg.FinaliseConcurrency > 0 {
+		finaliseQueue = lock.NewSemaphore(cfg.FinaliseConcurrency)
+	}
+
+	imageCreateTimeoutsCounter := metrics.NewCounter(
+		"draupnir_image_create_timeouts_total",
+		"The number of images whose subvolume creation timed out",
+	)
+
 	imageRouteSet := routes.Images{
-		ImageStore:    imageStore,
-		InstanceStore: instanceStore,
-		Executor:      executor,
+		ImageStore:        imageStore,
+		InstanceStore:     instanceStore,
+		Executor:          executor,
+		FinaliseLocks:     lock.NewKeyedMutex(),
+		FinaliseQueue:     finaliseQueue,
+		FinaliseQueueWait: finaliseQueueWait,
+		OperationStore:    operationStore,
+		Compression:       cfg.ImageCompression(),
+		MaxImages:         cfg.MaxImages,
+		CreateTimeout:     imageCreateTimeout,
+		CreateTimeouts:    imageCreateTimeoutsCounter,
+		ReplicationStore:  replicationStore,
+	}
+
+	var replicator *ImageReplicator
+	if len(cfg.ReplicationPeers) > 0 {
+		replicator = NewImageReplicator(logger.With("component", "replicator"), cfg.ReplicationPeers, imageStore, replicationStore)
+		imageRouteSet.Replicator = replicator
+	}
+
+	imageAliasRouteSet := routes.ImageAliases{
+		ImageAliasStore: imageAliasStore,
+		ImageStore:      imageStore,
+	}
+
+	var nameTemplate *template.Template
+	if cfg.InstanceNameTemplate != "" {
+		// The template has already been validated when loading the config
+		nameTemplate = template.Must(template.New("instance_name").Parse(cfg.InstanceNameTemplate))
 	}
 
 	instanceRouteSet := routes.Instances{
@@ -87,24 +314,134 @@ func Run(logger log.Logger) error {
 		ImageStore:              imageStore,
 		WhitelistedAddressStore: whitelistedAddressStore,
 		ApplyWhitelist:          whitelisterTriggerFunc,
+		OperationStore:          operationStore,
 		Executor:                executor,
 		MinInstancePort:         cfg.MinInstancePort,
 		MaxInstancePort:         cfg.MaxInstancePort,
+		AdminUserEmails:         cfg.AdminUserEmails,
+		NameTemplate:            nameTemplate,
+		MaxImageAge:             maxImageAge,
+		MaxImages:               cfg.MaxImages,
+		MaxConnections:          cfg.InstanceMaxConnections,
+		InstanceTTL:             instanceTTL,
+	}
+
+	operationRouteSet := routes.Operations{
+		OperationStore:  operationStore,
+		AdminUserEmails: cfg.AdminUserEmails,
+	}
+
+	userRouteSet := routes.Users{
+		AdminUserEmails: cfg.AdminUserEmails,
+	}
+
+	// The number of requests currently being served
+	var inFlight int64
+
+	adminRouteSet := routes.Admin{
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		TokenStore:    tokenStore,
+		Executor:      executor,
+		StartedAt:     startedAt,
+		AnonTimeout:   anonTimeout,
+		MaxImages:     cfg.MaxImages,
+		InFlight:      &inFlight,
+		NameTemplate:  nameTemplate,
+	}
+	// Revoking a user's tokens forgets that they were valid, although the
+	// RejectRevokedTokens middleware would reject them anyway
+	if cache, ok := authenticator.(auth.CacheInvalidator); ok {
+		adminRouteSet.AuthCache = cache
+	}
+
+	metricsRegistry := metrics.NewRegistry()
+	healthStatusGauge := metrics.NewGauge(
+		"draupnir_health_status",
+		"The health of the server: 0 if ok, 1 if degraded and 2 if down",
+	)
+	diskFreeGauge := metrics.NewGaugeFunc(
+		"draupnir_disk_free_bytes",
+		"The free space across all data volumes, in bytes",
+		func() (float64, error) {
+			usages, err := executor.DiskUsage(context.Background())
+			if err != nil {
+				return 0, err
+			}
+
+			var free uint64
+			for _, usage := range usages {
+				free += usage.FreeBytes
+			}
+			return float64(free), nil
+		},
+	)
+	finaliseQueueGauge := metrics.NewGaugeFunc(
+		"draupnir_finalise_queue_depth",
+		"The number of image finalisations waiting for a slot",
+		func() (float64, error) {
+			if finaliseQueue == nil {
+				return 0, nil
+			}
+			return float64(finaliseQueue.Waiting()), nil
+		},
+	)
+	metricsRegistry.MustRegister(
+		healthStatusGauge,
+		diskFreeGauge,
+		finaliseQueueGauge,
+		imageCreateTimeoutsCounter,
+	)
+	metricsRegistry.MustRegister(cleanerMetrics.Metrics()...)
+	metricsRegistry.MustRegister(whitelisterMetrics.Metrics()...)
+	metricsRegistry.MustRegister(reaperMetrics.Metrics()...)
+	metricsRegistry.MustRegister(executorMetrics.Metrics()...)
+
+	// draining is set once the server is asked to shut down
+	var draining int32
+
+	healthRouteSet := routes.Health{
+		Database:           database,
+		Executor:           executor,
+		StatusGauge:        healthStatusGauge,
+		MinFreeDiskPercent: cfg.MinFreeDiskPercent,
+		Draining:           func() bool { return atomic.LoadInt32(&draining) == 1 },
 	}
 
 	accessTokenRouteSet := routes.AccessTokens{
-		Callbacks: make(map[string]chan routes.OAuthCallback),
-		Client:    &oauthConfig,
+		Callbacks:  make(map[string]chan routes.OAuthCallback),
+		Client:     &oauthConfig,
+		TokenStore: tokenStore,
 	}
 
-	router := mux.NewRouter()
+	// Every route, including the health check and metrics, is mounted under the
+	// base path, so that draupnir can share a domain with other services
+	rootRouter := mux.NewRouter()
+	router := rootRouter
+	if cfg.BasePath != "" {
+		router = rootRouter.PathPrefix(cfg.BasePath).Subrouter()
+	}
+
+	// Every API request is bounded by a timeout, after which its context is
+	// cancelled and a 503 is rendered. Routes that are involved in uploading an
+	// image are expected to take longer, so are given a separate timeout.
+	withTimeout := func(h http.HandlerFunc) http.Handler {
+		return middleware.Timeout(requestTimeout, h)
+	}
+	withUploadTimeout := func(h http.HandlerFunc) http.Handler {
+		return middleware.Timeout(uploadRequestTimeout, h)
+	}
 
 	// Every request will be logged, and any error raised in serving the request
 	// will also be logged.
 	rootHandler := chain.
 		New(middleware.NewErrorHandler(logger)).
 		Add(middleware.RecordUserIPAddress(logger, trustedProxies, cfg.UseXForwardedFor)).
-		Add(middleware.NewRequestLogger(logger))
+		Add(middleware.NewRequestLogger(logger)).
+		Add(middleware.CountInFlight(&inFlight)).
+		Add(middleware.PrettyJSON(cfg.PrettyJSON)).
+		Add(middleware.RecordFeatures).
+		Add(middleware.RenderErrorDocuments)
 
 	rootHandler = rootHandler.
 		Add(middleware.NewSentryReporter(sentryClient))
@@ -112,16 +449,43 @@ func Run(logger log.Logger) error {
 	// Healthcheck
 	// We don't enforce a particular API version on this route, because it should
 	// be easy to hit to monitor the health of the system.
-	router.Methods("GET").Path("/health_check").HandlerFunc(
+	router.Methods("GET").Path("/health_check").Handler(
+		withTimeout(
+			rootHandler.
+				Add(middleware.WithVersion).
+				Add(middleware.AsJSON).
+				Resolve(healthRouteSet.Check),
+		),
+	)
+
+	// Probes
+	// Liveness only shows that the process is serving requests, whereas
+	// readiness is the health check, so that traffic is only routed to servers
+	// whose dependencies are reachable.
+	router.Methods("GET").Path("/healthz").Handler(
 		rootHandler.
 			Add(middleware.WithVersion).
 			Add(middleware.AsJSON).
-			Resolve(routes.HealthCheck),
+			Resolve(healthRouteSet.Live),
+	)
+	router.Methods("GET").Path("/readyz").Handler(
+		withTimeout(
+			rootHandler.
+				Add(middleware.WithVersion).
+				Add(middleware.AsJSON).
+				Resolve(healthRouteSet.Check),
+		),
 	)
 
+	// Metrics
+	// Like the health check, these are unauthenticated so that they can be
+	// scraped easily.
+	router.Methods("GET").Path("/metrics").Handler(metricsRegistry.Handler())
+
 	// OAuth
 	// These routes are a bit special, because they don't accept or return JSON.
-	// They're intended to be used through a web browser.
+	// They're intended to be used through a web browser, so aren't wrapped in a
+	// timeout (which would render a JSON error).
 	router.Methods("GET").Path("/authenticate").HandlerFunc(
 		rootHandler.
 			Resolve(accessTokenRouteSet.Authenticate),
@@ -141,60 +505,172 @@ func Run(logger log.Logger) error {
 		Add(middleware.WithVersion).
 		Add(middleware.AsJSON).
 		Add(middleware.CheckAPIVersion(version.Version)).
-		Add(middleware.Authenticate(authenticator))
+		Add(middleware.Authenticate(authenticator)).
+		Add(middleware.RejectRevokedTokens(tokenStore))
+
+	// Images, instances and operations are JSON:API resources. Clients from
+	// 5.4.0 must send them with its media type.
+	jsonapiChain := defaultChain.Add(middleware.RequireJSONAPI(JSONAPIClientVersion))
 
 	// Access Tokens
 	// This route is hit before the user is authenticated, so we don't use the
-	// Authenticate middleware
-	router.Methods("POST").Path("/access_tokens").HandlerFunc(
-		rootHandler.
-			Add(middleware.DefaultErrorRenderer).
-			Add(middleware.WithVersion).
-			Add(middleware.AsJSON).
-			Add(middleware.CheckAPIVersion(version.Version)).
-			Resolve(accessTokenRouteSet.Create),
+	// Authenticate middleware.
+	// It blocks until the user has completed the OAuth flow in their browser, so
+	// it is given the longer upload timeout.
+	router.Methods("POST").Path("/access_tokens").Handler(
+		withUploadTimeout(
+			rootHandler.
+				Add(middleware.DefaultErrorRenderer).
+				Add(middleware.WithVersion).
+				Add(middleware.AsJSON).
+				Add(middleware.CheckAPIVersion(version.Version)).
+				Resolve(accessTokenRouteSet.Create),
+		),
+	)
+
+	// Users
+	router.Methods("GET").Path("/me").Handler(
+		withTimeout(defaultChain.Resolve(userRouteSet.Me)),
 	)
 
 	// Images
-	router.Methods("GET").Path("/images").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.List),
+	router.Methods("GET").Path("/images").Handler(
+		withTimeout(jsonapiChain.Resolve(imageRouteSet.List)),
+	)
+
+	router.Methods("POST").Path("/images").Handler(
+		withUploadTimeout(jsonapiChain.Resolve(imageRouteSet.Create)),
+	)
+
+	router.Methods("GET").Path("/images/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(imageRouteSet.Get)),
+	)
+
+	router.Methods("POST").Path("/images/{id}/fetch").Handler(
+		withTimeout(jsonapiChain.Resolve(imageRouteSet.Fetch)),
+	)
+
+	router.Methods("GET").Path("/images/{id}/replications").Handler(
+		withTimeout(jsonapiChain.Resolve(imageRouteSet.Replications)),
+	)
+
+	router.Methods("POST").Path("/images/{id}/done").Handler(
+		withUploadTimeout(jsonapiChain.Resolve(imageRouteSet.Done)),
+	)
+
+	router.Methods("PATCH").Path("/images/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(imageRouteSet.Update)),
 	)
 
-	router.Methods("POST").Path("/images").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Create),
+	router.Methods("DELETE").Path("/images/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(imageRouteSet.Destroy)),
 	)
 
-	router.Methods("GET").Path("/images/{id}").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Get),
+	router.Methods("POST").Path("/images/{id}/promote").Handler(
+		withTimeout(jsonapiChain.Resolve(imageAliasRouteSet.Promote)),
 	)
 
-	router.Methods("POST").Path("/images/{id}/done").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Done),
+	// Image aliases
+	router.Methods("GET").Path("/image_aliases").Handler(
+		withTimeout(jsonapiChain.Resolve(imageAliasRouteSet.List)),
 	)
 
-	router.Methods("DELETE").Path("/images/{id}").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Destroy),
+	router.Methods("GET").Path("/image_aliases/{name}").Handler(
+		withTimeout(jsonapiChain.Resolve(imageAliasRouteSet.Get)),
 	)
 
+	// Fixtures for end-to-end tests, in builds with the testing tag only
+	registerSeedRoute(logger, router, defaultChain, imageStore, instanceStore, cfg.MinInstancePort)
+
 	// Instances
-	router.Methods("GET").Path("/instances").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.List),
+	router.Methods("GET").Path("/instances").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.List)),
+	)
+
+	router.Methods("POST").Path("/instances").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.Create)),
+	)
+
+	router.Methods("GET").Path("/instances/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.Get)),
+	)
+
+	router.Methods("POST").Path("/instances/{id}/restart").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.Restart)),
+	)
+
+	router.Methods("POST").Path("/instances/{id}/snapshot").Handler(
+		withUploadTimeout(jsonapiChain.Resolve(instanceRouteSet.Snapshot)),
+	)
+
+	router.Methods("GET").Path("/instances/{id}/logs").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.Logs)),
+	)
+
+	router.Methods("PATCH").Path("/instances/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.Update)),
 	)
 
-	router.Methods("POST").Path("/instances").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Create),
+	router.Methods("DELETE").Path("/instances/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(instanceRouteSet.Destroy)),
 	)
 
-	router.Methods("GET").Path("/instances/{id}").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Get),
+	// Operations
+	router.Methods("GET").Path("/operations").Handler(
+		withTimeout(jsonapiChain.Resolve(operationRouteSet.List)),
 	)
 
-	router.Methods("DELETE").Path("/instances/{id}").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Destroy),
+	router.Methods("GET").Path("/operations/{id}").Handler(
+		withTimeout(jsonapiChain.Resolve(operationRouteSet.Get)),
 	)
 
-	router.Methods("DELETE").Path("/instances/{id}").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Destroy),
+	// Admin
+	router.Methods("GET").Path("/admin/status").Handler(
+		withTimeout(
+			defaultChain.
+				Add(middleware.RequireAdmin(cfg.AdminUserEmails)).
+				Resolve(adminRouteSet.Status),
+		),
+	)
+
+	router.Methods("GET").Path("/admin/instances").Handler(
+		withTimeout(
+			defaultChain.
+				Add(middleware.RequireAdmin(cfg.AdminUserEmails)).
+				Resolve(adminRouteSet.ListInstances),
+		),
+	)
+
+	router.Methods("POST").Path("/admin/instances/adopt").Handler(
+		withTimeout(
+			defaultChain.
+				Add(middleware.RequireAdmin(cfg.AdminUserEmails)).
+				Resolve(adminRouteSet.AdoptInstance),
+		),
+	)
+
+	router.Methods("POST").Path("/admin/images/gc").Handler(
+		withUploadTimeout(
+			defaultChain.
+				Add(middleware.RequireAdmin(cfg.AdminUserEmails)).
+				Resolve(adminRouteSet.GCImages),
+		),
+	)
+
+	router.Methods("GET").Path("/admin/images/{id}/diff/{other_id}").Handler(
+		withUploadTimeout(
+			defaultChain.
+				Add(middleware.RequireAdmin(cfg.AdminUserEmails)).
+				Resolve(adminRouteSet.DiffImages),
+		),
+	)
+
+	router.Methods("POST").Path("/admin/revoke").Handler(
+		withTimeout(
+			defaultChain.
+				Add(middleware.RequireAdmin(cfg.AdminUserEmails)).
+				Resolve(adminRouteSet.RevokeTokens),
+		),
 	)
 
 	var g rungroup.Group
@@ -203,32 +679,93 @@ func Run(logger log.Logger) error {
 		// The default server for draupnir which will listen on TLS
 		server := http.Server{
 			Addr:    cfg.HTTPConfig.SecureListenAddress,
-			Handler: router,
+			Handler: rootRouter,
 		}
 
-		g.Add(
-			func() error {
-				return server.ListenAndServeTLS(cfg.HTTPConfig.TLSCertificatePath, cfg.HTTPConfig.TLSPrivateKeyPath)
-			},
-			func(error) { server.Shutdown(context.Background()) },
-		)
+		serveGracefully(&g, logger, &server, shutdownTimeout, func() error {
+			return server.ListenAndServeTLS(cfg.HTTPConfig.TLSCertificatePath, cfg.HTTPConfig.TLSPrivateKeyPath)
+		})
 	}
 
 	if cfg.HTTPConfig.InsecureListenAddress != "" {
 		// If configured, then allow connections via a non-TLS port.
 		serverInsecure := http.Server{
 			Addr:    cfg.HTTPConfig.InsecureListenAddress,
-			Handler: router,
+			Handler: rootRouter,
+		}
+
+		serveGracefully(&g, logger, &serverInsecure, shutdownTimeout, serverInsecure.ListenAndServe)
+	}
+
+	if cfg.HTTPConfig.UnixSocketPath != "" {
+		listener, err := listenUnix(cfg.HTTPConfig.UnixSocketPath)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen on unix socket")
 		}
+		logger.With("path", cfg.HTTPConfig.UnixSocketPath).Info("Listening on unix socket")
+
+		// Requests over the socket have no remote address, as they come from a
+		// proxy on the same host, so they are recorded as coming from
+		// localhost. The proxy should set X-Forwarded-For, with
+		// use_x_forwarded_for enabled, to identify the real client.
+		serverUnix := http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.RemoteAddr = "127.0.0.1:0"
+				rootRouter.ServeHTTP(w, r)
+			}),
+		}
+
+		// Shutting down closes the listener, which removes the socket
+		serveGracefully(&g, logger, &serverUnix, shutdownTimeout, func() error { return serverUnix.Serve(listener) })
+	}
+
+	if cfg.HTTPConfig.SecureListenAddress == "" && cfg.HTTPConfig.InsecureListenAddress == "" && cfg.HTTPConfig.UnixSocketPath == "" {
+		return errors.New("Neither a secure or insecure listen was address specified")
+	}
+
+	{
+		// On SIGTERM or SIGINT, readiness fails straight away, so that load
+		// balancers stop routing to the server. After the drain delay, every
+		// other actor is interrupted: the HTTP servers finish their in-flight
+		// requests and the background jobs are cancelled.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		stop := make(chan struct{})
 
 		g.Add(
-			func() error { return serverInsecure.ListenAndServe() },
-			func(error) { serverInsecure.Shutdown(context.Background()) },
+			func() error {
+				select {
+				case sig := <-signals:
+					logger.With("signal", sig.String()).Info("Shutting down")
+					atomic.StoreInt32(&draining, 1)
+					select {
+					case <-time.After(shutdownDrainDelay):
+					case <-stop:
+					}
+					return nil
+				case <-stop:
+					return nil
+				}
+			},
+			func(error) {
+				signal.Stop(signals)
+				close(stop)
+			},
 		)
 	}
 
-	if cfg.HTTPConfig.SecureListenAddress == "" && cfg.HTTPConfig.InsecureListenAddress == "" {
-		return errors.New("Neither a secure or insecure listen was address specified")
+	{
+		// Instances created with an instance_ttl are destroyed once they expire.
+		// The reaper runs regardless, as instances created before the TTL was
+		// removed may still carry an expiry.
+		instanceReaper := NewInstanceReaper(logger.With("component", "reaper"), sentryClient, instanceStore, executor, cfg.JobJitterPercent, reaperMetrics)
+
+		reaperCtx, reaperCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return instanceReaper.Start(reaperCtx, reapInterval) },
+			func(error) { reaperCancel() },
+		)
 	}
 
 	{
@@ -236,9 +773,9 @@ func Run(logger log.Logger) error {
 		// to the PostgreSQL instances only relies on certificate authentication. This
 		// means that is situations, such as a user being offboarded, they will lose
 		// access to the draupnir, but not their instances.
-		logger = logger.With("component", "cleaner")
+		logger := logger.With("component", "cleaner")
 
-		instanceCleaner := NewInstanceCleaner(logger, sentryClient, instanceStore, executor, authenticator)
+		instanceCleaner := NewInstanceCleaner(logger, sentryClient, instanceStore, executor, authenticator, cfg.JobJitterPercent, cleanerMetrics)
 		cleanInterval, err := time.ParseDuration(cfg.CleanInterval)
 		if err != nil {
 			return errors.Wrap(err, "invalid clean interval")
@@ -266,12 +803,87 @@ func Run(logger log.Logger) error {
 		)
 	}
 
+	if replicator != nil {
+		replicatorCtx, replicatorCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return replicator.Start(replicatorCtx) },
+			func(error) { replicatorCancel() },
+		)
+	}
+
 	if err := g.Run(); err != nil {
 		return errors.Wrap(err, "could not start HTTP servers")
 	}
+	logger.Info("Shut down")
 	return nil
 }
 
+// serveGracefully adds an actor to the group that runs serve until it is
+// interrupted, then stops the server accepting requests and waits for those in
+// flight to finish, for up to timeout. Serve returns as soon as shutdown
+// starts, so the actor waits for the shutdown to complete instead.
+func serveGracefully(g *rungroup.Group, logger log.Logger, server *http.Server, timeout time.Duration, serve func() error) {
+	done := make(chan struct{})
+
+	g.Add(
+		func() error {
+			err := serve()
+			if err == http.ErrServerClosed {
+				<-done
+				return nil
+			}
+			return err
+		},
+		func(error) {
+			go func() {
+				defer close(done)
+
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				if err := server.Shutdown(ctx); err != nil {
+					logger.With("error", err.Error()).Warn("Requests were still in flight at shutdown")
+				}
+			}()
+		},
+	)
+}
+
+// listenUnix listens on a unix socket at path, replacing a socket left behind
+// by a previous server. The socket may be used by draupnir's group, so that a
+// proxy running alongside draupnir can connect to it.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "failed to remove stale socket")
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "failed to set socket permissions")
+	}
+
+	return listener, nil
+}
+
+// parseDurationWithDefault parses a duration string from the configuration
+// file, falling back to the given default if it is unset
+func parseDurationWithDefault(value string, defaultValue string) (time.Duration, error) {
+	if value == "" {
+		value = defaultValue
+	}
+	return time.ParseDuration(value)
+}
+
 func createOauthConfig(c config.OAuthConfig) oauth2.Config {
 	return oauth2.Config{
 		ClientID:     c.ClientID,
@@ -300,7 +912,9 @@ func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
 	return trusted, nil
 }
 
-func createAuthenticator(c config.Config, oauthConfig oauth2.Config) auth.Authenticator {
+// createAuthenticator returns an authenticator that caches each token it has
+// checked for cacheTTL, unless it is zero
+func createAuthenticator(c config.Config, oauthConfig oauth2.Config, cacheTTL time.Duration) auth.Authenticator {
 	authenticator := auth.GoogleAuthenticator{
 		OAuthClient:            auth.GoogleOAuthClient{Config: &oauthConfig},
 		SharedSecret:           c.SharedSecret,
@@ -309,7 +923,18 @@ func createAuthenticator(c config.Config, oauthConfig oauth2.Config) auth.Authen
 	if c.Environment == "test" {
 		authenticator.OAuthClient = auth.IntegrationTestOAuthClient{}
 	}
-	return authenticator
+	if cacheTTL == 0 {
+		return authenticator
+	}
+	return auth.NewCachingAuthenticator(authenticator, cacheTTL)
+}
+
+// memoryDatabase stands in for the database when using in-memory storage,
+// which is always available
+type memoryDatabase struct{}
+
+func (memoryDatabase) PingContext(context.Context) error {
+	return nil
 }
 
 func createImageStore(db *sql.DB) store.ImageStore {
@@ -317,13 +942,38 @@ func createImageStore(db *sql.DB) store.ImageStore {
 }
 
 func createInstanceStore(db *sql.DB, cfg config.Config) store.InstanceStore {
-	return store.DBInstanceStore{DB: db, PublicHostname: cfg.PublicHostname}
+	return store.DBInstanceStore{
+		DB:                 db,
+		PublicHostname:     cfg.PublicHostname,
+		ConnectionTemplate: cfg.ConnectionTemplate,
+		PGOptions:          cfg.PGOptions,
+	}
 }
 
 func createWhitelistedAddressStore(db *sql.DB) store.WhitelistedAddressStore {
 	return store.DBWhitelistedAddressStore{DB: db}
 }
 
-func createExecutor(c config.Config) exec.Executor {
-	return exec.OSExecutor{DataPath: c.DataPath}
+func createTokenStore(db *sql.DB) store.TokenStore {
+	return store.DBTokenStore{DB: db}
+}
+
+func createOperationStore(db *sql.DB) store.OperationStore {
+	return store.DBOperationStore{DB: db}
+}
+
+func createReplicationStore(db *sql.DB) store.ReplicationStore {
+	return store.DBReplicationStore{DB: db}
+}
+
+func createImageAliasStore(db *sql.DB) store.ImageAliasStore {
+	return store.DBImageAliasStore{DB: db}
+}
+
+func createExecutor(c config.Config, anonTimeout time.Duration) exec.Executor {
+	return exec.OSExecutor{
+		DataPaths:   append([]string{c.DataPath}, c.ExtraDataPaths...),
+		AnonTimeout: anonTimeout,
+		FetchEnv:    c.ImageFetchEnv,
+	}
 }
@@ -41,13 +41,19 @@ type IPAddressWhitelister struct {
 	sentryClient            *raven.Client
 	whitelistedAddressStore store.WhitelistedAddressStore
 	reconcileTrigger        chan (reconcileRequest)
+	// jitterPercent randomises the interval between timed reconciles by up to
+	// this percentage of it
+	jitterPercent int
+	metrics       BackgroundJobMetrics
 }
 
-func NewIPAddressWhitelister(logger log.Logger, sentryClient *raven.Client, addressStore store.WhitelistedAddressStore) *IPAddressWhitelister {
+func NewIPAddressWhitelister(logger log.Logger, sentryClient *raven.Client, addressStore store.WhitelistedAddressStore, jitterPercent int, metrics BackgroundJobMetrics) *IPAddressWhitelister {
 	return &IPAddressWhitelister{
 		logger:                  logger,
 		sentryClient:            sentryClient,
 		whitelistedAddressStore: addressStore,
+		jitterPercent:           jitterPercent,
+		metrics:                 metrics,
 
 		// Use a capacity of 100 requests. If this is ever reached, and the buffer
 		// fills up, then we'll block API calls from completing.
@@ -76,7 +82,7 @@ func (iw *IPAddressWhitelister) Start(ctx context.Context, interval time.Duratio
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(interval):
+			case <-time.After(jitteredInterval(interval, iw.jitterPercent)):
 				// continue
 			}
 		}
@@ -87,7 +93,9 @@ func (iw *IPAddressWhitelister) Start(ctx context.Context, interval time.Duratio
 		case <-ctx.Done():
 			return nil
 		case request := <-iw.reconcileTrigger:
+			start := time.Now()
 			err = iw.reconcile(ipt, request)
+			iw.metrics.Observe(start)
 			if err != nil {
 				err = errors.Wrap(err, "failed to reconcile whitelist rules")
 				// Given that this is an asynchronous process, and the worst case
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+// ImageAliasStore records which image each alias points to
+type ImageAliasStore interface {
+	List() ([]models.ImageAlias, error)
+	Get(name string) (models.ImageAlias, error)
+	Promote(models.ImageAlias) (models.ImageAlias, error)
+}
+
+type DBImageAliasStore struct {
+	DB *sql.DB
+}
+
+func (s DBImageAliasStore) List() ([]models.ImageAlias, error) {
+	aliases := make([]models.ImageAlias, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT name, image_id, promoted_by, promoted_at
+		 FROM image_aliases
+		 ORDER BY name ASC`,
+	)
+	if err != nil {
+		return aliases, err
+	}
+
+	defer rows.Close()
+
+	var alias models.ImageAlias
+	for rows.Next() {
+		err = rows.Scan(&alias.Name, &alias.ImageID, &alias.PromotedBy, &alias.PromotedAt)
+		if err != nil {
+			return aliases, err
+		}
+
+		aliases = append(aliases, alias)
+	}
+
+	return aliases, rows.Err()
+}
+
+func (s DBImageAliasStore) Get(name string) (models.ImageAlias, error) {
+	alias := models.ImageAlias{}
+
+	row := s.DB.QueryRow(
+		`SELECT name, image_id, promoted_by, promoted_at
+		 FROM image_aliases
+		 WHERE name = $1`,
+		name,
+	)
+	err := row.Scan(&alias.Name, &alias.ImageID, &alias.PromotedBy, &alias.PromotedAt)
+	return alias, err
+}
+
+// Promote points the alias at its image, creating it if it doesn't exist. This
+// is a single statement, so concurrent promotions of the same alias are
+// serialised by the database, and the last to commit wins. It fails on the
+// image_aliases_image_id_fkey constraint if the image has been destroyed.
+func (s DBImageAliasStore) Promote(alias models.ImageAlias) (models.ImageAlias, error) {
+	_, err := s.DB.Exec(
+		`INSERT INTO image_aliases (name, image_id, promoted_by, promoted_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (name) DO UPDATE
+		 SET image_id = EXCLUDED.image_id,
+		     promoted_by = EXCLUDED.promoted_by,
+		     promoted_at = EXCLUDED.promoted_at`,
+		alias.Name,
+		alias.ImageID,
+		alias.PromotedBy,
+		alias.PromotedAt,
+	)
+	return alias, err
+}
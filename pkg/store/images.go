@@ -13,6 +13,10 @@ type ImageStore interface {
 	Get(id int) (models.Image, error)
 	Destroy(image models.Image) error
 	MarkAsReady(models.Image) (models.Image, error)
+	MarkAsErrored(image models.Image, message string) (models.Image, error)
+	MarkAsDestroying(models.Image) (models.Image, error)
+	UpdateAnon(image models.Image, anon string) (models.Image, error)
+	SetSourceURL(image models.Image, sourceURL string) (models.Image, error)
 }
 
 type DBImageStore struct {
@@ -23,7 +27,9 @@ func (s DBImageStore) List() ([]models.Image, error) {
 	images := make([]models.Image, 0)
 
 	rows, err := s.DB.Query(
-		`SELECT id, backed_up_at, ready, created_at, updated_at FROM images ORDER BY id ASC`,
+		`SELECT id, backed_up_at, ready, COALESCE(anon, ''), created_at, updated_at, COALESCE(data_path, ''), tags, COALESCE(error, ''), COALESCE(default_database, ''), COALESCE(compression, ''), destroying, COALESCE(source_url, '')
+		 FROM images
+		 ORDER BY id ASC`,
 	)
 	if err != nil {
 		return images, err
@@ -37,14 +43,23 @@ func (s DBImageStore) List() ([]models.Image, error) {
 			&image.ID,
 			&image.BackedUpAt,
 			&image.Ready,
+			&image.Anon,
 			&image.CreatedAt,
 			&image.UpdatedAt,
+			&image.DataPath,
+			&image.Tags,
+			&image.Error,
+			&image.DefaultDatabase,
+			&image.Compression,
+			&image.Destroying,
+			&image.SourceURL,
 		)
 
 		if err != nil {
 			return images, err
 		}
 
+		image.SetAnonStats()
 		images = append(images, image)
 	}
 
@@ -55,7 +70,7 @@ func (s DBImageStore) Get(id int) (models.Image, error) {
 	image := models.Image{}
 
 	row := s.DB.QueryRow(
-		`SELECT id, backed_up_at, ready, anon, created_at, updated_at
+		`SELECT id, backed_up_at, ready, anon, created_at, updated_at, COALESCE(data_path, ''), tags, COALESCE(error, ''), COALESCE(default_database, ''), COALESCE(compression, ''), destroying, COALESCE(source_url, '')
 		FROM images
 		WHERE id = $1`,
 		id,
@@ -67,24 +82,36 @@ func (s DBImageStore) Get(id int) (models.Image, error) {
 		&image.Anon,
 		&image.CreatedAt,
 		&image.UpdatedAt,
+		&image.DataPath,
+		&image.Tags,
+		&image.Error,
+		&image.DefaultDatabase,
+		&image.Compression,
+		&image.Destroying,
+		&image.SourceURL,
 	)
 	if err != nil {
 		return image, err
 	}
 
+	image.SetAnonStats()
 	return image, nil
 }
 
 func (s DBImageStore) Create(image models.Image) (models.Image, error) {
 	row := s.DB.QueryRow(
-		`INSERT INTO images (backed_up_at, ready, anon, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5)
+		`INSERT INTO images (backed_up_at, ready, anon, created_at, updated_at, data_path, tags, default_database, compression)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))
 		 RETURNING id, backed_up_at, ready, created_at, updated_at`,
 		image.BackedUpAt,
 		image.Ready,
 		image.Anon,
 		image.CreatedAt,
 		image.UpdatedAt,
+		image.DataPath,
+		image.Tags,
+		image.DefaultDatabase,
+		image.Compression,
 	)
 
 	err := row.Scan(
@@ -97,6 +124,8 @@ func (s DBImageStore) Create(image models.Image) (models.Image, error) {
 	if err != nil {
 		return image, err
 	}
+
+	image.SetAnonStats()
 	return image, nil
 }
 
@@ -104,10 +133,11 @@ func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 	row := s.DB.QueryRow(
 		`UPDATE images
 		 SET ready = TRUE,
+				 error = NULL,
 				 updated_at = now()
 		 WHERE id = $1
 		 AND ready = $2
-		 RETURNING id, backed_up_at, ready, created_at, updated_at`,
+		 RETURNING id, backed_up_at, ready, created_at, updated_at, COALESCE(data_path, ''), tags, COALESCE(default_database, '')`,
 		image.ID,
 		image.Ready,
 	)
@@ -118,10 +148,103 @@ func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 		&image.Ready,
 		&image.CreatedAt,
 		&image.UpdatedAt,
+		&image.DataPath,
+		&image.Tags,
+		&image.DefaultDatabase,
+	)
+	if err != nil {
+		return image, err
+	}
+
+	image.Error = ""
+	image.SetAnonStats()
+	return image, nil
+}
+
+// MarkAsErrored records why the image could not be finalised
+func (s DBImageStore) MarkAsErrored(image models.Image, message string) (models.Image, error) {
+	row := s.DB.QueryRow(
+		`UPDATE images
+		 SET error = $2,
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING updated_at`,
+		image.ID,
+		message,
+	)
+
+	err := row.Scan(&image.UpdatedAt)
+	if err != nil {
+		return image, err
+	}
+
+	image.Error = message
+	return image, nil
+}
+
+// MarkAsDestroying records that the image is about to be destroyed, so that no
+// more instances are created from it
+func (s DBImageStore) MarkAsDestroying(image models.Image) (models.Image, error) {
+	row := s.DB.QueryRow(
+		`UPDATE images
+		 SET destroying = TRUE,
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING updated_at`,
+		image.ID,
 	)
+
+	err := row.Scan(&image.UpdatedAt)
 	if err != nil {
 		return image, err
 	}
+
+	image.Destroying = true
+	return image, nil
+}
+
+// UpdateAnon replaces the anonymisation script of an image that hasn't been
+// finalised. It returns sql.ErrNoRows if the image is ready, as its script has
+// already been run.
+func (s DBImageStore) UpdateAnon(image models.Image, anon string) (models.Image, error) {
+	row := s.DB.QueryRow(
+		`UPDATE images
+		 SET anon = $2,
+				 updated_at = now()
+		 WHERE id = $1 AND NOT ready
+		 RETURNING updated_at`,
+		image.ID,
+		anon,
+	)
+
+	err := row.Scan(&image.UpdatedAt)
+	if err != nil {
+		return image, err
+	}
+
+	image.Anon = anon
+	image.SetAnonStats()
+	return image, nil
+}
+
+// SetSourceURL records the URL that the image's backup was fetched from
+func (s DBImageStore) SetSourceURL(image models.Image, sourceURL string) (models.Image, error) {
+	row := s.DB.QueryRow(
+		`UPDATE images
+		 SET source_url = $2,
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING updated_at`,
+		image.ID,
+		sourceURL,
+	)
+
+	err := row.Scan(&image.UpdatedAt)
+	if err != nil {
+		return image, err
+	}
+
+	image.SourceURL = sourceURL
 	return image, nil
 }
 
@@ -11,18 +11,22 @@ type InstanceStore interface {
 	Create(models.Instance) (models.Instance, error)
 	List() ([]models.Instance, error)
 	Get(id int) (models.Instance, error)
+	Rename(instance models.Instance, name string) (models.Instance, error)
+	Touch(instance models.Instance) (models.Instance, error)
 	Destroy(instance models.Instance) error
 }
 
 type DBInstanceStore struct {
-	DB             *sql.DB
-	PublicHostname string
+	DB                 *sql.DB
+	PublicHostname     string
+	ConnectionTemplate string
+	PGOptions          string
 }
 
 func (s DBInstanceStore) Create(instance models.Instance) (models.Instance, error) {
 	row := s.DB.QueryRow(
-		`INSERT INTO instances (image_id, port, created_at, updated_at, user_email, refresh_token)
-		 VALUES ($1, $2, $3, $4, $5, $6)
+		`INSERT INTO instances (image_id, port, created_at, updated_at, user_email, refresh_token, data_path, name, expires_at, schema_only, max_connections)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11)
 		 RETURNING id`,
 		instance.ImageID,
 		instance.Port,
@@ -30,10 +34,18 @@ func (s DBInstanceStore) Create(instance models.Instance) (models.Instance, erro
 		instance.UpdatedAt,
 		instance.UserEmail,
 		instance.RefreshToken,
+		instance.DataPath,
+		instance.Name,
+		sql.NullTime{Time: instance.ExpiresAt, Valid: !instance.ExpiresAt.IsZero()},
+		instance.SchemaOnly,
+		instance.MaxConnections,
 	)
 
 	err := row.Scan(&instance.ID)
 	instance.Hostname = s.PublicHostname
+	instance.ConnectionTemplate = s.ConnectionTemplate
+	instance.PGOptions = s.PGOptions
+	instance.SetApplicationName()
 
 	return instance, err
 }
@@ -42,9 +54,11 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 	instances := make([]models.Instance, 0)
 
 	rows, err := s.DB.Query(
-		`SELECT id, image_id, port, created_at, updated_at, user_email, refresh_token
+		`SELECT instances.id, image_id, port, instances.created_at, instances.updated_at, user_email, refresh_token,
+		        COALESCE(instances.data_path, ''), COALESCE(name, ''), instances.expires_at, instances.schema_only, instances.max_connections, images.backed_up_at, images.ready, COALESCE(images.default_database, '')
 		 FROM instances
-		 ORDER BY id ASC`,
+		 JOIN images ON images.id = instances.image_id
+		 ORDER BY instances.id ASC`,
 	)
 	if err != nil {
 		return instances, err
@@ -53,6 +67,7 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 	defer rows.Close()
 
 	var instance models.Instance
+	var expiresAt sql.NullTime
 	for rows.Next() {
 		err = rows.Scan(
 			&instance.ID,
@@ -62,13 +77,25 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 			&instance.UpdatedAt,
 			&instance.UserEmail,
 			&instance.RefreshToken,
+			&instance.DataPath,
+			&instance.Name,
+			&expiresAt,
+			&instance.SchemaOnly,
+			&instance.MaxConnections,
+			&instance.ImageBackedUpAt,
+			&instance.ImageReady,
+			&instance.ImageDefaultDatabase,
 		)
 
 		if err != nil {
 			return instances, err
 		}
 
+		instance.ExpiresAt = expiresAt.Time
 		instance.Hostname = s.PublicHostname
+		instance.ConnectionTemplate = s.ConnectionTemplate
+		instance.PGOptions = s.PGOptions
+		instance.SetApplicationName()
 		instances = append(instances, instance)
 	}
 
@@ -78,10 +105,13 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 func (s DBInstanceStore) Get(id int) (models.Instance, error) {
 	instance := models.Instance{}
 
+	var expiresAt sql.NullTime
 	row := s.DB.QueryRow(
-		`SELECT id, image_id, port, created_at, updated_at, user_email
+		`SELECT instances.id, image_id, port, instances.created_at, instances.updated_at, user_email,
+		        COALESCE(instances.data_path, ''), COALESCE(name, ''), instances.expires_at, instances.schema_only, instances.max_connections, images.backed_up_at, images.ready, COALESCE(images.default_database, '')
 		 FROM instances
-		 WHERE id = $1`,
+		 JOIN images ON images.id = instances.image_id
+		 WHERE instances.id = $1`,
 		id,
 	)
 	err := row.Scan(
@@ -91,15 +121,74 @@ func (s DBInstanceStore) Get(id int) (models.Instance, error) {
 		&instance.CreatedAt,
 		&instance.UpdatedAt,
 		&instance.UserEmail,
+		&instance.DataPath,
+		&instance.Name,
+		&expiresAt,
+		&instance.SchemaOnly,
+		&instance.MaxConnections,
+		&instance.ImageBackedUpAt,
+		&instance.ImageReady,
+		&instance.ImageDefaultDatabase,
 	)
 	if err != nil {
 		return instance, err
 	}
 
+	instance.ExpiresAt = expiresAt.Time
 	instance.Hostname = s.PublicHostname
+	instance.ConnectionTemplate = s.ConnectionTemplate
+	instance.PGOptions = s.PGOptions
+	instance.SetApplicationName()
 	return instance, nil
 }
 
+// Rename gives the instance a new name, failing on the instances_name_key
+// constraint if another instance already has it. It fails with sql.ErrNoRows
+// if the instance has been changed or destroyed since it was fetched.
+//
+// updated_at always moves forward, even when the previous change was made in
+// the same microsecond, so that the instance's ETag changes with it.
+func (s DBInstanceStore) Rename(instance models.Instance, name string) (models.Instance, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instances
+		 SET name = $2,
+		     updated_at = greatest(now(), updated_at + interval '1 microsecond')
+		 WHERE id = $1
+		 AND updated_at = $3
+		 RETURNING updated_at`,
+		instance.ID,
+		name,
+		instance.UpdatedAt,
+	)
+
+	err := row.Scan(&instance.UpdatedAt)
+	if err != nil {
+		return instance, err
+	}
+
+	instance.Name = name
+	return instance, nil
+}
+
+// Touch bumps the instance's updated_at, failing with sql.ErrNoRows if the
+// instance has been changed or destroyed since it was fetched. Changes that
+// can't be undone, like destroying the instance, touch it first so that they
+// can't race with another client's.
+func (s DBInstanceStore) Touch(instance models.Instance) (models.Instance, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instances
+		 SET updated_at = greatest(now(), updated_at + interval '1 microsecond')
+		 WHERE id = $1
+		 AND updated_at = $2
+		 RETURNING updated_at`,
+		instance.ID,
+		instance.UpdatedAt,
+	)
+
+	err := row.Scan(&instance.UpdatedAt)
+	return instance, err
+}
+
 func (s DBInstanceStore) Destroy(instance models.Instance) error {
 	_, err := s.DB.Exec("DELETE FROM instances WHERE id = $1", instance.ID)
 	return err
@@ -0,0 +1,632 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// memory holds the state of the in-memory stores. They share a single mutex so
+// that they can consult each other, as the database would with joins and
+// foreign keys, without risking deadlock.
+type memory struct {
+	sync.Mutex
+	images     map[int]models.Image
+	instances  map[int]models.Instance
+	operations map[int]models.Operation
+	addresses  map[string]models.WhitelistedAddress
+	// replications is keyed by ID
+	replications map[int]models.ImageReplication
+	// aliases is keyed by name
+	aliases map[string]models.ImageAlias
+	// issued and revoked are keyed by token hash and email respectively
+	issued  map[string]time.Time
+	revoked map[string]time.Time
+	// lastIDs is the most recently allocated ID of each kind of record
+	lastIDs map[string]int
+}
+
+// nextID allocates an ID for a new record of the given kind. The caller must
+// hold the lock.
+func (m *memory) nextID(kind string) int {
+	m.lastIDs[kind]++
+	return m.lastIDs[kind]
+}
+
+// MemoryStores implement every store without a database, for running the
+// server locally or in demos. Nothing is persisted across restarts.
+type MemoryStores struct {
+	Images               MemoryImageStore
+	Instances            MemoryInstanceStore
+	Operations           MemoryOperationStore
+	WhitelistedAddresses MemoryWhitelistedAddressStore
+	Tokens               MemoryTokenStore
+	Replications         MemoryReplicationStore
+	ImageAliases         MemoryImageAliasStore
+}
+
+// NewMemoryStores returns empty in-memory stores. Instances are given the
+// public hostname, connection template and session options, as with
+// DBInstanceStore.
+func NewMemoryStores(publicHostname, connectionTemplate, pgOptions string) MemoryStores {
+	m := &memory{
+		images:       make(map[int]models.Image),
+		instances:    make(map[int]models.Instance),
+		operations:   make(map[int]models.Operation),
+		addresses:    make(map[string]models.WhitelistedAddress),
+		replications: make(map[int]models.ImageReplication),
+		aliases:      make(map[string]models.ImageAlias),
+		issued:       make(map[string]time.Time),
+		revoked:      make(map[string]time.Time),
+		lastIDs:      make(map[string]int),
+	}
+
+	return MemoryStores{
+		Images: MemoryImageStore{memory: m},
+		Instances: MemoryInstanceStore{
+			memory:             m,
+			PublicHostname:     publicHostname,
+			ConnectionTemplate: connectionTemplate,
+			PGOptions:          pgOptions,
+		},
+		Operations:           MemoryOperationStore{memory: m},
+		WhitelistedAddresses: MemoryWhitelistedAddressStore{memory: m},
+		Tokens:               MemoryTokenStore{memory: m},
+		Replications:         MemoryReplicationStore{memory: m},
+		ImageAliases:         MemoryImageAliasStore{memory: m},
+	}
+}
+
+// MemoryImageStore is an ImageStore backed by a map
+type MemoryImageStore struct {
+	memory *memory
+}
+
+func (s MemoryImageStore) List() ([]models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	images := make([]models.Image, 0, len(s.memory.images))
+	for _, image := range s.memory.images {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+
+	return images, nil
+}
+
+func (s MemoryImageStore) Get(id int) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	image, ok := s.memory.images[id]
+	if !ok {
+		return models.Image{}, sql.ErrNoRows
+	}
+	return image, nil
+}
+
+func (s MemoryImageStore) Create(image models.Image) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	image.ID = s.memory.nextID("images")
+	image.SetAnonStats()
+	s.memory.images[image.ID] = image
+
+	return image, nil
+}
+
+// MarkAsReady fails with sql.ErrNoRows if the image's readiness has changed
+// since it was fetched, as DBImageStore does
+func (s MemoryImageStore) MarkAsReady(image models.Image) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.images[image.ID]
+	if !ok || stored.Ready != image.Ready {
+		return image, sql.ErrNoRows
+	}
+
+	stored.Ready = true
+	stored.Error = ""
+	stored.UpdatedAt = time.Now()
+	s.memory.images[image.ID] = stored
+
+	return stored, nil
+}
+
+func (s MemoryImageStore) MarkAsErrored(image models.Image, message string) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.images[image.ID]
+	if !ok {
+		return image, sql.ErrNoRows
+	}
+
+	stored.Error = message
+	stored.UpdatedAt = time.Now()
+	s.memory.images[image.ID] = stored
+
+	return stored, nil
+}
+
+func (s MemoryImageStore) MarkAsDestroying(image models.Image) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.images[image.ID]
+	if !ok {
+		return image, sql.ErrNoRows
+	}
+
+	stored.Destroying = true
+	stored.UpdatedAt = time.Now()
+	s.memory.images[image.ID] = stored
+
+	return stored, nil
+}
+
+func (s MemoryImageStore) UpdateAnon(image models.Image, anon string) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.images[image.ID]
+	if !ok || stored.Ready {
+		return image, sql.ErrNoRows
+	}
+
+	stored.Anon = anon
+	stored.SetAnonStats()
+	stored.UpdatedAt = time.Now()
+	s.memory.images[image.ID] = stored
+
+	return stored, nil
+}
+
+func (s MemoryImageStore) SetSourceURL(image models.Image, sourceURL string) (models.Image, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.images[image.ID]
+	if !ok {
+		return image, sql.ErrNoRows
+	}
+
+	stored.SourceURL = sourceURL
+	stored.UpdatedAt = time.Now()
+	s.memory.images[image.ID] = stored
+
+	return stored, nil
+}
+
+// Destroy refuses to destroy an image that has instances, with an error that
+// names the same constraint as the database would. Its replications are
+// destroyed along with it.
+func (s MemoryImageStore) Destroy(image models.Image) error {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	for _, instance := range s.memory.instances {
+		if instance.ImageID == image.ID {
+			return fmt.Errorf(`image %d is still referenced: violates foreign key constraint "instances_image_id_fkey"`, image.ID)
+		}
+	}
+
+	delete(s.memory.images, image.ID)
+	for id, replication := range s.memory.replications {
+		if replication.ImageID == image.ID {
+			delete(s.memory.replications, id)
+		}
+	}
+	for name, alias := range s.memory.aliases {
+		if alias.ImageID == image.ID {
+			delete(s.memory.aliases, name)
+		}
+	}
+	return nil
+}
+
+// MemoryInstanceStore is an InstanceStore backed by a map
+type MemoryInstanceStore struct {
+	memory             *memory
+	PublicHostname     string
+	ConnectionTemplate string
+	PGOptions          string
+}
+
+// decorate fills in the fields that DBInstanceStore derives rather than
+// stores. The caller must hold the lock.
+func (s MemoryInstanceStore) decorate(instance models.Instance) models.Instance {
+	instance.Hostname = s.PublicHostname
+	instance.ConnectionTemplate = s.ConnectionTemplate
+	instance.PGOptions = s.PGOptions
+	instance.SetApplicationName()
+
+	image := s.memory.images[instance.ImageID]
+	instance.ImageBackedUpAt = image.BackedUpAt
+	instance.ImageReady = image.Ready
+	instance.ImageDefaultDatabase = image.DefaultDatabase
+
+	return instance
+}
+
+func (s MemoryInstanceStore) Create(instance models.Instance) (models.Instance, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	if _, ok := s.memory.images[instance.ImageID]; !ok {
+		return instance, fmt.Errorf(`image %d does not exist: violates foreign key constraint "instances_image_id_fkey"`, instance.ImageID)
+	}
+
+	if instance.Name != "" {
+		for _, existing := range s.memory.instances {
+			if existing.Name == instance.Name {
+				return instance, fmt.Errorf(`name %q is taken: violates unique constraint "instances_name_key"`, instance.Name)
+			}
+		}
+	}
+
+	instance.ID = s.memory.nextID("instances")
+	s.memory.instances[instance.ID] = instance
+
+	return s.decorate(instance), nil
+}
+
+func (s MemoryInstanceStore) List() ([]models.Instance, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	instances := make([]models.Instance, 0, len(s.memory.instances))
+	for _, instance := range s.memory.instances {
+		instances = append(instances, s.decorate(instance))
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	return instances, nil
+}
+
+func (s MemoryInstanceStore) Get(id int) (models.Instance, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	instance, ok := s.memory.instances[id]
+	if !ok {
+		return models.Instance{}, sql.ErrNoRows
+	}
+
+	// As with DBInstanceStore, the refresh token is only available via List
+	instance.RefreshToken = ""
+	return s.decorate(instance), nil
+}
+
+// Rename fails with sql.ErrNoRows if the instance has been changed or
+// destroyed since it was fetched, as DBInstanceStore does
+func (s MemoryInstanceStore) Rename(instance models.Instance, name string) (models.Instance, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.instances[instance.ID]
+	if !ok || !stored.UpdatedAt.Equal(instance.UpdatedAt) {
+		return instance, sql.ErrNoRows
+	}
+
+	for _, existing := range s.memory.instances {
+		if existing.ID != instance.ID && existing.Name == name {
+			return instance, fmt.Errorf(`name %q is taken: violates unique constraint "instances_name_key"`, name)
+		}
+	}
+
+	stored.Name = name
+	stored.UpdatedAt = nextUpdatedAt(stored.UpdatedAt)
+	s.memory.instances[instance.ID] = stored
+
+	instance.Name = stored.Name
+	instance.UpdatedAt = stored.UpdatedAt
+	return instance, nil
+}
+
+// Touch fails with sql.ErrNoRows if the instance has been changed or destroyed
+// since it was fetched, as DBInstanceStore does
+func (s MemoryInstanceStore) Touch(instance models.Instance) (models.Instance, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	stored, ok := s.memory.instances[instance.ID]
+	if !ok || !stored.UpdatedAt.Equal(instance.UpdatedAt) {
+		return instance, sql.ErrNoRows
+	}
+
+	stored.UpdatedAt = nextUpdatedAt(stored.UpdatedAt)
+	s.memory.instances[instance.ID] = stored
+
+	instance.UpdatedAt = stored.UpdatedAt
+	return instance, nil
+}
+
+// nextUpdatedAt keeps only the microseconds that postgres would, so that ETags
+// match, and moves on by at least one of them, as DBInstanceStore does, so that
+// a change made in the same microsecond as the last still changes the ETag
+func nextUpdatedAt(previous time.Time) time.Time {
+	now := time.Now().Truncate(time.Microsecond)
+	if now.After(previous) {
+		return now
+	}
+	return previous.Add(time.Microsecond)
+}
+
+// Destroy removes the instance, along with its whitelisted addresses
+func (s MemoryInstanceStore) Destroy(instance models.Instance) error {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	delete(s.memory.instances, instance.ID)
+	for key, address := range s.memory.addresses {
+		if address.Instance.ID == instance.ID {
+			delete(s.memory.addresses, key)
+		}
+	}
+
+	return nil
+}
+
+// MemoryOperationStore is an OperationStore backed by a map
+type MemoryOperationStore struct {
+	memory *memory
+}
+
+func (s MemoryOperationStore) Create(operation models.Operation) (models.Operation, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	operation.ID = s.memory.nextID("operations")
+	s.memory.operations[operation.ID] = operation
+
+	return operation, nil
+}
+
+func (s MemoryOperationStore) Get(id int) (models.Operation, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	operation, ok := s.memory.operations[id]
+	if !ok {
+		return models.Operation{}, sql.ErrNoRows
+	}
+	return operation, nil
+}
+
+func (s MemoryOperationStore) Update(operation models.Operation) (models.Operation, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	if _, ok := s.memory.operations[operation.ID]; !ok {
+		return operation, sql.ErrNoRows
+	}
+
+	operation.UpdatedAt = time.Now()
+	operation.FinishedAt = time.Time{}
+	if operation.Status != models.OperationPending {
+		operation.FinishedAt = s.memory.operations[operation.ID].FinishedAt
+		if operation.FinishedAt.IsZero() {
+			operation.FinishedAt = operation.UpdatedAt
+		}
+	}
+	s.memory.operations[operation.ID] = operation
+
+	return operation, nil
+}
+
+// List returns the operations matching the query, the most recent first
+func (s MemoryOperationStore) List(query OperationQuery) ([]models.Operation, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	operations := make([]models.Operation, 0)
+	for _, operation := range s.memory.operations {
+		if query.Matches(operation) {
+			operations = append(operations, operation)
+		}
+	}
+
+	sort.Slice(operations, func(i, j int) bool {
+		if operations[i].CreatedAt.Equal(operations[j].CreatedAt) {
+			return operations[i].ID > operations[j].ID
+		}
+		return operations[i].CreatedAt.After(operations[j].CreatedAt)
+	})
+
+	if query.Limit > 0 && len(operations) > query.Limit {
+		operations = operations[:query.Limit]
+	}
+	return operations, nil
+}
+
+// MemoryReplicationStore is a ReplicationStore backed by a map
+type MemoryReplicationStore struct {
+	memory *memory
+}
+
+// Create fails if the image has already been replicated to the peer, as the
+// database's unique constraint would
+func (s MemoryReplicationStore) Create(replication models.ImageReplication) (models.ImageReplication, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	for _, existing := range s.memory.replications {
+		if existing.ImageID == replication.ImageID && existing.Peer == replication.Peer {
+			return replication, fmt.Errorf(`image %d is already replicated to %s: violates unique constraint "image_replications_image_id_peer_key"`, replication.ImageID, replication.Peer)
+		}
+	}
+
+	replication.ID = s.memory.nextID("replications")
+	s.memory.replications[replication.ID] = replication
+
+	return replication, nil
+}
+
+func (s MemoryReplicationStore) List(imageID int) ([]models.ImageReplication, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	replications := make([]models.ImageReplication, 0)
+	for _, replication := range s.memory.replications {
+		if replication.ImageID == imageID {
+			replications = append(replications, replication)
+		}
+	}
+	sort.Slice(replications, func(i, j int) bool { return replications[i].ID < replications[j].ID })
+
+	return replications, nil
+}
+
+func (s MemoryReplicationStore) Update(replication models.ImageReplication) (models.ImageReplication, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	if _, ok := s.memory.replications[replication.ID]; !ok {
+		return replication, sql.ErrNoRows
+	}
+
+	replication.UpdatedAt = time.Now()
+	s.memory.replications[replication.ID] = replication
+
+	return replication, nil
+}
+
+// MemoryImageAliasStore is an ImageAliasStore backed by a map
+type MemoryImageAliasStore struct {
+	memory *memory
+}
+
+func (s MemoryImageAliasStore) List() ([]models.ImageAlias, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	aliases := make([]models.ImageAlias, 0, len(s.memory.aliases))
+	for _, alias := range s.memory.aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Name < aliases[j].Name })
+
+	return aliases, nil
+}
+
+func (s MemoryImageAliasStore) Get(name string) (models.ImageAlias, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	alias, ok := s.memory.aliases[name]
+	if !ok {
+		return alias, sql.ErrNoRows
+	}
+	return alias, nil
+}
+
+// Promote fails if the image doesn't exist, as the database's foreign key
+// constraint would
+func (s MemoryImageAliasStore) Promote(alias models.ImageAlias) (models.ImageAlias, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	if _, ok := s.memory.images[alias.ImageID]; !ok {
+		return alias, fmt.Errorf(`image %d does not exist: violates foreign key constraint "image_aliases_image_id_fkey"`, alias.ImageID)
+	}
+
+	s.memory.aliases[alias.Name] = alias
+	return alias, nil
+}
+
+// MemoryWhitelistedAddressStore is a WhitelistedAddressStore backed by a map,
+// keyed by IP address and instance ID
+type MemoryWhitelistedAddressStore struct {
+	memory *memory
+}
+
+func (s MemoryWhitelistedAddressStore) Create(address models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	key := fmt.Sprintf("%s/%d", address.IPAddress, address.Instance.ID)
+	if existing, ok := s.memory.addresses[key]; ok {
+		address.CreatedAt = existing.CreatedAt
+		address.UpdatedAt = time.Now()
+	}
+	s.memory.addresses[key] = address
+
+	return address, nil
+}
+
+// List returns the addresses in the order they were first whitelisted, with
+// only the ID, port and user email of their instance, as
+// DBWhitelistedAddressStore does
+func (s MemoryWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	addresses := make([]models.WhitelistedAddress, 0, len(s.memory.addresses))
+	for _, address := range s.memory.addresses {
+		stored, ok := s.memory.instances[address.Instance.ID]
+		if !ok {
+			continue
+		}
+
+		address.Instance = &models.Instance{
+			ID:        stored.ID,
+			Port:      stored.Port,
+			UserEmail: stored.UserEmail,
+		}
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].CreatedAt.Before(addresses[j].CreatedAt) })
+
+	return addresses, nil
+}
+
+// MemoryTokenStore is a TokenStore backed by maps
+type MemoryTokenStore struct {
+	memory *memory
+}
+
+func (s MemoryTokenStore) RecordIssued(refreshToken string, issuedAt time.Time) error {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	s.memory.issued[hashToken(refreshToken)] = issuedAt
+	return nil
+}
+
+func (s MemoryTokenStore) IssuedAt(refreshToken string) (time.Time, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	issuedAt, ok := s.memory.issued[hashToken(refreshToken)]
+	if !ok {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return issuedAt, nil
+}
+
+func (s MemoryTokenStore) Revoke(email string, revokedAt time.Time) error {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	s.memory.revoked[email] = revokedAt
+	return nil
+}
+
+func (s MemoryTokenStore) RevokedAt(email string) (time.Time, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+
+	revokedAt, ok := s.memory.revoked[email]
+	if !ok {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return revokedAt, nil
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMemoryImage creates an image in the stores, failing the test if it can't
+func newMemoryImage(t *testing.T, stores MemoryStores) models.Image {
+	image, err := stores.Images.Create(models.NewImage(time.Now(), "", "/draupnir"))
+	assert.Nil(t, err)
+	return image
+}
+
+// newMemoryInstance creates an instance of the image in the stores, failing the
+// test if it can't
+func newMemoryInstance(t *testing.T, stores MemoryStores, image models.Image, name string) models.Instance {
+	instance := models.NewInstance(image, "test@draupnir", "refresh-token")
+	instance.Name = name
+	instance, err := stores.Instances.Create(instance)
+	assert.Nil(t, err)
+	return instance
+}
+
+func TestMemoryStoresAllocateIDs(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+
+	first := newMemoryImage(t, stores)
+	second := newMemoryImage(t, stores)
+	assert.Equal(t, 1, first.ID)
+	assert.Equal(t, 2, second.ID)
+
+	// Each kind of record has its own sequence
+	instance := newMemoryInstance(t, stores, first, "")
+	assert.Equal(t, 1, instance.ID)
+
+	// IDs aren't reused once their record is destroyed, as with a serial column
+	assert.Nil(t, stores.Instances.Destroy(instance))
+	instance = newMemoryInstance(t, stores, first, "")
+	assert.Equal(t, 2, instance.ID)
+}
+
+func TestMemoryInstanceStoreCreateWithMissingImage(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+
+	_, err := stores.Instances.Create(models.NewInstance(models.Image{ID: 9}, "test@draupnir", ""))
+
+	// Routes match the constraint name to render a 404
+	assert.Regexp(t, "instances_image_id_fkey", err.Error())
+}
+
+func TestMemoryInstanceStoreNameIsUnique(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+	newMemoryInstance(t, stores, image, "my-clone")
+	other := newMemoryInstance(t, stores, image, "other-clone")
+
+	// Routes match the constraint name to render a 409
+	instance := models.NewInstance(image, "test@draupnir", "")
+	instance.Name = "my-clone"
+	_, err := stores.Instances.Create(instance)
+	assert.Regexp(t, "instances_name_key", err.Error())
+
+	_, err = stores.Instances.Rename(other, "my-clone")
+	assert.Regexp(t, "instances_name_key", err.Error())
+}
+
+func TestMemoryInstanceStoreRenameWhenChanged(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+	instance := newMemoryInstance(t, stores, image, "my-clone")
+
+	renamed, err := stores.Instances.Rename(instance, "bug-1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "bug-1234", renamed.Name)
+
+	// The instance has been renamed since it was fetched
+	_, err = stores.Instances.Rename(instance, "bug-5678")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// The instance has been destroyed, as DBInstanceStore reports it too
+	assert.Nil(t, stores.Instances.Destroy(renamed))
+	_, err = stores.Instances.Rename(renamed, "bug-5678")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestMemoryImageStoreMarkAsReadyWhenChanged(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+
+	ready, err := stores.Images.MarkAsReady(image)
+	assert.Nil(t, err)
+	assert.True(t, ready.Ready)
+
+	// Another finalisation has already marked the image as ready
+	_, err = stores.Images.MarkAsReady(image)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = stores.Images.MarkAsReady(models.Image{ID: 9})
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestMemoryImageStoreDestroyWithInstances(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+	newMemoryInstance(t, stores, image, "")
+
+	// Routes match the constraint name to render a 422
+	err := stores.Images.Destroy(image)
+	assert.Regexp(t, "instances_image_id_fkey", err.Error())
+
+	_, err = stores.Images.Get(image.ID)
+	assert.Nil(t, err, "the image is kept")
+}
+
+func TestMemoryImageStoreDestroyCascades(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+	other := newMemoryImage(t, stores)
+
+	_, err := stores.Replications.Create(models.NewImageReplication(image.ID, "https://peer.example.com"))
+	assert.Nil(t, err)
+	_, err = stores.ImageAliases.Promote(models.NewImageAlias("latest-stable", image.ID, "test@draupnir"))
+	assert.Nil(t, err)
+	_, err = stores.ImageAliases.Promote(models.NewImageAlias("previous", other.ID, "test@draupnir"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, stores.Images.Destroy(image))
+
+	replications, err := stores.Replications.List(image.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, replications)
+
+	_, err = stores.ImageAliases.Get("latest-stable")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = stores.ImageAliases.Get("previous")
+	assert.Nil(t, err, "the other image's alias is kept")
+}
+
+func TestMemoryInstanceStoreDestroyCascades(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+	instance := newMemoryInstance(t, stores, image, "")
+	other := newMemoryInstance(t, stores, image, "")
+
+	for _, i := range []models.Instance{instance, other} {
+		i := i
+		_, err := stores.WhitelistedAddresses.Create(models.NewWhitelistedAddress("1.2.3.4", &i))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, stores.Instances.Destroy(instance))
+
+	addresses, err := stores.WhitelistedAddresses.List()
+	assert.Nil(t, err)
+	assert.Len(t, addresses, 1)
+	assert.Equal(t, other.ID, addresses[0].Instance.ID)
+}
+
+// TestMemoryInstanceStoreConcurrentCreateAndList is most useful with -race
+func TestMemoryInstanceStoreConcurrentCreateAndList(t *testing.T) {
+	stores := NewMemoryStores("draupnir.example.com", "", "")
+	image := newMemoryImage(t, stores)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			instance := models.NewInstance(image, "test@draupnir", "")
+			instance.Name = fmt.Sprintf("clone-%d", i)
+			_, err := stores.Instances.Create(instance)
+			assert.Nil(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := stores.Instances.List()
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	instances, err := stores.Instances.List()
+	assert.Nil(t, err)
+	assert.Len(t, instances, 20)
+
+	ids := make(map[int]bool)
+	for _, instance := range instances {
+		ids[instance.ID] = true
+	}
+	assert.Len(t, ids, 20, "every instance has its own ID")
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type OperationStore interface {
+	Create(models.Operation) (models.Operation, error)
+	Get(id int) (models.Operation, error)
+	List(OperationQuery) ([]models.Operation, error)
+	Update(models.Operation) (models.Operation, error)
+}
+
+// OperationQuery filters the operations returned by List. Empty fields match
+// every operation.
+type OperationQuery struct {
+	UserEmail string
+	Kind      string
+	Status    string
+	// Since excludes operations started before it
+	Since time.Time
+	// Limit is the most operations to return, the most recent first
+	Limit int
+}
+
+// Matches reports whether the operation is selected by the query, ignoring
+// its limit
+func (q OperationQuery) Matches(operation models.Operation) bool {
+	return (q.UserEmail == "" || operation.UserEmail == q.UserEmail) &&
+		(q.Kind == "" || operation.Kind == q.Kind) &&
+		(q.Status == "" || operation.Status == q.Status) &&
+		(q.Since.IsZero() || !operation.CreatedAt.Before(q.Since))
+}
+
+type DBOperationStore struct {
+	DB *sql.DB
+}
+
+const operationColumns = `id, COALESCE(kind, ''), status, COALESCE(instance_id, 0), COALESCE(error, ''), user_email,
+		        created_at, updated_at, COALESCE(image_id, 0), bytes_transferred, finished_at`
+
+func (s DBOperationStore) Create(operation models.Operation) (models.Operation, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO operations (status, instance_id, user_email, created_at, updated_at, image_id, kind, error, finished_at)
+		 VALUES ($1, NULLIF($2, 0), $3, $4, $5, NULLIF($6, 0), NULLIF($7, ''), NULLIF($8, ''), $9)
+		 RETURNING id`,
+		operation.Status,
+		operation.InstanceID,
+		operation.UserEmail,
+		operation.CreatedAt,
+		operation.UpdatedAt,
+		operation.ImageID,
+		operation.Kind,
+		operation.Error,
+		nullTime(operation.FinishedAt),
+	)
+
+	err := row.Scan(&operation.ID)
+	return operation, err
+}
+
+func (s DBOperationStore) Get(id int) (models.Operation, error) {
+	row := s.DB.QueryRow(
+		`SELECT `+operationColumns+`
+		 FROM operations
+		 WHERE id = $1`,
+		id,
+	)
+	return scanOperation(row)
+}
+
+// List returns the operations matching the query, the most recent first
+func (s DBOperationStore) List(query OperationQuery) ([]models.Operation, error) {
+	operations := make([]models.Operation, 0)
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	for _, filter := range []struct{ column, value string }{
+		{"user_email", query.UserEmail},
+		{"kind", query.Kind},
+		{"status", query.Status},
+	} {
+		if filter.value != "" {
+			args = append(args, filter.value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.column, len(args)))
+		}
+	}
+	if !query.Since.IsZero() {
+		args = append(args, query.Since)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+
+	statement := `SELECT ` + operationColumns + ` FROM operations`
+	if len(conditions) > 0 {
+		statement += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	statement += ` ORDER BY created_at DESC, id DESC`
+	if query.Limit > 0 {
+		args = append(args, query.Limit)
+		statement += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.DB.Query(statement, args...)
+	if err != nil {
+		return operations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		operation, err := scanOperation(rows)
+		if err != nil {
+			return operations, err
+		}
+		operations = append(operations, operation)
+	}
+
+	return operations, rows.Err()
+}
+
+// Update records the progress or outcome of an operation. The operation is
+// marked as finished the first time it is updated to a status other than
+// pending.
+func (s DBOperationStore) Update(operation models.Operation) (models.Operation, error) {
+	row := s.DB.QueryRow(
+		`UPDATE operations
+		 SET status = $2,
+		     instance_id = NULLIF($3, 0),
+		     error = NULLIF($4, ''),
+		     bytes_transferred = $5,
+		     updated_at = now(),
+		     finished_at = CASE WHEN $2 = 'pending' THEN NULL ELSE COALESCE(finished_at, now()) END
+		 WHERE id = $1
+		 RETURNING updated_at, finished_at`,
+		operation.ID,
+		operation.Status,
+		operation.InstanceID,
+		operation.Error,
+		operation.BytesTransferred,
+	)
+
+	var finishedAt sql.NullTime
+	err := row.Scan(&operation.UpdatedAt, &finishedAt)
+	operation.FinishedAt = finishedAt.Time
+	return operation, err
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOperation(row scanner) (models.Operation, error) {
+	operation := models.Operation{}
+
+	var finishedAt sql.NullTime
+	err := row.Scan(
+		&operation.ID,
+		&operation.Kind,
+		&operation.Status,
+		&operation.InstanceID,
+		&operation.Error,
+		&operation.UserEmail,
+		&operation.CreatedAt,
+		&operation.UpdatedAt,
+		&operation.ImageID,
+		&operation.BytesTransferred,
+		&finishedAt,
+	)
+	operation.FinishedAt = finishedAt.Time
+
+	return operation, err
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
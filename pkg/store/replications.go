@@ -0,0 +1,93 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+// ReplicationStore records the progress of copying images to peer servers
+type ReplicationStore interface {
+	Create(models.ImageReplication) (models.ImageReplication, error)
+	List(imageID int) ([]models.ImageReplication, error)
+	Update(models.ImageReplication) (models.ImageReplication, error)
+}
+
+type DBReplicationStore struct {
+	DB *sql.DB
+}
+
+func (s DBReplicationStore) Create(replication models.ImageReplication) (models.ImageReplication, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO image_replications (image_id, peer, status, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id`,
+		replication.ImageID,
+		replication.Peer,
+		replication.Status,
+		replication.CreatedAt,
+		replication.UpdatedAt,
+	)
+
+	err := row.Scan(&replication.ID)
+	return replication, err
+}
+
+func (s DBReplicationStore) List(imageID int) ([]models.ImageReplication, error) {
+	replications := make([]models.ImageReplication, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT id, image_id, peer, status, COALESCE(peer_image_id, 0), COALESCE(error, ''), created_at, updated_at
+		 FROM image_replications
+		 WHERE image_id = $1
+		 ORDER BY id ASC`,
+		imageID,
+	)
+	if err != nil {
+		return replications, err
+	}
+
+	defer rows.Close()
+
+	var replication models.ImageReplication
+	for rows.Next() {
+		err = rows.Scan(
+			&replication.ID,
+			&replication.ImageID,
+			&replication.Peer,
+			&replication.Status,
+			&replication.PeerImageID,
+			&replication.Error,
+			&replication.CreatedAt,
+			&replication.UpdatedAt,
+		)
+		if err != nil {
+			return replications, err
+		}
+
+		replications = append(replications, replication)
+	}
+
+	return replications, rows.Err()
+}
+
+// Update records the progress or outcome of a replication
+func (s DBReplicationStore) Update(replication models.ImageReplication) (models.ImageReplication, error) {
+	row := s.DB.QueryRow(
+		`UPDATE image_replications
+		 SET status = $2,
+		     peer_image_id = NULLIF($3, 0),
+		     error = NULLIF($4, ''),
+		     updated_at = now()
+		 WHERE id = $1
+		 RETURNING updated_at`,
+		replication.ID,
+		replication.Status,
+		replication.PeerImageID,
+		replication.Error,
+	)
+
+	err := row.Scan(&replication.UpdatedAt)
+	return replication, err
+}
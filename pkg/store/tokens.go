@@ -0,0 +1,75 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+// TokenStore records when each refresh token was issued, and when each user's
+// tokens were last revoked, so that tokens issued before a revocation can be
+// rejected. Tokens are only stored as hashes, so that the store never holds
+// usable credentials.
+type TokenStore interface {
+	RecordIssued(refreshToken string, issuedAt time.Time) error
+	// IssuedAt fails with sql.ErrNoRows if the token's issue wasn't recorded
+	IssuedAt(refreshToken string) (time.Time, error)
+	Revoke(email string, revokedAt time.Time) error
+	// RevokedAt fails with sql.ErrNoRows if the user's tokens were never revoked
+	RevokedAt(email string) (time.Time, error)
+}
+
+// hashToken identifies a token without revealing it
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type DBTokenStore struct {
+	DB *sql.DB
+}
+
+func (s DBTokenStore) RecordIssued(refreshToken string, issuedAt time.Time) error {
+	_, err := s.DB.Exec(
+		`INSERT INTO issued_tokens (token_hash, issued_at)
+		 VALUES ($1, $2)
+		 ON CONFLICT (token_hash) DO UPDATE SET issued_at = EXCLUDED.issued_at`,
+		hashToken(refreshToken),
+		issuedAt,
+	)
+	return err
+}
+
+func (s DBTokenStore) IssuedAt(refreshToken string) (time.Time, error) {
+	var issuedAt time.Time
+	row := s.DB.QueryRow(
+		"SELECT issued_at FROM issued_tokens WHERE token_hash = $1",
+		hashToken(refreshToken),
+	)
+	err := row.Scan(&issuedAt)
+	return issuedAt, err
+}
+
+func (s DBTokenStore) Revoke(email string, revokedAt time.Time) error {
+	_, err := s.DB.Exec(
+		`INSERT INTO token_revocations (email, revoked_at)
+		 VALUES ($1, $2)
+		 ON CONFLICT (email) DO UPDATE SET revoked_at = EXCLUDED.revoked_at`,
+		email,
+		revokedAt,
+	)
+	return err
+}
+
+func (s DBTokenStore) RevokedAt(email string) (time.Time, error) {
+	var revokedAt time.Time
+	row := s.DB.QueryRow(
+		"SELECT revoked_at FROM token_revocations WHERE email = $1",
+		email,
+	)
+	err := row.Scan(&revokedAt)
+	return revokedAt, err
+}
@@ -32,7 +32,7 @@ RSpec.describe "/images" do
           end
 
         expect(response.code).to eq(401)
-        expect(response.headers[:content_type]).to eq("application/json")
+        expect(response.headers[:content_type]).to eq("application/vnd.api+json")
         expect(JSON.parse(response.body)).to match(
           "status" => "401",
           "id" => "unauthorized",
@@ -52,7 +52,7 @@ RSpec.describe "/images" do
         response = post("/images", post_payload)
 
         expect(response.code).to eq(201)
-        expect(response.headers[:content_type]).to eq("application/json")
+        expect(response.headers[:content_type]).to eq("application/vnd.api+json")
         expect(JSON.parse(response.body)).to match(
           "data" => {
             "type" => "images",
@@ -76,7 +76,7 @@ RSpec.describe "/images" do
       response = get("/images")
 
       expect(response.code).to eq(200)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(JSON.parse(response.body)).to match(
         "data" => [
           {
@@ -90,6 +90,7 @@ RSpec.describe "/images" do
             ),
           },
         ],
+        "meta" => { "total_count" => 1, "ready_count" => 0 },
       )
     end
   end
@@ -103,7 +104,7 @@ RSpec.describe "/images" do
       response = get("/images/#{image_id}")
 
       expect(response.code).to eq(200)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(JSON.parse(response.body)).to match(
         "data" => {
           "type" => "images",
@@ -128,7 +129,7 @@ RSpec.describe "/images" do
       response = delete("/images/#{image_id}")
 
       expect(response.code).to eq(204)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(response.body).to eq("")
     end
   end
@@ -51,12 +51,12 @@ RSpec.describe "/instances" do
       rescue RestClient::UnprocessableEntity => e
         # TODO: fixture
         response = e.response
-        expect(response.headers[:content_type]).to eq("application/json")
+        expect(response.headers[:content_type]).to eq("application/vnd.api+json")
         expect(response.code).to eq(422)
         expect(JSON.parse(response.body)).to match(
           "id" => "unprocessable_entity",
           "status" => "422",
-          "code" => "unprocessable_entity",
+          "code" => "unready_image",
           "title" => "Image Not Ready",
           "detail" => "The specified image is not ready to be used",
           "source" => { "parameter" => "image_id" },
@@ -77,13 +77,17 @@ RSpec.describe "/instances" do
         },
       )
       expect(response.code).to eq(201)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(JSON.parse(response.body)).to match(
         "data" => {
           "id" => String,
           "type" => "instances",
           "attributes" => {
             "hostname" => "localhost",
+            "application_name" => "draupnir-upload",
+            "name" => String,
+            "image_backed_up_at" => String,
+            "image_ready" => true,
             "image_id" => image_id.to_i,
             "port" => Numeric,
             "created_at" => String,
@@ -120,7 +124,7 @@ RSpec.describe "/instances" do
 
       response = get("/instances")
       expect(response.code).to eq(200)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(JSON.parse(response.body)).to match(
         "data" => [
           {
@@ -128,6 +132,10 @@ RSpec.describe "/instances" do
             "type" => "instances",
             "attributes" => {
               "hostname" => "localhost",
+              "application_name" => "draupnir-upload",
+              "name" => String,
+              "image_backed_up_at" => String,
+              "image_ready" => true,
               "image_id" => image_id.to_i,
               "port" => Numeric,
               "updated_at" => String,
@@ -135,6 +143,7 @@ RSpec.describe "/instances" do
             },
           },
         ],
+        "meta" => { "total_count" => 1 },
       )
     end
   end
@@ -146,13 +155,17 @@ RSpec.describe "/instances" do
 
       response = get("/instances/#{instance_id}")
       expect(response.code).to eq(200)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(JSON.parse(response.body)).to match(
         "data" => {
           "id" => String,
           "type" => "instances",
           "attributes" => {
             "hostname" => "localhost",
+            "application_name" => "draupnir-upload",
+            "name" => String,
+            "image_backed_up_at" => String,
+            "image_ready" => true,
             "image_id" => image_id.to_i,
             "port" => Numeric,
             "updated_at" => String,
@@ -187,7 +200,7 @@ RSpec.describe "/instances" do
 
       response = get("/instances/#{instance_id}")
       expect(response.code).to eq(200)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
 
       body = JSON.parse(response.body)
       creds = body["included"][0]["attributes"]
@@ -204,6 +217,28 @@ RSpec.describe "/instances" do
     end
   end
 
+  describe "PATCH /instances/:id" do
+    it "renames the instance" do
+      image_id = create_ready_image
+      instance_id = create_instance(image_id)
+
+      response = patch(
+        "/instances/#{instance_id}",
+        data: {
+          type: "instances",
+          attributes: {
+            name: "bug-1234",
+          },
+        },
+      )
+      expect(response.code).to eq(200)
+      expect(JSON.parse(response.body)["data"]["attributes"]["name"]).to eq("bug-1234")
+
+      instances = JSON.parse(get("/instances").body)["data"]
+      expect(instances.map { |i| i["attributes"]["name"] }).to eq(["bug-1234"])
+    end
+  end
+
   describe "DELETE /instances/:id" do
     it "deletes the instance and returns a 204" do
       image_id = create_ready_image
@@ -211,7 +246,7 @@ RSpec.describe "/instances" do
 
       response = delete("/instances/#{instance_id}")
       expect(response.code).to eq(204)
-      expect(response.headers[:content_type]).to eq("application/json")
+      expect(response.headers[:content_type]).to eq("application/vnd.api+json")
       expect(response.body).to eq("")
 
       expect(JSON.parse(get("/instances").body)["data"]).to eq([])
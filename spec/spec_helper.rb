@@ -50,7 +50,7 @@ class Draupnir
       url: "https://#{@host}:#{@port}#{path}",
       payload: payload&.to_json,
       headers: {
-        content_type: "application/json",
+        content_type: "application/vnd.api+json",
         authorization: "Bearer thesharedsecret",
         draupnir_version: VERSION,
       }.merge(headers),
@@ -95,6 +95,10 @@ RSpec.configure do |config|
     client.request(:post, path, payload, headers)
   end
 
+  def patch(path, payload, headers = {})
+    client.request(:patch, path, payload, headers)
+  end
+
   def delete(path)
     client.request(:delete, path)
   end
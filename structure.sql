@@ -30,6 +30,54 @@ CREATE TABLE public.gorp_migrations (
 );
 
 
+--
+-- Name: image_aliases; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.image_aliases (
+    name text NOT NULL,
+    image_id integer NOT NULL,
+    promoted_by text NOT NULL,
+    promoted_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: image_replications; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.image_replications (
+    id integer NOT NULL,
+    image_id integer NOT NULL,
+    peer text NOT NULL,
+    status text NOT NULL,
+    peer_image_id integer,
+    error text,
+    created_at timestamp with time zone NOT NULL,
+    updated_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: image_replications_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.image_replications_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: image_replications_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.image_replications_id_seq OWNED BY public.image_replications.id;
+
+
 --
 -- Name: images; Type: TABLE; Schema: public; Owner: -
 --
@@ -40,7 +88,14 @@ CREATE TABLE public.images (
     ready boolean DEFAULT false NOT NULL,
     created_at timestamp with time zone NOT NULL,
     updated_at timestamp with time zone NOT NULL,
-    anon text
+    anon text,
+    data_path text,
+    tags text DEFAULT ''::text NOT NULL,
+    error text,
+    default_database text,
+    compression text,
+    destroying boolean DEFAULT false NOT NULL,
+    source_url text
 );
 
 
@@ -75,7 +130,12 @@ CREATE TABLE public.instances (
     updated_at timestamp with time zone NOT NULL,
     port integer NOT NULL,
     user_email text,
-    refresh_token text
+    refresh_token text,
+    data_path text,
+    name text,
+    expires_at timestamp with time zone,
+    schema_only boolean DEFAULT false NOT NULL,
+    max_connections integer DEFAULT 0 NOT NULL
 );
 
 
@@ -99,6 +159,65 @@ CREATE SEQUENCE public.instances_id_seq
 ALTER SEQUENCE public.instances_id_seq OWNED BY public.instances.id;
 
 
+--
+-- Name: issued_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.issued_tokens (
+    token_hash text NOT NULL,
+    issued_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: operations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.operations (
+    id integer NOT NULL,
+    status text NOT NULL,
+    instance_id integer,
+    error text,
+    user_email text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    image_id integer,
+    bytes_transferred bigint DEFAULT 0 NOT NULL,
+    kind text,
+    finished_at timestamp with time zone
+);
+
+
+--
+-- Name: operations_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.operations_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: operations_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.operations_id_seq OWNED BY public.operations.id;
+
+
+--
+-- Name: token_revocations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.token_revocations (
+    email text NOT NULL,
+    revoked_at timestamp with time zone NOT NULL
+);
+
+
 --
 -- Name: whitelisted_addresses; Type: TABLE; Schema: public; Owner: -
 --
@@ -111,6 +230,13 @@ CREATE TABLE public.whitelisted_addresses (
 );
 
 
+--
+-- Name: image_replications id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_replications ALTER COLUMN id SET DEFAULT nextval('public.image_replications_id_seq'::regclass);
+
+
 --
 -- Name: images id; Type: DEFAULT; Schema: public; Owner: -
 --
@@ -125,6 +251,13 @@ ALTER TABLE ONLY public.images ALTER COLUMN id SET DEFAULT nextval('public.image
 ALTER TABLE ONLY public.instances ALTER COLUMN id SET DEFAULT nextval('public.instances_id_seq'::regclass);
 
 
+--
+-- Name: operations id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.operations ALTER COLUMN id SET DEFAULT nextval('public.operations_id_seq'::regclass);
+
+
 --
 -- Name: gorp_migrations gorp_migrations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -133,6 +266,30 @@ ALTER TABLE ONLY public.gorp_migrations
     ADD CONSTRAINT gorp_migrations_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: image_aliases image_aliases_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_aliases
+    ADD CONSTRAINT image_aliases_pkey PRIMARY KEY (name);
+
+
+--
+-- Name: image_replications image_replications_image_id_peer_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_replications
+    ADD CONSTRAINT image_replications_image_id_peer_key UNIQUE (image_id, peer);
+
+
+--
+-- Name: image_replications image_replications_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_replications
+    ADD CONSTRAINT image_replications_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: images images_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -141,6 +298,14 @@ ALTER TABLE ONLY public.images
     ADD CONSTRAINT images_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: instances instances_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instances
+    ADD CONSTRAINT instances_name_key UNIQUE (name);
+
+
 --
 -- Name: instances instances_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -149,6 +314,30 @@ ALTER TABLE ONLY public.instances
     ADD CONSTRAINT instances_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: issued_tokens issued_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.issued_tokens
+    ADD CONSTRAINT issued_tokens_pkey PRIMARY KEY (token_hash);
+
+
+--
+-- Name: operations operations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.operations
+    ADD CONSTRAINT operations_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: token_revocations token_revocations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.token_revocations
+    ADD CONSTRAINT token_revocations_pkey PRIMARY KEY (email);
+
+
 --
 -- Name: whitelisted_addresses whitelisted_addresses_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -157,6 +346,29 @@ ALTER TABLE ONLY public.whitelisted_addresses
     ADD CONSTRAINT whitelisted_addresses_pkey PRIMARY KEY (ip_address, instance_id);
 
 
+--
+-- Name: operations_user_email_created_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX operations_user_email_created_at_idx ON public.operations USING btree (user_email, created_at);
+
+
+--
+-- Name: image_aliases image_aliases_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_aliases
+    ADD CONSTRAINT image_aliases_image_id_fkey FOREIGN KEY (image_id) REFERENCES public.images(id) ON DELETE CASCADE;
+
+
+--
+-- Name: image_replications image_replications_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_replications
+    ADD CONSTRAINT image_replications_image_id_fkey FOREIGN KEY (image_id) REFERENCES public.images(id) ON DELETE CASCADE;
+
+
 --
 -- Name: instances instances_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --